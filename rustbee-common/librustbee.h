@@ -6,25 +6,801 @@
 #include <stddef.h>
 #include <stdint.h>
 
-typedef struct _device {
-    uint8_t addr[6];
-    uint8_t _unused[58];
-} Device;
+// Opaque handle to a light, created by new_device or new_device_from_str and
+// freed with free_device, e.g.
+//
+//     RustbeeDevice* device = new_device_from_str("E8:D4:EA:C4:62:00");
+//     const uint8_t on = 1;
+//     if (device == NULL || !set_power(device, &on)) {
+//         const char* error = rustbee_last_error_message();
+//         fprintf(stderr, "%s\n", error);
+//         free_error_message(error);
+//     }
+//     free_device(device);
+//
+// Every free_* fn is a no-op with NULL, an already freed pointer or a pointer
+// returned for another free_* fn (e.g. a device passed to free_name)
+typedef struct RustbeeDevice RustbeeDevice;
+// Deprecated alias of RustbeeDevice
+typedef RustbeeDevice Device;
 
-Device* new_device(const uint8_t[6]);
-void free_device(Device*);
+// Filled by get_device_state, there is nothing to free
+typedef struct _device_state {
+    bool connected;
+    bool power;
+    // Raw brightness from 1 to 254, see get_brightness
+    uint8_t brightness;
+    // White only lights don't have a color, rgb is then black
+    bool has_color;
+    // At full brightness
+    uint8_t rgb[3];
+    // Nul terminated, see get_name
+    char name[20];
+} DeviceState;
 
-bool try_connect(Device*);
-bool try_disconnect(Device*);
+// The brightness and color of RUSTBEE_POWER_ON_FIXED
+typedef struct _power_on_state {
+    // Raw brightness from 1 to 254, see get_brightness
+    uint8_t brightness;
+    uint8_t rgb[3];
+} PowerOnState;
 
-bool set_power(Device*, const uint8_t*);
-bool set_brightness(Device*, const uint8_t*);
+// Counters of the daemon since it started, see get_daemon_stats
+typedef struct _daemon_stats {
+    uint32_t connected_count;
+    // Connections of devices that were already connected once
+    uint32_t total_reconnects;
+    uint32_t failed_commands;
+    // Of the device commands, including their (re)connection
+    uint32_t avg_latency_ms;
+    // Failed GATT writes that were retried, see set_write_retries
+    uint32_t write_retries;
+    // GATT writes that waited for the write rate, see set_global_write_rate
+    uint32_t delayed_writes;
+    // GATT writes dropped since they'd have waited more than a second
+    uint32_t dropped_writes;
+    // Dropped devices being reconnected, see set_reconnect_policy
+    uint32_t reconnecting_count;
+    // The longest of their current backoffs
+    uint32_t max_backoff_ms;
+} DaemonStats;
 
-const uint8_t* get_brightness(Device*);
+// Applied by set_state and schedule_command, a field is only written if its
+// has_ flag is set
+typedef struct _desired_state {
+    bool has_power;
+    bool power;
+    bool has_brightness;
+    // Raw brightness from 1 to 254, see set_brightness
+    uint8_t brightness;
+    bool has_rgb;
+    uint8_t rgb[3];
+    // Mireds, exclusive with rgb, see set_color_temp
+    bool has_color_temp;
+    uint16_t color_temp;
+    // Deciseconds of the power, brightness and color changes, 0 is instant
+    uint16_t transition_ds;
+} DesiredState;
 
+// Opaque handle to a daemon instance, see launch_daemon_instance
+typedef struct RustbeeDaemonHandle RustbeeDaemonHandle;
+
+typedef struct _device_list DeviceList;
+typedef struct _state_snapshot StateSnapshot;
+typedef struct _scene_list SceneList;
+typedef struct _managed_device_list ManagedDeviceList;
+typedef struct _scan_handle ScanHandle;
+
+// Error codes of the last failed call, see rustbee_last_error
+typedef enum _rustbee_error {
+    RUSTBEE_OK = 0,
+    RUSTBEE_NULL_POINTER = 1,
+    RUSTBEE_INVALID_ARG = 2,
+    RUSTBEE_DAEMON_UNREACHABLE = 3,
+    RUSTBEE_DEVICE_NOT_FOUND = 4,
+    RUSTBEE_NOT_CONNECTED = 5,
+    RUSTBEE_GATT_ERROR = 6,
+    RUSTBEE_DAEMON_ERROR = 7,
+    RUSTBEE_TIMEOUT = 8,
+    // No usable Bluetooth LE adapter, see adapter_available
+    RUSTBEE_NO_ADAPTER = 9,
+    // The platform cannot do it, e.g. request_connection_params on Linux
+    RUSTBEE_UNSUPPORTED = 10,
+    // The daemon cannot listen on its socket, another process (or a daemon
+    // that crashed) left it in place
+    RUSTBEE_SOCKET_IN_USE = 11,
+    // The directory of the daemon socket cannot be read or written
+    RUSTBEE_PERMISSION_DENIED = 12,
+    // The daemon couldn't be started, e.g. rustbee-daemon isn't in the PATH
+    RUSTBEE_SPAWN_FAILED = 13,
+} RustbeeError;
+
+// The last error is stored per thread and reset by every call so it must be
+// read from the same thread right after the failed call (e.g. Go callers must
+// use runtime.LockOSThread)
+int rustbee_last_error();
+// Returns NULL if there's no error, else it must be freed with free_error_message
+const char* rustbee_last_error_message();
+void free_error_message(const char*);
+
+RustbeeDevice* new_device(const uint8_t[6]);
+// Parses a "E8:D4:EA:C4:62:00" address (case insensitive), NULL if malformed
+RustbeeDevice* new_device_from_str(const char*);
+// Same as new_device for a device of the given daemon instance, the handle can
+// be freed before the device
+RustbeeDevice* new_device_with_daemon(const RustbeeDaemonHandle*, const uint8_t[6]);
+// Safe to call while other threads use the device: it blocks until their calls
+// return (bound by the command timeout, except the connection ones) and the
+// calls made meanwhile fail with RUSTBEE_NULL_POINTER. Called from a callback
+// of one of the device calls (e.g. wait_connected), the device is freed once
+// that call returns. The async setters copy what they need, their callbacks
+// may outlive the device
+void free_device(RustbeeDevice*);
+// A new handle of the same device, e.g. to rebuild one after a dropped
+// connection. It keeps the settings of the device (command timeout, write mode
+// and retries, brightness curve) and its name and capabilities so they aren't
+// read again. Both handles are independent and the clone isn't subscribed, it
+// must be freed with free_device. NULL with RUSTBEE_NULL_POINTER
+RustbeeDevice* clone_device(RustbeeDevice*);
+// Copies the address of the device, e.g. to tell which handle is which light,
+// two handles of the same address are the same light
+bool get_address(RustbeeDevice*, uint8_t out_addr[6]);
+
+bool try_connect(RustbeeDevice*);
+// Aborts the discovery/connection and returns false after timeout_ms,
+// 0 is the same as try_connect (daemon default timeouts)
+bool try_connect_timeout(RustbeeDevice*, uint32_t);
+// bond = 1 also pairs the device, the daemon keeps the bond so the next paired
+// connections skip the pairing. bond = 0 is the same as try_connect
+bool try_connect_paired(RustbeeDevice*, uint8_t bond);
+
+typedef enum _gamut {
+    // LivingColors and LightStrips
+    RUSTBEE_GAMUT_A = 1,
+    // First Hue bulbs
+    RUSTBEE_GAMUT_B = 2,
+    // Every recent light
+    RUSTBEE_GAMUT_C = 3,
+} Gamut;
+
+// Filled by try_connect_ex, there is nothing to free
+typedef struct _device_info {
+    // Nul terminated, see get_name_str
+    char name[20];
+    // See get_capabilities
+    uint8_t capabilities;
+    // Nul terminated, empty if the light doesn't expose it
+    char firmware[20];
+    // A Gamut, from the model of the light
+    uint8_t gamut;
+} DeviceInfo;
+
+// try_connect then reads what doesn't change while the device is connected in
+// one call, the name and capabilities are kept by the handle so their getters
+// don't ask the daemon again. out is left untouched on failure, the device
+// stays connected if only a read failed
+bool try_connect_ex(RustbeeDevice*, DeviceInfo* out);
+// Non blocking, it never connects the device
+bool is_paired(RustbeeDevice*);
+// Requests connection intervals from min to max ms (7.5ms rounded up to 8 up
+// to 4000) and an MTU (23 to 517, 0 keeps the negotiated one). It's best
+// effort: the OS and the light may pick other values and it doesn't tell
+// which ones. Windows maps the intervals to its closest preset and negotiates
+// the MTU itself. Returns false with RUSTBEE_UNSUPPORTED if the platform
+// cannot request them at all (Linux, Windows 10)
+bool request_connection_params(RustbeeDevice*, uint16_t min_interval_ms,
+                               uint16_t max_interval_ms, uint16_t mtu);
+
+typedef enum _connect_stage {
+    RUSTBEE_STAGE_SCANNING = 0,
+    RUSTBEE_STAGE_CONNECTING = 1,
+    RUSTBEE_STAGE_DISCOVERING_SERVICES = 2,
+    RUSTBEE_STAGE_READY = 3,
+} ConnectStage;
+
+// Called with the context and a ConnectStage
+typedef void (*RustbeeProgressCallback)(void*, uint8_t);
+
+// try_connect_timeout calling the optional progress callback (on the calling
+// thread) with every stage of the connection, the stages of an already known
+// device are skipped. On failure, the last reported stage is where it stalled
+bool wait_connected(RustbeeDevice*, uint32_t timeout_ms, RustbeeProgressCallback, void*);
+// Closes the BLE connection but the device stays valid and can be reconnected
+// later with try_connect. disconnect is an alias of try_disconnect
+bool try_disconnect(RustbeeDevice*);
+bool disconnect(RustbeeDevice*);
+// Non blocking, it never tries to (re)connect the device
+bool is_connected(RustbeeDevice*);
+// Max time the following calls of the device wait for the daemon (5000ms by
+// default), they then return false with RUSTBEE_TIMEOUT instead of hanging if
+// the light stopped responding. The calls get 30s more when the daemon may
+// have to discover the device first, the connect fns keep their own timeouts.
+// 0 waits as long as it takes. A timed out write may still be applied later.
+// On Windows it only applies to a remote daemon, named pipes have no timeout
+void set_command_timeout(RustbeeDevice*, uint32_t ms);
+// Prefixes the error messages of the device and its records in the daemon
+// logs with [tag] instead of [E8:D4:EA:C4:62:00], NULL or "" goes back to
+// the address. At most 19 bytes of UTF-8, else RUSTBEE_INVALID_ARG and the
+// tag is unchanged. The daemon keeps one tag per address
+void set_device_tag(RustbeeDevice*, const char* tag);
+// Round trip in ms of the last command of the device (the GATT operation with
+// its retries and the exchange with the daemon), a timed out one counts as
+// its timeout. It's timed from once the device is ready so the implicit
+// connect of the command doesn't count, connecting, disconnecting and pairing
+// aren't timed either. 0 if no command has run yet. With get_daemon_stats, it
+// helps tuning the command timeout and the debounce window to the speed of the
+// link
+uint32_t get_last_command_latency_ms(RustbeeDevice*);
+
+typedef enum _write_mode {
+    // Default, the light acknowledges every write so a set_* returns false if
+    // the acknowledgement is missing. Reliable but each write waits for it
+    RUSTBEE_WRITE_CONFIRMED = 0,
+    // Fire and forget, a set_* returns true once the write is queued even if
+    // the light never gets it. Fast, e.g. for a brightness sweep where a lost
+    // value is replaced by the next one, but not for a power switch
+    RUSTBEE_WRITE_UNCONFIRMED = 1,
+} WriteMode;
+
+// Applies to the following writes of the device, it's a WriteMode
+void set_write_mode(RustbeeDevice*, uint8_t mode);
+// Every setter retries a failed GATT write up to retries times before it
+// returns false, 2 by default and 0 fails on the first failure. The daemon
+// counts the retries in its stats
+void set_write_retries(RustbeeDevice*, uint8_t retries);
+// Barrier of the RUSTBEE_WRITE_UNCONFIRMED writes: the daemon waits for the
+// requests of the device it's running (of any client, async calls included)
+// then reads the device, which answers once the writes sent before the read
+// are applied. A following get_* reads the new values, the requests sent
+// during the flush wait for it
+bool flush(RustbeeDevice*);
+// The daemon reads the power of the device every interval_ms it goes without
+// commands so the link isn't dropped by the BLE supervision timeout, 0 (the
+// default) stops it. The reads wait for the commands in flight and don't count
+// as commands for set_idle_disconnect. It's reset when the daemon restarts,
+// RUSTBEE_OK tells it succeeded
+void set_keepalive(RustbeeDevice*, uint32_t interval_ms);
+
+// Blinks the light for a few seconds to find it physically, its power and
+// brightness are restored afterwards
+bool identify(RustbeeDevice*);
+
+bool set_power(RustbeeDevice*, const uint8_t*);
+// Raw brightness from 1 to 254 inclusive, see get_brightness_percent. Other
+// values are rejected with RUSTBEE_INVALID_ARG (as by set_brightness_transition
+// and set_brightness_batch) and nothing is sent. A valid value is clamped to the
+// range of the light, see get_brightness_range
+bool set_brightness(RustbeeDevice*, const uint8_t*);
+// Brightness from 0 to 100 through the BrightnessCurve of the device (linear
+// by default), above 100 is RUSTBEE_INVALID_ARG. 0 is the lowest brightness of
+// the light, not off
+bool set_brightness_percent(RustbeeDevice*, uint8_t percent);
+
+typedef enum _brightness_curve {
+    // Default, a percentage is the same share of the raw brightness. The low
+    // percentages look like big steps and the high ones barely change
+    RUSTBEE_BRIGHTNESS_LINEAR = 0,
+    // The raw brightness is the percentage raised to 2.2 (gamma corrected) so
+    // the eye sees even steps, e.g. for a slider. 50% is a raw 55
+    RUSTBEE_BRIGHTNESS_GAMMA = 1,
+} BrightnessCurve;
+
+// Applies to set_brightness_percent and get_brightness_percent of the device,
+// it's a BrightnessCurve
+void set_brightness_curve(RustbeeDevice*, uint8_t curve);
+// Raw brightness range supported by the light, some can't be dimmed as low as
+// others. Returns false if the light doesn't tell it, min and max are then set
+// to the full 1 to 254 range
+bool get_brightness_range(RustbeeDevice*, uint8_t* min, uint8_t* max);
+bool set_color_rgb(RustbeeDevice*, uint8_t, uint8_t, uint8_t);
+// Packed 0xRRGGBB color (e.g. "#FF8800"), the top byte is ignored
+bool set_color_rgb_hex(RustbeeDevice*, uint32_t);
+// CIE 1931 xy coordinates, both must be within 0.0 and 1.0. set_color_rgb is
+// converted to xy so the two are consistent
+bool set_color_xy(RustbeeDevice*, float, float);
+bool get_color_xy(RustbeeDevice*, float*, float*);
+// The color at full brightness, written into out. There is nothing to free and
+// out is left untouched on failure. Like the light, a xy outside of its gamut
+// (known from its model, read once per handle with get_capabilities) is
+// brought back to the nearest color it can show
+bool get_color_rgb_into(RustbeeDevice*, uint8_t out[3]);
+
+// Same as the setters above but the light fades to the new value, the
+// transition time is in deciseconds and 0 is an instant change
+bool set_power_transition(RustbeeDevice*, uint8_t, uint16_t);
+bool set_brightness_transition(RustbeeDevice*, uint8_t, uint16_t);
+bool set_color_rgb_transition(RustbeeDevice*, uint8_t, uint8_t, uint8_t, uint16_t);
+bool set_color_xy_transition(RustbeeDevice*, float, float, uint16_t);
+// Hue from 0 to 65535 (0 to 360°) and saturation from 0 to 254, converted to
+// xy at full value since the brightness is set on its own. The getters return
+// 0 on failure, check rustbee_last_error
+bool set_hue_sat(RustbeeDevice*, uint16_t, uint8_t);
+uint16_t get_hue(RustbeeDevice*);
+uint8_t get_saturation(RustbeeDevice*);
+
+// set_power without blocking, the callback is called with the context and
+// whether it succeeded from a librustbee thread (or from the calling thread
+// if the arguments are invalid). The last error can only be read from within
+// the callback. It's safe to call an exported cgo function as the callback
+// but it shouldn't block since it holds a thread of a shared pool.
+typedef void (*RustbeeCallback)(void*, bool);
+void set_power_async(RustbeeDevice*, uint8_t, RustbeeCallback, void*);
+
+// Sends the value to the n devices concurrently and returns false if any of
+// them failed. The optional results array (of n bools) tells which devices
+// succeeded, nothing is sent if one of the devices is NULL
+bool set_power_batch(RustbeeDevice**, size_t, uint8_t, bool*);
+bool set_brightness_batch(RustbeeDevice**, size_t, uint8_t, bool*);
+
+// Last measured signal strength in dBm, it doesn't connect the device so it's
+// only known once the device was discovered. Returns RUSTBEE_RSSI_UNAVAILABLE
+// (a positive value) on failure
+#define RUSTBEE_RSSI_UNAVAILABLE 1
+int16_t get_rssi(RustbeeDevice*);
+
+// Color temperature in mireds (1000000 / kelvin), the valid range is 153 (~6500K)
+// to 500 (2000K) and values outside of it are clamped.
+// get_color_temp returns 0 and set_color_temp false if the device doesn't
+// support color temperature
+uint16_t get_color_temp(RustbeeDevice*);
+bool set_color_temp(RustbeeDevice*, uint16_t);
+
+// Levels of the separate warm and cool white channels of the tunable white
+// variants that have them (RUSTBEE_SUPPORTS_WHITE_MIX). The others get the
+// closest color temperature (the share of warm white) and brightness (the
+// strongest channel), RUSTBEE_UNSUPPORTED if they don't support color
+// temperature either. Both at 0 is RUSTBEE_INVALID_ARG, see set_power.
+// get_white_mix leaves warm and cool untouched on failure
+bool set_white_mix(RustbeeDevice*, uint8_t warm, uint8_t cool);
+bool get_white_mix(RustbeeDevice*, uint8_t* warm, uint8_t* cool);
+
+// Writes the set fields of the state at once instead of a call per field. The
+// whole state is validated first (RUSTBEE_INVALID_ARG). The lights with the
+// combined control characteristic get a single GATT write, without flicker.
+// The others get a write per field: a light turned on is turned on before the
+// other writes and a light turned off is turned off after them. A failed
+// write doesn't stop the next ones, see set_state_ex for the fields that failed
+bool set_state(RustbeeDevice*, const DesiredState*);
+
+// Bits of the fields of a DesiredState, see set_state_ex
+#define RUSTBEE_FIELD_POWER (1 << 0)
+#define RUSTBEE_FIELD_BRIGHTNESS (1 << 1)
+#define RUSTBEE_FIELD_COLOR (1 << 2)
+#define RUSTBEE_FIELD_COLOR_TEMP (1 << 3)
+
+// Same as set_state, failed_fields (if not NULL) is set to the RUSTBEE_FIELD_
+// bits of the fields that weren't applied, the others were. The command
+// timeout covers the whole state, on RUSTBEE_TIMEOUT or when the daemon cannot
+// be reached every set field counts as failed. It's 0 on success and for an
+// invalid state since nothing is written then
+bool set_state_ex(RustbeeDevice*, const DesiredState*, uint8_t* failed_fields);
+
+// The daemon applies the state like set_state at at_unix_ms (ms since the Unix
+// epoch, right away if it's past), the caller doesn't have to stay running,
+// e.g. a sunrise fading in over 10 minutes. The state is validated first
+// (RUSTBEE_INVALID_ARG). Returns the job id, 0 on failure. The jobs are lost
+// if the daemon exits and it doesn't time out while some are waiting
+uint64_t schedule_command(RustbeeDevice*, const DesiredState*, uint64_t at_unix_ms);
+// Cancels a job of the default daemon instance, false with RUSTBEE_INVALID_ARG
+// if it doesn't exist or already started
+bool cancel_scheduled(uint64_t job_id);
+
+// Bitflag of what the light supports, e.g. white only lights don't support
+// colors. Returns 0 if the capabilities couldn't be read, they're only read
+// once per device handle
+#define RUSTBEE_SUPPORTS_COLOR (1 << 0)
+#define RUSTBEE_SUPPORTS_COLOR_TEMP (1 << 1)
+#define RUSTBEE_SUPPORTS_DIMMING (1 << 2)
+#define RUSTBEE_SUPPORTS_WHITE_MIX (1 << 3)
+uint8_t get_capabilities(RustbeeDevice*);
+
+// The RUSTBEE_SUPPORTS_ capabilities in the low byte, then what the light and
+// its firmware support. The daemon detects them from the characteristics of
+// the light and applies the quirks it knows of its model and firmware. Returns
+// 0 with RUSTBEE_GATT_ERROR if they couldn't be read, they're only read once
+// per device handle
+#define RUSTBEE_FEATURE_COMBINED_WRITE (1 << 8)
+#define RUSTBEE_FEATURE_EFFECTS (1 << 9)
+// See get_startup_state, older firmwares don't have it
+#define RUSTBEE_FEATURE_STARTUP_STATE (1 << 10)
+// The light only accepts the writes of a bonded central, see try_connect_paired
+#define RUSTBEE_FEATURE_NEEDS_BONDING (1 << 11)
+uint32_t feature_flags(RustbeeDevice*);
+
+// How the device comes up after a power loss (e.g. behind a physical switch)
+typedef enum _power_on_mode {
+    RUSTBEE_POWER_ON_LAST_STATE = 0,
+    RUSTBEE_POWER_ON_FIXED = 1,
+    RUSTBEE_POWER_ON_OFF = 2,
+} PowerOnMode;
+
+// The PowerOnState is required by RUSTBEE_POWER_ON_FIXED and ignored otherwise
+bool set_power_on_behavior(RustbeeDevice*, uint8_t mode, const PowerOnState*);
+// Returns a PowerOnMode or -1 on failure. The optional PowerOnState is only
+// filled with RUSTBEE_POWER_ON_FIXED
+int get_power_on_behavior(RustbeeDevice*, PowerOnState*);
+
+// The values the device boots with. In RUSTBEE_POWER_ON_FIXED the power (on),
+// brightness and rgb are set, in RUSTBEE_POWER_ON_OFF only the power (off) and
+// in RUSTBEE_POWER_ON_LAST_STATE none (it boots as it was). Both return false
+// with RUSTBEE_UNSUPPORTED if the device doesn't have a configurable startup
+bool get_startup_state(RustbeeDevice*, DesiredState* out);
+// Writes the set fields of the startup values, the others are kept, and
+// switches to RUSTBEE_POWER_ON_FIXED (RUSTBEE_POWER_ON_OFF if the power is
+// off). It's independent of the live state. There is no startup color
+// temperature (RUSTBEE_INVALID_ARG) and the transition is ignored
+bool set_startup_state(RustbeeDevice*, const DesiredState*);
+
+// Effects run until they're replaced or set to RUSTBEE_EFFECT_NONE
+typedef enum _effect {
+    RUSTBEE_EFFECT_NONE = 0,
+    RUSTBEE_EFFECT_COLOR_LOOP = 1,
+} Effect;
+
+// Returns false for an unknown effect or if the light doesn't support effects
+bool set_effect(RustbeeDevice*, uint8_t effect);
+// Returns an Effect or -1 on failure
+int get_effect(RustbeeDevice*);
+
+// Nul terminated name of at most 19 bytes (longer names end with "..."),
+// NULL on failure else it must be freed with free_name. The bytes are the ones
+// of the device, they may not be UTF-8. It's read once per device handle
+// (set_name updates it), the getters below share it
+char* get_name(RustbeeDevice*);
+void free_name(char*);
+// get_name as valid UTF-8 without trailing whitespaces, the invalid sequences
+// are replaced by U+FFFD. NULL on failure else it must be freed with
+// free_name_str
+const char* get_name_str(RustbeeDevice*);
+void free_name_str(const char*);
+// get_name_str written into out (nul terminated) so there is nothing to free,
+// out is left untouched on failure
+bool get_name_into(RustbeeDevice*, char out[20]);
+// Firmware revision of the device information service (e.g. "1.104.2") since
+// some behaviors differ between versions. NULL with RUSTBEE_GATT_ERROR if it's
+// unreadable, else it must be freed with free_firmware_version
+const char* get_firmware_version(RustbeeDevice*);
+void free_firmware_version(const char*);
+// The name must be UTF-8 and 1 to 19 bytes long (without nul terminator),
+// returns false if it's invalid or if the write failed
+bool set_name(RustbeeDevice*, const uint8_t*, size_t);
+
+// 1 when the light is on, 0 when it's off and -1 on failure with the last
+// error set, e.g. a disconnected bulb isn't reported as off
+int get_power_state(RustbeeDevice*);
+// Convenience for get_power_state that returns false on failure too, so a
+// failed read looks like an OFF light unless rustbee_last_error is checked
+bool get_power(RustbeeDevice*);
+// Reads the power then writes the inverse in a single request to the daemon,
+// unlike get_power_state then set_power there is no round trip for another
+// client to slip in and concurrent toggles of a light are serialized (with
+// each other, not with set_power). Returns the new state like
+// get_power_state, -1 on failure
+int toggle_power(RustbeeDevice*);
+
+// Raw brightness from 1 to 254, the scale of set_brightness. 0 on failure
+uint8_t get_brightness(RustbeeDevice*);
+// get_brightness as a percentage from 0 to 100 through the BrightnessCurve of
+// the device, the inverse of set_brightness_percent
+uint8_t get_brightness_percent(RustbeeDevice*);
+
+// Reads the connection, power, brightness, color and name at once (a single
+// exchange with the daemon instead of one per getter)
+bool get_device_state(RustbeeDevice*, DeviceState*);
+
+// Calls back with the current state then on every change (e.g. made by another
+// app or a physical switch) until unsubscribe_state, then once with NULL when
+// the subscription ended whatever the reason (e.g. the device disconnected).
+// The callbacks are made one at a time from a thread owned by the subscription
+// and the state is only valid during the call. It's safe to call an exported
+// cgo function as the callback but it shouldn't block to not delay the next
+// states. The name is only read when subscribing.
+typedef void (*RustbeeStateCallback)(void*, const DeviceState*);
+bool subscribe_state(RustbeeDevice*, RustbeeStateCallback, void*);
+// Returns once the last callback is done (unless called from the callback), the
+// subscription also ends with free_device
+bool unsubscribe_state(RustbeeDevice*);
+
+// Passed once to the callback of set_connection_callback when the watch ended
+#define RUSTBEE_CONNECTION_ENDED 2
+
+// Calls back with the connection state of the device (1 connected, 0 not)
+// right away then on every change until another callback replaces it or NULL
+// stops it, e.g. to gray out the controls of a light as soon as it drops. The
+// drops are noticed within a second, the connections, disconnections and
+// reconnections made by the daemon right away. The device doesn't have to be
+// connected nor even discovered. It's called a last time with
+// RUSTBEE_CONNECTION_ENDED once the watch ended whatever the reason (e.g. the
+// daemon exited). The callbacks are made one at a time from a thread owned by
+// the watch, the previous callback is done once this returns (unless called
+// from it). Errors are only reported through rustbee_last_error, the watch
+// also ends with free_device
+typedef void (*RustbeeConnectionCallback)(void*, uint8_t);
+void set_connection_callback(RustbeeDevice*, RustbeeConnectionCallback, void*);
+
+// The state of get_device_state with its color temperature and RSSI as a JSON
+// object, e.g. {"schema_version":1,"name":"Hue bar","connected":true,
+// "power":true,"brightness":254,"rgb":[255,136,0],"color_temp":null,
+// "rssi":-60}. rgb, color_temp and rssi are null when unsupported or unknown,
+// schema_version is bumped on breaking changes. NULL on failure else it must be
+// freed with free_state_json
+const char* device_state_json(RustbeeDevice*);
+void free_state_json(const char*);
+
+// Captures the power, brightness and color (if the light has one) to restore
+// them later, e.g. around a temporary override. Returns NULL on failure else
+// it must be freed with free_state_snapshot
+StateSnapshot* capture_state(RustbeeDevice*);
+bool restore_state(RustbeeDevice*, const StateSnapshot*);
+void free_state_snapshot(StateSnapshot*);
+
+// UNSTABLE AND UNSAFE: raw access to any characteristic, e.g. to experiment
+// with undocumented Hue features. A wrong value can put the light in a bad
+// state, these fns may change or go away in any release.
+//
+// The device must already be connected (RUSTBEE_NOT_CONNECTED) and have the
+// characteristic (RUSTBEE_INVALID_ARG). uuid128 is the 16 bytes of the full
+// 128-bit characteristic UUID in the order of its string form, a 16-bit UUID
+// of the Bluetooth SIG (e.g. 0x2A24) is 0000xxxx-0000-1000-8000-00805f9b34fb.
+// Values are at most 512 bytes. out_len is the capacity of out and is set to the length of the value,
+// if it doesn't fit it returns false and out_len is the length needed
+bool gatt_write(RustbeeDevice*, const uint8_t uuid128[16], const uint8_t* data, size_t len);
+bool gatt_read(RustbeeDevice*, const uint8_t uuid128[16], uint8_t* out, size_t* out_len);
+
+// Blocks for duration_ms and returns the devices found (can be empty) or NULL
+// on failure, the list must be freed with free_device_list
+DeviceList* scan_devices(uint32_t);
+size_t device_list_len(DeviceList*);
+// Copies the address and the nul terminated name (truncated to 13 bytes by the
+// daemon) of the device at index i, both are zeroed if i is out of bounds
+void device_list_get(DeviceList*, size_t, uint8_t[6], uint8_t[19]);
+// Copies the manufacturer data advertised by the device at index i, the
+// company id (little endian, 0x010F for Signify, Hue lights) followed by the
+// data, it's empty if it had none. len is the capacity of out and is set to
+// the length of the data (out can be NULL to only get it), if it doesn't fit
+// or i is out of bounds it returns false (RUSTBEE_INVALID_ARG). Hue lights
+// don't advertise their model id, it's the 0x2A24 characteristic of a
+// connected device (see gatt_read). Not filled by scan_devices_cb
+bool device_list_get_adv(DeviceList*, size_t i, uint8_t* out, size_t* len);
+void free_device_list(DeviceList*);
+
+// Called with the context, the address and the nul terminated name of a
+// device, both only valid during the call. Returning false stops the scan
+typedef bool (*RustbeeScanCallback)(void*, const uint8_t[6], const char*);
+// Same as scan_devices but the callback is called on the calling thread as
+// soon as a device is found, the scan stops after duration_ms or once the
+// callback returned false (it isn't a failure)
+bool scan_devices_cb(uint32_t duration_ms, RustbeeScanCallback, void*);
+// Same as scan_devices but the scan runs in the background so it can be
+// cancelled as soon as the caller found what it needed. NULL if the daemon is
+// unreachable else it must be freed with stop_scan
+ScanHandle* start_scan(uint32_t duration_ms);
+// Copies the next device found, waiting up to timeout_ms for it (0 doesn't
+// wait). False with RUSTBEE_TIMEOUT if none was found in time, false with
+// RUSTBEE_OK once the scan ended and every device was polled, unless it failed
+bool scan_poll(ScanHandle*, uint32_t timeout_ms, uint8_t out_addr[6], char out_name[20]);
+// Cancels the scan if it's still running and frees the handle, it returns once
+// the daemon ended the scan. False if the scan failed and no scan_poll
+// reported it
+bool stop_scan(ScanHandle*);
+
+// A ManagedDeviceList holds addresses and connection states only, not Device
+// handles: new_device with an address of the list gives a handle to control
+// it. It's only freed by free_managed_device_list (free_device_list is a no-op
+// on it)
+
+// Every device known by the daemon sorted by address, including the ones of
+// other processes. NULL on failure else it must be freed with
+// free_managed_device_list
+ManagedDeviceList* daemon_list_devices();
+size_t managed_device_list_len(ManagedDeviceList*);
+// Copies the address and the connection state (the one is_connected reports)
+// of the device at index i, false if it's out of bounds
+bool managed_device_list_get(ManagedDeviceList*, size_t i, uint8_t out_addr[6], bool* out_connected);
+void free_managed_device_list(ManagedDeviceList*);
+// Scans for scan_ms then connects every device found at once, each within
+// connect_ms (0 keeps the daemon default timeouts). The list only has the
+// addresses of the connected devices, the ones that failed to connect are
+// printed to stderr and left out. The daemon keeps them connected, call
+// new_device with each address to control them. NULL if the scan failed else
+// it must be freed with free_managed_device_list
+ManagedDeviceList* discover_and_connect(uint32_t scan_ms, uint32_t connect_ms);
+
+// Powers off every device connected to the daemon, no handle is needed.
+// all_on restores the power and brightness they had before the first all_off
+// (devices that weren't turned off are left as they are). Both return false if
+// any failed
+bool all_off();
+bool all_on();
+
+// Scenes are persisted by the daemon so they survive its restarts, names must
+// be valid UTF-8 and 1 to 18 bytes long (RUSTBEE_INVALID_ARG).
+//
+// save_scene snapshots every device connected to the daemon like capture_state
+// (RUSTBEE_DEVICE_NOT_FOUND if none is), an existing scene is replaced.
+// recall_scene restores its devices and connects them if needed, it returns
+// false for an unknown scene (RUSTBEE_INVALID_ARG) or if any device failed
+bool save_scene(const char* name);
+bool recall_scene(const char* name);
+// Sorted scene names, NULL on failure else it must be freed with
+// free_scene_list
+SceneList* list_scenes();
+size_t scene_list_len(SceneList*);
+// Copies the nul terminated name at index i, false if it's out of bounds
+bool scene_list_get(SceneList*, size_t i, char out[20]);
+void free_scene_list(SceneList*);
+
+typedef enum _log_level {
+    RUSTBEE_LOG_ERROR = 1,
+    RUSTBEE_LOG_WARN = 2,
+    RUSTBEE_LOG_INFO = 3,
+    RUSTBEE_LOG_DEBUG = 4,
+    RUSTBEE_LOG_TRACE = 5,
+} LogLevel;
+
+// Called with the context, a LogLevel and the nul terminated message, it's
+// only valid during the call
+typedef void (*RustbeeLogCallback)(void*, int, const char*);
+// Forwards the log records of the daemon at min_level or more severe (e.g.
+// RUSTBEE_LOG_WARN also gives the errors) to the callback, they're still
+// written to the daemon log file. The callbacks are made one at a time from a
+// thread owned by librustbee, not the calling one, so the callback and the
+// context must stay valid until the next set_log_callback call returns. It
+// may be called from the callback itself. NULL restores the default logging,
+// the previous callback is done once this returns (even if it failed).
+// The forwarding ends when the daemon exits, it doesn't keep it from timing
+// out. Failures are only reported through rustbee_last_error
+void set_log_callback(RustbeeLogCallback, void* ctx, int min_level);
+
+// Idle devices of the daemon are disconnected after the given seconds without
+// commands and reconnected by their next one, they're still reported as
+// connected. 0 (the default) disables it, it's reset when the daemon restarts.
+// Failures are only reported through rustbee_last_error
+void set_idle_disconnect(uint32_t seconds);
+// Disconnected devices are kept connected by the daemon for the given seconds
+// so that connecting them again is instant, they're still reported as
+// disconnected. 0 (the default) disables it, it's reset when the daemon
+// restarts. Failures are only reported through rustbee_last_error
+void set_connection_cache_ttl(uint32_t seconds);
+// Throttles the GATT writes of the daemon to each device to writes_per_sec
+// through a token bucket per device, bursts of up to a second of writes go
+// through at once and a flooded device doesn't hold back the others. A write that would wait more than a second is dropped
+// and its call fails, see the delayed and dropped writes of get_daemon_stats.
+// 0 (the default) disables it, it's reset when the daemon restarts. Failures
+// are only reported through rustbee_last_error
+void set_global_write_rate(uint32_t writes_per_sec);
+// enabled = 1 makes the daemon reconnect the subscribed devices that drop and
+// subscribe to their state again, each reconnection is logged (see
+// set_log_callback). 0 (the default) disables it, it's reset when the daemon
+// restarts. Failures are only reported through rustbee_last_error
+void set_auto_reconnect(uint8_t enabled);
+// The backoff between the reconnection attempts of a dropped device (see
+// set_auto_reconnect) starts at base_ms and doubles after every failure up to
+// max_ms. Every attempt, the first one too, waits a random part of it so the
+// devices that dropped together (e.g. on an adapter reset) don't all reconnect
+// at once. 500ms up to 30s by default, it's reset when the daemon restarts.
+// RUSTBEE_INVALID_ARG if base_ms is 0 or greater than max_ms, failures are
+// only reported through rustbee_last_error
+void set_reconnect_policy(uint32_t base_ms, uint32_t max_ms);
+// enabled = 1 makes the calls that need the daemon launch it (see
+// launch_daemon) if it isn't running, e.g. the first try_connect, so there is
+// no need to call launch_daemon. 0 (the default) fails them with
+// RUSTBEE_DAEMON_UNREACHABLE. It never launches the remote daemon of
+// connect_daemon_tcp. RUSTBEE_INVALID_ARG if enabled isn't 0 or 1
+void set_auto_launch_daemon(uint8_t enabled);
+
+// Overrides the daemon socket path (a named pipe on Windows) for this process
+// and must be called before launch_daemon to isolate its daemon. Returns false
+// if the directory of the path doesn't exist or isn't writable
+bool set_socket_path(const char*);
+
+// Directory of the scenes and bonds of the daemons launched by this process,
+// absolute and to free with free_data_dir. /var/lib/rustbee by default
+// (RUSTBEE_DATA_DIR overrides it), a daemon launched by another process may
+// use another one
+const char* daemon_data_dir(void);
+void free_data_dir(const char*);
+// Must be called before launch_daemon, a running daemon keeps its directory.
+// It's created with the first scene or bond, returns false if it exists and
+// isn't a writable directory
+bool set_data_dir(const char* path);
+
+// Returns false with RUSTBEE_NO_ADAPTER if the daemon isn't running and this
+// host has no usable Bluetooth LE adapter (see adapter_available) to launch it,
+// a running daemon is found without one
 bool launch_daemon();
-// Optional since the daemon closes itself after a timeout
-// without requests
-bool shutdown_daemon(const uint8_t*);
+
+typedef enum _launch_status {
+    RUSTBEE_LAUNCH_FAILED = 0,
+    RUSTBEE_LAUNCH_STARTED = 1,
+    RUSTBEE_LAUNCH_ALREADY_RUNNING = 2,
+} LaunchStatus;
+
+// Returns a LaunchStatus, RUSTBEE_LAUNCH_STARTED means that this call spawned
+// the daemon so the caller owns it and is responsible for shutdown_daemon.
+// With RUSTBEE_LAUNCH_ALREADY_RUNNING, another client owns it
+int launch_daemon_ex();
+// Launches the daemon with in memory virtual devices instead of Bluetooth
+// ones, for tests without an adapter nor lights. Scans find them, new_device
+// and try_connect work against them and their state changes like a light's.
+// E8:D4:EA:C4:62:00 and EC:27:A7:D6:5A:9C are known from the start. A daemon
+// already running is kept even if it isn't simulated
+bool launch_daemon_simulated();
+// Adds or replaces the virtual device of addr with the connection, power,
+// brightness, color and name of state (the name is cut to 11 bytes), a state
+// without color is a white only light. RUSTBEE_UNSUPPORTED if the daemon
+// isn't simulated
+bool seed_simulated_device(const uint8_t addr[6], const DeviceState *state);
+// Launches the daemon and makes it also listen on TCP at bind_addr (e.g.
+// "0.0.0.0:9740") for the clients that send the token, so a remote host can
+// drive the lights in range of this one. The previous listener is replaced
+// once bind_addr is bound, the daemon doesn't time out while listening. The
+// TCP clients only drive the devices, the settings, logs, stats and shutdown
+// of the daemon fail with RUSTBEE_DAEMON_ERROR. The connection isn't
+// encrypted, the token (1 to 255 bytes) only keeps out unknown clients
+bool launch_daemon_tcp(const char* bind_addr, const char* token);
+// Every later call that isn't given a RustbeeDaemonHandle goes to the daemon
+// listening on TCP at addr (e.g. "192.168.1.20:9740"), it's checked with a
+// ping and the previous daemon is kept on failure: RUSTBEE_DAEMON_ERROR if it
+// rejected the token. NULL goes back to the local daemon. launch_daemon still
+// launches a local daemon
+bool connect_daemon_tcp(const char* addr, const char* token);
+// Whether this host has a usable Bluetooth LE adapter, else it returns false
+// with RUSTBEE_NO_ADAPTER. It doesn't need the daemon so it can be checked
+// upfront to tell the user to plug or turn on their adapter
+bool adapter_available();
+
+// Filled by get_adapter_info, there is nothing to free
+typedef struct _adapter_info {
+    // Nul terminated, hci0 and its bus on Linux, the device id on Windows
+    char name[64];
+    // The address is unknown if false
+    bool has_address;
+    uint8_t address[6];
+} AdapterInfo;
+
+// The adapter the daemon uses, false with RUSTBEE_NO_ADAPTER if there is none
+bool get_adapter_info(AdapterInfo* out);
+
+// Pings the daemon without ever launching it, returns false if it's not
+// running or didn't answer within 500ms
+bool daemon_is_alive();
+
+// Version of the running daemon e.g. "0.1.0+1a2b3c4", NULL on failure.
+// Must be freed with free_version_string
+char* daemon_version();
+void free_version_string(char*);
+// daemon_version written into out (nul terminated) so there is nothing to
+// free, out is left untouched on failure
+bool daemon_version_into(char out[20]);
+
+// Fills out with the counters of the daemon, it's left untouched on failure
+bool get_daemon_stats(DaemonStats* out);
+
+// Optional since the daemon closes itself after a timeout without requests.
+// 0 is a graceful shutdown of the daemon listening on the socket path (see
+// set_socket_path): it finishes the pending requests, disconnects the devices
+// and this call waits up to 5 seconds for it to exit, else it returns false
+// with RUSTBEE_TIMEOUT. 1 kills the rustbee-daemon process right away.
+// Returns false if there was no running daemon to shutdown
+bool shutdown_daemon(uint8_t force);
+// shutdown_daemon telling how many devices were shut down cleanly (clean can
+// be NULL). Unless forced, the daemon drains the writes of every device (like
+// flush) and disconnects them at once, started in the order of their address
+// and all within 2s. A device that fails or takes longer is logged and isn't
+// counted. It returns once they're all done, a forced shutdown has no clean
+// devices
+bool shutdown_daemon_ex(uint8_t force, uint32_t* clean);
+
+// Launches (or reuses) the daemon listening on socket_path so several
+// instances can run side by side. The global fns above work on the default
+// instance (see set_socket_path). Returns NULL on failure
+RustbeeDaemonHandle* launch_daemon_instance(const char* socket_path);
+// Graceful shutdown of this instance only, it waits up to 5 seconds for the
+// daemon to disconnect the devices (RUSTBEE_TIMEOUT). On Windows, it returns
+// once the daemon acknowledged the shutdown
+bool shutdown_daemon_instance(const RustbeeDaemonHandle*);
+// It doesn't shutdown the daemon
+void free_daemon_handle(RustbeeDaemonHandle*);
 
 #endif
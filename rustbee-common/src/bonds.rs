@@ -0,0 +1,44 @@
+use std::collections::BTreeSet;
+use std::fs;
+use std::io;
+use std::path::Path;
+
+use crate::constants::ADDR_LEN;
+
+/// Addresses of the devices the daemon paired persisted as JSON, the file is read and written
+/// as a whole
+#[derive(Default)]
+pub struct Bonds(BTreeSet<[u8; ADDR_LEN]>);
+
+impl Bonds {
+    /// A missing file has no bonds
+    pub fn load(path: impl AsRef<Path>) -> io::Result<Self> {
+        match fs::read_to_string(path) {
+            Ok(content) => Ok(Self(serde_json::from_str(&content)?)),
+            Err(error) if error.kind() == io::ErrorKind::NotFound => Ok(Self::default()),
+            Err(error) => Err(error),
+        }
+    }
+
+    /// Creates the parent directories, the file is replaced at once so a crash can't leave it
+    /// half written
+    pub fn save(&self, path: impl AsRef<Path>) -> io::Result<()> {
+        let path = path.as_ref();
+        if let Some(dir) = path.parent() {
+            fs::create_dir_all(dir)?;
+        }
+
+        let tmp_path = path.with_extension("tmp");
+        fs::write(&tmp_path, serde_json::to_string(&self.0)?)?;
+        fs::rename(tmp_path, path)
+    }
+
+    pub fn contains(&self, addr: &[u8; ADDR_LEN]) -> bool {
+        self.0.contains(addr)
+    }
+
+    /// False if it was already there
+    pub fn insert(&mut self, addr: [u8; ADDR_LEN]) -> bool {
+        self.0.insert(addr)
+    }
+}
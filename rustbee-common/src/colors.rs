@@ -3,12 +3,72 @@ use std::sync::LazyLock;
 use color_space::Rgb;
 use log::*;
 
-// Limits for Hue Play lights
+// Limits for Hue Play lights, gamut C
 // https://developers.meethue.com/develop/application-design-guidance/color-conversion-formulas-rgb-to-xy-and-back/#Gamut
 static RED: LazyLock<Xy> = LazyLock::new(|| Xy::new(0.6915, 0.3038));
 static GREEN: LazyLock<Xy> = LazyLock::new(|| Xy::new(0.17, 0.7));
 static BLUE: LazyLock<Xy> = LazyLock::new(|| Xy::new(0.1532, 0.0475));
 
+/// Triangle of the colors a light can show, it depends on its model. The lights bring the colors
+/// outside of it back to its nearest point.
+#[repr(u8)]
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq)]
+pub enum Gamut {
+    /// LivingColors and LightStrips
+    A = 1,
+    /// First Hue bulbs
+    B = 2,
+    /// Every recent light
+    #[default]
+    C = 3,
+}
+
+impl Gamut {
+    /// From the model number characteristic (MODEL_UUID), the unknown models are recent ones
+    pub fn from_model(model: &str) -> Self {
+        match model.trim_end_matches('\0') {
+            "LST001" | "LLC005" | "LLC006" | "LLC007" | "LLC010" | "LLC011" | "LLC012"
+            | "LLC013" | "LLC014" => Self::A,
+            "LCT001" | "LCT002" | "LCT003" | "LCT007" | "LLM001" => Self::B,
+            _ => Self::C,
+        }
+    }
+
+    /// Red, green and blue corners
+    pub fn triangle(self) -> [Xy; 3] {
+        match self {
+            Self::A => [
+                Xy::new(0.704, 0.296),
+                Xy::new(0.2151, 0.7106),
+                Xy::new(0.138, 0.08),
+            ],
+            Self::B => [
+                Xy::new(0.675, 0.322),
+                Xy::new(0.409, 0.518),
+                Xy::new(0.167, 0.04),
+            ],
+            Self::C => [*RED, *GREEN, *BLUE],
+        }
+    }
+}
+
+/// 0 (unknown, e.g. an older daemon) and the other values are C
+impl From<u8> for Gamut {
+    fn from(value: u8) -> Self {
+        match value {
+            1 => Self::A,
+            2 => Self::B,
+            _ => Self::C,
+        }
+    }
+}
+
+impl From<Gamut> for u8 {
+    fn from(gamut: Gamut) -> Self {
+        gamut as _
+    }
+}
+
 #[derive(Debug, Clone, Copy)]
 pub struct Xy {
     pub x: f64,
@@ -31,10 +91,23 @@ impl Xy {
         }
     }
 
+    /// See to_rgb_in, for gamut C
+    pub fn to_rgb(self, brightness: f64) -> Rgb {
+        self.to_rgb_in(Gamut::C, brightness)
+    }
+
     // https://developers.meethue.com/develop/application-design-guidance/color-conversion-formulas-rgb-to-xy-and-back/#xy-to-rgb-color
-    pub fn to_rgb(mut self, brightness: f64) -> Rgb {
-        if !self.is_within_color_gamut() {
-            self = self.closest_point_in_triangle(&RED, &GREEN, &BLUE);
+    /// The color is first brought back to the nearest point of the gamut like the light does. At
+    /// full brightness it's the brightest color with this xy, the components outside of sRGB are
+    /// clamped.
+    pub fn to_rgb_in(mut self, gamut: Gamut, brightness: f64) -> Rgb {
+        if !self.is_within(gamut) {
+            let [red, green, blue] = gamut.triangle();
+            self = self.closest_point_in_triangle(&red, &green, &blue);
+        }
+
+        if self.y <= 0. {
+            return Rgb::new(0., 0., 0.);
         }
 
         // To XYZ
@@ -42,99 +115,44 @@ impl Xy {
         let x = (y / self.y) * self.x;
         let z = (y / self.y) * (1. - self.x - self.y);
 
-        self.brightness = Some(brightness);
-
-        // To RGB using Wide RGB D65
-        let mut r = x * 1.656492 - y * 0.354851 - z * 0.255038;
-        let mut g = -x * 0.707196 + y * 1.655397 + z * 0.036152;
-        let mut b = x * 0.051713 - y * 0.121364 + z * 1.011530;
-
-        // Weird checks stolen from
-        // https://developers.meethue.com/develop/application-design-guidance/color-conversion-formulas-rgb-to-xy-and-back/#Color-rgb-to-xy
-        if r > b && r > g && r > 1.0 {
-            // red is too big
-            g /= r;
-            b /= r;
-            r = 1.;
-        } else if g > b && g > r && g > 1.0 {
-            // green is too big
-            r /= g;
-            b /= g;
-            g = 1.;
-        } else if b > r && b > g && b > 1.0 {
-            // blue is too big
-            r /= b;
-            g /= b;
-            b = 1.;
-        }
+        // To RGB using sRGB D65, the inverse of the From<Rgb> conversion
+        let r = (x * 3.2406 - y * 1.5372 - z * 0.4986).max(0.);
+        let g = (-x * 0.9689 + y * 1.8758 + z * 0.0415).max(0.);
+        let b = (x * 0.0557 - y * 0.2040 + z * 1.0570).max(0.);
 
-        // Gamma correction
-        r = if r <= 0.0031308 {
-            12.92 * r
-        } else {
-            (1.0 + 0.055) * r.powf(1.0 / 2.4) - 0.055
-        };
-        g = if g <= 0.0031308 {
-            12.92 * g
-        } else {
-            (1.0 + 0.055) * g.powf(1.0 / 2.4) - 0.055
-        };
-        b = if b <= 0.0031308 {
-            12.92 * b
+        // The biggest component is scaled down to 1 and the others with it
+        let biggest = r.max(g).max(b);
+        let (r, g, b) = if biggest > 1. {
+            (r / biggest, g / biggest, b / biggest)
         } else {
-            (1.0 + 0.055) * b.powf(1.0 / 2.4) - 0.055
+            (r, g, b)
         };
 
-        // Weird checks stolen from
-        // https://developers.meethue.com/develop/application-design-guidance/color-conversion-formulas-rgb-to-xy-and-back/#Color-rgb-to-xy
-        if r > b && r > g {
-            // red is biggest
-            if r > 1. {
-                g /= r;
-                b /= r;
-                r = 1.;
-            }
-        } else if g > b && g > r {
-            // green is biggest
-            if g > 1. {
-                r /= g;
-                b /= g;
-                g = 1.;
-            }
-        } else if b > r && b > g {
-            // blue is biggest
-            if b > 1. {
-                r /= b;
-                g /= b;
-                b = 1.;
+        // Gamma correction
+        let gamma = |c: f64| {
+            if c <= 0.0031308 {
+                12.92 * c
+            } else {
+                (1.0 + 0.055) * c.powf(1.0 / 2.4) - 0.055
             }
-        }
+        };
 
         debug!("values after calc {:?} {:?}", self, (r, g, b));
 
-        /*
-        assert!(
-            (0.0..1.).contains(&r),
-            "After conversion, R should be between 0. && 1. Actual value {r}"
-        );
-        assert!(
-            (0.0..1.).contains(&g),
-            "After conversion, G should be between 0. && 1. Actual value {g}"
-        );
-        assert!(
-            (0.0..1.).contains(&b),
-            "After conversion, B should be between 0. && 1. Actual value {b}"
-        );
-        */
-
-        Rgb::new(r * 255., g * 255., b * 255.)
+        Rgb::new(gamma(r) * 255., gamma(g) * 255., gamma(b) * 255.)
     }
 
+    /// Within gamut C
     pub fn is_within_color_gamut(&self) -> bool {
+        self.is_within(Gamut::C)
+    }
+
+    pub fn is_within(&self, gamut: Gamut) -> bool {
+        let [red, green, blue] = gamut.triangle();
         let (x, y) = (self.x, self.y);
-        let (x1, y1) = (RED.x, RED.y);
-        let (x2, y2) = (GREEN.x, GREEN.y);
-        let (x3, y3) = (BLUE.x, BLUE.y);
+        let (x1, y1) = (red.x, red.y);
+        let (x2, y2) = (green.x, green.y);
+        let (x3, y3) = (blue.x, blue.y);
 
         let denominator = (y2 - y3) * (x1 - x3) + (x3 - x2) * (y1 - y3);
 
@@ -159,9 +177,10 @@ impl Xy {
         let d2 = euclidean_distance(&p2_closest, self);
         let d3 = euclidean_distance(&p3_closest, self);
 
-        if d1 < d2 && d1 < d3 {
+        // Two sides are as close when the closest point is their corner
+        if d1 <= d2 && d1 <= d3 {
             p1_closest
-        } else if d2 < d1 && d2 < d3 {
+        } else if d2 <= d3 {
             p2_closest
         } else {
             p3_closest
@@ -221,8 +240,9 @@ impl From<Rgb> for Xy {
 
         // Xy from XYZ
         let brightness = y;
-        let x = x / (x + y + z);
-        let y = y / (x + y + z);
+        let sum = x + y + z;
+        let x = x / sum;
+        let y = y / sum;
 
         let xy = Self {
             x,
@@ -261,4 +281,46 @@ mod color_tests {
         assert_eq!(red.g, rgb.g, "Red G isn't equal to RGB G");
         assert_eq!(red.b, rgb.b, "Red B isn't equal to RGB B");
     }
+
+    fn rounded(rgb: Rgb) -> [u8; 3] {
+        [rgb.r.round() as _, rgb.g.round() as _, rgb.b.round() as _]
+    }
+
+    #[test]
+    fn rgb_round_trips_within_the_gamut() {
+        for rgb in [[255, 128, 0], [255, 255, 255], [0, 64, 255], [255, 0, 128]] {
+            let xy = Xy::from(Rgb::new(rgb[0] as _, rgb[1] as _, rgb[2] as _));
+            let back = rounded(xy.to_rgb_in(Gamut::C, 1.));
+
+            for (expected, got) in rgb.into_iter().zip(back) {
+                assert!(expected.abs_diff(got) <= 1, "{rgb:?} came back as {back:?}");
+            }
+        }
+    }
+
+    #[test]
+    fn to_rgb_in_brings_the_color_back_to_the_gamut() {
+        // The green corner of gamut C is out of gamut B, its closest point is the green corner
+        // of B (0.409, 0.518)
+        let green = Xy::new(0.17, 0.7);
+        assert!(green.is_within(Gamut::C));
+        assert!(!green.is_within(Gamut::B));
+
+        let in_b = rounded(green.to_rgb_in(Gamut::B, 1.));
+        assert_eq!(in_b, rounded(Xy::new(0.409, 0.518).to_rgb_in(Gamut::B, 1.)));
+        assert_ne!(in_b, rounded(green.to_rgb_in(Gamut::C, 1.)));
+
+        let back = Xy::from(Rgb::new(in_b[0] as _, in_b[1] as _, in_b[2] as _));
+        assert!((back.x - 0.409).abs() < 0.01 && (back.y - 0.518).abs() < 0.01);
+    }
+
+    #[test]
+    fn gamut_from_model() {
+        assert_eq!(Gamut::from_model("LCT001"), Gamut::B);
+        assert_eq!(Gamut::from_model("LST001\0"), Gamut::A);
+        assert_eq!(Gamut::from_model("LCA001"), Gamut::C);
+        assert_eq!(Gamut::from_model(""), Gamut::C);
+        assert_eq!(Gamut::from(0), Gamut::C);
+        assert_eq!(Gamut::from(u8::from(Gamut::B)), Gamut::B);
+    }
 }
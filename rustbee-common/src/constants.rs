@@ -1,8 +1,10 @@
 use uuid::{uuid, Uuid};
 
-pub type MaskT = u16;
+pub type MaskT = u64;
 
 pub const APP_ID: &str = "Rustbee";
+/// Semver of rustbee-common, bumped on releases so the daemon and its clients share it
+pub const VERSION: &str = env!("CARGO_PKG_VERSION");
 pub const HUE_BAR_1_ADDR: [u8; ADDR_LEN] = [0xE8, 0xD4, 0xEA, 0xC4, 0x62, 0x00];
 pub const HUE_BAR_2_ADDR: [u8; ADDR_LEN] = [0xEC, 0x27, 0xA7, 0xD6, 0x5A, 0x9C];
 
@@ -12,19 +14,75 @@ pub const POWER_UUID: Uuid = uuid!("932c32bd-0002-47a2-835a-a8d455b859dd");
 pub const BRIGHTNESS_UUID: Uuid = uuid!("932c32bd-0003-47a2-835a-a8d455b859dd");
 pub const TEMPERATURE_UUID: Uuid = uuid!("932c32bd-0004-47a2-835a-a8d455b859dd");
 pub const COLOR_UUID: Uuid = uuid!("932c32bd-0005-47a2-835a-a8d455b859dd");
+// Combined control characteristic, writes are type-length-value entries (see `control`) and it's
+// the only one that supports transitions
+pub const CONTROL_UUID: Uuid = uuid!("932c32bd-0007-47a2-835a-a8d455b859dd");
+// Power-on behavior after a power loss, [mode (see `power_on`), brightness, color xy (4 bytes)]
+pub const POWER_ON_UUID: Uuid = uuid!("932c32bd-0006-47a2-835a-a8d455b859dd");
+// Supported raw brightness [min, max], lights without it use MIN_BRIGHTNESS..=MAX_BRIGHTNESS. It
+// isn't in the gist, it's guessed from the numbering of the others so its value is only trusted if
+// it's a valid range (see get_brightness_range)
+pub const BRIGHTNESS_RANGE_UUID: Uuid = uuid!("932c32bd-0008-47a2-835a-a8d455b859dd");
+// Running effect, a single byte (see `effect`). It isn't in the gist, it's guessed from the
+// numbering of the others so a device only has it once probed (see probe_char)
+pub const EFFECT_UUID: Uuid = uuid!("932c32bd-0009-47a2-835a-a8d455b859dd");
+// Levels of the separate white channels [warm, cool] of the tunable white variants that have them,
+// the others only have TEMPERATURE_UUID. Guessed from the numbering like EFFECT_UUID, so it's only
+// used once probed too
+pub const WHITE_MIX_UUID: Uuid = uuid!("932c32bd-000a-47a2-835a-a8d455b859dd");
+pub const CONFIG_SERVICES_UUID: Uuid = uuid!("0000fe0f-0000-1000-8000-00805f9b34fb");
+pub const NAME_UUID: Uuid = uuid!("97fe6561-0003-4f62-86e9-b71ee2da3d22");
 pub const MISC_SERVICES_UUID: Uuid = uuid!("0000180a-0000-1000-8000-00805f9b34fb");
 pub const MODEL_UUID: Uuid = uuid!("00002a24-0000-1000-8000-00805f9b34fb");
 pub const MANUFACTURER_UUID: Uuid = uuid!("00002a29-0000-1000-8000-00805f9b34fb");
+pub const FIRMWARE_UUID: Uuid = uuid!("00002a26-0000-1000-8000-00805f9b34fb");
 
 #[cfg(target_os = "windows")]
 pub const SOCKET_PATH: &str = r#"\\.\pipe\rustbee-daemon.sock"#;
 #[cfg(target_os = "windows")]
 pub const LOG_PATH: &str = "./rustbee.log"; // TODO: Use APPDATA
+#[cfg(target_os = "windows")]
+pub const DATA_DIR: &str = "."; // TODO: Use APPDATA
+#[cfg(target_os = "windows")]
+pub const SCENES_FILE: &str = "rustbee-scenes.json";
+#[cfg(target_os = "windows")]
+pub const BONDS_FILE: &str = "rustbee-bonds.json";
 
 #[cfg(not(target_os = "windows"))]
 pub const SOCKET_PATH: &str = "/var/run/rustbee-daemon.sock";
 #[cfg(not(target_os = "windows"))]
 pub const LOG_PATH: &str = "/var/log/rustbee.log";
+/// Where the daemon keeps its files, shared by every instance unless DATA_DIR_ENV overrides it
+#[cfg(not(target_os = "windows"))]
+pub const DATA_DIR: &str = "/var/lib/rustbee";
+/// Scenes of the daemon in its data dir
+#[cfg(not(target_os = "windows"))]
+pub const SCENES_FILE: &str = "scenes.json";
+/// Devices paired by the daemon in its data dir, see bonds
+#[cfg(not(target_os = "windows"))]
+pub const BONDS_FILE: &str = "bonds.json";
+
+/// The bind address and the token of TCP_LISTEN and the token of the TCP handshake are sent
+/// after their length byte
+pub const TCP_ARG_MAX_LEN: usize = u8::MAX as _;
+
+/// Overrides SOCKET_PATH, it's how a custom socket path is passed to the launched daemon
+pub const SOCKET_PATH_ENV: &str = "RUSTBEE_SOCKET_PATH";
+
+/// Overrides DATA_DIR, it's how a custom data dir is passed to the launched daemon
+pub const DATA_DIR_ENV: &str = "RUSTBEE_DATA_DIR";
+
+/// Set for a daemon launched by launch_simulated_daemon_at, it then drives virtual devices
+/// instead of Bluetooth ones
+pub const SIMULATE_ENV: &str = "RUSTBEE_SIMULATE";
+
+/// Exit codes of a daemon that cannot start, reported by launch_daemon_at. Any other failure
+/// exits with 1
+pub mod exit_code {
+    pub const SOCKET_IN_USE: i32 = 2;
+    /// The directory of the socket cannot be read or written
+    pub const PERMISSION_DENIED: i32 = 3;
+}
 
 // Levels ERROR < WARN < INFO < DEBUG < TRACE
 pub const LOG_LEVEL: log::Level = log::Level::Debug;
@@ -32,19 +90,53 @@ pub const LOG_LEVEL: log::Level = log::Level::Debug;
 /// Buffer input
 /// Sent by the client
 /// Received by the server
-pub const BUFFER_LEN: usize = ADDR_LEN + 2 + 1 + DATA_LEN; // ADDR_LEN bytes BLE UUID length + 2 for the flags (u16 divided by 2 u8)
-                                                           // + 1 for the SET/GET flag + DATA_LEN for values when SET
+pub const BUFFER_LEN: usize = ADDR_LEN + FLAGS_LEN + 1 + DATA_LEN; // ADDR_LEN bytes BLE UUID length + FLAGS_LEN for the flags (little endian MaskT)
+                                                                   // + 1 for the SET/GET flag + DATA_LEN for values when SET
+pub const FLAGS_LEN: usize = std::mem::size_of::<MaskT>();
 
 /// Buffer output
 /// Sent by the server
 /// Received by the client
 pub const OUTPUT_LEN: usize = 1 + 19; // 1 for output status code + 20 bytes output data (mostly because of strings)
 
-pub const DATA_LEN: usize = 10;
+pub const DATA_LEN: usize = 19; // Fits a device name (the same length as the output data)
 pub const ADDR_LEN: usize = 6;
 
 pub const GUI_SAVE_INTERVAL_SECS: u64 = 60;
 
+/// Color temperature range in mireds (1 000 000 / kelvin) of the Hue white ambiance lights
+pub const MIN_MIREDS: u16 = 153;
+pub const MAX_MIREDS: u16 = 500;
+
+/// Raw brightness range of the brightness characteristic
+pub const MIN_BRIGHTNESS: u8 = 1;
+pub const MAX_BRIGHTNESS: u8 = 254;
+
+/// Identify blinks the light between the min and max brightness every interval
+pub const IDENTIFY_BLINKS: usize = 3;
+pub const IDENTIFY_INTERVAL_MS: u64 = 400;
+
+/// Returned by the FFI when the RSSI cannot be read, a measured RSSI is always negative
+pub const RSSI_UNAVAILABLE: i16 = 1;
+
+/// A daemon that doesn't answer a ping in time is considered dead
+pub const PING_TIMEOUT_MS: u64 = 500;
+
+/// Default time a FFI command waits for the daemon answer once connected, see set_command_timeout
+pub const COMMAND_TIMEOUT_MS: u32 = 5000;
+/// Added to the command timeout of the requests that may connect the device first, the daemon
+/// gives the discovery of a device it doesn't know up to 30s
+pub const CONNECT_TIMEOUT_MS: u32 = 30 * 1000;
+
+/// How long a graceful shutdown_daemon waits for the daemon to exit
+pub const SHUTDOWN_TIMEOUT_SECS: u64 = 5;
+
+/// How long a launch waits for the one of another process, see lock_launch
+pub const LAUNCH_LOCK_TIMEOUT_SECS: u64 = 5;
+
+/// Hue API saturation scale, kept for HSV callers of the FFI
+pub const MAX_SATURATION: u8 = 254;
+
 #[derive(Debug, Clone, Copy, PartialEq)]
 pub enum OutputCode {
     Success,
@@ -52,6 +144,7 @@ pub enum OutputCode {
     DeviceNotFound,
     Streaming,
     StreamEOF,
+    Timeout,
 }
 
 impl OutputCode {
@@ -68,6 +161,7 @@ impl From<u8> for OutputCode {
             2 => OutputCode::DeviceNotFound,
             3 => OutputCode::Streaming,
             4 => OutputCode::StreamEOF,
+            5 => OutputCode::Timeout,
             x => panic!("Output code is {x} which is not handled"),
         }
     }
@@ -81,6 +175,7 @@ impl From<OutputCode> for u8 {
             OutputCode::DeviceNotFound => 2,
             OutputCode::Streaming => 3,
             OutputCode::StreamEOF => 4,
+            OutputCode::Timeout => 5,
         }
     }
 }
@@ -100,6 +195,49 @@ pub mod flags {
     pub const BRIGHTNESS: MaskT = 7;
     pub const NAME: MaskT = 8;
     pub const SEARCH_NAME: MaskT = 9;
+    pub const TEMPERATURE: MaskT = 10;
+    pub const SCAN: MaskT = 11;
+    pub const TRANSITION: MaskT = 12;
+    pub const IDENTIFY: MaskT = 13;
+    pub const PING: MaskT = 14;
+    pub const VERSION: MaskT = 15;
+    pub const RSSI: MaskT = 16;
+    pub const STATE: MaskT = 17;
+    pub const SUBSCRIBE: MaskT = 18;
+    pub const POWER_ON: MaskT = 19;
+    pub const CAPABILITIES: MaskT = 20;
+    pub const CONNECT_PROGRESS: MaskT = 21;
+    pub const ALL_POWER: MaskT = 22;
+    pub const BRIGHTNESS_RANGE: MaskT = 23;
+    pub const SHUTDOWN: MaskT = 24;
+    pub const GATT: MaskT = 25;
+    pub const CONFIRMED_WRITES: MaskT = 26;
+    pub const UNCONFIRMED_WRITES: MaskT = 27;
+    pub const EFFECT: MaskT = 28;
+    pub const IDLE_DISCONNECT: MaskT = 29;
+    pub const SCENE: MaskT = 30;
+    pub const STATS: MaskT = 31;
+    pub const CONNECTION_CACHE: MaskT = 32;
+    pub const DEVICES: MaskT = 33;
+    pub const LOGS: MaskT = 34;
+    pub const PAIR: MaskT = 35;
+    pub const AUTO_RECONNECT: MaskT = 36;
+    pub const TCP_LISTEN: MaskT = 37;
+    pub const FIRMWARE: MaskT = 38;
+    pub const TOGGLE_POWER: MaskT = 39;
+    pub const CONNECTION_PARAMS: MaskT = 40;
+    pub const SCHEDULE: MaskT = 41;
+    pub const ADVERTISEMENT: MaskT = 42;
+    pub const KEEPALIVE: MaskT = 43;
+    pub const FLUSH: MaskT = 44;
+    pub const WRITE_RATE: MaskT = 45;
+    pub const WHITE_MIX: MaskT = 46;
+    pub const APPLY_STATE: MaskT = 47;
+    pub const CONNECTION_EVENTS: MaskT = 48;
+    pub const SIMULATED_DEVICE: MaskT = 49;
+    pub const DEVICE_TAG: MaskT = 50;
+    pub const FEATURES: MaskT = 51;
+    pub const RECONNECT_POLICY: MaskT = 52;
 }
 
 pub mod masks {
@@ -114,4 +252,231 @@ pub mod masks {
     pub const BRIGHTNESS: MaskT = 1 << 6;
     pub const NAME: MaskT = 1 << 7;
     pub const SEARCH_NAME: MaskT = 1 << 8;
+    pub const TEMPERATURE: MaskT = 1 << 9;
+    pub const SCAN: MaskT = 1 << 10;
+    pub const TRANSITION: MaskT = 1 << 11;
+    pub const IDENTIFY: MaskT = 1 << 12;
+    pub const PING: MaskT = 1 << 13;
+    pub const VERSION: MaskT = 1 << 14;
+    pub const RSSI: MaskT = 1 << 15;
+    pub const STATE: MaskT = 1 << 16;
+    pub const SUBSCRIBE: MaskT = 1 << 17;
+    pub const POWER_ON: MaskT = 1 << 18;
+    pub const CAPABILITIES: MaskT = 1 << 19;
+    pub const CONNECT_PROGRESS: MaskT = 1 << 20;
+    pub const ALL_POWER: MaskT = 1 << 21;
+    pub const BRIGHTNESS_RANGE: MaskT = 1 << 22;
+    pub const SHUTDOWN: MaskT = 1 << 23;
+    pub const GATT: MaskT = 1 << 24;
+    pub const CONFIRMED_WRITES: MaskT = 1 << 25;
+    pub const UNCONFIRMED_WRITES: MaskT = 1 << 26;
+    pub const EFFECT: MaskT = 1 << 27;
+    pub const IDLE_DISCONNECT: MaskT = 1 << 28;
+    pub const SCENE: MaskT = 1 << 29;
+    pub const STATS: MaskT = 1 << 30;
+    pub const CONNECTION_CACHE: MaskT = 1 << 31;
+    pub const DEVICES: MaskT = 1 << 32;
+    pub const LOGS: MaskT = 1 << 33;
+    pub const PAIR: MaskT = 1 << 34;
+    pub const AUTO_RECONNECT: MaskT = 1 << 35;
+    pub const TCP_LISTEN: MaskT = 1 << 36;
+    pub const FIRMWARE: MaskT = 1 << 37;
+    pub const TOGGLE_POWER: MaskT = 1 << 38;
+    pub const CONNECTION_PARAMS: MaskT = 1 << 39;
+    pub const SCHEDULE: MaskT = 1 << 40;
+    pub const ADVERTISEMENT: MaskT = 1 << 41;
+    pub const KEEPALIVE: MaskT = 1 << 42;
+    pub const FLUSH: MaskT = 1 << 43;
+    pub const WRITE_RATE: MaskT = 1 << 44;
+    pub const WHITE_MIX: MaskT = 1 << 45;
+    pub const APPLY_STATE: MaskT = 1 << 46;
+    pub const CONNECTION_EVENTS: MaskT = 1 << 47;
+    pub const SIMULATED_DEVICE: MaskT = 1 << 48;
+    pub const DEVICE_TAG: MaskT = 1 << 49;
+    pub const FEATURES: MaskT = 1 << 50;
+    pub const RECONNECT_POLICY: MaskT = 1 << 51;
+
+    /// The top byte isn't a flag, it's the retries of the failed GATT writes of the request
+    pub const WRITE_RETRIES_SHIFT: u32 = MaskT::BITS - 8;
+}
+
+/// Types of the CONTROL_UUID characteristic entries
+pub mod control {
+    pub const POWER: u8 = 0x01;
+    pub const BRIGHTNESS: u8 = 0x02;
+    pub const TEMPERATURE: u8 = 0x03;
+    pub const COLOR: u8 = 0x04;
+    /// Deciseconds (u16 little endian)
+    pub const TRANSITION: u8 = 0x05;
+
+    /// Longest payload written at once, the default ATT MTU (23) without the header of the write
+    pub const MAX_LEN: usize = 20;
+}
+
+/// Modes of the POWER_ON_UUID characteristic
+pub mod power_on {
+    pub const LAST_STATE: u8 = 0;
+    /// Comes up with the brightness and color of the characteristic
+    pub const FIXED: u8 = 1;
+    pub const OFF: u8 = 2;
+}
+
+/// Values of the EFFECT_UUID characteristic
+pub mod effect {
+    pub const NONE: u8 = 0;
+    /// Cycles through the colors until it's stopped
+    pub const COLOR_LOOP: u8 = 1;
+}
+
+/// First data byte of a SCENE command, the scene name follows (nul padded)
+pub mod scene_op {
+    /// Captures every connected device
+    pub const SAVE: u8 = 0;
+    /// Streams the devices of the scene, the client restores them
+    pub const GET: u8 = 1;
+    /// Streams the names, the name is ignored
+    pub const LIST: u8 = 2;
 }
+
+/// First data byte of a SCHEDULE command
+pub mod schedule_op {
+    /// Followed by the time in ms since the Unix epoch (u64 little endian) then the
+    /// `scheduled_state`, the output is the job id (u64 little endian)
+    pub const ADD: u8 = 0;
+    /// Followed by the job id, a job that already started cannot be cancelled
+    pub const CANCEL: u8 = 1;
+}
+
+/// State of a scheduled command: the `bits` of its fields, the raw brightness, the color (xy as
+/// u16 little endian), the mireds then the transition in deciseconds (u16 little endian)
+pub mod scheduled_state {
+    pub const LEN: usize = 10;
+
+    pub mod bits {
+        pub const POWER: u8 = 1 << 0;
+        /// The power to apply if POWER is set
+        pub const ON: u8 = 1 << 1;
+        pub const BRIGHTNESS: u8 = 1 << 2;
+        pub const COLOR: u8 = 1 << 3;
+        pub const TEMPERATURE: u8 = 1 << 4;
+    }
+}
+
+/// Bits of the fields of a state that weren't applied for the FFI set_state_ex, the
+/// `scheduled_state::bits` without ON
+pub mod state_field {
+    pub const POWER: u8 = 1 << 0;
+    pub const BRIGHTNESS: u8 = 1 << 1;
+    pub const COLOR: u8 = 1 << 2;
+    pub const COLOR_TEMP: u8 = 1 << 3;
+}
+
+/// Data of a SIMULATED_DEVICE command adding or replacing a virtual device of a simulated daemon:
+/// whether it's connected, its power, raw brightness, whether it has a color, its color (xy as u16
+/// little endian) then its name (nul padded). A daemon that isn't simulated fails it
+pub mod simulated_device {
+    pub const NAME_OFFSET: usize = 8;
+}
+
+/// First data byte of a failed SCHEDULE command cancelling a job that doesn't exist (anymore)
+pub const SCHEDULE_UNKNOWN_JOB: u8 = 1;
+
+/// First data byte of a STATS request, the version of the stats the client reads. The daemon
+/// answers the clients of an older version (0 before the versions) with the first output only
+pub const STATS_VERSION: u8 = 2;
+
+/// Write modes of a FFI device, see set_write_mode
+pub mod write_mode {
+    /// The device acknowledges every write, a missing acknowledgement is a failure
+    pub const CONFIRMED: u8 = 0;
+    /// Fire and forget, a write succeeds once it's queued
+    pub const UNCONFIRMED: u8 = 1;
+
+    /// Retries of a failed write, see set_write_retries
+    pub const DEFAULT_RETRIES: u8 = 2;
+}
+
+/// Curves of the brightness percentages of a FFI device, see set_brightness_curve
+pub mod brightness_curve {
+    /// The percentage is a share of the raw brightness
+    pub const LINEAR: u8 = 0;
+    /// The raw brightness is the percentage raised to GAMMA_EXPONENT, the eye sees the steps
+    /// as even
+    pub const GAMMA: u8 = 1;
+
+    pub const GAMMA_EXPONENT: f64 = 2.2;
+}
+
+/// Bits of a device capabilities, set when the light has the matching characteristic
+pub mod capabilities {
+    pub const COLOR: u8 = 1 << 0;
+    pub const COLOR_TEMP: u8 = 1 << 1;
+    pub const DIMMING: u8 = 1 << 2;
+    /// Separate warm and cool white channels, see WHITE_MIX_UUID
+    pub const WHITE_MIX: u8 = 1 << 3;
+}
+
+/// Bits of the FEATURES output (u32 little endian), the low byte is the `capabilities`. The
+/// others come from the characteristics of the light, then from its model and firmware (see
+/// quirks)
+pub mod features {
+    pub const CAPABILITIES: u32 = 0xff;
+    /// The fields of a state are written at once, see write_control
+    pub const COMBINED_WRITE: u32 = 1 << 8;
+    pub const EFFECTS: u32 = 1 << 9;
+    /// The values the light boots with, older firmwares don't have them
+    pub const STARTUP_STATE: u32 = 1 << 10;
+    /// The light only accepts the writes of a bonded central, see PAIR
+    pub const NEEDS_BONDING: u32 = 1 << 11;
+}
+
+/// Stages of a connection streamed with CONNECT_PROGRESS, READY is the last one once the device
+/// is ready for the commands of the request
+pub mod connect_stage {
+    pub const SCANNING: u8 = 0;
+    pub const CONNECTING: u8 = 1;
+    pub const DISCOVERING_SERVICES: u8 = 2;
+    pub const READY: u8 = 3;
+}
+
+/// Bounds of the data of a CONNECTION_PARAMS command: the min and max intervals in ms then the
+/// MTU, all u16 little endian
+pub mod connection_params {
+    /// 7.5ms rounded up, the shortest interval of the Bluetooth spec
+    pub const MIN_INTERVAL_MS: u16 = 8;
+    pub const MAX_INTERVAL_MS: u16 = 4000;
+    /// An MTU of 0 keeps the negotiated one
+    pub const MIN_MTU: u16 = 23;
+    pub const MAX_MTU: u16 = 517;
+    /// First data byte of a failed CONNECTION_PARAMS command when the platform cannot request them
+    pub const UNSUPPORTED: u8 = 1;
+}
+
+/// Length of the POWER_ON_UUID characteristic value
+pub const POWER_ON_LEN: usize = 6;
+/// Length of the EFFECT_UUID characteristic value
+pub const EFFECT_LEN: usize = 1;
+/// Length of the WHITE_MIX_UUID characteristic value
+pub const WHITE_MIX_LEN: usize = 2;
+
+/// Max value length of a raw GATT read or write (the max length of an ATT attribute)
+pub const GATT_MAX_LEN: usize = 512;
+/// First data byte of a failed GATT command when the device doesn't have the characteristic
+pub const GATT_UNKNOWN_CHAR: u8 = 1;
+
+/// Max length of a scene name, it's sent after the scene_op
+pub const SCENE_NAME_MAX_LEN: usize = DATA_LEN - 1;
+/// First data byte of a failed SCENE command when there is no scene with this name
+pub const SCENE_UNKNOWN: u8 = 1;
+
+/// Bytes of a log message in a Streaming output of the LOGS command, they follow the level and
+/// whether it's the last chunk of the message
+pub const LOG_CHUNK_LEN: usize = OUTPUT_LEN - 3;
+
+/// Bytes of manufacturer data in a Streaming output of a SCAN with ADVERTISEMENT, they follow
+/// their count. A shorter (maybe empty) chunk is the last one of the device.
+pub const ADV_CHUNK_LEN: usize = OUTPUT_LEN - 2;
+
+/// Offset of the transition time (u16 LE deciseconds) in the data of a TRANSITION command, right
+/// after the largest value (a color)
+pub const TRANSITION_OFFSET: usize = 4;
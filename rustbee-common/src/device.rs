@@ -1,7 +1,10 @@
+use std::collections::BTreeMap;
 use std::marker::PhantomData;
 use std::ops::Deref;
 use std::pin::Pin;
-use std::sync::Arc;
+use std::sync::atomic::{AtomicU32, Ordering};
+use std::sync::{Arc, Mutex as StdMutex};
+use std::time::{Duration, Instant};
 
 use futures::{future, stream, StreamExt};
 use interprocess::local_socket::{
@@ -10,15 +13,114 @@ use interprocess::local_socket::{
 use log::*;
 use tokio::io::{AsyncReadExt as _, AsyncWriteExt as _};
 use tokio::sync::Mutex;
+use uuid::Uuid;
 
 #[cfg(feature = "ffi")]
 use interprocess::local_socket::{traits::Stream as _, Stream as SyncStream};
 
 use crate::constants::{masks::*, *};
+use crate::utils::socket_path;
 use crate::InnerDevice;
 
 pub const EMPTY_BUFFER: [u8; DATA_LEN + 1] = [0; DATA_LEN + 1];
 
+/// GATT writes retried since the process started, see write_retries
+pub static RETRIED_WRITES: AtomicU32 = AtomicU32::new(0);
+
+/// A write that would wait longer for the write rate is dropped, see set_write_rate
+const WRITE_RATE_MAX_DELAY_MS: u64 = 1000;
+
+/// GATT writes held back by the write rate since the process started
+pub static DELAYED_WRITES: AtomicU32 = AtomicU32::new(0);
+/// GATT writes dropped by the write rate since the process started
+pub static DROPPED_WRITES: AtomicU32 = AtomicU32::new(0);
+
+/// The writes per second of every device (0 doesn't throttle them) and their buckets, each device
+/// has its own so a client flooding one of them doesn't hold back or drop the writes to the others
+static WRITE_BUCKETS: StdMutex<(u32, BTreeMap<[u8; ADDR_LEN], WriteBucket>)> =
+    StdMutex::new((0, BTreeMap::new()));
+
+/// Token bucket of the GATT writes, it holds at most a second of writes
+pub(crate) struct WriteBucket {
+    per_sec: u32,
+    tokens: f64,
+    refilled: Instant,
+}
+
+impl WriteBucket {
+    pub(crate) fn new(per_sec: u32, now: Instant) -> Self {
+        Self {
+            per_sec,
+            tokens: per_sec as _,
+            refilled: now,
+        }
+    }
+
+    /// Takes a token for a write, it returns how long the write must wait or None if that's over
+    /// WRITE_RATE_MAX_DELAY_MS. The tokens go below zero so the waiting writes are sent in order
+    pub(crate) fn reserve(&mut self, now: Instant) -> Option<Duration> {
+        let per_sec = self.per_sec as f64;
+        let elapsed = now.saturating_duration_since(self.refilled).as_secs_f64();
+        self.tokens = (self.tokens + elapsed * per_sec).min(per_sec);
+        self.refilled = now;
+
+        let wait = Duration::from_secs_f64((1. - self.tokens).max(0.) / per_sec);
+        if wait > Duration::from_millis(WRITE_RATE_MAX_DELAY_MS) {
+            return None;
+        }
+
+        self.tokens -= 1.;
+        Some(wait)
+    }
+}
+
+/// Throttles the GATT writes of each device to per_sec, 0 doesn't throttle them
+pub fn set_write_rate(per_sec: u32) {
+    *WRITE_BUCKETS.lock().unwrap() = (per_sec, BTreeMap::new());
+}
+
+/// How long the next write to addr waits for the write rate, None if it must be dropped
+pub(crate) fn reserve_write(addr: [u8; ADDR_LEN], now: Instant) -> Option<Duration> {
+    let (per_sec, buckets) = &mut *WRITE_BUCKETS.lock().unwrap();
+    if *per_sec == 0 {
+        return Some(Duration::ZERO);
+    }
+
+    buckets
+        .entry(addr)
+        .or_insert_with(|| WriteBucket::new(*per_sec, now))
+        .reserve(now)
+}
+
+/// Waits for the write rate before a GATT write to addr, false if the write must be dropped
+pub(crate) async fn throttle_write(addr: [u8; ADDR_LEN]) -> bool {
+    match reserve_write(addr, Instant::now()) {
+        Some(wait) if wait.is_zero() => true,
+        Some(wait) => {
+            DELAYED_WRITES.fetch_add(1, Ordering::Relaxed);
+            tokio::time::sleep(wait).await;
+            true
+        }
+        None => {
+            DROPPED_WRITES.fetch_add(1, Ordering::Relaxed);
+            false
+        }
+    }
+}
+
+/// Whether the devices have the characteristics guessed from the numbering of the others, by
+/// address and UUID. See probe_char
+static PROBED_CHARS: StdMutex<BTreeMap<([u8; ADDR_LEN], Uuid), bool>> =
+    StdMutex::new(BTreeMap::new());
+
+pub(crate) fn probed_char(addr: [u8; ADDR_LEN], charac: &Uuid) -> Option<bool> {
+    PROBED_CHARS.lock().unwrap().get(&(addr, *charac)).copied()
+}
+
+pub(crate) fn set_probed_char(addr: [u8; ADDR_LEN], charac: Uuid, found: bool) {
+    PROBED_CHARS.lock().unwrap().insert((addr, charac), found);
+}
+
 #[derive(Debug)]
 pub struct Error(pub String);
 
@@ -30,10 +132,45 @@ impl std::fmt::Display for Error {
 
 impl std::error::Error for Error {}
 
+/// The Bluetooth adapter the daemon uses, see bluetooth::get_adapter_info
+#[derive(Debug, Default)]
+pub struct AdapterInfo {
+    /// hci0 and its bus on Linux, the device id on Windows
+    pub name: String,
+    /// None if the platform doesn't tell
+    pub address: Option<[u8; ADDR_LEN]>,
+}
+
 #[derive(Debug, Default, Hash)]
 pub struct FoundDevice {
     pub address: [u8; ADDR_LEN],
     pub name: String,
+    /// Company id (u16 little endian) followed by the data, empty if the scan didn't ask for the
+    /// advertisements or the device had none
+    pub manufacturer_data: Vec<u8>,
+}
+
+/// From a daemon Streaming output, the address followed by the nul padded name. The manufacturer
+/// data is in the Streaming outputs that follow it, if any.
+impl From<[u8; OUTPUT_LEN - 1]> for FoundDevice {
+    fn from(device_buf: [u8; OUTPUT_LEN - 1]) -> Self {
+        let mut address = [0; ADDR_LEN];
+        let len = address.len();
+        address.copy_from_slice(&device_buf[..len]);
+
+        let idx = device_buf[len..]
+            .iter()
+            .position(|b| *b == b'\0')
+            .unwrap_or(device_buf[len..].len())
+            + len; // since I'm getting the index of the sub_slice [len..] I need to add the
+                   // offset len to have the exact index of the slice
+
+        Self {
+            address,
+            name: String::from_utf8_lossy(&device_buf[len..idx]).into_owned(),
+            manufacturer_data: Vec::new(),
+        }
+    }
 }
 
 #[derive(Clone, Debug, Default)]
@@ -48,6 +185,11 @@ pub struct FFI;
 pub struct HueDevice<Type> {
     pub addr: [u8; ADDR_LEN],
     pub device: Option<InnerDevice>,
+    /// Whether the writes wait for the device acknowledgement, None is the default of the
+    /// platform (unconfirmed on Linux, confirmed on Windows)
+    pub confirmed_writes: Option<bool>,
+    /// Retries of a failed GATT write, 0 fails on the first failure
+    pub write_retries: u8,
     _type: PhantomData<Type>,
 }
 
@@ -56,6 +198,8 @@ impl Default for HueDevice<Server> {
         Self {
             addr: Default::default(),
             device: Default::default(),
+            confirmed_writes: Default::default(),
+            write_retries: Default::default(),
             _type: Default::default(),
         }
     }
@@ -65,6 +209,8 @@ impl Default for HueDevice<Client> {
         Self {
             addr: Default::default(),
             device: Default::default(),
+            confirmed_writes: Default::default(),
+            write_retries: Default::default(),
             _type: Default::default(),
         }
     }
@@ -75,6 +221,8 @@ impl Default for HueDevice<FFI> {
         Self {
             addr: Default::default(),
             device: Default::default(),
+            confirmed_writes: Default::default(),
+            write_retries: Default::default(),
             _type: Default::default(),
         }
     }
@@ -195,24 +343,6 @@ where
         // 1 for set/get byte offset
         buf[1..len + 1].copy_from_slice(&bytes[..len]);
 
-        let get_found_device = |device_buf: [u8; OUTPUT_LEN - 1]| {
-            let mut address = [0; ADDR_LEN];
-            let len = address.len();
-            address.copy_from_slice(&device_buf[..len]);
-
-            let idx = device_buf[len..]
-                .iter()
-                .position(|b| *b == b'\0')
-                .unwrap_or(device_buf[len..].len())
-                + len; // since I'm getting the index of the sub_slice [len..] I need to add the
-                       // offset len to have the exact index of the slice
-
-            FoundDevice {
-                address,
-                name: String::from_utf8(device_buf[len..idx].to_vec()).unwrap(),
-            }
-        };
-
         let stream = Arc::new(Mutex::new(Self::get_file_socket().await));
 
         let stream_iter = stream::unfold(
@@ -232,7 +362,10 @@ where
 
                     drop(stream_guard);
 
-                    return Some((get_found_device(device_buf), Some((stream_guard_ref, true))));
+                    return Some((
+                        FoundDevice::from(device_buf),
+                        Some((stream_guard_ref, true)),
+                    ));
                 }
 
                 let (code, device_buf) = Self::receive_packet_from_daemon(&mut stream_guard).await;
@@ -244,7 +377,10 @@ where
 
                 drop(stream_guard);
 
-                Some((get_found_device(device_buf), Some((stream_guard_ref, true))))
+                Some((
+                    FoundDevice::from(device_buf),
+                    Some((stream_guard_ref, true)),
+                ))
             },
         );
 
@@ -262,14 +398,16 @@ where
     }
 
     async fn get_file_socket() -> TokioStream {
-        let fs_name = SOCKET_PATH
+        let socket_path = socket_path();
+        let fs_name = socket_path
+            .as_str()
             .to_fs_name::<GenericFilePath>()
             .unwrap_or_else(|error| {
                 error!("Error cannot create filesystem path name: {error}");
                 std::process::exit(2);
             });
         TokioStream::connect(fs_name).await.unwrap_or_else(|error| {
-            error!("Error cannot connect to file socket name: {SOCKET_PATH} => {error}");
+            error!("Error cannot connect to file socket name: {socket_path} => {error}");
             std::process::exit(2);
         })
     }
@@ -300,10 +438,8 @@ where
             }
         }
         offset = ADDR_LEN;
-        chunks[offset] = (flags & 0xff) as _;
-        offset += 1;
-        chunks[offset] = (flags >> 8) as _;
-        offset += 1;
+        chunks[offset..offset + FLAGS_LEN].copy_from_slice(&flags.to_le_bytes());
+        offset += FLAGS_LEN;
         for (i, byte) in data.iter().enumerate() {
             chunks[i + offset] = *byte;
         }
@@ -339,25 +475,39 @@ impl HueDevice<FFI>
 where
     HueDevice<FFI>: Default + std::fmt::Debug,
 {
-    pub fn get_file_socket() -> interprocess::local_socket::Stream {
-        let fs_name = SOCKET_PATH
-            .to_fs_name::<GenericFilePath>()
-            .unwrap_or_else(|error| {
-                error!("Error cannot create filesystem path name: {error}");
-                std::process::exit(2);
-            });
-        SyncStream::connect(fs_name).unwrap_or_else(|error| {
-            error!("Error cannot connect to file socket name: {SOCKET_PATH} => {error}");
-            std::process::exit(2);
-        })
+    /// Unlike the Client, it must not exit the process since it's running in the host program
+    pub fn get_file_socket() -> std::io::Result<SyncStream> {
+        Self::get_file_socket_at(&socket_path())
+    }
+
+    /// Same as get_file_socket but for the daemon listening on socket_path
+    pub fn get_file_socket_at(socket_path: &str) -> std::io::Result<SyncStream> {
+        let fs_name = socket_path.to_fs_name::<GenericFilePath>()?;
+
+        SyncStream::connect(fs_name)
     }
 
     pub fn send_packet_to_daemon(
-        stream: &mut SyncStream,
+        stream: &mut (impl std::io::Read + std::io::Write),
         address: Option<[u8; ADDR_LEN]>,
         flags: MaskT,
         data: [u8; DATA_LEN + 1],
     ) -> CmdOutput {
+        if let Err(error) = Self::write_packet_to_daemon(stream, address, flags, data) {
+            error!("Error cannot write to daemon socket: {error}");
+            return (OutputCode::Failure, [0; OUTPUT_LEN - 1]);
+        }
+
+        Self::receive_packet_from_daemon(stream)
+    }
+
+    /// Only writes the packet, for the commands that are followed by more data on the stream
+    pub fn write_packet_to_daemon(
+        stream: &mut impl std::io::Write,
+        address: Option<[u8; ADDR_LEN]>,
+        flags: MaskT,
+        data: [u8; DATA_LEN + 1],
+    ) -> std::io::Result<()> {
         use std::io::Write as _;
 
         #[allow(unused_assignments)]
@@ -369,27 +519,29 @@ where
             }
         }
         offset = ADDR_LEN;
-        chunks[offset] = (flags & 0xff) as _;
-        offset += 1;
-        chunks[offset] = (flags >> 8) as _;
-        offset += 1;
+        chunks[offset..offset + FLAGS_LEN].copy_from_slice(&flags.to_le_bytes());
+        offset += FLAGS_LEN;
         for (i, byte) in data.iter().enumerate() {
             chunks[i + offset] = *byte;
         }
 
-        stream.write_all(&chunks[..]).unwrap();
-        stream.flush().unwrap();
-
-        Self::receive_packet_from_daemon(stream)
+        stream.write_all(&chunks[..])?;
+        stream.flush()
     }
 
-    fn receive_packet_from_daemon(stream: &mut SyncStream) -> CmdOutput {
-        use std::io::Read as _;
-
+    pub fn receive_packet_from_daemon(stream: &mut impl std::io::Read) -> CmdOutput {
         let mut output = [0; OUTPUT_LEN - 1];
 
         let mut buf = [0; OUTPUT_LEN];
         if let Err(error) = stream.read_exact(&mut buf) {
+            // The read timeout of the socket, see set_command_timeout
+            if matches!(
+                error.kind(),
+                std::io::ErrorKind::WouldBlock | std::io::ErrorKind::TimedOut
+            ) {
+                return (OutputCode::Timeout, output);
+            }
+
             error!("Error cannot read daemon output, please check `rustbee logs` ({error}) buffer: {buf:?}");
             return (OutputCode::Failure, output);
         }
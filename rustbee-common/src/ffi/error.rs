@@ -0,0 +1,125 @@
+use std::cell::RefCell;
+use std::ffi::{c_char, c_int, CString};
+use std::ptr;
+
+use crate::constants::{OutputCode, ADDR_LEN};
+use crate::utils;
+
+use super::{track, untrack};
+
+thread_local! {
+    static LAST_ERROR: RefCell<Option<(ErrorCode, String)>> = const { RefCell::new(None) };
+    /// Address and tag of the devices of the calls in progress on this thread, the last one
+    /// labels the errors. See set_device_tag
+    static LABELS: RefCell<Vec<([u8; ADDR_LEN], Option<String>)>> = const { RefCell::new(Vec::new()) };
+}
+
+/// Keep it in sync with the RustbeeError enum of the C header
+#[derive(Debug, Clone, Copy, PartialEq)]
+#[repr(C)]
+pub enum ErrorCode {
+    None = 0,
+    NullPointer = 1,
+    InvalidArg = 2,
+    DaemonUnreachable = 3,
+    DeviceNotFound = 4,
+    NotConnected = 5,
+    GattError = 6,
+    DaemonError = 7,
+    Timeout = 8,
+    NoAdapter = 9,
+    Unsupported = 10,
+    SocketInUse = 11,
+    PermissionDenied = 12,
+    SpawnFailed = 13,
+}
+
+pub fn set_last_error(code: ErrorCode, message: impl Into<String>) {
+    let mut message = message.into();
+    LABELS.with_borrow(|labels| {
+        if let Some((addr, tag)) = labels.last() {
+            let label = tag.clone().unwrap_or_else(|| utils::format_addr(addr));
+            message = format!("[{label}] {message}");
+        }
+    });
+
+    LAST_ERROR.with_borrow_mut(|last_error| *last_error = Some((code, message)));
+}
+
+pub fn push_label(addr: [u8; ADDR_LEN], tag: Option<String>) {
+    LABELS.with_borrow_mut(|labels| labels.push((addr, tag)));
+}
+
+pub fn pop_label() {
+    LABELS.with_borrow_mut(Vec::pop);
+}
+
+pub fn clear_last_error() {
+    LAST_ERROR.with_borrow_mut(|last_error| *last_error = None);
+}
+
+/// Used to bring the last error of a worker thread back to the calling thread
+pub fn take_last_error() -> Option<(ErrorCode, String)> {
+    LAST_ERROR.with_borrow_mut(Option::take)
+}
+
+fn has_last_error() -> bool {
+    LAST_ERROR.with_borrow(Option::is_some)
+}
+
+/// Sets the last error from a daemon output code if it's not a success
+/// and if the error hasn't already been set by the transport (e.g. daemon unreachable)
+///
+/// `action` completes "Failed to ..." for the error message
+pub fn check_output(code: OutputCode, on_failure: ErrorCode, action: &str) -> bool {
+    if code.is_success() {
+        return true;
+    }
+
+    if has_last_error() {
+        return false;
+    }
+
+    match code {
+        OutputCode::DeviceNotFound => set_last_error(
+            ErrorCode::DeviceNotFound,
+            format!("Failed to {action}: device not found or not in range"),
+        ),
+        OutputCode::Timeout => {
+            set_last_error(ErrorCode::Timeout, format!("Failed to {action}: timed out"))
+        }
+        _ => set_last_error(on_failure, format!("Failed to {action}")),
+    }
+
+    false
+}
+
+#[no_mangle]
+pub(super) extern "C" fn rustbee_last_error() -> c_int {
+    LAST_ERROR.with_borrow(|last_error| {
+        last_error
+            .as_ref()
+            .map_or(ErrorCode::None, |(code, _)| *code) as _
+    })
+}
+
+#[no_mangle]
+pub(super) extern "C" fn rustbee_last_error_message() -> *const c_char {
+    LAST_ERROR.with_borrow(|last_error| match last_error {
+        Some((_, message)) => CString::new(message.as_str()).map_or(ptr::null(), |message| {
+            track(message.into_raw()).cast_const()
+        }),
+        None => ptr::null(),
+    })
+}
+
+#[no_mangle]
+pub(super) extern "C" fn free_error_message(message_ptr: *const c_char) {
+    if !untrack(message_ptr) {
+        return;
+    }
+
+    unsafe {
+        drop(CString::from_raw(message_ptr.cast_mut()));
+    }
+}
@@ -0,0 +1,6146 @@
+mod error;
+mod stream;
+
+use std::cell::RefCell;
+use std::collections::{BTreeMap, BTreeSet};
+use std::ffi::{
+    c_char, c_float, c_int, c_short as int16_t, c_uchar as uint8_t, c_uint as uint32_t,
+    c_ulonglong as uint64_t, c_ushort as uint16_t, c_void, CStr, CString,
+};
+use std::io::{self, Write as _};
+use std::ops::{Deref, DerefMut};
+use std::ptr;
+use std::sync::atomic::{AtomicBool, AtomicU32, Ordering};
+use std::sync::{mpsc, Arc, Condvar, Mutex, OnceLock};
+use std::thread::{self, JoinHandle};
+use std::time::{Duration, Instant};
+
+use color_space::{Hsv, Rgb};
+use tokio::runtime::{Builder, Runtime};
+
+use crate::colors::{Gamut, Xy};
+use crate::constants::{
+    brightness_curve, capabilities, connect_stage, connection_params, effect, masks::*, power_on,
+    scene_op, schedule_op, scheduled_state, state_field, write_mode, MaskT, OutputCode, ADDR_LEN,
+    ADV_CHUNK_LEN, COMMAND_TIMEOUT_MS, CONNECT_TIMEOUT_MS, DATA_LEN, GATT_MAX_LEN,
+    GATT_UNKNOWN_CHAR, LOG_CHUNK_LEN, MAX_BRIGHTNESS, MAX_MIREDS, MAX_SATURATION, MIN_BRIGHTNESS,
+    MIN_MIREDS, OUTPUT_LEN, PING_TIMEOUT_MS, POWER_ON_LEN, RSSI_UNAVAILABLE, SCENE_NAME_MAX_LEN,
+    SCENE_UNKNOWN, SCHEDULE_UNKNOWN_JOB, SET, STATS_VERSION, TCP_ARG_MAX_LEN, TRANSITION_OFFSET,
+};
+use crate::device::{AdapterInfo as Adapter, CmdOutput, FoundDevice, HueDevice, EMPTY_BUFFER, FFI};
+use crate::utils;
+
+use error::*;
+use stream::{SendHalf, Stream};
+
+static THREAD: OnceLock<Runtime> = OnceLock::new();
+
+fn runtime() -> &'static Runtime {
+    THREAD.get_or_init(|| Builder::new_current_thread().enable_all().build().unwrap())
+}
+
+/// Addresses of the allocations handed to the caller and not freed yet with their kind, the free_*
+/// fns are no-ops for anything else (NULL, double frees, pointers that don't come from librustbee
+/// and allocations of another kind)
+static ALLOCATIONS: Mutex<BTreeMap<usize, AllocKind>> = Mutex::new(BTreeMap::new());
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+enum AllocKind {
+    Device,
+    /// Every CString, they're all freed the same way
+    String,
+    StateSnapshot,
+    SceneList,
+    DeviceList,
+    ManagedDeviceList,
+    ScanHandle,
+    DaemonHandle,
+}
+
+/// The types handed to the caller, a pointer is only freed as the type it was tracked as
+trait Tracked {
+    const KIND: AllocKind;
+}
+
+macro_rules! tracked {
+    ($($ty:ty => $kind:ident),* $(,)?) => {
+        $(impl Tracked for $ty {
+            const KIND: AllocKind = AllocKind::$kind;
+        })*
+    };
+}
+
+tracked! {
+    Device => Device,
+    c_char => String,
+    StateSnapshot => StateSnapshot,
+    SceneList => SceneList,
+    DeviceList => DeviceList,
+    ManagedDeviceList => ManagedDeviceList,
+    ScanHandle => ScanHandle,
+    DaemonHandle => DaemonHandle,
+}
+
+fn track<T: Tracked>(ptr: *mut T) -> *mut T {
+    if !ptr.is_null() {
+        ALLOCATIONS.lock().unwrap().insert(ptr as usize, T::KIND);
+    }
+
+    ptr
+}
+
+/// Returns false if the pointer isn't a live allocation of T, it must then not be freed
+fn untrack<T: Tracked>(ptr: *const T) -> bool {
+    let mut allocations = ALLOCATIONS.lock().unwrap();
+    if allocations.get(&(ptr as usize)) != Some(&T::KIND) {
+        return false;
+    }
+
+    allocations.remove(&(ptr as usize));
+    true
+}
+
+/// Calls in progress per device, free_device waits for them to return. The calls made on a device
+/// while it's being freed fail like on a null device
+struct InFlight {
+    calls: BTreeMap<usize, usize>,
+    freeing: BTreeSet<usize>,
+    /// Freed from a callback of one of its calls, the last call to return frees it
+    deferred: BTreeSet<usize>,
+}
+
+static IN_FLIGHT: Mutex<InFlight> = Mutex::new(InFlight {
+    calls: BTreeMap::new(),
+    freeing: BTreeSet::new(),
+    deferred: BTreeSet::new(),
+});
+static CALLS_DONE: Condvar = Condvar::new();
+
+thread_local! {
+    /// Devices with a call in progress on this thread, a callback of the call freeing its device
+    /// cannot wait for it
+    static ENTERED: RefCell<Vec<usize>> = const { RefCell::new(Vec::new()) };
+}
+
+/// A device for the duration of a call, see deref_device. The bool is whether it labels the errors
+/// set meanwhile, see DeviceRef::labelled
+struct DeviceRef(*mut Device, bool);
+
+impl DeviceRef {
+    /// None if the device is being freed
+    fn enter(device_ptr: *mut Device) -> Option<Self> {
+        let mut in_flight = IN_FLIGHT.lock().unwrap();
+        if in_flight.freeing.contains(&(device_ptr as usize)) {
+            return None;
+        }
+
+        *in_flight.calls.entry(device_ptr as usize).or_default() += 1;
+        ENTERED.with_borrow_mut(|entered| entered.push(device_ptr as usize));
+
+        Some(Self(device_ptr, false))
+    }
+
+    /// Only for the calls on a single device, the errors of a batch aren't about one of them
+    fn labelled(mut self) -> Self {
+        push_label(self.addr, self.tag.clone());
+        self.1 = true;
+        self
+    }
+}
+
+impl Deref for DeviceRef {
+    type Target = Device;
+
+    fn deref(&self) -> &Device {
+        unsafe { &*self.0 }
+    }
+}
+
+impl DerefMut for DeviceRef {
+    fn deref_mut(&mut self) -> &mut Device {
+        unsafe { &mut *self.0 }
+    }
+}
+
+impl Drop for DeviceRef {
+    fn drop(&mut self) {
+        if self.1 {
+            pop_label();
+        }
+
+        let key = self.0 as usize;
+        ENTERED.with_borrow_mut(|entered| {
+            if let Some(i) = entered.iter().rposition(|ptr| *ptr == key) {
+                entered.swap_remove(i);
+            }
+        });
+
+        let mut in_flight = IN_FLIGHT.lock().unwrap();
+        let calls = in_flight.calls.get_mut(&key).unwrap(); // Shouldn't panic
+        *calls -= 1;
+        if *calls > 0 {
+            return;
+        }
+
+        in_flight.calls.remove(&key);
+        if in_flight.deferred.remove(&key) {
+            in_flight.freeing.remove(&key);
+            drop(in_flight);
+            release_device(self.0);
+        } else {
+            CALLS_DONE.notify_all();
+        }
+    }
+}
+
+macro_rules! block_on {
+    ($async_fn:expr) => {{
+        runtime().block_on($async_fn)
+    }};
+}
+
+/// Called with the user context and whether the command succeeded
+type Callback = extern "C" fn(*mut c_void, bool);
+
+/// Called with the user context and the stage of the connection, see wait_connected
+type ProgressCallback = extern "C" fn(*mut c_void, uint8_t);
+
+/// Called with the user context, the address and the name of a device, see scan_devices_cb
+type ScanCallback = extern "C" fn(*mut c_void, *const [uint8_t; ADDR_LEN], *const c_char) -> bool;
+
+/// Called with the user context and the state, see subscribe_state
+type StateCallback = extern "C" fn(*mut c_void, *const DeviceState);
+
+/// Called with the user context, the level and the message of a daemon log record, see
+/// set_log_callback
+type LogCallback = extern "C" fn(*mut c_void, c_int, *const c_char);
+
+/// Called with the user context and the connection state, see set_connection_callback
+type ConnectionCallback = extern "C" fn(*mut c_void, uint8_t);
+
+/// The user context of a callback, only passed back to it
+struct CallbackCtx(*mut c_void);
+
+unsafe impl Send for CallbackCtx {}
+
+/// Clears the last error of the previous call and returns early with $ret after setting the
+/// last error if the device pointer is null
+macro_rules! deref_device {
+    ($device_ptr:expr, $ret:expr) => {{
+        clear_last_error();
+
+        if $device_ptr.is_null() {
+            eprintln!("[ERROR] Device pointer is null");
+            set_last_error(ErrorCode::NullPointer, "Device pointer is null");
+            return $ret;
+        }
+
+        let Some(device) = DeviceRef::enter($device_ptr).map(DeviceRef::labelled) else {
+            set_last_error(ErrorCode::NullPointer, "The device is being freed");
+            return $ret;
+        };
+
+        device
+    }};
+}
+
+/// See set_auto_launch_daemon
+static AUTO_LAUNCH: AtomicBool = AtomicBool::new(false);
+/// Held while launching so the concurrent calls (e.g. of a batch) don't launch it twice
+static AUTO_LAUNCHING: Mutex<()> = Mutex::new(());
+
+/// Time left to an auto launched daemon to create its socket
+const AUTO_LAUNCH_TIMEOUT_MS: u64 = 2000;
+
+/// RustbeeDaemonHandle on the C side, a daemon instance known by its socket path. The default
+/// instance has none so it follows utils::socket_path (and set_socket_path)
+#[derive(Clone, Default)]
+struct DaemonHandle {
+    socket_path: Option<String>,
+}
+
+impl DaemonHandle {
+    fn socket_path(&self) -> String {
+        self.socket_path.clone().unwrap_or_else(utils::socket_path)
+    }
+
+    /// Sets the DaemonUnreachable last error if the daemon cannot be reached, the default
+    /// instance is the remote daemon of connect_daemon_tcp if any
+    fn socket(&self) -> Option<Stream> {
+        if self.socket_path.is_none() {
+            if let Some(remote) = REMOTE_DAEMON.lock().unwrap().as_ref() {
+                return remote.socket();
+            }
+        }
+
+        self.local_socket()
+    }
+
+    /// Same as socket but never the remote daemon. It launches the instance if it isn't running
+    /// with AUTO_LAUNCH, the launch errors are then the last error
+    fn local_socket(&self) -> Option<Stream> {
+        let socket_path = self.socket_path();
+
+        let connected = HueDevice::<FFI>::get_file_socket_at(&socket_path);
+        if connected.is_err() && AUTO_LAUNCH.load(Ordering::Relaxed) {
+            return self.auto_launch();
+        }
+
+        match connected {
+            Ok(stream) => Some(stream.into()),
+            Err(error) => {
+                set_last_error(
+                    ErrorCode::DaemonUnreachable,
+                    format!(
+                        "Cannot connect to the daemon socket {socket_path}, is it running ? ({error})"
+                    ),
+                );
+                None
+            }
+        }
+    }
+
+    /// Launches the instance then connects to it once its socket exists, None with the last
+    /// error set on failure
+    fn auto_launch(&self) -> Option<Stream> {
+        let _launching = AUTO_LAUNCHING.lock().unwrap();
+        let socket_path = self.socket_path();
+
+        // Launched by a concurrent call meanwhile
+        if let Ok(stream) = HueDevice::<FFI>::get_file_socket_at(&socket_path) {
+            return Some(stream.into());
+        }
+
+        launch(self).ok()?;
+
+        let deadline = Instant::now() + Duration::from_millis(AUTO_LAUNCH_TIMEOUT_MS);
+        loop {
+            match HueDevice::<FFI>::get_file_socket_at(&socket_path) {
+                Ok(stream) => return Some(stream.into()),
+                Err(error) if Instant::now() >= deadline => {
+                    set_last_error(
+                        ErrorCode::DaemonUnreachable,
+                        format!("The launched daemon isn't listening on {socket_path} ({error})"),
+                    );
+                    return None;
+                }
+                Err(_) => thread::sleep(Duration::from_millis(50)),
+            }
+        }
+    }
+}
+
+/// The daemon listening on TCP that replaces the default instance, see connect_daemon_tcp
+static REMOTE_DAEMON: Mutex<Option<RemoteDaemon>> = Mutex::new(None);
+
+struct RemoteDaemon {
+    addr: String,
+    token: Vec<u8>,
+}
+
+impl RemoteDaemon {
+    /// Sets the DaemonUnreachable last error if the daemon cannot be reached and the DaemonError
+    /// one if it rejected the token
+    fn socket(&self) -> Option<Stream> {
+        match Stream::connect_tcp(&self.addr, &self.token) {
+            Ok(stream) => Some(stream),
+            Err(error) if error.kind() == io::ErrorKind::PermissionDenied => {
+                set_last_error(
+                    ErrorCode::DaemonError,
+                    format!("The daemon at {} rejected the token", self.addr),
+                );
+                None
+            }
+            Err(error) => {
+                set_last_error(
+                    ErrorCode::DaemonUnreachable,
+                    format!(
+                        "Cannot connect to the daemon at {}, is it listening ? ({error})",
+                        self.addr
+                    ),
+                );
+                None
+            }
+        }
+    }
+}
+
+/// Socket of the default daemon instance, see DaemonHandle::socket
+fn daemon_socket() -> Option<Stream> {
+    DaemonHandle::default().socket()
+}
+
+/// RustbeeDevice on the C side, it's opaque so its layout can change
+struct Device {
+    addr: [uint8_t; ADDR_LEN],
+    inner: HueDevice<FFI>,
+    /// A copy of the handle so the device outlives it
+    daemon: DaemonHandle,
+    /// 0 waits for the daemon as long as it takes, see set_command_timeout
+    command_timeout_ms: uint32_t,
+    /// See `constants::write_mode`
+    write_mode: uint8_t,
+    /// See set_write_retries
+    write_retries: uint8_t,
+    /// See `constants::brightness_curve`
+    brightness_curve: uint8_t,
+    /// See get_last_command_latency_ms, shared with the exchanges of the async setters
+    last_latency_ms: Arc<AtomicU32>,
+    /// Read once per handle, set_name updates it. See clone_device
+    metadata: Metadata,
+    /// See set_device_tag
+    tag: Option<String>,
+}
+
+/// Static characteristics of a device, they're the same across connections
+#[derive(Clone, Copy, Default)]
+struct Metadata {
+    /// A NAME output
+    name: Option<[u8; OUTPUT_LEN - 1]>,
+    capabilities: Option<uint8_t>,
+    /// Read with the capabilities
+    gamut: Option<Gamut>,
+    /// See feature_flags
+    features: Option<uint32_t>,
+}
+
+impl std::ops::Deref for Device {
+    type Target = HueDevice<FFI>;
+
+    fn deref(&self) -> &Self::Target {
+        &self.inner
+    }
+}
+
+impl Device {
+    fn new(addr: [uint8_t; ADDR_LEN]) -> Self {
+        Self::with_daemon(addr, DaemonHandle::default())
+    }
+
+    fn with_daemon(addr: [uint8_t; ADDR_LEN], daemon: DaemonHandle) -> Self {
+        Self {
+            addr,
+            inner: HueDevice::new(addr),
+            daemon,
+            command_timeout_ms: COMMAND_TIMEOUT_MS,
+            write_mode: write_mode::CONFIRMED,
+            write_retries: write_mode::DEFAULT_RETRIES,
+            brightness_curve: brightness_curve::LINEAR,
+            last_latency_ms: Arc::default(),
+            metadata: Metadata::default(),
+            tag: None,
+        }
+    }
+
+    /// The cached name output, else it's read from the device with the GattError last error on
+    /// failure
+    fn name_output(&mut self) -> Option<[u8; OUTPUT_LEN - 1]> {
+        if let Some(name) = self.metadata.name {
+            return Some(name);
+        }
+
+        let (code, buf) = self.send_to_socket(CONNECT | NAME, EMPTY_BUFFER);
+        if !check_output(code, ErrorCode::GattError, "get name") {
+            return None;
+        }
+
+        self.metadata.name = Some(buf);
+        Some(buf)
+    }
+
+    /// Modifier sent along every command, the daemon only applies it to the writes
+    fn write_mode_mask(&self) -> MaskT {
+        if self.write_mode == write_mode::UNCONFIRMED {
+            UNCONFIRMED_WRITES
+        } else {
+            CONFIRMED_WRITES
+        }
+    }
+
+    /// write_mode_mask with the retries of the writes
+    fn write_masks(&self) -> MaskT {
+        self.write_mode_mask() | (self.write_retries as MaskT) << WRITE_RETRIES_SHIFT
+    }
+
+    fn boxed(self) -> Box<Self> {
+        Box::new(self)
+    }
+
+    /// Sets the DaemonUnreachable last error if the daemon socket cannot be reached and the
+    /// Timeout one if the daemon doesn't answer within the command timeout
+    fn send_to_socket(&mut self, masks: MaskT, buffer: [u8; DATA_LEN + 1]) -> CmdOutput {
+        self.send_to_socket_timeout(masks, buffer, self.timeout_ms(masks))
+    }
+
+    /// The command timeout, the requests with CONNECT may discover the device first so they
+    /// get CONNECT_TIMEOUT_MS more
+    fn timeout_ms(&self, masks: MaskT) -> uint32_t {
+        if self.command_timeout_ms == 0 || masks & CONNECT == 0 {
+            return self.command_timeout_ms;
+        }
+
+        self.command_timeout_ms.saturating_add(CONNECT_TIMEOUT_MS)
+    }
+
+    /// Same as send_to_socket with another timeout, 0 waits as long as it takes
+    fn send_to_socket_timeout(
+        &self,
+        masks: MaskT,
+        buffer: [u8; DATA_LEN + 1],
+        timeout_ms: uint32_t,
+    ) -> CmdOutput {
+        let Some(mut stream) = self.daemon.socket() else {
+            return (OutputCode::Failure, [0; OUTPUT_LEN - 1]);
+        };
+
+        let timed = masks & !CONNECTION_MASKS != 0;
+        let progress = if timed { CONNECT_PROGRESS } else { 0 };
+
+        let mut start = Instant::now();
+        set_read_timeout(&stream, timeout_ms);
+        let output = Self::_send_to_socket(
+            &mut stream,
+            Some(self.addr),
+            masks | progress | self.write_masks(),
+            buffer,
+        );
+
+        if !timed {
+            return output;
+        }
+
+        let output = skip_connect_stages(&mut stream, output, &mut start);
+        record_latency(&self.last_latency_ms, start);
+
+        output
+    }
+
+    fn _send_to_socket(
+        stream: &mut Stream,
+        addr: Option<[u8; ADDR_LEN]>,
+        masks: MaskT,
+        buffer: [u8; DATA_LEN + 1],
+    ) -> CmdOutput {
+        HueDevice::<FFI>::send_packet_to_daemon(stream, addr, masks, buffer)
+    }
+}
+
+/// The connection management commands, the other ones of a device are timed (see
+/// get_last_command_latency_ms)
+const CONNECTION_MASKS: MaskT = CONNECT | DISCONNECT | PAIR;
+
+/// Reads past the connection stages of a request sent with CONNECT_PROGRESS, start is reset
+/// when the daemon reports the device READY so the latency doesn't count the implicit connect
+fn skip_connect_stages(
+    stream: &mut Stream,
+    mut output: CmdOutput,
+    start: &mut Instant,
+) -> CmdOutput {
+    while output.0 == OutputCode::Streaming {
+        let ready = output.1[0] == connect_stage::READY;
+        if ready {
+            *start = Instant::now();
+        }
+
+        output = HueDevice::<FFI>::receive_packet_from_daemon(stream);
+        // The outputs after it are the ones of the commands
+        if ready {
+            break;
+        }
+    }
+
+    output
+}
+
+/// Rounded up to 1ms so 0 stays "no command yet"
+fn record_latency(last_latency_ms: &AtomicU32, start: Instant) {
+    let elapsed_ms = start.elapsed().as_millis().clamp(1, uint32_t::MAX as _);
+    last_latency_ms.store(elapsed_ms as _, Ordering::Relaxed);
+}
+
+/// Bounds each read of the daemon answer so a device that stopped responding cannot block the
+/// caller longer than timeout_ms, 0 waits as long as it takes. A read that times out is a Timeout
+/// output, the daemon still runs the request so a write may still be applied. Named pipes have no
+/// read timeout, on Windows it only applies to a remote daemon
+fn set_read_timeout(stream: &Stream, timeout_ms: uint32_t) {
+    let timeout = (timeout_ms > 0).then(|| Duration::from_millis(timeout_ms as _));
+    if let Err(error) = stream.set_read_timeout(timeout) {
+        if error.kind() != io::ErrorKind::Unsupported {
+            eprintln!("[WARN] Cannot set the timeout of the daemon socket: {error}");
+        }
+    }
+}
+
+/// Sends the same command to every device concurrently, each one on its own daemon connection,
+/// and returns whether it succeeded for each device. Nothing is sent if a pointer is null.
+///
+/// The last error is set from the first failure since the workers have their own last error
+fn send_to_devices(
+    devices_ptr: *const *mut Device,
+    len: usize,
+    masks: MaskT,
+    buffer: [u8; DATA_LEN + 1],
+    on_failure: ErrorCode,
+    action: &str,
+) -> Option<Vec<bool>> {
+    clear_last_error();
+
+    if devices_ptr.is_null() && len > 0 {
+        set_last_error(ErrorCode::NullPointer, "Devices pointer is null");
+        return None;
+    }
+
+    let mut devices = Vec::with_capacity(len);
+    for i in 0..len {
+        let device_ptr = unsafe { *devices_ptr.add(i) };
+        if device_ptr.is_null() {
+            set_last_error(
+                ErrorCode::NullPointer,
+                format!("Device pointer at index {i} is null"),
+            );
+            return None;
+        }
+
+        let Some(device) = DeviceRef::enter(device_ptr) else {
+            set_last_error(
+                ErrorCode::NullPointer,
+                format!("Device at index {i} is being freed"),
+            );
+            return None;
+        };
+        devices.push(device);
+    }
+
+    let targets = devices
+        .iter()
+        .map(|device| (device.addr, &device.daemon, device.write_masks()))
+        .collect::<Vec<_>>();
+
+    let errors = std::thread::scope(|scope| {
+        let workers = targets
+            .iter()
+            .map(|(addr, daemon, write_mask)| {
+                scope.spawn(move || {
+                    let Some(mut stream) = daemon.socket() else {
+                        return take_last_error();
+                    };
+
+                    let masks = masks | write_mask;
+                    let (code, _) =
+                        Device::_send_to_socket(&mut stream, Some(*addr), masks, buffer);
+                    check_output(code, on_failure, action);
+
+                    take_last_error()
+                })
+            })
+            .collect::<Vec<_>>();
+
+        workers
+            .into_iter()
+            .map(|worker| {
+                worker
+                    .join()
+                    .unwrap_or_else(|_| Some((on_failure, format!("Failed to {action}"))))
+            })
+            .collect::<Vec<_>>()
+    });
+
+    let failed = errors.iter().flatten().count();
+    if let Some((code, message)) = errors.iter().flatten().next() {
+        set_last_error(
+            *code,
+            format!("{failed}/{len} devices failed, first error: {message}"),
+        );
+    }
+
+    Some(errors.iter().map(Option::is_none).collect())
+}
+
+/// Fills the optional results array (of len bools) and returns false if any device failed
+fn batch_results(results: Option<Vec<bool>>, results_ptr: *mut bool) -> bool {
+    let Some(results) = results else {
+        return false;
+    };
+
+    if !results_ptr.is_null() {
+        unsafe { std::slice::from_raw_parts_mut(results_ptr, results.len()) }
+            .copy_from_slice(&results);
+    }
+
+    results.iter().all(|ok| *ok)
+}
+
+/// Adds the TRANSITION modifier to the command if there is a transition time (deciseconds)
+fn with_transition(
+    masks: MaskT,
+    mut buffer: [u8; DATA_LEN + 1],
+    transition_ds: uint16_t,
+) -> (MaskT, [u8; DATA_LEN + 1]) {
+    if transition_ds == 0 {
+        return (masks, buffer);
+    }
+
+    // + 1 for the set/get byte
+    let offset = TRANSITION_OFFSET + 1;
+    buffer[offset..offset + 2].copy_from_slice(&transition_ds.to_le_bytes());
+
+    (masks | TRANSITION, buffer)
+}
+
+/// The fields are only applied if their has_* flag is set, see set_state
+#[repr(C)]
+#[derive(Default)]
+struct DesiredState {
+    has_power: bool,
+    power: bool,
+    has_brightness: bool,
+    brightness: uint8_t,
+    has_rgb: bool,
+    rgb: [uint8_t; 3],
+    has_color_temp: bool,
+    color_temp: uint16_t,
+    /// Deciseconds of the power, brightness and color changes, 0 is an instant change
+    transition_ds: uint16_t,
+}
+
+/// Opaque to the C side, the raw values read from the characteristics
+struct StateSnapshot {
+    power: u8,
+    brightness: u8,
+    /// White only lights don't have a color
+    color: Option<[u8; 4]>,
+}
+
+/// Filled by get_device_state, it has a fixed size so there is nothing to free
+#[repr(C)]
+struct DeviceState {
+    connected: bool,
+    power: bool,
+    /// Raw, see get_brightness
+    brightness: uint8_t,
+    /// White only lights don't have a color, rgb is then black
+    has_color: bool,
+    /// At full brightness
+    rgb: [uint8_t; 3],
+    /// Nul terminated, at most OUTPUT_LEN - 1 bytes like get_name
+    name: [c_char; OUTPUT_LEN],
+}
+
+impl DeviceState {
+    /// From the state_output of the daemon and a name output
+    fn from_outputs(
+        state: &[u8; OUTPUT_LEN - 1],
+        name_buf: &[u8; OUTPUT_LEN - 1],
+        gamut: Gamut,
+    ) -> Self {
+        let has_color = state[3] == true as u8;
+        let rgb = if has_color {
+            rgb_from_xy(&state[4..8], gamut)
+        } else {
+            [0; 3]
+        };
+
+        let mut name = [0; OUTPUT_LEN];
+        for (i, byte) in name_buf.iter().take_while(|b| **b != b'\0').enumerate() {
+            name[i] = *byte as c_char;
+        }
+
+        Self {
+            connected: state[0] == true as u8,
+            power: state[1] == true as u8,
+            brightness: state[2],
+            has_color,
+            rgb,
+            name,
+        }
+    }
+}
+
+/// The brightness and color of the RUSTBEE_POWER_ON_FIXED mode
+#[repr(C)]
+struct PowerOnState {
+    /// Raw, see get_brightness
+    brightness: uint8_t,
+    rgb: [uint8_t; 3],
+}
+
+/// Filled by get_daemon_stats
+#[repr(C)]
+struct DaemonStats {
+    connected_count: uint32_t,
+    /// Connections of devices that were already connected once
+    total_reconnects: uint32_t,
+    failed_commands: uint32_t,
+    /// Of the device commands, including their (re)connection
+    avg_latency_ms: uint32_t,
+    /// Failed GATT writes that were retried, see set_write_retries
+    write_retries: uint32_t,
+    /// GATT writes that waited for the write rate, see set_global_write_rate
+    delayed_writes: uint32_t,
+    /// GATT writes that would have waited more than a second for the write rate
+    dropped_writes: uint32_t,
+    /// Dropped devices being reconnected, see set_reconnect_policy
+    reconnecting_count: uint32_t,
+    /// The longest of their current backoffs
+    max_backoff_ms: uint32_t,
+}
+
+impl DaemonStats {
+    /// From the two outputs of the daemon
+    fn from_outputs(buf: &[u8; OUTPUT_LEN - 1], writes_buf: &[u8; OUTPUT_LEN - 1]) -> Self {
+        let u32_at = |buf: &[u8], i: usize| u32::from_le_bytes(buf[i..i + 4].try_into().unwrap());
+
+        Self {
+            connected_count: u16::from_le_bytes([buf[0], buf[1]]) as _,
+            total_reconnects: u32_at(buf, 2),
+            failed_commands: u32_at(buf, 6),
+            avg_latency_ms: u32_at(buf, 10),
+            write_retries: u32_at(buf, 14),
+            delayed_writes: u32_at(writes_buf, 0),
+            dropped_writes: u32_at(writes_buf, 4),
+            reconnecting_count: u32_at(writes_buf, 8),
+            max_backoff_ms: u32_at(writes_buf, 12),
+        }
+    }
+}
+
+/// Opaque to the C side, only accessed through the device_list_* fns
+struct DeviceList(Vec<FoundDevice>);
+
+/// Opaque to the C side, only accessed through the scene_list_* fns
+struct SceneList(Vec<String>);
+
+/// Opaque to the C side, only accessed through the managed_device_list_* fns
+struct ManagedDeviceList(Vec<ManagedDevice>);
+
+struct ManagedDevice {
+    addr: [u8; ADDR_LEN],
+    connected: bool,
+}
+
+#[no_mangle]
+extern "C" fn new_device(addr_ptr: *const [uint8_t; ADDR_LEN]) -> *mut Device {
+    clear_last_error();
+
+    if addr_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Address pointer is null");
+        return ptr::null_mut();
+    }
+
+    unsafe { track(Box::into_raw(Device::new(*addr_ptr).boxed())) }
+}
+
+/// Same as new_device but the device talks to the given daemon instance instead of the default
+/// one, the handle can be freed before the device
+#[no_mangle]
+extern "C" fn new_device_with_daemon(
+    daemon_ptr: *const DaemonHandle,
+    addr_ptr: *const [uint8_t; ADDR_LEN],
+) -> *mut Device {
+    clear_last_error();
+
+    if daemon_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Daemon handle pointer is null");
+        return ptr::null_mut();
+    }
+
+    if addr_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Address pointer is null");
+        return ptr::null_mut();
+    }
+
+    let daemon = unsafe { &*daemon_ptr }.clone();
+
+    unsafe {
+        track(Box::into_raw(
+            Device::with_daemon(*addr_ptr, daemon).boxed(),
+        ))
+    }
+}
+
+/// Parses a "E8:D4:EA:C4:62:00" address (case insensitive), returns NULL if it's malformed
+#[no_mangle]
+extern "C" fn new_device_from_str(addr_ptr: *const c_char) -> *mut Device {
+    clear_last_error();
+
+    if addr_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Address pointer is null");
+        return ptr::null_mut();
+    }
+
+    let addr = unsafe { CStr::from_ptr(addr_ptr) }.to_string_lossy();
+    let Some(addr) = utils::parse_addr(&addr) else {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Malformed address {addr:?}, expected xx:xx:xx:xx:xx:xx"),
+        );
+        return ptr::null_mut();
+    };
+
+    track(Box::into_raw(Device::new(addr).boxed()))
+}
+
+/// A new handle of the same device with the settings (timeouts, write mode, retries, brightness
+/// curve) and the cached name and capabilities of this one, so e.g. a reconnection doesn't read
+/// them again. It isn't subscribed and both handles are independent, the connection is the
+/// daemon's. It must be freed with free_device
+#[no_mangle]
+extern "C" fn clone_device(device_ptr: *mut Device) -> *mut Device {
+    let device = deref_device!(device_ptr, ptr::null_mut());
+
+    let clone = Device {
+        command_timeout_ms: device.command_timeout_ms,
+        write_mode: device.write_mode,
+        write_retries: device.write_retries,
+        brightness_curve: device.brightness_curve,
+        metadata: device.metadata,
+        tag: device.tag.clone(),
+        ..Device::with_daemon(device.addr, device.daemon.clone())
+    };
+
+    track(Box::into_raw(clone.boxed()))
+}
+
+/// Copies the address of the device, e.g. of a handle made by new_device_from_str
+#[no_mangle]
+extern "C" fn get_address(device_ptr: *mut Device, out_addr: *mut [uint8_t; ADDR_LEN]) -> bool {
+    let device = deref_device!(device_ptr, false);
+
+    if out_addr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Address pointer is null");
+        return false;
+    }
+
+    unsafe { *out_addr = device.addr };
+
+    true
+}
+
+/// Blocks until the calls in progress on the device return, they're bound by the command timeout
+/// except the connection ones. The calls made meanwhile fail with NullPointer. From a callback of
+/// one of its calls (e.g. wait_connected progress), the device is freed once that call returns
+#[no_mangle]
+extern "C" fn free_device(device_ptr: *mut Device) {
+    if !untrack(device_ptr) {
+        return;
+    }
+
+    let key = device_ptr as usize;
+    let mut in_flight = IN_FLIGHT.lock().unwrap();
+    in_flight.freeing.insert(key);
+
+    if in_flight.calls.contains_key(&key) && ENTERED.with_borrow(|entered| entered.contains(&key)) {
+        in_flight.deferred.insert(key);
+        return;
+    }
+
+    while in_flight.calls.contains_key(&key) {
+        in_flight = CALLS_DONE.wait(in_flight).unwrap();
+    }
+    in_flight.freeing.remove(&key);
+    drop(in_flight);
+
+    release_device(device_ptr);
+}
+
+fn release_device(device_ptr: *mut Device) {
+    unsubscribe(device_ptr);
+    unwatch_connection(device_ptr);
+
+    unsafe {
+        drop(Box::from_raw(device_ptr));
+    }
+}
+
+// For some reason, if this fn is called "connect" it seg faults
+// the program without even calling it, must be conflicting somewhere
+// REASON: https://github.com/rust-lang/rust/issues/28179 fixed in Rust 1.82
+#[no_mangle]
+extern "C" fn try_connect(device_ptr: *mut Device) -> bool {
+    try_connect_timeout(device_ptr, 0)
+}
+
+/// The timeout is handled by the daemon so the discovery and the connection are actually
+/// cancelled, 0 keeps the daemon default timeouts
+#[no_mangle]
+extern "C" fn try_connect_timeout(device_ptr: *mut Device, timeout_ms: uint32_t) -> bool {
+    let device = deref_device!(device_ptr, false);
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1..5].copy_from_slice(&timeout_ms.to_le_bytes());
+
+    // Not bound to the command timeout, connecting can take longer
+    check_output(
+        device.send_to_socket_timeout(CONNECT, buf, 0).0,
+        ErrorCode::NotConnected,
+        "connect to the device",
+    )
+}
+
+/// Filled by try_connect_ex
+#[repr(C)]
+struct DeviceInfo {
+    /// Nul terminated, see get_name_str
+    name: [c_char; OUTPUT_LEN],
+    /// See get_capabilities
+    capabilities: uint8_t,
+    /// Nul terminated, empty if the light doesn't expose it
+    firmware: [c_char; OUTPUT_LEN],
+    /// A `colors::Gamut`
+    gamut: uint8_t,
+}
+
+/// try_connect then reads what doesn't change while the device is connected, the name and the
+/// capabilities are kept by the handle so their getters don't ask the daemon again. out is left
+/// untouched on failure, the device stays connected if a read failed
+#[no_mangle]
+extern "C" fn try_connect_ex(device_ptr: *mut Device, out_ptr: *mut DeviceInfo) -> bool {
+    if out_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Output pointer is null");
+        return false;
+    }
+
+    if !try_connect_timeout(device_ptr, 0) {
+        return false;
+    }
+
+    let mut device = deref_device!(device_ptr, false);
+
+    let Some(name_buf) = device.name_output() else {
+        return false;
+    };
+    let Some(capabilities) = capabilities(&mut device) else {
+        return false;
+    };
+
+    // Older lights don't expose it, it's not a failure
+    let (code, firmware_buf) = device.send_to_socket(CONNECT | FIRMWARE, EMPTY_BUFFER);
+    let firmware = if code.is_success() {
+        name_from_output(&firmware_buf)
+    } else {
+        String::new()
+    };
+
+    let out = unsafe { &mut *out_ptr };
+    write_c_str(&mut out.name, name_from_output(&name_buf).as_bytes());
+    out.capabilities = capabilities;
+    write_c_str(&mut out.firmware, firmware.as_bytes());
+    out.gamut = gamut(&mut device).into();
+
+    true
+}
+
+/// try_connect that also pairs the device when bond is 1, the daemon records the bond so the
+/// next paired connections don't pair again. InvalidArg if bond isn't 0 or 1
+#[no_mangle]
+extern "C" fn try_connect_paired(device_ptr: *mut Device, bond: uint8_t) -> bool {
+    let device = deref_device!(device_ptr, false);
+
+    match bond {
+        0 => return try_connect(device_ptr),
+        1 => (),
+        _ => {
+            set_last_error(
+                ErrorCode::InvalidArg,
+                format!("Bond must be 0 or 1, got {bond}"),
+            );
+            return false;
+        }
+    }
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+
+    // Not bound to the command timeout, pairing can wait for the OS agent
+    check_output(
+        device.send_to_socket_timeout(CONNECT | PAIR, buf, 0).0,
+        ErrorCode::NotConnected,
+        "connect to and pair the device",
+    )
+}
+
+/// Whether the OS has a bond with the device, it never connects it
+#[no_mangle]
+extern "C" fn is_paired(device_ptr: *mut Device) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    let (code, buf) = device.send_to_socket(PAIR, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get bond status") {
+        return false;
+    }
+
+    buf[0] == true as u8
+}
+
+/// Best effort request of the connection intervals (ms) and MTU of a connected device, the
+/// platform is free to pick others. 0 as mtu keeps the negotiated one. Returns false with the
+/// Unsupported last error if the platform cannot request them at all, see
+/// `constants::connection_params` for the bounds
+#[no_mangle]
+extern "C" fn request_connection_params(
+    device_ptr: *mut Device,
+    min_interval_ms: uint16_t,
+    max_interval_ms: uint16_t,
+    mtu: uint16_t,
+) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    let intervals = connection_params::MIN_INTERVAL_MS..=connection_params::MAX_INTERVAL_MS;
+    if !intervals.contains(&min_interval_ms)
+        || !intervals.contains(&max_interval_ms)
+        || min_interval_ms > max_interval_ms
+    {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!(
+                "Connection intervals must be from {} to {}ms with min <= max, got {min_interval_ms} and {max_interval_ms}",
+                connection_params::MIN_INTERVAL_MS,
+                connection_params::MAX_INTERVAL_MS
+            ),
+        );
+        return false;
+    }
+
+    if mtu != 0 && !(connection_params::MIN_MTU..=connection_params::MAX_MTU).contains(&mtu) {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!(
+                "MTU must be 0 or from {} to {}, got {mtu}",
+                connection_params::MIN_MTU,
+                connection_params::MAX_MTU
+            ),
+        );
+        return false;
+    }
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    for (i, value) in [min_interval_ms, max_interval_ms, mtu]
+        .into_iter()
+        .enumerate()
+    {
+        buf[1 + i * 2..][..2].copy_from_slice(&value.to_le_bytes());
+    }
+
+    let (code, buf) = device.send_to_socket(CONNECT | CONNECTION_PARAMS, buf);
+    if matches!(code, OutputCode::Failure) && buf[0] == connection_params::UNSUPPORTED {
+        set_last_error(
+            ErrorCode::Unsupported,
+            "This platform cannot request connection parameters",
+        );
+        return false;
+    }
+
+    check_output(code, ErrorCode::GattError, "request connection parameters")
+}
+
+/// Makes the daemon read the power of the device every interval_ms without commands so the
+/// connection isn't dropped by the supervision timeout, 0 (the default) stops it. The reads wait
+/// for the commands in flight, it's reset when the daemon restarts
+#[no_mangle]
+extern "C" fn set_keepalive(device_ptr: *mut Device, interval_ms: uint32_t) {
+    let mut device = deref_device!(device_ptr, ());
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1..5].copy_from_slice(&interval_ms.to_le_bytes());
+
+    let (code, _) = device.send_to_socket(CONNECT | KEEPALIVE, buf);
+    check_output(code, ErrorCode::DaemonError, "set the keep-alive");
+}
+
+/// See `constants::write_mode`, InvalidArg if the mode is unknown and the mode is unchanged
+#[no_mangle]
+extern "C" fn set_write_mode(device_ptr: *mut Device, mode: uint8_t) {
+    let mut device = deref_device!(device_ptr, ());
+
+    if mode != write_mode::CONFIRMED && mode != write_mode::UNCONFIRMED {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Write mode must be 0 (CONFIRMED) or 1 (UNCONFIRMED), got {mode}"),
+        );
+        return;
+    }
+
+    device.write_mode = mode;
+}
+
+/// Retries of a failed GATT write of every setter before it fails, DEFAULT_RETRIES by default
+/// and 0 fails on the first failure. The daemon counts them in its stats
+#[no_mangle]
+extern "C" fn set_write_retries(device_ptr: *mut Device, retries: uint8_t) {
+    let mut device = deref_device!(device_ptr, ());
+
+    device.write_retries = retries;
+}
+
+/// Barrier of the unconfirmed writes (see set_write_mode), the daemon waits for the requests it's
+/// running on the device then reads it, the light answers once the writes before the read are
+/// applied
+#[no_mangle]
+extern "C" fn flush(device_ptr: *mut Device) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    let (code, _) = device.send_to_socket(CONNECT | FLUSH, EMPTY_BUFFER);
+    check_output(code, ErrorCode::GattError, "flush the writes")
+}
+
+/// Round trip in ms of the last command of the device through the daemon (including the GATT
+/// operation and its retries, a timed out one counts as its timeout), from once the device is
+/// ready so the implicit connect isn't timed, nor the connection management. 0 if no command has
+/// run yet
+#[no_mangle]
+extern "C" fn get_last_command_latency_ms(device_ptr: *mut Device) -> uint32_t {
+    let device = deref_device!(device_ptr, 0);
+
+    device.last_latency_ms.load(Ordering::Relaxed)
+}
+
+/// Applies to the following calls of the device once connected (the connection has its own
+/// timeouts), they fail with the Timeout last error if the daemon doesn't answer in time. The
+/// calls that may connect the device first get CONNECT_TIMEOUT_MS more for its discovery. 0
+/// waits as long as it takes, it's COMMAND_TIMEOUT_MS by default
+#[no_mangle]
+extern "C" fn set_command_timeout(device_ptr: *mut Device, timeout_ms: uint32_t) {
+    let mut device = deref_device!(device_ptr, ());
+
+    device.command_timeout_ms = timeout_ms;
+}
+
+/// Labels the errors of the device and its records in the daemon logs with tag instead of its
+/// address, e.g. to tell the lights apart. NULL or an empty tag goes back to the address. The
+/// daemon keeps one tag per address, the last handle to set it wins. InvalidArg if it's longer
+/// than DATA_LEN bytes or not UTF-8, the tag is then unchanged. A daemon error doesn't undo the
+/// tag of the errors
+#[no_mangle]
+extern "C" fn set_device_tag(device_ptr: *mut Device, tag_ptr: *const c_char) {
+    let mut device = deref_device!(device_ptr, ());
+
+    let tag = if tag_ptr.is_null() {
+        ""
+    } else {
+        match unsafe { CStr::from_ptr(tag_ptr) }.to_str() {
+            Ok(tag) if tag.len() <= DATA_LEN => tag,
+            Ok(tag) => {
+                set_last_error(
+                    ErrorCode::InvalidArg,
+                    format!(
+                        "Tag must be at most {DATA_LEN} bytes long, got {}",
+                        tag.len()
+                    ),
+                );
+                return;
+            }
+            Err(_) => {
+                set_last_error(ErrorCode::InvalidArg, "Tag must be valid UTF-8");
+                return;
+            }
+        }
+    };
+
+    device.tag = (!tag.is_empty()).then(|| tag.to_owned());
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1..tag.len() + 1].copy_from_slice(tag.as_bytes());
+
+    // Not a command of the device, it's not timed
+    let Some(mut stream) = device.daemon.socket() else {
+        return;
+    };
+
+    let (code, _) = Device::_send_to_socket(&mut stream, Some(device.addr), DEVICE_TAG, buf);
+    check_output(code, ErrorCode::DaemonError, "set the device tag");
+}
+
+/// try_connect_timeout calling progress with every stage of the connection (see
+/// `constants::connect_stage`) on the calling thread. On failure, the last reported stage is the
+/// one that stalled or failed
+#[no_mangle]
+extern "C" fn wait_connected(
+    device_ptr: *mut Device,
+    timeout_ms: uint32_t,
+    progress: Option<ProgressCallback>,
+    ctx: *mut c_void,
+) -> bool {
+    let device = deref_device!(device_ptr, false);
+
+    let Some(mut stream) = device.daemon.socket() else {
+        return false;
+    };
+
+    let report = |stage| {
+        if let Some(progress) = progress {
+            progress(ctx, stage);
+        }
+    };
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1..5].copy_from_slice(&timeout_ms.to_le_bytes());
+
+    let (mut code, mut stage_buf) = Device::_send_to_socket(
+        &mut stream,
+        Some(device.addr),
+        CONNECT | CONNECT_PROGRESS,
+        buf,
+    );
+    while code == OutputCode::Streaming {
+        // Reported below once the connection succeeded, like with a daemon that doesn't send it
+        if stage_buf[0] != connect_stage::READY {
+            report(stage_buf[0]);
+        }
+        (code, stage_buf) = HueDevice::<FFI>::receive_packet_from_daemon(&mut stream);
+    }
+
+    if !check_output(code, ErrorCode::NotConnected, "connect to the device") {
+        return false;
+    }
+
+    report(connect_stage::READY);
+
+    true
+}
+
+#[no_mangle]
+extern "C" fn try_disconnect(device_ptr: *mut Device) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+
+    check_output(
+        device.send_to_socket(DISCONNECT, buf).0,
+        ErrorCode::GattError,
+        "disconnect from the device",
+    )
+}
+
+/// Same as try_disconnect, the handle stays valid so try_connect can reconnect it
+#[no_mangle]
+extern "C" fn disconnect(device_ptr: *mut Device) -> bool {
+    try_disconnect(device_ptr)
+}
+
+/// Doesn't try to connect nor discover the device, it only reads the current connection state
+#[no_mangle]
+extern "C" fn is_connected(device_ptr: *mut Device) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    let (code, buf) = device.send_to_socket(CONNECT, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get connection state") {
+        return false;
+    }
+
+    buf[0] == true as u8
+}
+
+/// Blinks the light for a few seconds then restores its power and brightness
+#[no_mangle]
+extern "C" fn identify(device_ptr: *mut Device) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+
+    check_output(
+        device.send_to_socket(CONNECT | IDENTIFY, buf).0,
+        ErrorCode::GattError,
+        "identify the device",
+    )
+}
+
+#[no_mangle]
+extern "C" fn set_power(device_ptr: *mut Device, state: *const uint8_t) -> bool {
+    if state.is_null() {
+        eprintln!("[ERROR] State pointer is null");
+        set_last_error(ErrorCode::NullPointer, "State pointer is null");
+        return false;
+    }
+
+    set_power_transition(device_ptr, unsafe { *state }, 0)
+}
+
+/// The transition time is in deciseconds, 0 is an instant change
+#[no_mangle]
+extern "C" fn set_power_transition(
+    device_ptr: *mut Device,
+    state: uint8_t,
+    transition_ds: uint16_t,
+) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    if state > 1 {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Power state must be 0 (OFF) or 1 (ON), got {state}"),
+        );
+        return false;
+    }
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1] = state;
+
+    let (masks, buf) = with_transition(CONNECT | POWER, buf, transition_ds);
+    check_output(
+        device.send_to_socket(masks, buf).0,
+        ErrorCode::GattError,
+        "set power state",
+    )
+}
+
+/// set_power without blocking, the command is sent from a thread of the runtime blocking pool and
+/// the callback is called from that thread once done (or right away from the calling thread if
+/// the arguments are invalid). The last error is only readable from within the callback since
+/// it's per thread.
+///
+/// The device address is copied so the device can be freed before the callback is called
+#[no_mangle]
+extern "C" fn set_power_async(
+    device_ptr: *mut Device,
+    state: uint8_t,
+    callback: Option<Callback>,
+    ctx: *mut c_void,
+) {
+    clear_last_error();
+
+    let Some(callback) = callback else {
+        eprintln!("[ERROR] Callback pointer is null");
+        set_last_error(ErrorCode::NullPointer, "Callback pointer is null");
+        return;
+    };
+
+    let device = deref_device!(device_ptr, callback(ctx, false));
+
+    if state > 1 {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Power state must be 0 (OFF) or 1 (ON), got {state}"),
+        );
+        callback(ctx, false);
+        return;
+    }
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1] = state;
+
+    let addr = device.addr;
+    let daemon = device.daemon.clone();
+    let masks = CONNECT | CONNECT_PROGRESS | POWER | device.write_masks();
+    let last_latency_ms = Arc::clone(&device.last_latency_ms);
+    let ctx = CallbackCtx(ctx);
+
+    runtime().spawn_blocking(move || {
+        // The pool threads are reused
+        clear_last_error();
+
+        let ok = match daemon.socket() {
+            Some(mut stream) => {
+                let mut start = Instant::now();
+                let output = Device::_send_to_socket(&mut stream, Some(addr), masks, buf);
+                let (code, _) = skip_connect_stages(&mut stream, output, &mut start);
+                record_latency(&last_latency_ms, start);
+
+                check_output(code, ErrorCode::GattError, "set power state")
+            }
+            None => false,
+        };
+
+        // Not moved out of ctx before the call so the closure captures the whole Send wrapper
+        let ctx = ctx;
+        callback(ctx.0, ok);
+    });
+}
+
+#[no_mangle]
+extern "C" fn set_power_batch(
+    devices_ptr: *const *mut Device,
+    len: usize,
+    state: uint8_t,
+    results_ptr: *mut bool,
+) -> bool {
+    clear_last_error();
+
+    if state > 1 {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Power state must be 0 (OFF) or 1 (ON), got {state}"),
+        );
+        return false;
+    }
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1] = state;
+
+    let results = send_to_devices(
+        devices_ptr,
+        len,
+        CONNECT | POWER,
+        buf,
+        ErrorCode::GattError,
+        "set power state",
+    );
+
+    batch_results(results, results_ptr)
+}
+
+#[no_mangle]
+extern "C" fn set_brightness(device_ptr: *mut Device, value: *const uint8_t) -> bool {
+    if value.is_null() {
+        eprintln!("[ERROR] Value pointer is null");
+        set_last_error(ErrorCode::NullPointer, "Brightness pointer is null");
+        return false;
+    }
+
+    set_brightness_transition(device_ptr, unsafe { *value }, 0)
+}
+
+/// Brightness from 0 to 100 through the curve of the device (see set_brightness_curve), InvalidArg
+/// above 100. 0 is the lowest raw brightness, not off
+#[no_mangle]
+extern "C" fn set_brightness_percent(device_ptr: *mut Device, percent: uint8_t) -> bool {
+    let curve = deref_device!(device_ptr, false).brightness_curve;
+
+    if percent > 100 {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Brightness percentage must be within 0 and 100, got {percent}"),
+        );
+        return false;
+    }
+
+    set_brightness_transition(device_ptr, utils::percent_to_brightness(percent, curve), 0)
+}
+
+/// See `constants::brightness_curve`, it applies to set_brightness_percent and
+/// get_brightness_percent. InvalidArg if the curve is unknown and the curve is unchanged
+#[no_mangle]
+extern "C" fn set_brightness_curve(device_ptr: *mut Device, curve: uint8_t) {
+    let mut device = deref_device!(device_ptr, ());
+
+    if curve != brightness_curve::LINEAR && curve != brightness_curve::GAMMA {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Brightness curve must be 0 (LINEAR) or 1 (GAMMA), got {curve}"),
+        );
+        return;
+    }
+
+    device.brightness_curve = curve;
+}
+
+/// Raw brightness range supported by the light, min and max are set to MIN_BRIGHTNESS and
+/// MAX_BRIGHTNESS when it returns false. The daemon already clamps the brightness to it
+#[no_mangle]
+extern "C" fn get_brightness_range(
+    device_ptr: *mut Device,
+    min_ptr: *mut uint8_t,
+    max_ptr: *mut uint8_t,
+) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    if min_ptr.is_null() || max_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Min or max pointer is null");
+        return false;
+    }
+
+    let (code, buf) = device.send_to_socket(CONNECT | BRIGHTNESS_RANGE, EMPTY_BUFFER);
+    let ok = check_output(code, ErrorCode::GattError, "get brightness range");
+    let (min, max) = if ok {
+        (buf[0], buf[1])
+    } else {
+        (MIN_BRIGHTNESS, MAX_BRIGHTNESS)
+    };
+
+    unsafe {
+        *min_ptr = min;
+        *max_ptr = max;
+    }
+
+    ok
+}
+
+/// Unstable, for the raw GATT access. Sets the NotConnected last error since the daemon never
+/// connects the device for it
+fn check_connected(device: &mut Device) -> bool {
+    let (code, buf) = device.send_to_socket(CONNECT, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get connection state") {
+        return false;
+    }
+
+    if buf[0] != true as u8 {
+        set_last_error(
+            ErrorCode::NotConnected,
+            "The device must be connected first",
+        );
+        return false;
+    }
+
+    true
+}
+
+/// An unknown characteristic is an InvalidArg
+fn check_gatt_output(code: OutputCode, buf: &[u8], action: &str) -> bool {
+    if matches!(code, OutputCode::Failure) && buf[0] == GATT_UNKNOWN_CHAR {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Failed to {action}: the device doesn't have this characteristic"),
+        );
+        return false;
+    }
+
+    check_output(code, ErrorCode::GattError, action)
+}
+
+/// Unstable escape hatch writing any characteristic of a connected device, uuid128 is the 16
+/// bytes of the full characteristic UUID in the order of its string form (the 16-bit UUIDs of
+/// the Bluetooth SIG are expanded with its base UUID)
+#[no_mangle]
+extern "C" fn gatt_write(
+    device_ptr: *mut Device,
+    uuid128_ptr: *const [uint8_t; 16],
+    data_ptr: *const uint8_t,
+    len: usize,
+) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    if uuid128_ptr.is_null() || (data_ptr.is_null() && len > 0) {
+        set_last_error(ErrorCode::NullPointer, "UUID or data pointer is null");
+        return false;
+    }
+
+    if len > GATT_MAX_LEN {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("The value is {len} bytes, the max is {GATT_MAX_LEN}"),
+        );
+        return false;
+    }
+
+    if !check_connected(&mut device) {
+        return false;
+    }
+
+    let value = if len > 0 {
+        unsafe { std::slice::from_raw_parts(data_ptr, len) }
+    } else {
+        &[]
+    };
+
+    let Some(mut stream) = device.daemon.socket() else {
+        return false;
+    };
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1..17].copy_from_slice(unsafe { &*uuid128_ptr });
+    buf[17..19].copy_from_slice(&(len as u16).to_le_bytes());
+
+    let sent = HueDevice::<FFI>::write_packet_to_daemon(&mut stream, Some(device.addr), GATT, buf)
+        .and_then(|_| stream.write_all(value))
+        .and_then(|_| stream.flush());
+    if let Err(error) = sent {
+        set_last_error(
+            ErrorCode::DaemonUnreachable,
+            format!("Cannot write to the daemon socket: {error}"),
+        );
+        return false;
+    }
+
+    let (code, buf) = HueDevice::<FFI>::receive_packet_from_daemon(&mut stream);
+    check_gatt_output(code, &buf, "write the characteristic")
+}
+
+/// Unstable escape hatch reading any characteristic of a connected device, see gatt_write.
+/// out_len is the capacity of out and is set to the value len, if the value doesn't fit it fails
+/// with InvalidArg and out_len is set to the len needed
+#[no_mangle]
+extern "C" fn gatt_read(
+    device_ptr: *mut Device,
+    uuid128_ptr: *const [uint8_t; 16],
+    out_ptr: *mut uint8_t,
+    out_len_ptr: *mut usize,
+) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    if uuid128_ptr.is_null() || out_len_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "UUID or out len pointer is null");
+        return false;
+    }
+
+    let capacity = unsafe { *out_len_ptr };
+    if out_ptr.is_null() && capacity > 0 {
+        set_last_error(ErrorCode::NullPointer, "Out pointer is null");
+        return false;
+    }
+
+    if !check_connected(&mut device) {
+        return false;
+    }
+
+    let Some(mut stream) = device.daemon.socket() else {
+        return false;
+    };
+
+    let mut buf = EMPTY_BUFFER;
+    buf[1..17].copy_from_slice(unsafe { &*uuid128_ptr });
+
+    let mut value = Vec::new();
+    let (mut code, mut chunk) = Device::_send_to_socket(&mut stream, Some(device.addr), GATT, buf);
+    while matches!(code, OutputCode::Streaming) {
+        let len = (chunk[0] as usize).min(chunk.len() - 1);
+        value.extend_from_slice(&chunk[1..][..len]);
+        (code, chunk) = HueDevice::<FFI>::receive_packet_from_daemon(&mut stream);
+    }
+
+    if !matches!(code, OutputCode::StreamEOF) {
+        return check_gatt_output(code, &chunk, "read the characteristic");
+    }
+
+    unsafe { *out_len_ptr = value.len() };
+    if value.len() > capacity {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("The value is {} bytes, out is {capacity}", value.len()),
+        );
+        return false;
+    }
+
+    if !value.is_empty() {
+        unsafe { std::slice::from_raw_parts_mut(out_ptr, value.len()) }.copy_from_slice(&value);
+    }
+
+    true
+}
+
+/// Sets the InvalidArg last error if the raw brightness is out of MIN_BRIGHTNESS..=MAX_BRIGHTNESS
+fn check_brightness(value: uint8_t) -> bool {
+    if !(MIN_BRIGHTNESS..=MAX_BRIGHTNESS).contains(&value) {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Brightness must be within {MIN_BRIGHTNESS} and {MAX_BRIGHTNESS}, got {value}"),
+        );
+        return false;
+    }
+
+    true
+}
+
+/// The transition time is in deciseconds, 0 is an instant change
+#[no_mangle]
+extern "C" fn set_brightness_transition(
+    device_ptr: *mut Device,
+    value: uint8_t,
+    transition_ds: uint16_t,
+) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    if !check_brightness(value) {
+        return false;
+    }
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1] = value;
+
+    let (masks, buf) = with_transition(CONNECT | BRIGHTNESS, buf, transition_ds);
+    check_output(
+        device.send_to_socket(masks, buf).0,
+        ErrorCode::GattError,
+        "set brightness",
+    )
+}
+
+#[no_mangle]
+extern "C" fn set_brightness_batch(
+    devices_ptr: *const *mut Device,
+    len: usize,
+    value: uint8_t,
+    results_ptr: *mut bool,
+) -> bool {
+    clear_last_error();
+
+    if !check_brightness(value) {
+        return false;
+    }
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1] = value;
+
+    let results = send_to_devices(
+        devices_ptr,
+        len,
+        CONNECT | BRIGHTNESS,
+        buf,
+        ErrorCode::GattError,
+        "set brightness",
+    );
+
+    batch_results(results, results_ptr)
+}
+
+#[no_mangle]
+extern "C" fn set_color_rgb(device_ptr: *mut Device, r: uint8_t, g: uint8_t, b: uint8_t) -> bool {
+    set_color_rgb_transition(device_ptr, r, g, b, 0)
+}
+
+/// Packed 0xRRGGBB color, the top byte is ignored
+#[no_mangle]
+extern "C" fn set_color_rgb_hex(device_ptr: *mut Device, rgb: uint32_t) -> bool {
+    let [r, g, b] = unpack_rgb(rgb);
+
+    set_color_rgb(device_ptr, r, g, b)
+}
+
+fn unpack_rgb(rgb: u32) -> [u8; 3] {
+    let [_, r, g, b] = rgb.to_be_bytes();
+
+    [r, g, b]
+}
+
+/// The transition time is in deciseconds, 0 is an instant change
+#[no_mangle]
+extern "C" fn set_color_rgb_transition(
+    device_ptr: *mut Device,
+    r: uint8_t,
+    g: uint8_t,
+    b: uint8_t,
+    transition_ds: uint16_t,
+) -> bool {
+    // Written as xy so both stay consistent, the brightness being its own characteristic
+    let xy = Xy::from(Rgb::new(r as _, g as _, b as _));
+
+    set_color_xy_transition(device_ptr, xy.x as _, xy.y as _, transition_ds)
+}
+
+#[no_mangle]
+extern "C" fn set_color_xy(device_ptr: *mut Device, x: c_float, y: c_float) -> bool {
+    set_color_xy_transition(device_ptr, x, y, 0)
+}
+
+/// The transition time is in deciseconds, 0 is an instant change
+#[no_mangle]
+extern "C" fn set_color_xy_transition(
+    device_ptr: *mut Device,
+    x: c_float,
+    y: c_float,
+    transition_ds: uint16_t,
+) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    // Also rejects NaN
+    if !(0.0..=1.0).contains(&x) || !(0.0..=1.0).contains(&y) {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("x and y must be within 0.0 and 1.0, got ({x}, {y})"),
+        );
+        return false;
+    }
+
+    // The color characteristic expects CIE xy coordinates scaled to u16 (little endian)
+    let scaled_x = (x as f64 * 0xFFFF as f64) as u16;
+    let scaled_y = (y as f64 * 0xFFFF as f64) as u16;
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1..3].copy_from_slice(&scaled_x.to_le_bytes());
+    buf[3..5].copy_from_slice(&scaled_y.to_le_bytes());
+
+    let (masks, buf) = with_transition(CONNECT | COLOR_XY, buf, transition_ds);
+    check_output(
+        device.send_to_socket(masks, buf).0,
+        ErrorCode::GattError,
+        "set color",
+    )
+}
+
+#[no_mangle]
+extern "C" fn get_color_xy(
+    device_ptr: *mut Device,
+    x_ptr: *mut c_float,
+    y_ptr: *mut c_float,
+) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    if x_ptr.is_null() || y_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "x or y pointer is null");
+        return false;
+    }
+
+    let (code, buf) = device.send_to_socket(CONNECT | COLOR_XY, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get color") {
+        return false;
+    }
+
+    unsafe {
+        *x_ptr = (u16::from_le_bytes([buf[0], buf[1]]) as f64 / 0xFFFF as f64) as _;
+        *y_ptr = (u16::from_le_bytes([buf[2], buf[3]]) as f64 / 0xFFFF as f64) as _;
+    }
+
+    true
+}
+
+/// Hue from 0 to 65535 mapping 0 to 360°, saturation from 0 to 254. The value being the
+/// brightness, it's its own characteristic
+#[no_mangle]
+extern "C" fn set_hue_sat(device_ptr: *mut Device, hue: uint16_t, sat: uint8_t) -> bool {
+    clear_last_error();
+
+    if sat > MAX_SATURATION {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Saturation must be within 0 and {MAX_SATURATION}, got {sat}"),
+        );
+        return false;
+    }
+
+    let hsv = Hsv::new(
+        hue as f64 * 360. / u16::MAX as f64,
+        sat as f64 / MAX_SATURATION as f64,
+        1.,
+    );
+    let xy = Xy::from(Rgb::from(hsv));
+
+    set_color_xy(device_ptr, xy.x as _, xy.y as _)
+}
+
+/// The color at full brightness written into the caller buffer, there is nothing to free. It's
+/// left untouched on failure
+#[no_mangle]
+extern "C" fn get_color_rgb_into(device_ptr: *mut Device, out_ptr: *mut [uint8_t; 3]) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    if out_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Output pointer is null");
+        return false;
+    }
+
+    let gamut = gamut(&mut device);
+    let (code, buf) = device.send_to_socket(CONNECT | COLOR_XY, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get color") {
+        return false;
+    }
+
+    unsafe { *out_ptr = rgb_from_xy(&buf[..4], gamut) };
+
+    true
+}
+
+/// Reads the xy color and converts it back to HSV at full value
+fn get_hsv(device: &mut Device) -> Option<Hsv> {
+    let gamut = gamut(device);
+    let (code, buf) = device.send_to_socket(CONNECT | COLOR_XY, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get color") {
+        return None;
+    }
+
+    let [r, g, b] = rgb_from_xy(&buf[..4], gamut);
+
+    Some(Hsv::from(Rgb::new(r as _, g as _, b as _)))
+}
+
+/// The color at full brightness of a xy (u16 little endian) value, it's first brought back within
+/// the gamut of the light like the light does
+fn rgb_from_xy(xy: &[u8], gamut: Gamut) -> [uint8_t; 3] {
+    let x = u16::from_le_bytes([xy[0], xy[1]]) as f64 / 0xFFFF as f64;
+    let y = u16::from_le_bytes([xy[2], xy[3]]) as f64 / 0xFFFF as f64;
+    let rgb = Xy::new(x, y).to_rgb_in(gamut, 1.);
+
+    [rgb.r.round() as _, rgb.g.round() as _, rgb.b.round() as _]
+}
+
+/// Read with the capabilities once per handle, gamut C if they cannot be read. There is no last
+/// error then, the caller reads the color right after.
+fn gamut(device: &mut Device) -> Gamut {
+    if let Some(gamut) = device.metadata.gamut {
+        return gamut;
+    }
+
+    let (code, buf) = device.send_to_socket(CONNECT | CAPABILITIES, EMPTY_BUFFER);
+    if !matches!(code, OutputCode::Success) {
+        clear_last_error();
+        return Gamut::default();
+    }
+
+    device.metadata.capabilities = Some(buf[0]);
+    device.metadata.gamut = Some(Gamut::from(buf[1]));
+
+    Gamut::from(buf[1])
+}
+
+#[no_mangle]
+extern "C" fn get_hue(device_ptr: *mut Device) -> uint16_t {
+    let mut device = deref_device!(device_ptr, 0);
+
+    get_hsv(&mut device).map_or(0, |hsv| (hsv.h / 360. * u16::MAX as f64).round() as _)
+}
+
+#[no_mangle]
+extern "C" fn get_saturation(device_ptr: *mut Device) -> uint8_t {
+    let mut device = deref_device!(device_ptr, 0);
+
+    get_hsv(&mut device).map_or(0, |hsv| (hsv.s * MAX_SATURATION as f64).round() as _)
+}
+
+/// Last measured signal strength in dBm, it never connects the device so it's only known once the
+/// daemon discovered it. RSSI_UNAVAILABLE on failure
+#[no_mangle]
+extern "C" fn get_rssi(device_ptr: *mut Device) -> int16_t {
+    let mut device = deref_device!(device_ptr, RSSI_UNAVAILABLE);
+
+    let (code, buf) = device.send_to_socket(RSSI, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get RSSI") {
+        return RSSI_UNAVAILABLE;
+    }
+
+    i16::from_le_bytes([buf[0], buf[1]])
+}
+
+#[no_mangle]
+extern "C" fn get_color_temp(device_ptr: *mut Device) -> uint16_t {
+    let mut device = deref_device!(device_ptr, 0);
+
+    let (code, buf) = device.send_to_socket(CONNECT | TEMPERATURE, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get color temperature") {
+        return 0;
+    }
+
+    u16::from_le_bytes([buf[0], buf[1]])
+}
+
+#[no_mangle]
+extern "C" fn set_color_temp(device_ptr: *mut Device, mireds: uint16_t) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1..3].copy_from_slice(&mireds.clamp(MIN_MIREDS, MAX_MIREDS).to_le_bytes());
+
+    check_output(
+        device.send_to_socket(CONNECT | TEMPERATURE, buf).0,
+        ErrorCode::GattError,
+        "set color temperature",
+    )
+}
+
+/// Writes the warm and cool white channels of the variants that have them (see get_capabilities).
+/// The others get the closest color temperature (the share of warm white) and brightness (the
+/// strongest channel), it's Unsupported if they don't have a color temperature either. Both at 0
+/// is InvalidArg, the light is turned off with set_power
+#[no_mangle]
+extern "C" fn set_white_mix(device_ptr: *mut Device, warm: uint8_t, cool: uint8_t) -> bool {
+    if device_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Device pointer is null");
+        return false;
+    }
+
+    if warm == 0 && cool == 0 {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            "Warm and cool are both 0, turn the light off with set_power",
+        );
+        return false;
+    }
+
+    let Some(white_mix) = white_mix_support(device_ptr) else {
+        return false;
+    };
+
+    if !white_mix {
+        let (mireds, brightness) = utils::white_mix_to_temp(warm, cool);
+        return set_color_temp(device_ptr, mireds) && set_brightness(device_ptr, &brightness);
+    }
+
+    let mut device = deref_device!(device_ptr, false);
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1] = warm;
+    buf[2] = cool;
+
+    check_output(
+        device.send_to_socket(CONNECT | WHITE_MIX, buf).0,
+        ErrorCode::GattError,
+        "set the white mix",
+    )
+}
+
+/// The inverse of set_white_mix, out is left untouched on failure
+#[no_mangle]
+extern "C" fn get_white_mix(
+    device_ptr: *mut Device,
+    warm_ptr: *mut uint8_t,
+    cool_ptr: *mut uint8_t,
+) -> bool {
+    if warm_ptr.is_null() || cool_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Warm or cool pointer is null");
+        return false;
+    }
+
+    let Some(white_mix) = white_mix_support(device_ptr) else {
+        return false;
+    };
+
+    let (warm, cool) = if white_mix {
+        let mut device = deref_device!(device_ptr, false);
+
+        let (code, buf) = device.send_to_socket(CONNECT | WHITE_MIX, EMPTY_BUFFER);
+        if !check_output(code, ErrorCode::GattError, "get the white mix") {
+            return false;
+        }
+
+        (buf[0], buf[1])
+    } else {
+        let mireds = get_color_temp(device_ptr);
+        if mireds == 0 {
+            return false;
+        }
+        let brightness = get_brightness(device_ptr);
+        if brightness == 0 {
+            return false;
+        }
+
+        utils::temp_to_white_mix(mireds, brightness)
+    };
+
+    unsafe {
+        *warm_ptr = warm;
+        *cool_ptr = cool;
+    }
+
+    true
+}
+
+/// Whether the device has separate white channels, false if it only has a color temperature and
+/// None (with the last error) if it has neither
+fn white_mix_support(device_ptr: *mut Device) -> Option<bool> {
+    let caps = get_capabilities(device_ptr);
+    if rustbee_last_error() != ErrorCode::None as i32 {
+        return None;
+    }
+
+    if caps & capabilities::WHITE_MIX != 0 {
+        return Some(true);
+    }
+
+    if caps & capabilities::COLOR_TEMP == 0 {
+        set_last_error(
+            ErrorCode::Unsupported,
+            "The light has neither white channels nor a color temperature",
+        );
+        return None;
+    }
+
+    Some(false)
+}
+
+/// Validates the whole state before writing only its set fields. The daemon writes them at once
+/// with the combined control characteristic of the lights that have it, the others get a write
+/// per field: a light turned on is turned on first so it shows the others, a light turned off is
+/// turned off last. A failed write doesn't stop the next ones, see set_state_ex
+#[no_mangle]
+extern "C" fn set_state(device_ptr: *mut Device, state_ptr: *const DesiredState) -> bool {
+    set_state_ex(device_ptr, state_ptr, ptr::null_mut())
+}
+
+/// Same as set_state, failed_fields_ptr (if not NULL) is set to the `state_field` bits of the
+/// fields that weren't applied, the others were: a failed write doesn't stop the next ones.
+/// The command timeout covers the whole state, on a timeout or when the daemon cannot be reached
+/// every set field counts as failed. It's 0 on success and when the state is invalid since
+/// nothing is written then
+#[no_mangle]
+extern "C" fn set_state_ex(
+    device_ptr: *mut Device,
+    state_ptr: *const DesiredState,
+    failed_fields_ptr: *mut uint8_t,
+) -> bool {
+    let set_failed = |failed| {
+        if !failed_fields_ptr.is_null() {
+            unsafe {
+                *failed_fields_ptr = failed;
+            }
+        }
+    };
+    set_failed(0);
+
+    let mut device = deref_device!(device_ptr, false);
+
+    let Some(state) = checked_state(state_ptr) else {
+        return false;
+    };
+
+    let packed = pack_state(state);
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1..][..scheduled_state::LEN].copy_from_slice(&packed);
+
+    let (code, buf) = device.send_to_socket(CONNECT | APPLY_STATE, buf);
+    if check_output(code, ErrorCode::GattError, "set the state") {
+        return true;
+    }
+
+    // Only a failed write tells which fields failed
+    set_failed(state_fields(match code {
+        OutputCode::Failure if buf[0] != 0 => buf[0],
+        _ => packed[0],
+    }));
+
+    false
+}
+
+/// Sets the last error if the state pointer is null or the state is invalid
+fn checked_state<'a>(state_ptr: *const DesiredState) -> Option<&'a DesiredState> {
+    if state_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "State pointer is null");
+        return None;
+    }
+
+    let state = unsafe { &*state_ptr };
+    if state.has_rgb && state.has_color_temp {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            "A state has either a color or a color temperature",
+        );
+        return None;
+    }
+    if state.has_brightness && !check_brightness(state.brightness) {
+        return None;
+    }
+
+    Some(state)
+}
+
+/// The state validated like set_state is applied by the daemon at the time in ms since the Unix
+/// epoch (right away if it's past), the caller can exit meanwhile. Returns the job id for
+/// cancel_scheduled, 0 on failure
+#[no_mangle]
+extern "C" fn schedule_command(
+    device_ptr: *mut Device,
+    state_ptr: *const DesiredState,
+    at_unix_ms: uint64_t,
+) -> uint64_t {
+    let mut device = deref_device!(device_ptr, 0);
+
+    let Some(state) = checked_state(state_ptr) else {
+        return 0;
+    };
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1] = schedule_op::ADD;
+    buf[2..10].copy_from_slice(&at_unix_ms.to_le_bytes());
+    buf[10..].copy_from_slice(&pack_state(state));
+
+    let (code, buf) = device.send_to_socket(CONNECT | SCHEDULE, buf);
+    if !check_output(code, ErrorCode::DaemonError, "schedule the command") {
+        return 0;
+    }
+
+    u64::from_le_bytes(buf[..8].try_into().unwrap())
+}
+
+/// The `state_field` bits of `scheduled_state::bits`
+fn state_fields(bits: u8) -> u8 {
+    [
+        (scheduled_state::bits::POWER, state_field::POWER),
+        (scheduled_state::bits::BRIGHTNESS, state_field::BRIGHTNESS),
+        (scheduled_state::bits::COLOR, state_field::COLOR),
+        (scheduled_state::bits::TEMPERATURE, state_field::COLOR_TEMP),
+    ]
+    .into_iter()
+    .filter(|(bit, _)| bits & bit != 0)
+    .fold(0, |fields, (_, field)| fields | field)
+}
+
+/// The `scheduled_state` of a checked state
+fn pack_state(state: &DesiredState) -> [u8; scheduled_state::LEN] {
+    use scheduled_state::bits;
+
+    let mut packed = [0; scheduled_state::LEN];
+    if state.has_power {
+        packed[0] |= bits::POWER;
+        if state.power {
+            packed[0] |= bits::ON;
+        }
+    }
+    if state.has_brightness {
+        packed[0] |= bits::BRIGHTNESS;
+        packed[1] = state.brightness;
+    }
+    if state.has_rgb {
+        let [r, g, b] = state.rgb;
+        let xy = Xy::from(Rgb::new(r as _, g as _, b as _));
+
+        packed[0] |= bits::COLOR;
+        packed[2..4].copy_from_slice(&((xy.x * 0xFFFF as f64) as u16).to_le_bytes());
+        packed[4..6].copy_from_slice(&((xy.y * 0xFFFF as f64) as u16).to_le_bytes());
+    }
+    if state.has_color_temp {
+        let mireds = state.color_temp.clamp(MIN_MIREDS, MAX_MIREDS);
+
+        packed[0] |= bits::TEMPERATURE;
+        packed[6..8].copy_from_slice(&mireds.to_le_bytes());
+    }
+    packed[8..].copy_from_slice(&state.transition_ds.to_le_bytes());
+
+    packed
+}
+
+/// Cancels a job of schedule_command on the default daemon instance, InvalidArg if it doesn't
+/// exist or already started
+#[no_mangle]
+extern "C" fn cancel_scheduled(job_id: uint64_t) -> bool {
+    clear_last_error();
+
+    let Some(mut stream) = daemon_socket() else {
+        return false;
+    };
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1] = schedule_op::CANCEL;
+    buf[2..10].copy_from_slice(&job_id.to_le_bytes());
+
+    let (code, buf) = Device::_send_to_socket(&mut stream, None, SCHEDULE, buf);
+    if code == OutputCode::Failure && buf[0] == SCHEDULE_UNKNOWN_JOB {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("No scheduled job {job_id} is waiting"),
+        );
+        return false;
+    }
+
+    check_output(code, ErrorCode::DaemonError, "cancel the scheduled job")
+}
+
+/// Bitflag of `constants::capabilities`, 0 if it couldn't be read
+#[no_mangle]
+extern "C" fn get_capabilities(device_ptr: *mut Device) -> uint8_t {
+    let mut device = deref_device!(device_ptr, 0);
+
+    capabilities(&mut device).unwrap_or(0)
+}
+
+/// The cached capabilities, else they're read with the gamut with the GattError last error on
+/// failure
+fn capabilities(device: &mut Device) -> Option<uint8_t> {
+    if let Some(capabilities) = device.metadata.capabilities {
+        return Some(capabilities);
+    }
+
+    let (code, buf) = device.send_to_socket(CONNECT | CAPABILITIES, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get capabilities") {
+        return None;
+    }
+
+    device.metadata.capabilities = Some(buf[0]);
+    device.metadata.gamut = Some(Gamut::from(buf[1]));
+
+    Some(buf[0])
+}
+
+/// Bitflag of `constants::features`: the capabilities in the low byte, then what the light and its
+/// firmware support (the daemon knows the quirks of some models and firmwares). 0 with the
+/// GattError last error if it couldn't be read, it's cached like the capabilities
+#[no_mangle]
+extern "C" fn feature_flags(device_ptr: *mut Device) -> uint32_t {
+    let mut device = deref_device!(device_ptr, 0);
+
+    if let Some(features) = device.metadata.features {
+        return features;
+    }
+
+    let (code, buf) = device.send_to_socket(CONNECT | FEATURES, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get the features") {
+        return 0;
+    }
+
+    let features = uint32_t::from_le_bytes(buf[..4].try_into().unwrap());
+    device.metadata.features = Some(features);
+
+    features
+}
+
+/// The state is required by the fixed mode and ignored by the others
+#[no_mangle]
+extern "C" fn set_power_on_behavior(
+    device_ptr: *mut Device,
+    mode: uint8_t,
+    state_ptr: *const PowerOnState,
+) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    if !matches!(mode, power_on::LAST_STATE | power_on::FIXED | power_on::OFF) {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Unknown power-on mode {mode}"),
+        );
+        return false;
+    }
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1] = mode;
+
+    if mode == power_on::FIXED {
+        if state_ptr.is_null() {
+            set_last_error(ErrorCode::NullPointer, "The fixed mode requires a state");
+            return false;
+        }
+
+        let state = unsafe { &*state_ptr };
+
+        buf[2] = state.brightness.clamp(MIN_BRIGHTNESS, MAX_BRIGHTNESS);
+        buf[3..7].copy_from_slice(&power_on_color(state.rgb));
+    }
+
+    check_output(
+        device.send_to_socket(CONNECT | POWER_ON, buf).0,
+        ErrorCode::GattError,
+        "set power-on behavior",
+    )
+}
+
+/// Returns the mode or -1 on failure, the state (optional) is only filled in the fixed mode
+#[no_mangle]
+extern "C" fn get_power_on_behavior(
+    device_ptr: *mut Device,
+    state_ptr: *mut PowerOnState,
+) -> c_int {
+    let mut device = deref_device!(device_ptr, -1);
+
+    let gamut = gamut(&mut device);
+    let (code, buf) = device.send_to_socket(CONNECT | POWER_ON, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get power-on behavior") {
+        return -1;
+    }
+
+    let value = &buf[..POWER_ON_LEN];
+    let mode = value[0];
+
+    if mode == power_on::FIXED && !state_ptr.is_null() {
+        unsafe {
+            *state_ptr = PowerOnState {
+                brightness: value[1],
+                rgb: rgb_from_xy(&value[2..6], gamut),
+            };
+        }
+    }
+
+    mode as _
+}
+
+/// The xy (u16 little endian) of the POWER_ON_UUID characteristic
+fn power_on_color([r, g, b]: [uint8_t; 3]) -> [u8; 4] {
+    let xy = Xy::from(Rgb::new(r as _, g as _, b as _));
+
+    let mut color = [0; 4];
+    color[..2].copy_from_slice(&((xy.x * 0xFFFF as f64) as u16).to_le_bytes());
+    color[2..].copy_from_slice(&((xy.y * 0xFFFF as f64) as u16).to_le_bytes());
+
+    color
+}
+
+/// Reads the POWER_ON_UUID value, Unsupported if the device doesn't have the characteristic
+fn read_power_on(device: &mut Device, action: &str) -> Option<[u8; POWER_ON_LEN]> {
+    let (code, buf) = device.send_to_socket(CONNECT | POWER_ON, EMPTY_BUFFER);
+    if !check_power_on_output(code, &buf, action) {
+        return None;
+    }
+
+    let mut value = [0; POWER_ON_LEN];
+    value.copy_from_slice(&buf[..POWER_ON_LEN]);
+
+    Some(value)
+}
+
+fn check_power_on_output(code: OutputCode, buf: &[u8; OUTPUT_LEN - 1], action: &str) -> bool {
+    if matches!(code, OutputCode::Failure) && buf[0] == GATT_UNKNOWN_CHAR {
+        set_last_error(
+            ErrorCode::Unsupported,
+            "This device doesn't have a configurable power-on state",
+        );
+        return false;
+    }
+
+    check_output(code, ErrorCode::GattError, action)
+}
+
+/// Fills the state with the values the device boots with: everything in the fixed power-on mode,
+/// only the power in the off mode and nothing in the last state mode (it boots as it was). False
+/// with the Unsupported last error if the device doesn't have a configurable startup
+#[no_mangle]
+extern "C" fn get_startup_state(device_ptr: *mut Device, state_ptr: *mut DesiredState) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    if state_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "State pointer is null");
+        return false;
+    }
+
+    let gamut = gamut(&mut device);
+    let Some(value) = read_power_on(&mut device, "get startup state") else {
+        return false;
+    };
+
+    let mut state = DesiredState {
+        has_power: value[0] != power_on::LAST_STATE,
+        power: value[0] == power_on::FIXED,
+        ..Default::default()
+    };
+    if value[0] == power_on::FIXED {
+        state.has_brightness = true;
+        state.brightness = value[1];
+        state.has_rgb = true;
+        state.rgb = rgb_from_xy(&value[2..6], gamut);
+    }
+
+    unsafe { *state_ptr = state };
+
+    true
+}
+
+/// Writes the values the device boots with and switches it to the fixed power-on mode, or to the
+/// off mode if the state turns it off. The unset fields keep their stored values, a color
+/// temperature is InvalidArg (the characteristic only has a color) and the transition is ignored
+#[no_mangle]
+extern "C" fn set_startup_state(device_ptr: *mut Device, state_ptr: *const DesiredState) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    let Some(state) = checked_state(state_ptr) else {
+        return false;
+    };
+    if state.has_color_temp {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            "A startup state cannot have a color temperature",
+        );
+        return false;
+    }
+
+    let Some(mut value) = read_power_on(&mut device, "set startup state") else {
+        return false;
+    };
+
+    value[0] = if state.has_power && !state.power {
+        power_on::OFF
+    } else {
+        power_on::FIXED
+    };
+    if state.has_brightness {
+        value[1] = state.brightness;
+    }
+    if state.has_rgb {
+        value[2..6].copy_from_slice(&power_on_color(state.rgb));
+    }
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1..][..POWER_ON_LEN].copy_from_slice(&value);
+
+    let (code, buf) = device.send_to_socket(CONNECT | POWER_ON, buf);
+    check_power_on_output(code, &buf, "set startup state")
+}
+
+/// See `constants::effect`, effects run until they're replaced or set to none
+#[no_mangle]
+extern "C" fn set_effect(device_ptr: *mut Device, effect: uint8_t) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    if !matches!(effect, effect::NONE | effect::COLOR_LOOP) {
+        set_last_error(ErrorCode::InvalidArg, format!("Unknown effect {effect}"));
+        return false;
+    }
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1] = effect;
+
+    check_output(
+        device.send_to_socket(CONNECT | EFFECT, buf).0,
+        ErrorCode::GattError,
+        "set effect",
+    )
+}
+
+/// Returns the running effect or -1 on failure
+#[no_mangle]
+extern "C" fn get_effect(device_ptr: *mut Device) -> c_int {
+    let mut device = deref_device!(device_ptr, -1);
+
+    let (code, buf) = device.send_to_socket(CONNECT | EFFECT, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get effect") {
+        return -1;
+    }
+
+    buf[0] as _
+}
+
+/// The name bytes as the device returned them (they may not be UTF-8, see get_name_str), nul
+/// terminated and must be freed with free_name
+#[no_mangle]
+extern "C" fn get_name(device_ptr: *mut Device) -> *mut c_char {
+    let mut device = deref_device!(device_ptr, ptr::null_mut());
+
+    let Some(buf) = device.name_output() else {
+        return ptr::null_mut();
+    };
+
+    let len = buf.iter().position(|b| *b == b'\0').unwrap_or(buf.len());
+
+    // Cannot fail since it stops at the first nul byte
+    track(CString::new(&buf[..len]).unwrap().into_raw())
+}
+
+/// get_name as a valid UTF-8 string, it must be freed with free_name_str
+#[no_mangle]
+extern "C" fn get_name_str(device_ptr: *mut Device) -> *const c_char {
+    let mut device = deref_device!(device_ptr, ptr::null());
+
+    let Some(buf) = device.name_output() else {
+        return ptr::null();
+    };
+
+    // Cannot fail since it stops at the first nul byte
+    track(CString::new(name_from_output(&buf)).unwrap().into_raw()).cast_const()
+}
+
+#[no_mangle]
+extern "C" fn free_name_str(name_ptr: *const c_char) {
+    free_name(name_ptr.cast_mut());
+}
+
+/// Firmware revision read from the device information service (e.g. "1.104.2"), behaviors
+/// differ between versions. NULL with the GattError last error if it's unreadable, else it must
+/// be freed with free_firmware_version
+#[no_mangle]
+extern "C" fn get_firmware_version(device_ptr: *mut Device) -> *const c_char {
+    let mut device = deref_device!(device_ptr, ptr::null());
+
+    let (code, buf) = device.send_to_socket(CONNECT | FIRMWARE, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get the firmware version") {
+        return ptr::null();
+    }
+
+    // Cannot fail since it stops at the first nul byte
+    track(CString::new(name_from_output(&buf)).unwrap().into_raw()).cast_const()
+}
+
+#[no_mangle]
+extern "C" fn free_firmware_version(version_ptr: *const c_char) {
+    free_name(version_ptr.cast_mut());
+}
+
+/// get_name_str written into the caller buffer, there is nothing to free. It's left untouched on
+/// failure
+#[no_mangle]
+extern "C" fn get_name_into(device_ptr: *mut Device, out_ptr: *mut [c_char; OUTPUT_LEN]) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    if out_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Output pointer is null");
+        return false;
+    }
+
+    let Some(buf) = device.name_output() else {
+        return false;
+    };
+
+    write_c_str(unsafe { &mut *out_ptr }, name_from_output(&buf).as_bytes());
+
+    true
+}
+
+/// Nul terminated and padded, bytes is at most OUTPUT_LEN - 1 long since it's from an output
+fn write_c_str(out: &mut [c_char; OUTPUT_LEN], bytes: &[u8]) {
+    *out = [0; OUTPUT_LEN];
+    for (i, byte) in bytes.iter().take(OUTPUT_LEN - 1).enumerate() {
+        out[i] = *byte as _;
+    }
+}
+
+/// The nul padded name without trailing whitespaces, valid UTF-8 whatever the device returned:
+/// a run of invalid sequences is replaced by one U+FFFD and an invalid tail (e.g. a char cut by
+/// the daemon) is dropped. It's never longer than buf so it still fits the outputs
+fn name_from_output(buf: &[u8]) -> String {
+    let len = buf.iter().position(|b| *b == b'\0').unwrap_or(buf.len());
+
+    let mut name = String::with_capacity(buf.len());
+    let mut chunks = buf[..len].utf8_chunks().peekable();
+    while let Some(chunk) = chunks.next() {
+        let end = (name.len() + chunk.valid().len()).min(buf.len());
+        let mut valid_len = end - name.len();
+        while !chunk.valid().is_char_boundary(valid_len) {
+            valid_len -= 1;
+        }
+        name.push_str(&chunk.valid()[..valid_len]);
+
+        let followed = chunks.peek().is_some_and(|next| !next.valid().is_empty());
+        let replaced = name.len() + char::REPLACEMENT_CHARACTER.len_utf8();
+        if followed && replaced <= buf.len() {
+            name.push(char::REPLACEMENT_CHARACTER);
+        }
+    }
+
+    name.truncate(name.trim_end().len());
+    name
+}
+
+/// Rejects names that are empty, longer than what get_name returns, not UTF-8 or with nul bytes
+#[no_mangle]
+extern "C" fn set_name(device_ptr: *mut Device, name_ptr: *const uint8_t, len: usize) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    if name_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Name pointer is null");
+        return false;
+    }
+
+    if len == 0 || len > DATA_LEN {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Name must be 1 to {DATA_LEN} bytes long, got {len}"),
+        );
+        return false;
+    }
+
+    let name = unsafe { std::slice::from_raw_parts(name_ptr, len) };
+    if std::str::from_utf8(name).is_err() || name.contains(&b'\0') {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            "Name must be valid UTF-8 without nul bytes",
+        );
+        return false;
+    }
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1..len + 1].copy_from_slice(name);
+
+    let ok = check_output(
+        device.send_to_socket(CONNECT | NAME, buf).0,
+        ErrorCode::GattError,
+        "set name",
+    );
+
+    // A failed write may still have renamed it
+    device.metadata.name = ok.then(|| {
+        let mut output = [0; OUTPUT_LEN - 1];
+        output[..len].copy_from_slice(name);
+        output
+    });
+
+    ok
+}
+
+#[no_mangle]
+extern "C" fn free_name(name_ptr: *mut c_char) {
+    if !untrack(name_ptr) {
+        return;
+    }
+
+    unsafe {
+        drop(CString::from_raw(name_ptr));
+    }
+}
+
+/// 1 when the light is on, 0 when it's off and -1 on failure
+#[no_mangle]
+extern "C" fn get_power_state(device_ptr: *mut Device) -> c_int {
+    let mut device = deref_device!(device_ptr, -1);
+
+    let (code, buf) = device.send_to_socket(CONNECT | POWER, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get power state") {
+        return -1;
+    }
+
+    (buf[0] == true as u8) as _
+}
+
+/// Reads the power and writes the inverse in a single request to the daemon, unlike
+/// get_power_state then set_power there is no round trip for another client to slip in and the
+/// concurrent toggles of the device are serialized with each other, not with set_power. Returns the
+/// new state like get_power_state, -1 on failure
+#[no_mangle]
+extern "C" fn toggle_power(device_ptr: *mut Device) -> c_int {
+    let mut device = deref_device!(device_ptr, -1);
+
+    let (code, buf) = device.send_to_socket(CONNECT | TOGGLE_POWER, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "toggle power") {
+        return -1;
+    }
+
+    (buf[0] == true as u8) as _
+}
+
+/// get_power_state with the failures reported as off, only the last error tells them apart
+#[no_mangle]
+extern "C" fn get_power(device_ptr: *mut Device) -> bool {
+    get_power_state(device_ptr) == 1
+}
+
+/// Raw value of the brightness characteristic (MIN_BRIGHTNESS to MAX_BRIGHTNESS), the same scale
+/// as set_brightness. 0 on failure
+#[no_mangle]
+extern "C" fn get_brightness(device_ptr: *mut Device) -> uint8_t {
+    let mut device = deref_device!(device_ptr, 0);
+
+    let (code, buf) = device.send_to_socket(CONNECT | BRIGHTNESS, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get brightness") {
+        return 0;
+    }
+
+    buf[0]
+}
+
+/// get_brightness normalized from 0 to 100 through the curve of the device, the inverse of
+/// set_brightness_percent
+#[no_mangle]
+extern "C" fn get_brightness_percent(device_ptr: *mut Device) -> uint8_t {
+    let curve = deref_device!(device_ptr, 0).brightness_curve;
+
+    let raw = get_brightness(device_ptr);
+    if raw == 0 {
+        return 0;
+    }
+
+    utils::brightness_to_percent_curved(raw, curve)
+}
+
+/// Reads the whole state of the device in a single exchange with the daemon (a Streaming output
+/// followed by the final one with the name)
+#[no_mangle]
+extern "C" fn get_device_state(device_ptr: *mut Device, state_ptr: *mut DeviceState) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    if state_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "State pointer is null");
+        return false;
+    }
+
+    let Some(state) = read_device_state(&mut device) else {
+        return false;
+    };
+
+    unsafe {
+        *state_ptr = state;
+    }
+
+    true
+}
+
+/// Sets the last error on failure
+fn read_device_state(device: &mut Device) -> Option<DeviceState> {
+    let gamut = gamut(device);
+    let mut stream = device.daemon.socket()?;
+
+    set_read_timeout(&stream, device.timeout_ms(CONNECT | STATE));
+    let state = Device::_send_to_socket(
+        &mut stream,
+        Some(device.addr),
+        CONNECT | STATE,
+        EMPTY_BUFFER,
+    );
+    // The name follows the state
+    let name = matches!(state.0, OutputCode::Streaming)
+        .then(|| HueDevice::<FFI>::receive_packet_from_daemon(&mut stream));
+
+    let (code, buf) = state;
+    let Some((code, name_buf)) = name else {
+        check_output(code, ErrorCode::GattError, "get device state");
+        return None;
+    };
+
+    if !check_output(code, ErrorCode::GattError, "get device state") {
+        return None;
+    }
+
+    Some(DeviceState::from_outputs(&buf, &name_buf, gamut))
+}
+
+/// Bumped on breaking changes of the device_state_json output
+const STATE_JSON_VERSION: u8 = 1;
+
+/// The optional values are null when the light doesn't support them (or the RSSI is unknown)
+#[derive(serde::Serialize)]
+struct StateJson {
+    schema_version: u8,
+    name: String,
+    connected: bool,
+    power: bool,
+    brightness: u8,
+    rgb: Option<[u8; 3]>,
+    color_temp: Option<u16>,
+    rssi: Option<i16>,
+}
+
+/// The state as a JSON object, NULL on failure else it must be freed with free_state_json
+#[no_mangle]
+extern "C" fn device_state_json(device_ptr: *mut Device) -> *const c_char {
+    let mut device = deref_device!(device_ptr, ptr::null());
+
+    let Some(state) = read_device_state(&mut device) else {
+        return ptr::null();
+    };
+
+    // Optional, their failures aren't errors of this call
+    let (code, buf) = device.send_to_socket(CONNECT | TEMPERATURE, EMPTY_BUFFER);
+    let color_temp = code
+        .is_success()
+        .then(|| u16::from_le_bytes([buf[0], buf[1]]));
+    let (code, buf) = device.send_to_socket(RSSI, EMPTY_BUFFER);
+    let rssi = code
+        .is_success()
+        .then(|| i16::from_le_bytes([buf[0], buf[1]]));
+
+    let name = state
+        .name
+        .iter()
+        .take_while(|c| **c != 0)
+        .map(|c| *c as u8)
+        .collect::<Vec<_>>();
+
+    let json = StateJson {
+        schema_version: STATE_JSON_VERSION,
+        name: String::from_utf8_lossy(&name).into_owned(),
+        connected: state.connected,
+        power: state.power,
+        brightness: state.brightness,
+        rgb: state.has_color.then_some(state.rgb),
+        color_temp,
+        rssi,
+    };
+
+    // Cannot fail, the struct has no maps and JSON escapes nul bytes
+    let json = serde_json::to_string(&json).unwrap();
+    track(CString::new(json).unwrap().into_raw()).cast_const()
+}
+
+#[no_mangle]
+extern "C" fn free_state_json(json_ptr: *const c_char) {
+    if !untrack(json_ptr) {
+        return;
+    }
+
+    unsafe {
+        drop(CString::from_raw(json_ptr.cast_mut()));
+    }
+}
+
+/// Subscribes to the state changes of the device (see subscribe_state) or to the daemon logs (see
+/// set_log_callback)
+struct Subscription {
+    /// Writing anything ends the subscription on the daemon side
+    sender: SendHalf,
+    thread: JoinHandle<()>,
+}
+
+/// By device pointer
+static SUBSCRIPTIONS: Mutex<Vec<(usize, Subscription)>> = Mutex::new(Vec::new());
+
+/// Calls back with the current state then on every change until unsubscribe_state and once with
+/// NULL when the subscription ended (whatever the reason). The callbacks are made one at a time
+/// from a thread owned by the subscription and the state is only valid during the call.
+///
+/// The name is only read when subscribing
+#[no_mangle]
+extern "C" fn subscribe_state(
+    device_ptr: *mut Device,
+    callback: Option<StateCallback>,
+    ctx: *mut c_void,
+) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    let Some(callback) = callback else {
+        set_last_error(ErrorCode::NullPointer, "Callback pointer is null");
+        return false;
+    };
+
+    {
+        let mut subscriptions = SUBSCRIPTIONS.lock().unwrap();
+        // A subscription that ended on its own can be replaced
+        subscriptions.retain(|(ptr, sub)| *ptr != device_ptr as usize || !sub.thread.is_finished());
+        if subscriptions
+            .iter()
+            .any(|(ptr, _)| *ptr == device_ptr as usize)
+        {
+            set_last_error(ErrorCode::InvalidArg, "The device is already subscribed");
+            return false;
+        }
+    }
+
+    let gamut = gamut(&mut device);
+    let (code, name_buf) = device.send_to_socket(CONNECT | NAME, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get name") {
+        return false;
+    }
+
+    let Some(mut stream) = device.daemon.socket() else {
+        return false;
+    };
+
+    let (code, state_buf) = Device::_send_to_socket(
+        &mut stream,
+        Some(device.addr),
+        CONNECT | SUBSCRIBE,
+        EMPTY_BUFFER,
+    );
+    if !matches!(code, OutputCode::Streaming) {
+        check_output(code, ErrorCode::GattError, "subscribe to the device state");
+        return false;
+    }
+
+    let (mut receiver, sender) = stream.split();
+    let ctx = CallbackCtx(ctx);
+
+    let thread = thread::spawn(move || {
+        // Captures the whole Send wrapper
+        let ctx = ctx;
+        let mut state = DeviceState::from_outputs(&state_buf, &name_buf, gamut);
+
+        loop {
+            callback(ctx.0, &state);
+
+            let (code, state_buf) = HueDevice::<FFI>::receive_packet_from_daemon(&mut receiver);
+            if !matches!(code, OutputCode::Streaming) {
+                break;
+            }
+
+            state = DeviceState::from_outputs(&state_buf, &name_buf, gamut);
+        }
+
+        callback(ctx.0, ptr::null());
+    });
+
+    SUBSCRIPTIONS
+        .lock()
+        .unwrap()
+        .push((device_ptr as usize, Subscription { sender, thread }));
+
+    true
+}
+
+/// Returns once the last callback is done (unless called from the callback itself), false if the
+/// device isn't subscribed
+#[no_mangle]
+extern "C" fn unsubscribe_state(device_ptr: *mut Device) -> bool {
+    let _ = deref_device!(device_ptr, false);
+
+    if !unsubscribe(device_ptr) {
+        set_last_error(ErrorCode::InvalidArg, "The device is not subscribed");
+        return false;
+    }
+
+    true
+}
+
+fn unsubscribe(device_ptr: *mut Device) -> bool {
+    let mut subscriptions = SUBSCRIPTIONS.lock().unwrap();
+    let Some(i) = subscriptions
+        .iter()
+        .position(|(ptr, _)| *ptr == device_ptr as usize)
+    else {
+        return false;
+    };
+    let (_, subscription) = subscriptions.swap_remove(i);
+    // The callback may subscribe or unsubscribe
+    drop(subscriptions);
+
+    end_subscription(subscription);
+
+    true
+}
+
+/// Returns once the last callback is done, unless it's called from the callback itself
+fn end_subscription(mut subscription: Subscription) {
+    // Fails if the daemon already ended it
+    let _ = subscription
+        .sender
+        .write_all(&[0])
+        .and_then(|_| subscription.sender.flush());
+
+    if subscription.thread.thread().id() != thread::current().id() {
+        let _ = subscription.thread.join();
+    }
+}
+
+/// Last state passed to the callback of set_connection_callback, the watch ended
+const CONNECTION_ENDED: uint8_t = 2;
+
+/// By device pointer, see set_connection_callback
+static CONNECTION_WATCHES: Mutex<Vec<(usize, Subscription)>> = Mutex::new(Vec::new());
+
+/// Calls back with the connection state of the device (1 connected, 0 disconnected) right away
+/// then on every change, the drops and the reconnections made by the daemon included, until
+/// another callback replaces it or NULL stops it. It's called a last time with CONNECTION_ENDED
+/// once the watch ended, whatever the reason (e.g. the daemon exited). The callbacks are made one
+/// at a time from a thread owned by the watch.
+///
+/// The device doesn't have to be connected nor even discovered. The previous callback is done
+/// once this returns, even if it failed
+#[no_mangle]
+extern "C" fn set_connection_callback(
+    device_ptr: *mut Device,
+    callback: Option<ConnectionCallback>,
+    ctx: *mut c_void,
+) {
+    let device = deref_device!(device_ptr, ());
+
+    // The callback may set another one
+    unwatch_connection(device_ptr);
+
+    let Some(callback) = callback else {
+        return;
+    };
+
+    let Some(mut stream) = device.daemon.socket() else {
+        return;
+    };
+
+    let (code, state_buf) = Device::_send_to_socket(
+        &mut stream,
+        Some(device.addr),
+        CONNECTION_EVENTS,
+        EMPTY_BUFFER,
+    );
+    if !matches!(code, OutputCode::Streaming) {
+        check_output(code, ErrorCode::DaemonError, "watch the connection state");
+        return;
+    }
+
+    let (mut receiver, sender) = stream.split();
+    let ctx = CallbackCtx(ctx);
+
+    let thread = thread::spawn(move || {
+        // Captures the whole Send wrapper
+        let ctx = ctx;
+        let mut connected = state_buf[0];
+
+        loop {
+            callback(ctx.0, connected);
+
+            let (code, state_buf) = HueDevice::<FFI>::receive_packet_from_daemon(&mut receiver);
+            if !matches!(code, OutputCode::Streaming) {
+                break;
+            }
+
+            connected = state_buf[0];
+        }
+
+        callback(ctx.0, CONNECTION_ENDED);
+    });
+
+    // Another call may have set one in the meantime
+    let replaced = {
+        let mut watches = CONNECTION_WATCHES.lock().unwrap();
+        let replaced = watches
+            .iter()
+            .position(|(ptr, _)| *ptr == device_ptr as usize)
+            .map(|i| watches.swap_remove(i).1);
+        watches.push((device_ptr as usize, Subscription { sender, thread }));
+
+        replaced
+    };
+    if let Some(replaced) = replaced {
+        end_subscription(replaced);
+    }
+}
+
+/// Returns once the last callback of the watch is done (unless called from it), a no-op if the
+/// device isn't watched
+fn unwatch_connection(device_ptr: *mut Device) {
+    let mut watches = CONNECTION_WATCHES.lock().unwrap();
+    let Some(i) = watches
+        .iter()
+        .position(|(ptr, _)| *ptr == device_ptr as usize)
+    else {
+        return;
+    };
+    let (_, watch) = watches.swap_remove(i);
+    // The callback may set another one
+    drop(watches);
+
+    end_subscription(watch);
+}
+
+/// The forwarding of the daemon logs to the callback of set_log_callback
+static LOG_FORWARDING: Mutex<Option<Subscription>> = Mutex::new(None);
+
+/// Forwards the daemon log records of min_level (see log::Level) or more severe to the callback,
+/// NULL stops it. The callbacks are made one at a time from a thread owned by the forwarding and
+/// the message is only valid during the call, it ends when the daemon exits.
+///
+/// The previous callback is done once this returns, even if it failed
+#[no_mangle]
+extern "C" fn set_log_callback(callback: Option<LogCallback>, ctx: *mut c_void, min_level: c_int) {
+    clear_last_error();
+
+    // The callback may set another one
+    let previous = LOG_FORWARDING.lock().unwrap().take();
+    if let Some(previous) = previous {
+        end_subscription(previous);
+    }
+
+    let Some(callback) = callback else {
+        return;
+    };
+
+    if !(log::Level::Error as c_int..=log::Level::Trace as c_int).contains(&min_level) {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Unknown log level {min_level}"),
+        );
+        return;
+    }
+
+    let Some(mut stream) = daemon_socket() else {
+        return;
+    };
+
+    let mut buf = EMPTY_BUFFER;
+    buf[1] = min_level as _;
+
+    let (code, _) = Device::_send_to_socket(&mut stream, None, LOGS, buf);
+    if !check_output(code, ErrorCode::DaemonError, "stream the daemon logs") {
+        return;
+    }
+
+    let (mut receiver, sender) = stream.split();
+    let ctx = CallbackCtx(ctx);
+
+    let thread = thread::spawn(move || {
+        // Captures the whole Send wrapper
+        let ctx = ctx;
+        let mut message = Vec::new();
+
+        loop {
+            let (code, buf) = HueDevice::<FFI>::receive_packet_from_daemon(&mut receiver);
+            if !matches!(code, OutputCode::Streaming) {
+                break;
+            }
+
+            let chunk = &buf[2..][..LOG_CHUNK_LEN];
+            let len = chunk
+                .iter()
+                .position(|b| *b == b'\0')
+                .unwrap_or(chunk.len());
+            message.extend_from_slice(&chunk[..len]);
+
+            if buf[1] == true as u8 {
+                // Cannot fail, the chunks stop at their first nul byte
+                let c_message = CString::new(String::from_utf8_lossy(&message).as_ref()).unwrap();
+                callback(ctx.0, buf[0] as _, c_message.as_ptr());
+                message.clear();
+            }
+        }
+    });
+
+    // Another call may have set one in the meantime
+    let replaced = LOG_FORWARDING
+        .lock()
+        .unwrap()
+        .replace(Subscription { sender, thread });
+    if let Some(replaced) = replaced {
+        end_subscription(replaced);
+    }
+}
+
+/// Reads the power, brightness and color (if any) of the device, returns NULL on failure
+#[no_mangle]
+extern "C" fn capture_state(device_ptr: *mut Device) -> *mut StateSnapshot {
+    let mut device = deref_device!(device_ptr, ptr::null_mut());
+
+    let (code, power_buf) = device.send_to_socket(CONNECT | POWER, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get power state") {
+        return ptr::null_mut();
+    }
+
+    let (code, brightness_buf) = device.send_to_socket(CONNECT | BRIGHTNESS, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::GattError, "get brightness") {
+        return ptr::null_mut();
+    }
+
+    let (code, color_buf) = device.send_to_socket(CONNECT | COLOR_XY, EMPTY_BUFFER);
+    let color = code.is_success().then(|| {
+        let mut color = [0; 4];
+        color.copy_from_slice(&color_buf[..4]);
+        color
+    });
+
+    track(Box::into_raw(Box::new(StateSnapshot {
+        power: power_buf[0],
+        brightness: brightness_buf[0],
+        color,
+    })))
+}
+
+/// Writes the color first so a light that was OFF is turned off last
+#[no_mangle]
+extern "C" fn restore_state(device_ptr: *mut Device, snapshot_ptr: *const StateSnapshot) -> bool {
+    let mut device = deref_device!(device_ptr, false);
+
+    if snapshot_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Snapshot pointer is null");
+        return false;
+    }
+
+    restore(&mut device, unsafe { &*snapshot_ptr })
+}
+
+fn restore(device: &mut Device, snapshot: &StateSnapshot) -> bool {
+    if let Some(color) = snapshot.color {
+        let mut buf = EMPTY_BUFFER;
+        buf[0] = SET;
+        buf[1..5].copy_from_slice(&color);
+
+        let (code, _) = device.send_to_socket(CONNECT | COLOR_XY, buf);
+        if !check_output(code, ErrorCode::GattError, "restore color") {
+            return false;
+        }
+    }
+
+    for (mask, value, action) in [
+        (BRIGHTNESS, snapshot.brightness, "restore brightness"),
+        (POWER, snapshot.power, "restore power state"),
+    ] {
+        let mut buf = EMPTY_BUFFER;
+        buf[0] = SET;
+        buf[1] = value;
+
+        let (code, _) = device.send_to_socket(CONNECT | mask, buf);
+        if !check_output(code, ErrorCode::GattError, action) {
+            return false;
+        }
+    }
+
+    true
+}
+
+#[no_mangle]
+extern "C" fn free_state_snapshot(snapshot_ptr: *mut StateSnapshot) {
+    if !untrack(snapshot_ptr) {
+        return;
+    }
+
+    unsafe {
+        drop(Box::from_raw(snapshot_ptr));
+    }
+}
+
+/// The SCENE command of the op with the nul terminated name, it must be valid UTF-8 and 1 to
+/// SCENE_NAME_MAX_LEN bytes long
+fn scene_buffer(op: u8, name_ptr: *const c_char) -> Option<[u8; DATA_LEN + 1]> {
+    if name_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Scene name pointer is null");
+        return None;
+    }
+
+    let name = unsafe { CStr::from_ptr(name_ptr) };
+    let len = name.to_bytes().len();
+    if name.to_str().is_err() || len == 0 || len > SCENE_NAME_MAX_LEN {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Scene name must be valid UTF-8 and 1 to {SCENE_NAME_MAX_LEN} bytes long"),
+        );
+        return None;
+    }
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1] = op;
+    buf[2..][..len].copy_from_slice(name.to_bytes());
+
+    Some(buf)
+}
+
+/// Snapshots every device connected to the daemon into the scene, an existing scene is replaced.
+/// Scenes are persisted by the daemon and survive its restarts
+#[no_mangle]
+extern "C" fn save_scene(name_ptr: *const c_char) -> bool {
+    clear_last_error();
+
+    let Some(buf) = scene_buffer(scene_op::SAVE, name_ptr) else {
+        return false;
+    };
+
+    let Some(mut stream) = daemon_socket() else {
+        return false;
+    };
+
+    let (code, _) = Device::_send_to_socket(&mut stream, None, SCENE, buf);
+    if code == OutputCode::DeviceNotFound {
+        set_last_error(ErrorCode::DeviceNotFound, "No connected device to save");
+        return false;
+    }
+
+    check_output(code, ErrorCode::DaemonError, "save the scene")
+}
+
+/// Restores every device of the scene like restore_state, connecting them if needed. Sets the
+/// InvalidArg last error for an unknown scene, it returns false if any device failed
+#[no_mangle]
+extern "C" fn recall_scene(name_ptr: *const c_char) -> bool {
+    clear_last_error();
+
+    let Some(buf) = scene_buffer(scene_op::GET, name_ptr) else {
+        return false;
+    };
+
+    let Some(mut stream) = daemon_socket() else {
+        return false;
+    };
+
+    let mut scene = Vec::new();
+    let (mut code, mut device_buf) = Device::_send_to_socket(&mut stream, None, SCENE, buf);
+    while code == OutputCode::Streaming {
+        let mut addr = [0; ADDR_LEN];
+        addr.copy_from_slice(&device_buf[..ADDR_LEN]);
+
+        let snapshot = StateSnapshot {
+            power: device_buf[ADDR_LEN],
+            brightness: device_buf[ADDR_LEN + 1],
+            color: (device_buf[ADDR_LEN + 2] == true as u8).then(|| {
+                let mut color = [0; 4];
+                color.copy_from_slice(&device_buf[ADDR_LEN + 3..][..4]);
+                color
+            }),
+        };
+        scene.push((addr, snapshot));
+
+        (code, device_buf) = HueDevice::<FFI>::receive_packet_from_daemon(&mut stream);
+    }
+    drop(stream);
+
+    if code != OutputCode::StreamEOF {
+        if code == OutputCode::Failure && device_buf[0] == SCENE_UNKNOWN {
+            set_last_error(
+                ErrorCode::InvalidArg,
+                format!("Unknown scene {:?}", unsafe { CStr::from_ptr(name_ptr) }),
+            );
+        } else {
+            check_output(code, ErrorCode::DaemonError, "get the scene");
+        }
+        return false;
+    }
+
+    let mut restored = true;
+    for (addr, snapshot) in scene {
+        // Keeps going so a device out of range doesn't prevent the others from being restored
+        restored &= restore(&mut Device::new(addr), &snapshot);
+    }
+
+    restored
+}
+
+/// Returns NULL on failure, an empty list is not a failure: the daemon has no scenes
+#[no_mangle]
+extern "C" fn list_scenes() -> *mut SceneList {
+    clear_last_error();
+
+    let Some(mut stream) = daemon_socket() else {
+        return ptr::null_mut();
+    };
+
+    let mut buf = EMPTY_BUFFER;
+    buf[1] = scene_op::LIST;
+
+    let mut names = Vec::new();
+    let (mut code, mut name_buf) = Device::_send_to_socket(&mut stream, None, SCENE, buf);
+    while code == OutputCode::Streaming {
+        names.push(name_from_output(&name_buf));
+        (code, name_buf) = HueDevice::<FFI>::receive_packet_from_daemon(&mut stream);
+    }
+
+    if code != OutputCode::StreamEOF {
+        check_output(code, ErrorCode::DaemonError, "list the scenes");
+        return ptr::null_mut();
+    }
+
+    track(Box::into_raw(Box::new(SceneList(names))))
+}
+
+#[no_mangle]
+extern "C" fn scene_list_len(list_ptr: *mut SceneList) -> usize {
+    if list_ptr.is_null() {
+        return 0;
+    }
+
+    unsafe { (*list_ptr).0.len() }
+}
+
+/// Copies the nul terminated name at index, it returns false if the index is out of bounds
+#[no_mangle]
+extern "C" fn scene_list_get(
+    list_ptr: *mut SceneList,
+    index: usize,
+    out_ptr: *mut [c_char; OUTPUT_LEN],
+) -> bool {
+    clear_last_error();
+
+    if list_ptr.is_null() || out_ptr.is_null() {
+        set_last_error(
+            ErrorCode::NullPointer,
+            "Scene list or output pointer is null",
+        );
+        return false;
+    }
+
+    let list = unsafe { &*list_ptr };
+    let Some(name) = list.0.get(index) else {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!(
+                "Index {index} out of bounds, the list has {} scenes",
+                list.0.len()
+            ),
+        );
+        return false;
+    };
+
+    write_c_str(unsafe { &mut *out_ptr }, name.as_bytes());
+
+    true
+}
+
+#[no_mangle]
+extern "C" fn free_scene_list(list_ptr: *mut SceneList) {
+    if !untrack(list_ptr) {
+        return;
+    }
+
+    unsafe {
+        drop(Box::from_raw(list_ptr));
+    }
+}
+
+/// Returns NULL on failure, an empty list is not a failure: no device was found during the scan
+#[no_mangle]
+extern "C" fn scan_devices(duration_ms: uint32_t) -> *mut DeviceList {
+    clear_last_error();
+
+    let Some(mut stream) = daemon_socket() else {
+        return ptr::null_mut();
+    };
+
+    let mut devices = Vec::new();
+    let scanned = scan(&mut stream, duration_ms, true, |device| {
+        devices.push(device);
+        true
+    });
+    if !scanned {
+        return ptr::null_mut();
+    }
+
+    track(Box::into_raw(Box::new(DeviceList(devices))))
+}
+
+/// Same as scan_devices but the callback is called (on the calling thread) with the address and
+/// the nul terminated name of every device as soon as it's found, they're only valid during the
+/// call. The callback returns false to stop the scan early, it isn't a failure
+#[no_mangle]
+extern "C" fn scan_devices_cb(
+    duration_ms: uint32_t,
+    callback: Option<ScanCallback>,
+    ctx: *mut c_void,
+) -> bool {
+    clear_last_error();
+
+    let Some(callback) = callback else {
+        set_last_error(ErrorCode::NullPointer, "Callback pointer is null");
+        return false;
+    };
+
+    let Some(mut stream) = daemon_socket() else {
+        return false;
+    };
+
+    scan(&mut stream, duration_ms, false, |device| {
+        let name = CString::new(device.name).unwrap_or_default();
+        callback(ctx, &device.address, name.as_ptr())
+    })
+}
+
+/// Calls on_found with every device streamed by the daemon until it returns false, sets the
+/// DaemonError last error on failure. The manufacturer data of the devices is only received with
+/// advertisement.
+fn scan(
+    stream: &mut Stream,
+    duration_ms: uint32_t,
+    advertisement: bool,
+    mut on_found: impl FnMut(FoundDevice) -> bool,
+) -> bool {
+    let mut buf = EMPTY_BUFFER;
+    buf[1..5].copy_from_slice(&duration_ms.to_le_bytes());
+
+    let mask = if advertisement {
+        SCAN | ADVERTISEMENT
+    } else {
+        SCAN
+    };
+    let (mut code, mut device_buf) = Device::_send_to_socket(stream, None, mask, buf);
+
+    while code == OutputCode::Streaming {
+        let mut device = FoundDevice::from(device_buf);
+
+        while advertisement {
+            let chunk;
+            (code, chunk) = HueDevice::<FFI>::receive_packet_from_daemon(stream);
+            if code != OutputCode::Streaming {
+                check_output(code, ErrorCode::DaemonError, "scan devices");
+                return false;
+            }
+
+            let len = (chunk[0] as usize).min(ADV_CHUNK_LEN);
+            device
+                .manufacturer_data
+                .extend_from_slice(&chunk[1..][..len]);
+            if len < ADV_CHUNK_LEN {
+                break;
+            }
+        }
+
+        // The daemon notices it on its next write
+        if !on_found(device) {
+            return true;
+        }
+
+        (code, device_buf) = HueDevice::<FFI>::receive_packet_from_daemon(stream);
+    }
+
+    if code != OutputCode::StreamEOF {
+        check_output(code, ErrorCode::DaemonError, "scan devices");
+        return false;
+    }
+
+    true
+}
+
+/// ScanHandle on the C side, see start_scan
+struct ScanHandle {
+    /// Writing anything cancels the scan on the daemon side
+    sender: SendHalf,
+    found: mpsc::Receiver<FoundDevice>,
+    /// Gives the scan failure, taken by the call that reports it
+    thread: Option<JoinHandle<Option<(ErrorCode, String)>>>,
+}
+
+impl ScanHandle {
+    /// Receives the devices streamed on stream, the scan must have been sent
+    fn new(stream: Stream) -> Self {
+        let (mut receiver, sender) = stream.split();
+        let (tx, found) = mpsc::channel();
+
+        let thread = thread::spawn(move || {
+            let (mut code, mut buf) = HueDevice::<FFI>::receive_packet_from_daemon(&mut receiver);
+            while code == OutputCode::Streaming {
+                // The handle is only freed once the thread is done
+                let _ = tx.send(FoundDevice::from(buf));
+
+                (code, buf) = HueDevice::<FFI>::receive_packet_from_daemon(&mut receiver);
+            }
+
+            if code != OutputCode::StreamEOF {
+                check_output(code, ErrorCode::DaemonError, "scan devices");
+            }
+
+            take_last_error()
+        });
+
+        Self {
+            sender,
+            found,
+            thread: Some(thread),
+        }
+    }
+
+    /// Sets the last error if the scan failed and it wasn't reported yet
+    fn report_failure(&mut self) -> bool {
+        let failure = self
+            .thread
+            .take()
+            .and_then(|thread| thread.join().unwrap_or(None));
+
+        let Some((code, message)) = failure else {
+            return false;
+        };
+        set_last_error(code, message);
+
+        true
+    }
+}
+
+/// Same as scan_devices but the scan runs in the background, its devices are taken with scan_poll
+/// and stop_scan cancels it as soon as the caller found what it needed. NULL if the daemon is
+/// unreachable, else it must be freed with stop_scan
+#[no_mangle]
+extern "C" fn start_scan(duration_ms: uint32_t) -> *mut ScanHandle {
+    clear_last_error();
+
+    let Some(mut stream) = daemon_socket() else {
+        return ptr::null_mut();
+    };
+
+    let mut buf = EMPTY_BUFFER;
+    buf[1..5].copy_from_slice(&duration_ms.to_le_bytes());
+
+    let sent = HueDevice::<FFI>::write_packet_to_daemon(&mut stream, None, SCAN, buf);
+    if let Err(error) = sent {
+        set_last_error(
+            ErrorCode::DaemonUnreachable,
+            format!("Cannot write to the daemon socket: {error}"),
+        );
+        return ptr::null_mut();
+    }
+
+    track(Box::into_raw(Box::new(ScanHandle::new(stream))))
+}
+
+/// Copies the next device found (the address and the nul terminated name), waiting up to
+/// timeout_ms for it (0 doesn't wait). It returns false with RUSTBEE_TIMEOUT if none was found in
+/// time, and false without a last error once the scan ended and every device was polled, unless
+/// the scan failed
+#[no_mangle]
+extern "C" fn scan_poll(
+    scan_ptr: *mut ScanHandle,
+    timeout_ms: uint32_t,
+    out_addr: *mut [uint8_t; ADDR_LEN],
+    out_name: *mut [c_char; OUTPUT_LEN],
+) -> bool {
+    clear_last_error();
+
+    if scan_ptr.is_null() || out_addr.is_null() || out_name.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Scan or output pointer is null");
+        return false;
+    }
+
+    let scan = unsafe { &mut *scan_ptr };
+    match scan
+        .found
+        .recv_timeout(Duration::from_millis(timeout_ms as _))
+    {
+        Ok(device) => {
+            unsafe { *out_addr = device.address };
+            write_c_str(unsafe { &mut *out_name }, device.name.as_bytes());
+
+            true
+        }
+        Err(mpsc::RecvTimeoutError::Timeout) => {
+            set_last_error(
+                ErrorCode::Timeout,
+                format!("No device found within {timeout_ms}ms"),
+            );
+            false
+        }
+        Err(mpsc::RecvTimeoutError::Disconnected) => {
+            scan.report_failure();
+            false
+        }
+    }
+}
+
+/// Cancels the scan if it's still running and frees the handle, it returns once the daemon ended
+/// the scan. False if the scan failed and no scan_poll reported it
+#[no_mangle]
+extern "C" fn stop_scan(scan_ptr: *mut ScanHandle) -> bool {
+    clear_last_error();
+
+    if !untrack(scan_ptr) {
+        set_last_error(
+            ErrorCode::NullPointer,
+            "Scan pointer is null or already stopped",
+        );
+        return false;
+    }
+
+    let mut scan = unsafe { Box::from_raw(scan_ptr) };
+    // Fails if the daemon already ended it
+    let _ = scan
+        .sender
+        .write_all(&[0])
+        .and_then(|_| scan.sender.flush());
+
+    !scan.report_failure()
+}
+
+#[no_mangle]
+extern "C" fn device_list_len(list_ptr: *mut DeviceList) -> usize {
+    if list_ptr.is_null() {
+        return 0;
+    }
+
+    unsafe { (*list_ptr).0.len() }
+}
+
+/// The name is nul padded, both outputs are zeroed if the index is out of bounds
+#[no_mangle]
+extern "C" fn device_list_get(
+    list_ptr: *mut DeviceList,
+    index: usize,
+    out_addr: *mut [uint8_t; ADDR_LEN],
+    out_name: *mut [uint8_t; OUTPUT_LEN - 1],
+) {
+    clear_last_error();
+
+    if list_ptr.is_null() || out_addr.is_null() || out_name.is_null() {
+        set_last_error(
+            ErrorCode::NullPointer,
+            "Device list or output pointer is null",
+        );
+        return;
+    }
+
+    let (out_addr, out_name) = unsafe { (&mut *out_addr, &mut *out_name) };
+    out_addr.fill(0);
+    out_name.fill(0);
+
+    let list = unsafe { &*list_ptr };
+    let Some(device) = list.0.get(index) else {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!(
+                "Index {index} out of bounds, the list has {} devices",
+                list.0.len()
+            ),
+        );
+        return;
+    };
+
+    let name = device.name.as_bytes();
+    // Keeps at least one nul byte at the end so it can be read as a C string
+    let len = usize::min(name.len(), out_name.len() - 1);
+
+    out_addr.copy_from_slice(&device.address);
+    out_name[..len].copy_from_slice(&name[..len]);
+}
+
+/// Manufacturer specific data advertised by the device at index, the company id (u16 little
+/// endian, 0x010F for Signify) followed by the data, empty if it had none. out_len is the capacity
+/// of out and is set to the data len (out may be NULL to only get it), if the data doesn't fit or
+/// the index is out of bounds it fails with InvalidArg
+#[no_mangle]
+extern "C" fn device_list_get_adv(
+    list_ptr: *mut DeviceList,
+    index: usize,
+    out_ptr: *mut uint8_t,
+    out_len_ptr: *mut usize,
+) -> bool {
+    clear_last_error();
+
+    if list_ptr.is_null() || out_len_ptr.is_null() {
+        set_last_error(
+            ErrorCode::NullPointer,
+            "Device list or out len pointer is null",
+        );
+        return false;
+    }
+
+    let capacity = unsafe { *out_len_ptr };
+    if out_ptr.is_null() && capacity > 0 {
+        set_last_error(ErrorCode::NullPointer, "Out pointer is null");
+        return false;
+    }
+
+    let list = unsafe { &*list_ptr };
+    let Some(device) = list.0.get(index) else {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!(
+                "Index {index} out of bounds, the list has {} devices",
+                list.0.len()
+            ),
+        );
+        return false;
+    };
+
+    let data = &device.manufacturer_data;
+    unsafe { *out_len_ptr = data.len() };
+    if data.len() > capacity {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("The data is {} bytes, out is {capacity}", data.len()),
+        );
+        return false;
+    }
+
+    if !data.is_empty() {
+        unsafe { std::slice::from_raw_parts_mut(out_ptr, data.len()) }.copy_from_slice(data);
+    }
+
+    true
+}
+
+#[no_mangle]
+extern "C" fn free_device_list(list_ptr: *mut DeviceList) {
+    if !untrack(list_ptr) {
+        return;
+    }
+
+    unsafe {
+        drop(Box::from_raw(list_ptr));
+    }
+}
+
+/// Returns NULL on failure, an empty list is not a failure: the daemon doesn't know any device
+#[no_mangle]
+extern "C" fn daemon_list_devices() -> *mut ManagedDeviceList {
+    clear_last_error();
+
+    let Some(mut stream) = daemon_socket() else {
+        return ptr::null_mut();
+    };
+
+    let mut devices = Vec::new();
+    let (mut code, mut buf) = Device::_send_to_socket(&mut stream, None, DEVICES, EMPTY_BUFFER);
+    while code == OutputCode::Streaming {
+        devices.push(ManagedDevice {
+            addr: buf[..ADDR_LEN].try_into().unwrap(),
+            connected: buf[ADDR_LEN] == true as u8,
+        });
+        (code, buf) = HueDevice::<FFI>::receive_packet_from_daemon(&mut stream);
+    }
+
+    if code != OutputCode::StreamEOF {
+        check_output(code, ErrorCode::DaemonError, "list the daemon devices");
+        return ptr::null_mut();
+    }
+
+    track(Box::into_raw(Box::new(ManagedDeviceList(devices))))
+}
+
+/// Scans for scan_ms then connects every device found concurrently, each one on its own daemon
+/// connection and within connect_ms (0 keeps the daemon default timeouts, see
+/// try_connect_timeout). The list only has the addresses of the connected devices, not handles,
+/// the ones that failed to connect are printed to stderr and left out. Returns NULL if the scan
+/// failed, an empty list is not a failure
+#[no_mangle]
+extern "C" fn discover_and_connect(
+    scan_ms: uint32_t,
+    connect_ms: uint32_t,
+) -> *mut ManagedDeviceList {
+    clear_last_error();
+
+    let Some(mut stream) = daemon_socket() else {
+        return ptr::null_mut();
+    };
+
+    let mut found = Vec::new();
+    let scanned = scan(&mut stream, scan_ms, false, |device| {
+        found.push(device.address);
+        true
+    });
+    if !scanned {
+        return ptr::null_mut();
+    }
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1..5].copy_from_slice(&connect_ms.to_le_bytes());
+
+    let devices = std::thread::scope(|scope| {
+        let workers = found
+            .iter()
+            .map(|addr| {
+                scope.spawn(move || {
+                    let Some(mut stream) = daemon_socket() else {
+                        return take_last_error();
+                    };
+
+                    let (code, _) = Device::_send_to_socket(&mut stream, Some(*addr), CONNECT, buf);
+                    check_output(code, ErrorCode::NotConnected, "connect to the device");
+
+                    take_last_error()
+                })
+            })
+            .collect::<Vec<_>>();
+
+        workers
+            .into_iter()
+            .zip(&found)
+            .filter_map(|(worker, addr)| {
+                let error = worker.join().unwrap_or_else(|_| {
+                    Some((
+                        ErrorCode::NotConnected,
+                        "Failed to connect to the device".into(),
+                    ))
+                });
+                if let Some((_, message)) = error {
+                    eprintln!("[WARN] {}: {message}", utils::format_addr(addr));
+                    return None;
+                }
+
+                Some(ManagedDevice {
+                    addr: *addr,
+                    connected: true,
+                })
+            })
+            .collect::<Vec<_>>()
+    });
+
+    track(Box::into_raw(Box::new(ManagedDeviceList(devices))))
+}
+
+#[no_mangle]
+extern "C" fn managed_device_list_len(list_ptr: *mut ManagedDeviceList) -> usize {
+    if list_ptr.is_null() {
+        return 0;
+    }
+
+    unsafe { (*list_ptr).0.len() }
+}
+
+/// Copies the address and the connection state at index, it returns false if the index is out of
+/// bounds
+#[no_mangle]
+extern "C" fn managed_device_list_get(
+    list_ptr: *mut ManagedDeviceList,
+    index: usize,
+    out_addr: *mut [uint8_t; ADDR_LEN],
+    out_connected: *mut bool,
+) -> bool {
+    clear_last_error();
+
+    if list_ptr.is_null() || out_addr.is_null() || out_connected.is_null() {
+        set_last_error(
+            ErrorCode::NullPointer,
+            "Device list or output pointer is null",
+        );
+        return false;
+    }
+
+    let list = unsafe { &*list_ptr };
+    let Some(device) = list.0.get(index) else {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!(
+                "Index {index} out of bounds, the list has {} devices",
+                list.0.len()
+            ),
+        );
+        return false;
+    };
+
+    unsafe {
+        *out_addr = device.addr;
+        *out_connected = device.connected;
+    }
+
+    true
+}
+
+#[no_mangle]
+extern "C" fn free_managed_device_list(list_ptr: *mut ManagedDeviceList) {
+    if !untrack(list_ptr) {
+        return;
+    }
+
+    unsafe {
+        drop(Box::from_raw(list_ptr));
+    }
+}
+
+/// Powers off every device connected to the daemon, all_on restores their power and brightness.
+/// Returns false if any of them failed
+#[no_mangle]
+extern "C" fn all_off() -> bool {
+    all_power(false)
+}
+
+/// Devices that weren't turned off by all_off are left as they are
+#[no_mangle]
+extern "C" fn all_on() -> bool {
+    all_power(true)
+}
+
+fn all_power(on: bool) -> bool {
+    clear_last_error();
+
+    let Some(mut stream) = daemon_socket() else {
+        return false;
+    };
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1] = on as _;
+
+    // Not a device request so the writes get the default retries
+    let retries = (write_mode::DEFAULT_RETRIES as MaskT) << WRITE_RETRIES_SHIFT;
+    let (code, _) = Device::_send_to_socket(&mut stream, None, ALL_POWER | retries, buf);
+    check_output(
+        code,
+        ErrorCode::GattError,
+        if on {
+            "power on every device"
+        } else {
+            "power off every device"
+        },
+    )
+}
+
+/// Disconnects the devices of the daemon after the given seconds without commands, their next
+/// command reconnects them. 0 (the default) disables it, it's reset when the daemon restarts
+#[no_mangle]
+extern "C" fn set_idle_disconnect(seconds: uint32_t) {
+    set_daemon_setting(IDLE_DISCONNECT, seconds, "set the idle disconnect");
+}
+
+/// Keeps the connection of a disconnected device open for the given seconds so connecting it
+/// again is instant, the client sees it disconnected meanwhile. 0 (the default) disables it, it's
+/// reset when the daemon restarts
+#[no_mangle]
+extern "C" fn set_connection_cache_ttl(seconds: uint32_t) {
+    set_daemon_setting(CONNECTION_CACHE, seconds, "set the connection cache TTL");
+}
+
+/// 1 makes the daemon reconnect the subscribed devices that drop and subscribe to their state
+/// again, the reconnections are logged (see set_log_callback). 0 (the default) disables it, it's
+/// reset when the daemon restarts. InvalidArg if enabled isn't 0 or 1
+#[no_mangle]
+extern "C" fn set_auto_reconnect(enabled: uint8_t) {
+    if enabled > 1 {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Enabled must be 0 or 1, got {enabled}"),
+        );
+        return;
+    }
+
+    set_daemon_setting(AUTO_RECONNECT, enabled as _, "set the auto reconnect");
+}
+
+/// The backoff between the reconnection attempts of a dropped device (see set_auto_reconnect)
+/// starts at base_ms and doubles up to max_ms, every attempt waits a random part of it so the
+/// devices that dropped together don't reconnect at once. 500ms up to 30s by default, it's reset
+/// when the daemon restarts. InvalidArg if base_ms is 0 or greater than max_ms
+#[no_mangle]
+extern "C" fn set_reconnect_policy(base_ms: uint32_t, max_ms: uint32_t) {
+    clear_last_error();
+
+    if base_ms == 0 || max_ms < base_ms {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("The backoff must be from 1ms up to max_ms, got {base_ms}ms up to {max_ms}ms"),
+        );
+        return;
+    }
+
+    let Some(mut stream) = daemon_socket() else {
+        return;
+    };
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1..5].copy_from_slice(&base_ms.to_le_bytes());
+    buf[5..9].copy_from_slice(&max_ms.to_le_bytes());
+
+    let (code, _) = Device::_send_to_socket(&mut stream, None, RECONNECT_POLICY, buf);
+    check_output(code, ErrorCode::DaemonError, "set the reconnect policy");
+}
+
+/// 1 makes the calls that need the daemon launch it (like launch_daemon) if it isn't running yet
+/// instead of failing with DaemonUnreachable, 0 is the default. It's the instance of the device,
+/// never the remote daemon of connect_daemon_tcp. InvalidArg if enabled isn't 0 or 1
+#[no_mangle]
+extern "C" fn set_auto_launch_daemon(enabled: uint8_t) {
+    clear_last_error();
+
+    if enabled > 1 {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Enabled must be 0 or 1, got {enabled}"),
+        );
+        return;
+    }
+
+    AUTO_LAUNCH.store(enabled == 1, Ordering::Relaxed);
+}
+
+/// Throttles the GATT writes of the daemon to each device to writes_per_sec with a token bucket
+/// per device (up to a second of writes at once), so a flooded device doesn't hold back the
+/// others. A write that would wait more than a second is dropped and fails, see
+/// get_daemon_stats. 0 (the default) disables it, it's reset when the daemon restarts
+#[no_mangle]
+extern "C" fn set_global_write_rate(writes_per_sec: uint32_t) {
+    set_daemon_setting(WRITE_RATE, writes_per_sec, "set the global write rate");
+}
+
+/// Sends a daemon wide setting (a count or a boolean), failures are only reported through the
+/// last error
+fn set_daemon_setting(mask: MaskT, value: u32, action: &str) {
+    clear_last_error();
+
+    let Some(mut stream) = daemon_socket() else {
+        return;
+    };
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    buf[1..5].copy_from_slice(&value.to_le_bytes());
+
+    let (code, _) = Device::_send_to_socket(&mut stream, None, mask, buf);
+    check_output(code, ErrorCode::DaemonError, action);
+}
+
+/// Must be called before launch_daemon, the launched daemon gets the path through its env
+#[no_mangle]
+extern "C" fn set_socket_path(path_ptr: *const c_char) -> bool {
+    clear_last_error();
+
+    let Some(path) = socket_path_arg(path_ptr) else {
+        return false;
+    };
+
+    utils::set_socket_path(path);
+
+    true
+}
+
+/// Where the daemons launched by this process keep their scenes and bonds (absolute, see
+/// set_data_dir), a daemon launched by another process may use another one. It must be freed with
+/// free_data_dir, NULL if the path isn't UTF-8
+#[no_mangle]
+extern "C" fn daemon_data_dir() -> *const c_char {
+    clear_last_error();
+
+    let dir = utils::data_dir();
+    let Some(dir) = dir.to_str().and_then(|dir| CString::new(dir).ok()) else {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Data directory {} isn't valid UTF-8", dir.display()),
+        );
+        return ptr::null();
+    };
+
+    track(dir.into_raw()).cast_const()
+}
+
+#[no_mangle]
+extern "C" fn free_data_dir(dir_ptr: *const c_char) {
+    if !untrack(dir_ptr) {
+        return;
+    }
+
+    unsafe {
+        drop(CString::from_raw(dir_ptr.cast_mut()));
+    }
+}
+
+/// Must be called before launch_daemon like set_socket_path, a running daemon keeps its data
+/// dir. It's created along with the first scene or bond, an existing one must be a writable
+/// directory
+#[no_mangle]
+extern "C" fn set_data_dir(path_ptr: *const c_char) -> bool {
+    clear_last_error();
+
+    if path_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Path pointer is null");
+        return false;
+    }
+
+    let path = match unsafe { CStr::from_ptr(path_ptr) }.to_str() {
+        Ok("") => {
+            set_last_error(ErrorCode::InvalidArg, "Data directory path is empty");
+            return false;
+        }
+        Ok(path) => std::path::Path::new(path),
+        Err(_) => {
+            set_last_error(ErrorCode::InvalidArg, "Path must be valid UTF-8");
+            return false;
+        }
+    };
+
+    if path.exists() && !path.is_dir() {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("Data directory {} isn't a directory", path.display()),
+        );
+        return false;
+    }
+
+    if path.is_dir() && !utils::is_dir_writable(path) {
+        set_last_error(
+            ErrorCode::PermissionDenied,
+            format!("Directory {} isn't writable", path.display()),
+        );
+        return false;
+    }
+
+    utils::set_data_dir(path);
+
+    true
+}
+
+/// Sets the last error if the path is null, not UTF-8 or cannot be created by this process
+fn socket_path_arg(path_ptr: *const c_char) -> Option<String> {
+    if path_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Path pointer is null");
+        return None;
+    }
+
+    let Ok(path) = unsafe { CStr::from_ptr(path_ptr) }.to_str() else {
+        set_last_error(ErrorCode::InvalidArg, "Path must be valid UTF-8");
+        return None;
+    };
+
+    // Windows named pipes don't live in a directory
+    #[cfg(not(target_os = "windows"))]
+    {
+        let dir = match std::path::Path::new(path).parent() {
+            Some(dir) if !dir.as_os_str().is_empty() => dir,
+            _ => {
+                set_last_error(
+                    ErrorCode::InvalidArg,
+                    format!("Socket path {path:?} has no parent directory"),
+                );
+                return None;
+            }
+        };
+
+        if !dir.is_dir() {
+            set_last_error(
+                ErrorCode::InvalidArg,
+                format!("Directory {} doesn't exist", dir.display()),
+            );
+            return None;
+        }
+
+        if !utils::is_dir_writable(dir) {
+            set_last_error(
+                ErrorCode::PermissionDenied,
+                format!("Directory {} isn't writable", dir.display()),
+            );
+            return None;
+        }
+    }
+
+    Some(path.to_owned())
+}
+
+/// Sets the NoAdapter last error if there is no usable Bluetooth adapter, see adapter_available
+fn check_adapter() -> Option<Adapter> {
+    let info = block_on!(crate::bluetooth::get_adapter_info());
+    if info.is_none() {
+        set_last_error(
+            ErrorCode::NoAdapter,
+            "No Bluetooth LE adapter found (maybe your Bluetooth is OFF ?)",
+        );
+    }
+
+    info
+}
+
+/// Sets the last error of launch_error_code on failure, NoAdapter if the daemon wasn't running and
+/// there is no Bluetooth adapter to spawn it. Ok(false) if the instance was already running
+fn launch(daemon: &DaemonHandle) -> io::Result<bool> {
+    let launched = block_on!(utils::launch_daemon_at(&daemon.socket_path()));
+    if let Err(error) = &launched {
+        set_last_error(launch_error_code(error), error.to_string());
+    }
+
+    launched
+}
+
+/// See `utils::launch_error`, a daemon that couldn't be spawned or exited for another reason is
+/// SpawnFailed
+fn launch_error_code(error: &io::Error) -> ErrorCode {
+    if utils::is_no_adapter(error) {
+        return ErrorCode::NoAdapter;
+    }
+
+    match error.kind() {
+        io::ErrorKind::AddrInUse => ErrorCode::SocketInUse,
+        io::ErrorKind::PermissionDenied => ErrorCode::PermissionDenied,
+        _ => ErrorCode::SpawnFailed,
+    }
+}
+
+/// Launches the default daemon instance, see launch_daemon_instance
+#[no_mangle]
+extern "C" fn launch_daemon() -> bool {
+    clear_last_error();
+
+    launch(&DaemonHandle::default()).is_ok()
+}
+
+/// Launches (or reuses) the daemon listening on socket_path, several instances can run side by
+/// side on distinct paths. Returns NULL on failure, the handle must be freed with
+/// free_daemon_handle, it doesn't shutdown the daemon
+#[no_mangle]
+extern "C" fn launch_daemon_instance(path_ptr: *const c_char) -> *mut DaemonHandle {
+    clear_last_error();
+
+    let Some(socket_path) = socket_path_arg(path_ptr) else {
+        return ptr::null_mut();
+    };
+
+    let daemon = DaemonHandle {
+        socket_path: Some(socket_path),
+    };
+    if launch(&daemon).is_err() {
+        return ptr::null_mut();
+    }
+
+    track(Box::into_raw(Box::new(daemon)))
+}
+
+/// Asks the daemon instance to shutdown gracefully and waits for it to disconnect the devices,
+/// up to SHUTDOWN_TIMEOUT_SECS (Timeout last error). Unlike shutdown_daemon, it only stops this
+/// instance and cannot force it
+#[no_mangle]
+extern "C" fn shutdown_daemon_instance(daemon_ptr: *const DaemonHandle) -> bool {
+    clear_last_error();
+
+    if daemon_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Daemon handle pointer is null");
+        return false;
+    }
+
+    let daemon = unsafe { &*daemon_ptr };
+    let Some(mut stream) = daemon.socket() else {
+        return false;
+    };
+
+    let (code, _) = Device::_send_to_socket(&mut stream, None, SHUTDOWN, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::DaemonError, "shutdown the daemon") {
+        return false;
+    }
+
+    wait_for_shutdown(daemon)
+}
+
+/// The daemon removes its socket last, a named pipe cannot be polled the same way so on Windows
+/// it's true once the shutdown is acknowledged. Timeout last error after SHUTDOWN_TIMEOUT_SECS
+fn wait_for_shutdown(daemon: &DaemonHandle) -> bool {
+    #[cfg(not(target_os = "windows"))]
+    {
+        use crate::constants::SHUTDOWN_TIMEOUT_SECS;
+
+        let socket_path = daemon.socket_path();
+        let deadline = Instant::now() + Duration::from_secs(SHUTDOWN_TIMEOUT_SECS);
+
+        while std::path::Path::new(&socket_path).exists() {
+            if Instant::now() >= deadline {
+                set_last_error(
+                    ErrorCode::Timeout,
+                    format!("The daemon didn't shutdown within {SHUTDOWN_TIMEOUT_SECS}s"),
+                );
+                return false;
+            }
+
+            thread::sleep(Duration::from_millis(100));
+        }
+    }
+
+    #[cfg(target_os = "windows")]
+    let _ = daemon;
+
+    true
+}
+
+#[no_mangle]
+extern "C" fn free_daemon_handle(daemon_ptr: *mut DaemonHandle) {
+    if !untrack(daemon_ptr) {
+        return;
+    }
+
+    unsafe {
+        drop(Box::from_raw(daemon_ptr));
+    }
+}
+
+/// Keep it in sync with the LaunchStatus enum of the C header
+#[repr(C)]
+enum LaunchStatus {
+    Failed = 0,
+    Started = 1,
+    AlreadyRunning = 2,
+}
+
+/// Same as launch_daemon but tells if the daemon was started by this call, in which case the
+/// caller owns its lifecycle
+#[no_mangle]
+extern "C" fn launch_daemon_ex() -> c_int {
+    clear_last_error();
+
+    let status = match launch(&DaemonHandle::default()) {
+        Ok(true) => LaunchStatus::Started,
+        Ok(false) => LaunchStatus::AlreadyRunning,
+        Err(_) => LaunchStatus::Failed,
+    };
+
+    status as _
+}
+
+/// Launches the default daemon instance with in memory virtual devices instead of Bluetooth ones,
+/// so no adapter is needed. Its scans find them, new_device and try_connect work against them and
+/// their state changes like a light's. Two are known from the start (HUE_BAR_1_ADDR and
+/// HUE_BAR_2_ADDR, see seed_simulated_device for others). A daemon already running is kept even
+/// if it isn't simulated
+#[no_mangle]
+extern "C" fn launch_daemon_simulated() -> bool {
+    clear_last_error();
+
+    let launched = block_on!(utils::launch_simulated_daemon_at(
+        &DaemonHandle::default().socket_path()
+    ));
+    if let Err(error) = &launched {
+        set_last_error(launch_error_code(error), error.to_string());
+    }
+
+    launched.is_ok()
+}
+
+/// Adds or replaces the virtual device of addr with the state, connected or not. Only the
+/// connection, power, brightness, color and name are seeded, the name is cut to fit and a device
+/// without color is a white only light. It fails with the Unsupported last error if the daemon
+/// isn't simulated, see launch_daemon_simulated
+#[no_mangle]
+extern "C" fn seed_simulated_device(
+    addr_ptr: *const [uint8_t; ADDR_LEN],
+    state_ptr: *const DeviceState,
+) -> bool {
+    use crate::constants::simulated_device::NAME_OFFSET;
+
+    clear_last_error();
+
+    if addr_ptr.is_null() || state_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Address or state pointer is null");
+        return false;
+    }
+
+    let (addr, state) = unsafe { (*addr_ptr, &*state_ptr) };
+
+    let Some(mut stream) = daemon_socket() else {
+        return false;
+    };
+
+    let mut buf = EMPTY_BUFFER;
+    buf[0] = SET;
+    let data = &mut buf[1..];
+    data[0] = state.connected as _;
+    data[1] = state.power as _;
+    data[2] = state.brightness;
+    data[3] = state.has_color as _;
+    if state.has_color {
+        let [r, g, b] = state.rgb;
+        let xy = Xy::from(Rgb::new(r as _, g as _, b as _));
+
+        data[4..6].copy_from_slice(&((xy.x * 0xFFFF as f64) as u16).to_le_bytes());
+        data[6..8].copy_from_slice(&((xy.y * 0xFFFF as f64) as u16).to_le_bytes());
+    }
+    for (i, c) in state
+        .name
+        .iter()
+        .take_while(|c| **c != 0)
+        .take(DATA_LEN - NAME_OFFSET)
+        .enumerate()
+    {
+        data[NAME_OFFSET + i] = *c as _;
+    }
+
+    let (code, _) = Device::_send_to_socket(&mut stream, Some(addr), SIMULATED_DEVICE, buf);
+    check_output(
+        code,
+        ErrorCode::Unsupported,
+        "seed the virtual device, the daemon isn't simulated",
+    )
+}
+
+/// Sets the last error if the pointer is null, the string is empty or longer than TCP_ARG_MAX_LEN
+fn tcp_arg<'a>(arg_ptr: *const c_char, what: &str) -> Option<&'a str> {
+    if arg_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, format!("{what} pointer is null"));
+        return None;
+    }
+
+    let Ok(arg) = unsafe { CStr::from_ptr(arg_ptr) }.to_str() else {
+        set_last_error(ErrorCode::InvalidArg, format!("{what} must be valid UTF-8"));
+        return None;
+    };
+    if arg.is_empty() || arg.len() > TCP_ARG_MAX_LEN {
+        set_last_error(
+            ErrorCode::InvalidArg,
+            format!("{what} must be 1 to {TCP_ARG_MAX_LEN} bytes long"),
+        );
+        return None;
+    }
+
+    Some(arg)
+}
+
+/// Launches the default daemon instance (see launch_daemon) and makes it also listen on TCP at
+/// bind_addr (e.g. "0.0.0.0:9740") for the clients of connect_daemon_tcp that send the token.
+/// The previous listener is replaced once bind_addr is bound and the daemon doesn't time out
+/// while it's listening. The TCP clients only drive the devices, the settings, logs, stats and
+/// shutdown of the daemon fail with the DaemonError last error.
+///
+/// The TCP connection isn't encrypted, the token only keeps out the clients that don't know it
+#[no_mangle]
+extern "C" fn launch_daemon_tcp(bind_addr_ptr: *const c_char, token_ptr: *const c_char) -> bool {
+    clear_last_error();
+
+    let (Some(bind_addr), Some(token)) = (
+        tcp_arg(bind_addr_ptr, "Bind address"),
+        tcp_arg(token_ptr, "Token"),
+    ) else {
+        return false;
+    };
+
+    let daemon = DaemonHandle::default();
+    if launch(&daemon).is_err() {
+        return false;
+    }
+    let Some(mut stream) = daemon.local_socket() else {
+        return false;
+    };
+
+    // Followed by the bind address and the token, each after its length
+    let mut args = Vec::with_capacity(2 + bind_addr.len() + token.len());
+    for arg in [bind_addr, token] {
+        args.push(arg.len() as u8);
+        args.extend_from_slice(arg.as_bytes());
+    }
+
+    let sent =
+        HueDevice::<FFI>::write_packet_to_daemon(&mut stream, None, TCP_LISTEN, EMPTY_BUFFER)
+            .and_then(|_| stream.write_all(&args))
+            .and_then(|_| stream.flush());
+    if let Err(error) = sent {
+        set_last_error(
+            ErrorCode::DaemonError,
+            format!("Cannot write to the daemon socket ({error})"),
+        );
+        return false;
+    }
+
+    let (code, _) = HueDevice::<FFI>::receive_packet_from_daemon(&mut stream);
+    check_output(
+        code,
+        ErrorCode::DaemonError,
+        &format!("listen on TCP {bind_addr}"),
+    )
+}
+
+/// Makes the default daemon instance the one listening on TCP at addr (see launch_daemon_tcp),
+/// every later call without a daemon handle goes through it. It's checked with a ping, on failure
+/// the previous default instance is kept (DaemonError if it rejected the token). NULL goes back
+/// to the local daemon.
+///
+/// launch_daemon and the other calls that start the daemon still start it locally
+#[no_mangle]
+extern "C" fn connect_daemon_tcp(addr_ptr: *const c_char, token_ptr: *const c_char) -> bool {
+    clear_last_error();
+
+    if addr_ptr.is_null() {
+        *REMOTE_DAEMON.lock().unwrap() = None;
+        return true;
+    }
+
+    let (Some(addr), Some(token)) = (tcp_arg(addr_ptr, "Address"), tcp_arg(token_ptr, "Token"))
+    else {
+        return false;
+    };
+
+    let remote = RemoteDaemon {
+        addr: addr.to_owned(),
+        token: token.as_bytes().to_vec(),
+    };
+    let Some(mut stream) = remote.socket() else {
+        return false;
+    };
+
+    let (code, _) = Device::_send_to_socket(&mut stream, None, PING, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::DaemonUnreachable, "ping the daemon") {
+        return false;
+    }
+
+    *REMOTE_DAEMON.lock().unwrap() = Some(remote);
+
+    true
+}
+
+/// Whether this host has a usable Bluetooth LE adapter, else it sets the NoAdapter last error.
+/// It's what launch_daemon checks before spawning the daemon, it doesn't need the daemon
+#[no_mangle]
+extern "C" fn adapter_available() -> bool {
+    clear_last_error();
+
+    check_adapter().is_some()
+}
+
+/// Filled by get_adapter_info
+#[repr(C)]
+struct AdapterInfo {
+    /// Nul terminated, truncated to ADAPTER_NAME_LEN - 1 bytes
+    name: [c_char; ADAPTER_NAME_LEN],
+    /// The address is unknown if false
+    has_address: bool,
+    address: [uint8_t; ADDR_LEN],
+}
+
+const ADAPTER_NAME_LEN: usize = 64;
+
+/// Name and address of the adapter the daemon uses, false with the NoAdapter last error if there
+/// is none
+#[no_mangle]
+extern "C" fn get_adapter_info(out_ptr: *mut AdapterInfo) -> bool {
+    clear_last_error();
+
+    if out_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Out pointer is null");
+        return false;
+    }
+
+    let Some(adapter) = check_adapter() else {
+        return false;
+    };
+
+    let mut info = AdapterInfo {
+        name: [0; ADAPTER_NAME_LEN],
+        has_address: adapter.address.is_some(),
+        address: adapter.address.unwrap_or_default(),
+    };
+    for (dst, src) in info.name[..ADAPTER_NAME_LEN - 1]
+        .iter_mut()
+        .zip(adapter.name.bytes())
+    {
+        *dst = src as _;
+    }
+
+    unsafe { *out_ptr = info };
+
+    true
+}
+
+/// Pure liveness check, it never launches the daemon. The ping is sent from another thread so a
+/// hung daemon cannot block the caller longer than PING_TIMEOUT_MS
+#[no_mangle]
+extern "C" fn daemon_is_alive() -> bool {
+    clear_last_error();
+
+    let Some(mut stream) = daemon_socket() else {
+        return false;
+    };
+
+    let (tx, rx) = mpsc::channel();
+    thread::spawn(move || {
+        let (code, _) = Device::_send_to_socket(&mut stream, None, PING, EMPTY_BUFFER);
+        let _ = tx.send(code);
+    });
+
+    match rx.recv_timeout(Duration::from_millis(PING_TIMEOUT_MS)) {
+        Ok(code) => check_output(code, ErrorCode::DaemonUnreachable, "ping the daemon"),
+        Err(_) => {
+            set_last_error(
+                ErrorCode::Timeout,
+                format!("The daemon didn't answer the ping within {PING_TIMEOUT_MS}ms"),
+            );
+            false
+        }
+    }
+}
+
+/// Version of the running daemon (semver with the commit hash as build metadata if known), it is
+/// nul terminated and must be freed with free_version_string
+#[no_mangle]
+extern "C" fn daemon_version() -> *mut c_char {
+    clear_last_error();
+
+    let Some(mut stream) = daemon_socket() else {
+        return ptr::null_mut();
+    };
+
+    let (code, buf) = Device::_send_to_socket(&mut stream, None, VERSION, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::DaemonError, "get the daemon version") {
+        return ptr::null_mut();
+    }
+
+    let len = buf.iter().position(|b| *b == b'\0').unwrap_or(buf.len());
+
+    // Cannot fail since it stops at the first nul byte
+    track(CString::new(&buf[..len]).unwrap().into_raw())
+}
+
+/// daemon_version written into the caller buffer, there is nothing to free. It's left untouched
+/// on failure
+#[no_mangle]
+extern "C" fn daemon_version_into(out_ptr: *mut [c_char; OUTPUT_LEN]) -> bool {
+    clear_last_error();
+
+    if out_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Output pointer is null");
+        return false;
+    }
+
+    let Some(mut stream) = daemon_socket() else {
+        return false;
+    };
+
+    let (code, buf) = Device::_send_to_socket(&mut stream, None, VERSION, EMPTY_BUFFER);
+    if !check_output(code, ErrorCode::DaemonError, "get the daemon version") {
+        return false;
+    }
+
+    let len = buf.iter().position(|b| *b == b'\0').unwrap_or(buf.len());
+    write_c_str(unsafe { &mut *out_ptr }, &buf[..len]);
+
+    true
+}
+
+/// The counters of the daemon since it started, out is left untouched on failure
+#[no_mangle]
+extern "C" fn get_daemon_stats(out_ptr: *mut DaemonStats) -> bool {
+    clear_last_error();
+
+    if out_ptr.is_null() {
+        set_last_error(ErrorCode::NullPointer, "Output pointer is null");
+        return false;
+    }
+
+    let Some(mut stream) = daemon_socket() else {
+        return false;
+    };
+
+    let mut request = EMPTY_BUFFER;
+    request[1] = STATS_VERSION;
+
+    let (code, buf) = Device::_send_to_socket(&mut stream, None, STATS, request);
+    if !check_output(code, ErrorCode::DaemonError, "get the daemon stats") {
+        return false;
+    }
+
+    // A daemon older than STATS_VERSION closes the connection after the first output, the
+    // counters of the second one are left at 0
+    let (code, writes_buf) = HueDevice::<FFI>::receive_packet_from_daemon(&mut stream);
+    let writes_buf = if code.is_success() {
+        writes_buf
+    } else {
+        [0; OUTPUT_LEN - 1]
+    };
+
+    unsafe {
+        *out_ptr = DaemonStats::from_outputs(&buf, &writes_buf);
+    }
+
+    true
+}
+
+#[no_mangle]
+extern "C" fn free_version_string(version_ptr: *mut c_char) {
+    if !untrack(version_ptr) {
+        return;
+    }
+
+    unsafe {
+        drop(CString::from_raw(version_ptr));
+    }
+}
+
+/// A graceful shutdown is asked to the daemon of the default instance (see set_socket_path), a
+/// forced one kills the rustbee-daemon process
+#[no_mangle]
+extern "C" fn shutdown_daemon(force: uint8_t) -> bool {
+    if force != 1 {
+        return shutdown_daemon_ex(force, ptr::null_mut());
+    }
+
+    clear_last_error();
+
+    match utils::shutdown_daemon(true) {
+        Ok(true) => true,
+        Ok(false) => {
+            set_last_error(ErrorCode::DaemonError, "No running daemon to shutdown");
+            false
+        }
+        Err(error) if error.kind() == io::ErrorKind::TimedOut => {
+            set_last_error(ErrorCode::Timeout, error.to_string());
+            false
+        }
+        Err(error) => {
+            set_last_error(ErrorCode::DaemonError, error.to_string());
+            false
+        }
+    }
+}
+
+/// shutdown_daemon telling how many devices the daemon shut down cleanly, clean_ptr can be null.
+/// Unless forced, the daemon drains the writes of every device and disconnects them at once,
+/// started in the order of their address and all within 2s. A device that fails or takes too long
+/// is logged and doesn't count. The call returns once they're all done, a forced shutdown has none
+#[no_mangle]
+extern "C" fn shutdown_daemon_ex(force: uint8_t, clean_ptr: *mut uint32_t) -> bool {
+    let clean = if force == 1 {
+        if !shutdown_daemon(force) {
+            return false;
+        }
+
+        0
+    } else {
+        clear_last_error();
+
+        // Like shutdown_daemon, it's never the remote daemon and it doesn't launch one
+        let daemon = DaemonHandle::default();
+        let Ok(stream) = HueDevice::<FFI>::get_file_socket_at(&daemon.socket_path()) else {
+            set_last_error(ErrorCode::DaemonError, "No running daemon to shutdown");
+            return false;
+        };
+        let mut stream = Stream::from(stream);
+
+        let mut buf = EMPTY_BUFFER;
+        buf[0] = SET;
+        let (code, _) = Device::_send_to_socket(&mut stream, None, SHUTDOWN, buf);
+        if !check_output(code, ErrorCode::DaemonError, "shutdown the daemon") {
+            return false;
+        }
+
+        // Sent once the devices are disconnected, [clean, total] as u32 little endian
+        let (code, report) = HueDevice::<FFI>::receive_packet_from_daemon(&mut stream);
+        if !check_output(code, ErrorCode::DaemonError, "get the shutdown report") {
+            return false;
+        }
+
+        if !wait_for_shutdown(&daemon) {
+            return false;
+        }
+
+        u32::from_le_bytes(report[..4].try_into().unwrap())
+    };
+
+    if !clean_ptr.is_null() {
+        unsafe { *clean_ptr = clean };
+    }
+
+    true
+}
+
+#[cfg(test)]
+mod ffi_tests {
+    use std::io::Read as _;
+    use std::net::{TcpListener, TcpStream};
+
+    use super::*;
+
+    #[test]
+    fn launch_and_shutdown_daemon_without_devices() {
+        // On its own socket so a daemon running on the default one is left alone. If
+        // rustbee-daemon isn't installed (or there is no adapter), there is nothing to shutdown so
+        // it must fail instead of crashing
+        let socket_path =
+            std::env::temp_dir().join(format!("rustbee-shutdown-{}.sock", std::process::id()));
+        let path = CString::new(socket_path.to_str().unwrap()).unwrap();
+        assert!(set_socket_path(path.as_ptr()));
+
+        let launched = launch_daemon();
+        assert_eq!(shutdown_daemon(0), launched);
+
+        // Nothing left to shutdown
+        let mut clean = u32::MAX;
+        assert!(!shutdown_daemon_ex(0, &mut clean));
+        assert_eq!(rustbee_last_error(), ErrorCode::DaemonError as i32);
+        assert_eq!(clean, u32::MAX);
+
+        utils::reset_socket_path();
+    }
+
+    #[test]
+    fn last_error_on_null_device() {
+        assert!(!try_connect(ptr::null_mut()));
+        assert!(!try_connect_paired(ptr::null_mut(), 1));
+        assert!(!is_paired(ptr::null_mut()));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        assert_eq!(get_power_state(ptr::null_mut()), -1);
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+        assert!(!get_power(ptr::null_mut()));
+        assert!(get_firmware_version(ptr::null_mut()).is_null());
+        assert_eq!(toggle_power(ptr::null_mut()), -1);
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+        assert!(!request_connection_params(ptr::null_mut(), 15, 30, 0));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+        set_keepalive(ptr::null_mut(), 1000);
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+        assert!(!flush(ptr::null_mut()));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+        assert!(!set_brightness_percent(ptr::null_mut(), 50));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+        assert_eq!(schedule_command(ptr::null_mut(), ptr::null(), 0), 0);
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+        assert!(!get_startup_state(ptr::null_mut(), ptr::null_mut()));
+        assert!(!set_startup_state(ptr::null_mut(), ptr::null()));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        let message = rustbee_last_error_message();
+        assert!(!message.is_null());
+        free_error_message(message);
+    }
+
+    #[test]
+    fn free_fns_ignore_null_and_double_frees() {
+        free_device(ptr::null_mut());
+        free_name(ptr::null_mut());
+        free_state_snapshot(ptr::null_mut());
+        free_device_list(ptr::null_mut());
+        free_version_string(ptr::null_mut());
+        free_state_json(ptr::null());
+        free_error_message(ptr::null());
+        free_daemon_handle(ptr::null_mut());
+        free_scene_list(ptr::null_mut());
+        free_managed_device_list(ptr::null_mut());
+        free_data_dir(ptr::null());
+
+        let device = new_device(&[0; ADDR_LEN]);
+        free_device(device);
+        free_device(device);
+
+        let daemon = track(Box::into_raw(Box::new(DaemonHandle::default())));
+        let device = new_device_with_daemon(daemon, &[0; ADDR_LEN]);
+        free_daemon_handle(daemon);
+        free_daemon_handle(daemon);
+        free_device(device);
+
+        // The other allocations need a daemon, they are tracked the same way
+        for free in [free_name as extern "C" fn(_), free_version_string] {
+            let string = track(CString::new("Hue").unwrap().into_raw());
+            free(string);
+            free(string);
+        }
+
+        let json = track(CString::new("{}").unwrap().into_raw()).cast_const();
+        free_state_json(json);
+        free_state_json(json);
+
+        let list = track(Box::into_raw(Box::new(DeviceList(Vec::new()))));
+        free_device_list(list);
+        free_device_list(list);
+
+        let list = track(Box::into_raw(Box::new(SceneList(Vec::new()))));
+        free_scene_list(list);
+        free_scene_list(list);
+
+        let list = track(Box::into_raw(Box::new(ManagedDeviceList(Vec::new()))));
+        free_managed_device_list(list);
+        free_managed_device_list(list);
+
+        assert!(!try_connect(ptr::null_mut()));
+        let message = rustbee_last_error_message();
+        free_error_message(message);
+        free_error_message(message);
+    }
+
+    #[test]
+    fn free_fns_ignore_the_allocations_of_other_kinds() {
+        let tracked = |ptr: usize| ALLOCATIONS.lock().unwrap().contains_key(&ptr);
+
+        let device = new_device(&[0; ADDR_LEN]);
+        free_name(device.cast());
+        free_state_json(device.cast());
+        assert!(tracked(device as usize));
+        free_device(device);
+        assert!(!tracked(device as usize));
+
+        // What discover_and_connect returns, it's only freed by free_managed_device_list
+        let list = track(Box::into_raw(Box::new(ManagedDeviceList(Vec::new()))));
+        free_device_list(list.cast());
+        free_scene_list(list.cast());
+        assert!(tracked(list as usize));
+        free_managed_device_list(list);
+        assert!(!tracked(list as usize));
+    }
+
+    #[test]
+    fn scan_handle_polls_until_stopped() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let client = TcpStream::connect(listener.local_addr().unwrap()).unwrap();
+        let (mut daemon, _) = listener.accept().unwrap();
+
+        let scan = track(Box::into_raw(Box::new(ScanHandle::new(Stream::Tcp(
+            client,
+        )))));
+        let mut addr = [0; ADDR_LEN];
+        let mut name = [0; OUTPUT_LEN];
+
+        assert!(!scan_poll(scan, 10, &mut addr, &mut name));
+        assert_eq!(rustbee_last_error(), ErrorCode::Timeout as i32);
+
+        let mut found = [0; OUTPUT_LEN];
+        found[0] = OutputCode::Streaming.into();
+        found[1..][..ADDR_LEN].copy_from_slice(&[1; ADDR_LEN]);
+        found[1 + ADDR_LEN..][..3].copy_from_slice(b"Hue");
+        daemon.write_all(&found).unwrap();
+
+        assert!(scan_poll(scan, 1000, &mut addr, &mut name));
+        assert_eq!(addr, [1; ADDR_LEN]);
+        assert_eq!(unsafe { CStr::from_ptr(name.as_ptr()) }, c"Hue");
+
+        // The daemon ends the scan once the client wrote anything
+        let cancelled = thread::spawn(move || {
+            let mut byte = [0];
+            daemon.read_exact(&mut byte).unwrap();
+
+            let mut eof = [0; OUTPUT_LEN];
+            eof[0] = OutputCode::StreamEOF.into();
+            daemon.write_all(&eof).unwrap();
+        });
+        assert!(stop_scan(scan));
+        cancelled.join().unwrap();
+
+        assert!(!stop_scan(scan));
+        assert!(!scan_poll(ptr::null_mut(), 0, &mut addr, &mut name));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+    }
+
+    #[test]
+    fn device_list_get_adv_tells_the_len_needed() {
+        let list = track(Box::into_raw(Box::new(DeviceList(vec![FoundDevice {
+            manufacturer_data: vec![0x0F, 0x01, 0x02, 0x03],
+            ..Default::default()
+        }]))));
+
+        let mut len = 0;
+        assert!(!device_list_get_adv(list, 0, ptr::null_mut(), &mut len));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+        assert_eq!(len, 4);
+
+        let mut out = [0; 4];
+        assert!(device_list_get_adv(list, 0, out.as_mut_ptr(), &mut len));
+        assert_eq!(out, [0x0F, 0x01, 0x02, 0x03]);
+
+        assert!(!device_list_get_adv(list, 1, out.as_mut_ptr(), &mut len));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+
+        free_device_list(list);
+    }
+
+    #[test]
+    fn a_silent_daemon_times_out() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let mut stream = Stream::Tcp(TcpStream::connect(listener.local_addr().unwrap()).unwrap());
+        // Accepted but never answered
+        let _daemon = listener.accept().unwrap();
+
+        clear_last_error();
+        set_read_timeout(&stream, 50);
+        let start = Instant::now();
+        let (code, _) = Device::_send_to_socket(&mut stream, None, PING, EMPTY_BUFFER);
+        assert_eq!(code, OutputCode::Timeout);
+        assert!(start.elapsed() < Duration::from_secs(5));
+        assert!(!check_output(code, ErrorCode::GattError, "ping"));
+        assert_eq!(rustbee_last_error(), ErrorCode::Timeout as i32);
+
+        // The requests that may discover the device get more time
+        let device = new_device(&[0; ADDR_LEN]);
+        assert_eq!(unsafe { (*device).timeout_ms(POWER) }, COMMAND_TIMEOUT_MS);
+        assert_eq!(
+            unsafe { (*device).timeout_ms(CONNECT | POWER) },
+            COMMAND_TIMEOUT_MS + CONNECT_TIMEOUT_MS
+        );
+        set_command_timeout(device, 0);
+        assert_eq!(unsafe { (*device).timeout_ms(CONNECT | POWER) }, 0);
+        free_device(device);
+
+        set_command_timeout(ptr::null_mut(), 0);
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+    }
+
+    #[test]
+    fn set_write_mode_rejects_unknown_modes() {
+        let device = new_device(&[0; ADDR_LEN]);
+        assert_eq!(unsafe { (*device).write_mode_mask() }, CONFIRMED_WRITES);
+
+        set_write_mode(device, write_mode::UNCONFIRMED);
+        assert_eq!(unsafe { (*device).write_mode_mask() }, UNCONFIRMED_WRITES);
+
+        set_write_mode(device, 2);
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+        assert_eq!(unsafe { (*device).write_mode_mask() }, UNCONFIRMED_WRITES);
+
+        free_device(device);
+    }
+
+    #[test]
+    fn try_connect_ex_needs_an_output() {
+        let device = new_device(&[0; ADDR_LEN]);
+        let mut info = DeviceInfo {
+            name: [0; OUTPUT_LEN],
+            capabilities: 0,
+            firmware: [0; OUTPUT_LEN],
+            gamut: 0,
+        };
+
+        assert!(!try_connect_ex(device, ptr::null_mut()));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+        assert!(!try_connect_ex(ptr::null_mut(), &mut info));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        free_device(device);
+    }
+
+    #[test]
+    fn get_address_of_a_parsed_device() {
+        let device = new_device_from_str(c"e8:d4:ea:c4:62:00".as_ptr());
+        let mut addr = [0; ADDR_LEN];
+
+        assert!(get_address(device, &mut addr));
+        assert_eq!(addr, [0xE8, 0xD4, 0xEA, 0xC4, 0x62, 0x00]);
+
+        assert!(!get_address(device, ptr::null_mut()));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+        assert!(!get_address(ptr::null_mut(), &mut addr));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        free_device(device);
+    }
+
+    #[test]
+    fn white_mix_needs_white_channels_or_a_color_temp() {
+        let device = new_device(&[1; ADDR_LEN]);
+        unsafe {
+            (*device).metadata.capabilities = Some(capabilities::COLOR | capabilities::DIMMING);
+        }
+        let (mut warm, mut cool) = (0, 0);
+
+        assert!(!set_white_mix(device, 0, 0));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+        assert!(!set_white_mix(ptr::null_mut(), 0, 0));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        // Served from the cache, there is no daemon
+        assert!(!set_white_mix(device, 255, 40));
+        assert_eq!(rustbee_last_error(), ErrorCode::Unsupported as i32);
+        assert!(!get_white_mix(device, &mut warm, &mut cool));
+        assert_eq!(rustbee_last_error(), ErrorCode::Unsupported as i32);
+
+        assert!(!get_white_mix(device, ptr::null_mut(), &mut cool));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        free_device(device);
+    }
+
+    #[test]
+    fn clone_device_keeps_the_settings_and_metadata() {
+        use crate::constants::{capabilities, features};
+
+        let device = new_device(&[1; ADDR_LEN]);
+        set_write_retries(device, 5);
+        set_brightness_curve(device, brightness_curve::GAMMA);
+
+        let mut name = [0; OUTPUT_LEN - 1];
+        name[..3].copy_from_slice(b"Hue");
+        unsafe {
+            (*device).metadata = Metadata {
+                name: Some(name),
+                capabilities: Some(capabilities::COLOR | capabilities::DIMMING),
+                gamut: Some(Gamut::B),
+                features: Some(features::COMBINED_WRITE),
+            };
+        }
+
+        let clone = clone_device(device);
+        free_device(device);
+
+        // Served from the cache, there is no daemon
+        let cloned = unsafe { &*clone };
+        assert_eq!(cloned.addr, [1; ADDR_LEN]);
+        assert_eq!(cloned.write_retries, 5);
+        assert_eq!(cloned.brightness_curve, brightness_curve::GAMMA);
+        assert_eq!(
+            get_capabilities(clone),
+            capabilities::COLOR | capabilities::DIMMING
+        );
+        assert_eq!(feature_flags(clone), features::COMBINED_WRITE);
+
+        let name = get_name_str(clone);
+        assert_eq!(unsafe { CStr::from_ptr(name) }.to_str(), Ok("Hue"));
+        free_name_str(name);
+
+        free_device(clone);
+
+        assert!(clone_device(ptr::null_mut()).is_null());
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+    }
+
+    #[test]
+    fn brightness_percent_checks_its_args_before_the_daemon() {
+        let device = new_device(&[0; ADDR_LEN]);
+        assert_eq!(
+            unsafe { (*device).brightness_curve },
+            brightness_curve::LINEAR
+        );
+
+        set_brightness_curve(device, brightness_curve::GAMMA);
+        assert_eq!(
+            unsafe { (*device).brightness_curve },
+            brightness_curve::GAMMA
+        );
+
+        set_brightness_curve(device, 2);
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+        assert_eq!(
+            unsafe { (*device).brightness_curve },
+            brightness_curve::GAMMA
+        );
+
+        assert!(!set_brightness_percent(device, 101));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+
+        free_device(device);
+    }
+
+    #[test]
+    fn command_latency_is_zero_until_a_command_ran() {
+        let device = new_device(&[0; ADDR_LEN]);
+        assert_eq!(get_last_command_latency_ms(device), 0);
+
+        // A sub-millisecond command still counts
+        record_latency(unsafe { &(*device).last_latency_ms }, Instant::now());
+        assert_eq!(get_last_command_latency_ms(device), 1);
+
+        let start = Instant::now() - Duration::from_millis(40);
+        record_latency(unsafe { &(*device).last_latency_ms }, start);
+        assert!(get_last_command_latency_ms(device) >= 40);
+
+        assert_eq!(get_last_command_latency_ms(ptr::null_mut()), 0);
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        free_device(device);
+    }
+
+    #[test]
+    fn command_latency_is_timed_once_the_device_is_ready() {
+        use std::io::{Read as _, Write as _};
+        use std::os::unix::net::UnixListener;
+
+        use crate::constants::BUFFER_LEN;
+
+        let dir = std::env::temp_dir();
+        let socket_path = dir.join(format!("rustbee-latency-{}.sock", std::process::id()));
+        let _ = std::fs::remove_file(&socket_path);
+        let listener = UnixListener::bind(&socket_path).unwrap();
+
+        // A slow implicit connect then an instant command
+        let fake_daemon = thread::spawn(move || {
+            let (mut conn, _) = listener.accept().unwrap();
+            let mut packet = [0; BUFFER_LEN];
+            conn.read_exact(&mut packet).unwrap();
+
+            let mut send = |code: OutputCode, stage| {
+                let mut output = [0; OUTPUT_LEN];
+                output[0] = code.into();
+                output[1] = stage;
+                conn.write_all(&output).unwrap();
+            };
+
+            send(OutputCode::Streaming, connect_stage::CONNECTING);
+            thread::sleep(Duration::from_millis(200));
+            send(OutputCode::Streaming, connect_stage::READY);
+            send(OutputCode::Success, 0);
+        });
+
+        let daemon = DaemonHandle {
+            socket_path: Some(socket_path.to_str().unwrap().to_owned()),
+        };
+        let device = new_device_with_daemon(&daemon, &[0; ADDR_LEN]);
+
+        assert!(flush(device));
+        let latency_ms = get_last_command_latency_ms(device);
+        assert!(latency_ms > 0 && latency_ms < 200, "{latency_ms}ms");
+
+        fake_daemon.join().unwrap();
+        free_device(device);
+        let _ = std::fs::remove_file(&socket_path);
+    }
+
+    #[test]
+    fn write_retries_are_sent_in_the_top_byte() {
+        let device = new_device(&[0; ADDR_LEN]);
+        let retries =
+            |device: *mut Device| unsafe { (*device).write_masks() } >> WRITE_RETRIES_SHIFT;
+        assert_eq!(retries(device), write_mode::DEFAULT_RETRIES as MaskT);
+
+        set_write_retries(device, u8::MAX);
+        assert_eq!(retries(device), u8::MAX as MaskT);
+        assert_eq!(
+            unsafe { (*device).write_masks() } & !(MaskT::MAX << WRITE_RETRIES_SHIFT),
+            CONFIRMED_WRITES
+        );
+
+        free_device(device);
+    }
+
+    #[test]
+    fn into_getters_check_the_output_pointer() {
+        let device = new_device(&[0; ADDR_LEN]);
+
+        assert!(!get_color_rgb_into(device, ptr::null_mut()));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        assert!(!get_name_into(device, ptr::null_mut()));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        assert!(!daemon_version_into(ptr::null_mut()));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        free_device(device);
+    }
+
+    #[test]
+    fn write_c_str_nul_terminates() {
+        let mut out = [1; OUTPUT_LEN];
+
+        write_c_str(&mut out, b"Hue");
+        assert_eq!(&out[..4], &[b'H' as c_char, b'u' as _, b'e' as _, 0]);
+        assert!(out[4..].iter().all(|c| *c == 0));
+
+        write_c_str(&mut out, &[b'a'; OUTPUT_LEN + 1]);
+        assert_eq!(out[OUTPUT_LEN - 1], 0);
+    }
+
+    #[test]
+    fn scene_names_are_checked_before_the_daemon() {
+        assert!(!save_scene(ptr::null()));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        for name in ["", "A scene name too long"] {
+            let name = CString::new(name).unwrap();
+            assert!(!recall_scene(name.as_ptr()));
+            assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+        }
+
+        let buf = scene_buffer(scene_op::GET, c"Movie".as_ptr()).unwrap();
+        assert_eq!(
+            &buf[..8],
+            &[SET, scene_op::GET, b'M', b'o', b'v', b'i', b'e', 0]
+        );
+    }
+
+    #[test]
+    fn scene_list_get_checks_the_index() {
+        let list = track(Box::into_raw(Box::new(SceneList(vec!["Movie".into()]))));
+        let mut out = [1; OUTPUT_LEN];
+
+        assert!(scene_list_get(list, 0, &mut out));
+        assert_eq!(
+            &out[..6],
+            &[
+                b'M' as c_char,
+                b'o' as _,
+                b'v' as _,
+                b'i' as _,
+                b'e' as _,
+                0
+            ]
+        );
+
+        assert!(!scene_list_get(list, 1, &mut out));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+
+        free_scene_list(list);
+    }
+
+    #[test]
+    fn set_log_callback_checks_the_level_before_the_daemon() {
+        extern "C" fn callback(_: *mut c_void, _: c_int, _: *const c_char) {}
+
+        for level in [0, 6] {
+            set_log_callback(Some(callback), ptr::null_mut(), level);
+            assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+        }
+
+        set_log_callback(None, ptr::null_mut(), 0);
+        assert_eq!(rustbee_last_error(), ErrorCode::None as i32);
+        assert!(LOG_FORWARDING.lock().unwrap().is_none());
+    }
+
+    #[test]
+    fn set_connection_callback_can_stop_an_unwatched_device() {
+        extern "C" fn callback(_: *mut c_void, _: uint8_t) {}
+
+        set_connection_callback(ptr::null_mut(), Some(callback), ptr::null_mut());
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        let device = new_device(&[0; ADDR_LEN]);
+        set_connection_callback(device, None, ptr::null_mut());
+        assert_eq!(rustbee_last_error(), ErrorCode::None as i32);
+        assert!(CONNECTION_WATCHES.lock().unwrap().is_empty());
+
+        free_device(device);
+    }
+
+    #[test]
+    fn managed_device_list_get_checks_the_index() {
+        let device = ManagedDevice {
+            addr: [1, 2, 3, 4, 5, 6],
+            connected: true,
+        };
+        let list = track(Box::into_raw(Box::new(ManagedDeviceList(vec![device]))));
+        let (mut addr, mut connected) = ([0; ADDR_LEN], false);
+
+        assert_eq!(managed_device_list_len(list), 1);
+        assert!(managed_device_list_get(list, 0, &mut addr, &mut connected));
+        assert_eq!((addr, connected), ([1, 2, 3, 4, 5, 6], true));
+
+        assert!(!managed_device_list_get(list, 1, &mut addr, &mut connected));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+
+        free_managed_device_list(list);
+    }
+
+    #[test]
+    fn daemon_stats_from_output() {
+        let mut buf = [0; OUTPUT_LEN - 1];
+        buf[..2].copy_from_slice(&3u16.to_le_bytes());
+        buf[2..6].copy_from_slice(&7u32.to_le_bytes());
+        buf[6..10].copy_from_slice(&1u32.to_le_bytes());
+        buf[10..14].copy_from_slice(&450u32.to_le_bytes());
+        buf[14..18].copy_from_slice(&4u32.to_le_bytes());
+        let mut writes_buf = [0; OUTPUT_LEN - 1];
+        writes_buf[..4].copy_from_slice(&12u32.to_le_bytes());
+        writes_buf[4..8].copy_from_slice(&2u32.to_le_bytes());
+        writes_buf[8..12].copy_from_slice(&5u32.to_le_bytes());
+        writes_buf[12..16].copy_from_slice(&4000u32.to_le_bytes());
+
+        let stats = DaemonStats::from_outputs(&buf, &writes_buf);
+        assert_eq!(stats.connected_count, 3);
+        assert_eq!(stats.total_reconnects, 7);
+        assert_eq!(stats.failed_commands, 1);
+        assert_eq!(stats.avg_latency_ms, 450);
+        assert_eq!(stats.write_retries, 4);
+        assert_eq!(stats.delayed_writes, 12);
+        assert_eq!(stats.dropped_writes, 2);
+        assert_eq!(stats.reconnecting_count, 5);
+        assert_eq!(stats.max_backoff_ms, 4000);
+
+        assert!(!get_daemon_stats(ptr::null_mut()));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+    }
+
+    #[test]
+    fn set_brightness_rejects_out_of_range_values() {
+        let device = new_device(&[0; ADDR_LEN]);
+
+        for value in [0, MAX_BRIGHTNESS + 1] {
+            assert!(!set_brightness(device, &value));
+            assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+
+            assert!(!set_brightness_batch(&device, 1, value, ptr::null_mut()));
+            assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+        }
+
+        // Valid so it only fails once it reaches the (missing) daemon
+        for value in [MIN_BRIGHTNESS, MAX_BRIGHTNESS] {
+            set_brightness(device, &value);
+            assert_ne!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+        }
+
+        free_device(device);
+    }
+
+    #[test]
+    fn set_state_is_validated_before_any_write() {
+        let device = new_device(&[0; ADDR_LEN]);
+        let mut state = DesiredState {
+            has_power: true,
+            power: true,
+            has_brightness: false,
+            brightness: 0,
+            has_rgb: true,
+            rgb: [255, 0, 0],
+            has_color_temp: true,
+            color_temp: MIN_MIREDS,
+            transition_ds: 0,
+        };
+
+        assert!(!set_state(device, &state));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+
+        state.has_color_temp = false;
+        state.has_brightness = true;
+        assert!(!set_state(device, &state));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+
+        assert!(!set_state(device, ptr::null()));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        // Nothing was written so no field failed
+        let mut failed = u8::MAX;
+        assert!(!set_state_ex(device, &state, &mut failed));
+        assert_eq!(failed, 0);
+
+        free_device(device);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn set_state_ex_tells_the_fields_the_daemon_failed() {
+        use std::io::{Read as _, Write as _};
+        use std::os::unix::net::UnixListener;
+
+        use crate::constants::BUFFER_LEN;
+
+        let dir = std::env::temp_dir();
+        let socket_path = dir.join(format!("rustbee-state-{}.sock", std::process::id()));
+        let _ = std::fs::remove_file(&socket_path);
+        let listener = UnixListener::bind(&socket_path).unwrap();
+
+        // A white light failing the color
+        let fake_daemon = thread::spawn(move || {
+            let (mut conn, _) = listener.accept().unwrap();
+            let mut packet = [0; BUFFER_LEN];
+            conn.read_exact(&mut packet).unwrap();
+
+            let mut output = [0; OUTPUT_LEN];
+            output[0] = OutputCode::Failure.into();
+            output[1] = scheduled_state::bits::COLOR;
+            conn.write_all(&output).unwrap();
+        });
+
+        let daemon = DaemonHandle {
+            socket_path: Some(socket_path.to_str().unwrap().to_owned()),
+        };
+        let device = new_device_with_daemon(&daemon, &[0; ADDR_LEN]);
+        let state = DesiredState {
+            has_power: false,
+            power: false,
+            has_brightness: true,
+            brightness: MAX_BRIGHTNESS,
+            has_rgb: true,
+            rgb: [255, 0, 0],
+            has_color_temp: false,
+            color_temp: 0,
+            transition_ds: 0,
+        };
+
+        let mut failed = 0;
+        assert!(!set_state_ex(device, &state, &mut failed));
+        assert_eq!(failed, state_field::COLOR);
+        assert_eq!(rustbee_last_error(), ErrorCode::GattError as i32);
+
+        fake_daemon.join().unwrap();
+        free_device(device);
+        let _ = std::fs::remove_file(&socket_path);
+    }
+
+    #[test]
+    fn schedule_command_is_validated_like_set_state() {
+        let device = new_device(&[0; ADDR_LEN]);
+        let mut state = DesiredState {
+            has_power: true,
+            power: true,
+            has_brightness: true,
+            brightness: u8::MAX,
+            has_rgb: false,
+            rgb: [0; 3],
+            has_color_temp: false,
+            color_temp: 0,
+            transition_ds: 6000,
+        };
+
+        assert_eq!(schedule_command(device, &state, 0), 0);
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+
+        state.brightness = MAX_BRIGHTNESS;
+        state.has_rgb = true;
+        state.has_color_temp = true;
+        assert_eq!(schedule_command(device, &state, 0), 0);
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+
+        assert_eq!(schedule_command(device, ptr::null(), 0), 0);
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        free_device(device);
+    }
+
+    #[test]
+    fn set_startup_state_rejects_color_temperatures() {
+        let device = new_device(&[0; ADDR_LEN]);
+        let state = DesiredState {
+            has_color_temp: true,
+            color_temp: 300,
+            ..Default::default()
+        };
+
+        // Checked before the daemon is reached
+        assert!(!set_startup_state(device, &state));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+
+        free_device(device);
+    }
+
+    #[test]
+    fn set_effect_rejects_unknown_effects() {
+        let device = new_device(&[0; ADDR_LEN]);
+
+        assert!(!set_effect(device, effect::COLOR_LOOP + 1));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+
+        free_device(device);
+    }
+
+    #[test]
+    fn request_connection_params_checks_its_args_before_the_daemon() {
+        let device = new_device(&[0; ADDR_LEN]);
+
+        for (min, max, mtu) in [
+            (5, 30, 0),
+            (15, 5000, 0),
+            (30, 15, 0),
+            (15, 30, 22),
+            (15, 30, 518),
+        ] {
+            assert!(!request_connection_params(device, min, max, mtu));
+            assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+        }
+
+        free_device(device);
+    }
+
+    #[test]
+    fn set_auto_reconnect_checks_the_value_before_the_daemon() {
+        set_auto_reconnect(2);
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+    }
+
+    #[test]
+    fn set_reconnect_policy_checks_the_backoff_before_the_daemon() {
+        for (base_ms, max_ms) in [(0, 1000), (2000, 1000)] {
+            set_reconnect_policy(base_ms, max_ms);
+            assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+        }
+    }
+
+    #[test]
+    fn try_connect_paired_rejects_unknown_bonds() {
+        let device = new_device(&[0; ADDR_LEN]);
+
+        assert!(!try_connect_paired(device, 2));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+
+        free_device(device);
+    }
+
+    #[test]
+    fn get_adapter_info_checks_its_out_pointer() {
+        assert!(!get_adapter_info(ptr::null_mut()));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+    }
+
+    #[test]
+    fn tcp_fns_check_their_args_before_the_daemon() {
+        let addr = CString::new("127.0.0.1:9740").unwrap();
+        let empty = CString::new("").unwrap();
+        let long_token = CString::new(vec![b'a'; TCP_ARG_MAX_LEN + 1]).unwrap();
+
+        assert!(!launch_daemon_tcp(addr.as_ptr(), ptr::null()));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+        assert!(!launch_daemon_tcp(addr.as_ptr(), empty.as_ptr()));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+        assert!(!connect_daemon_tcp(addr.as_ptr(), long_token.as_ptr()));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+
+        // Back to the local daemon
+        assert!(connect_daemon_tcp(ptr::null(), ptr::null()));
+        assert!(REMOTE_DAEMON.lock().unwrap().is_none());
+    }
+
+    #[test]
+    fn gatt_fns_check_their_args_before_the_daemon() {
+        let device = new_device(&[0; ADDR_LEN]);
+        let value = [0; GATT_MAX_LEN + 1];
+
+        assert!(!gatt_write(device, ptr::null(), value.as_ptr(), 1));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        assert!(!gatt_write(device, &[0; 16], value.as_ptr(), value.len()));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+
+        assert!(!gatt_read(
+            device,
+            &[0; 16],
+            ptr::null_mut(),
+            ptr::null_mut()
+        ));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        free_device(device);
+    }
+
+    #[test]
+    fn free_device_waits_for_the_calls_in_progress() {
+        let device = new_device(&[0; ADDR_LEN]);
+        let call = DeviceRef::enter(device).unwrap();
+
+        let device_addr = device as usize;
+        let (freed_tx, freed_rx) = mpsc::channel();
+        let freeing = thread::spawn(move || {
+            free_device(device_addr as *mut Device);
+            freed_tx.send(()).unwrap();
+        });
+
+        while !IN_FLIGHT.lock().unwrap().freeing.contains(&device_addr) {
+            thread::yield_now();
+        }
+        assert!(freed_rx.recv_timeout(Duration::from_millis(50)).is_err());
+
+        // The new calls would wait forever, they fail instead
+        assert_eq!(get_last_command_latency_ms(device), 0);
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+
+        drop(call);
+        freed_rx.recv_timeout(Duration::from_secs(1)).unwrap();
+        freeing.join().unwrap();
+
+        let in_flight = IN_FLIGHT.lock().unwrap();
+        assert!(!in_flight.calls.contains_key(&device_addr));
+        assert!(!in_flight.freeing.contains(&device_addr));
+    }
+
+    #[test]
+    fn free_device_from_a_callback_of_the_device() {
+        extern "C" fn callback(ctx: *mut c_void, _ok: bool) {
+            free_device(ctx.cast());
+        }
+
+        let device = new_device(&[0; ADDR_LEN]);
+
+        // The invalid state calls back right away, from within the call
+        set_power_async(device, 2, Some(callback), device.cast());
+
+        let in_flight = IN_FLIGHT.lock().unwrap();
+        assert!(!in_flight.calls.contains_key(&(device as usize)));
+        assert!(!in_flight.deferred.contains(&(device as usize)));
+        assert!(!ALLOCATIONS.lock().unwrap().contains_key(&(device as usize)));
+    }
+
+    #[test]
+    fn set_power_async_invalid_state_calls_back_right_away() {
+        extern "C" fn callback(ctx: *mut c_void, ok: bool) {
+            // The last error is set on the calling thread
+            assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+            unsafe { *(ctx as *mut Option<bool>) = Some(ok) };
+        }
+
+        let device = new_device(&[0; ADDR_LEN]);
+        let mut result: Option<bool> = None;
+
+        set_power_async(device, 2, Some(callback), ptr::from_mut(&mut result).cast());
+        assert_eq!(result, Some(false));
+
+        free_device(device);
+    }
+
+    #[test]
+    fn set_color_rgb_hex_unpacks_the_color() {
+        assert_eq!(unpack_rgb(0xFF8800), [255, 136, 0]);
+        assert_eq!(unpack_rgb(0xAAFF8800), [255, 136, 0]);
+
+        // Goes through set_color_rgb, which checks the device
+        assert!(!set_color_rgb_hex(ptr::null_mut(), 0xFF8800));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+    }
+
+    #[test]
+    fn set_color_xy_out_of_gamut() {
+        let device = new_device(&[0; ADDR_LEN]);
+
+        for (x, y) in [(-0.1, 0.5), (0.5, 1.1), (f32::NAN, 0.5)] {
+            assert!(!set_color_xy(device, x, y));
+            assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+        }
+
+        free_device(device);
+    }
+
+    #[test]
+    fn set_name_rejects_invalid_names() {
+        let device = new_device(&[0; ADDR_LEN]);
+
+        for name in [&b""[..], &[b'a'; DATA_LEN + 1], b"Hue\0", &[0xff, 0xfe]] {
+            assert!(!set_name(device, name.as_ptr(), name.len()));
+            assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+        }
+
+        free_device(device);
+    }
+
+    #[test]
+    fn name_from_output_replaces_invalid_sequences() {
+        let mut buf = [0; OUTPUT_LEN - 1];
+        buf[..9].copy_from_slice(b"Sa\xfflon\xc3\x28 ");
+        assert_eq!(name_from_output(&buf), "Sa\u{fffd}lon\u{fffd}(");
+
+        // A run is replaced once, garbage at the end is dropped like a cut char
+        buf = [0; OUTPUT_LEN - 1];
+        buf[..9].copy_from_slice(b"Sa\xfe\xfflon\xfe\xff");
+        assert_eq!(name_from_output(&buf), "Sa\u{fffd}lon");
+        assert_eq!(name_from_output(&[0xff; OUTPUT_LEN - 1]), "");
+
+        // The replacements would make it longer than the output
+        let name = name_from_output(&b"a\xff".repeat(OUTPUT_LEN)[..OUTPUT_LEN - 1]);
+        assert!(name.len() <= OUTPUT_LEN - 1);
+        assert!(name.starts_with("a\u{fffd}a\u{fffd}"));
+    }
+
+    #[test]
+    fn name_from_output_keeps_valid_utf8() {
+        let mut buf = [0; OUTPUT_LEN - 1];
+        buf[..6].copy_from_slice("Café ".as_bytes());
+        assert_eq!(name_from_output(&buf), "Café");
+
+        // "Salon é" cut in the middle of the "é"
+        let cut = &"Salon é".as_bytes()[..7];
+        buf = [0; OUTPUT_LEN - 1];
+        buf[..cut.len()].copy_from_slice(cut);
+        assert_eq!(name_from_output(&buf), "Salon");
+
+        assert_eq!(
+            name_from_output(&[b'a'; OUTPUT_LEN - 1]),
+            "a".repeat(OUTPUT_LEN - 1)
+        );
+    }
+
+    #[test]
+    fn set_auto_launch_daemon_rejects_non_booleans() {
+        set_auto_launch_daemon(2);
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+        assert!(!AUTO_LAUNCH.load(Ordering::Relaxed));
+    }
+
+    #[test]
+    fn set_socket_path_rejects_unwritable_dir() {
+        assert!(!set_socket_path(c"/nonexistent/rustbee.sock".as_ptr()));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+    }
+
+    #[test]
+    fn launch_daemon_instance_rejects_a_bad_path() {
+        assert!(launch_daemon_instance(c"/nonexistent/rustbee.sock".as_ptr()).is_null());
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+        assert!(launch_daemon_instance(c"rustbee.sock".as_ptr()).is_null());
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+    }
+
+    #[test]
+    fn data_dir_is_absolute() {
+        assert!(!set_data_dir(ptr::null()));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+        assert!(!set_data_dir(c"".as_ptr()));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+
+        let file = std::env::temp_dir().join(format!("rustbee-data-{}", std::process::id()));
+        std::fs::write(&file, "").unwrap();
+        let path = CString::new(file.to_str().unwrap()).unwrap();
+        assert!(!set_data_dir(path.as_ptr()));
+        assert_eq!(rustbee_last_error(), ErrorCode::InvalidArg as i32);
+        std::fs::remove_file(&file).unwrap();
+
+        // Created later by the daemon
+        assert!(set_data_dir(c"rustbee-data".as_ptr()));
+        let dir = daemon_data_dir();
+        assert_eq!(
+            unsafe { CStr::from_ptr(dir) }.to_str().unwrap(),
+            std::env::current_dir()
+                .unwrap()
+                .join("rustbee-data")
+                .to_str()
+                .unwrap()
+        );
+        free_data_dir(dir);
+
+        utils::reset_data_dir();
+    }
+
+    #[test]
+    fn launch_errors_tell_why() {
+        use crate::constants::exit_code;
+
+        let error = |kind| io::Error::new(kind, "");
+
+        assert_eq!(
+            launch_error_code(&utils::launch_error(Some(exit_code::SOCKET_IN_USE), "")),
+            ErrorCode::SocketInUse
+        );
+        assert_eq!(
+            launch_error_code(&utils::launch_error(Some(exit_code::PERMISSION_DENIED), "")),
+            ErrorCode::PermissionDenied
+        );
+        assert_eq!(
+            launch_error_code(&utils::launch_error(Some(1), "")),
+            ErrorCode::SpawnFailed
+        );
+        assert_eq!(
+            launch_error_code(&utils::spawn_error(error(io::ErrorKind::NotFound))),
+            ErrorCode::SpawnFailed
+        );
+        assert_eq!(
+            launch_error_code(&utils::spawn_error(error(io::ErrorKind::PermissionDenied))),
+            ErrorCode::PermissionDenied
+        );
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn launching_on_a_busy_socket_is_socket_in_use() {
+        use std::os::unix::net::UnixListener;
+
+        // Its own dir so the socket and the launch lock aren't shared with anything on the host
+        let dir = std::env::temp_dir().join(format!("rustbee-busy-{}", std::process::id()));
+        let _ = std::fs::remove_dir_all(&dir);
+        std::fs::create_dir_all(&dir).unwrap();
+        let socket_path = dir.join("rustbee.sock");
+        let _listener = UnixListener::bind(&socket_path).unwrap();
+
+        // Not a daemon since it never answers the ping, so it doesn't count as one already running.
+        // It fails before looking for an adapter or the daemon binary
+        let launched = block_on!(utils::launch_daemon_at(socket_path.to_str().unwrap()));
+        let error = launched.unwrap_err();
+        assert_eq!(launch_error_code(&error), ErrorCode::SocketInUse);
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn batch_with_null_device_sends_nothing() {
+        let device = new_device(&[0; ADDR_LEN]);
+        let devices = [device, ptr::null_mut()];
+        let mut results = [true; 2];
+
+        assert!(!set_power_batch(
+            devices.as_ptr(),
+            devices.len(),
+            1,
+            results.as_mut_ptr()
+        ));
+        assert_eq!(rustbee_last_error(), ErrorCode::NullPointer as i32);
+        // Untouched since nothing was sent
+        assert_eq!(results, [true; 2]);
+
+        free_device(device);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn batch_results_flag_the_unreachable_device() {
+        use std::io::{Read as _, Write as _};
+        use std::os::unix::net::UnixListener;
+
+        use crate::constants::BUFFER_LEN;
+
+        let dir = std::env::temp_dir();
+        let socket_path = dir.join(format!("rustbee-batch-{}.sock", std::process::id()));
+        let _ = std::fs::remove_file(&socket_path);
+        let listener = UnixListener::bind(&socket_path).unwrap();
+
+        // Answers the two reachable devices
+        let fake_daemon = thread::spawn(move || {
+            for _ in 0..2 {
+                let (mut conn, _) = listener.accept().unwrap();
+                let mut packet = [0; BUFFER_LEN];
+                conn.read_exact(&mut packet).unwrap();
+
+                let mut output = [0; OUTPUT_LEN];
+                output[0] = OutputCode::Success.into();
+                conn.write_all(&output).unwrap();
+            }
+        });
+
+        let reachable = DaemonHandle {
+            socket_path: Some(socket_path.to_str().unwrap().to_owned()),
+        };
+        let unreachable = DaemonHandle {
+            socket_path: Some(
+                dir.join("rustbee-nonexistent.sock")
+                    .to_str()
+                    .unwrap()
+                    .to_owned(),
+            ),
+        };
+        let devices = [&reachable, &unreachable, &reachable]
+            .map(|daemon| new_device_with_daemon(daemon, &[0; ADDR_LEN]));
+        let mut results = [false; 3];
+
+        assert!(!set_power_batch(
+            devices.as_ptr(),
+            devices.len(),
+            1,
+            results.as_mut_ptr()
+        ));
+        assert_eq!(results, [true, false, true]);
+        assert_eq!(rustbee_last_error(), ErrorCode::DaemonUnreachable as i32);
+
+        fake_daemon.join().unwrap();
+        for device in devices {
+            free_device(device);
+        }
+        let _ = std::fs::remove_file(&socket_path);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn get_color_rgb_is_within_the_gamut_of_the_light() {
+        use std::io::{Read as _, Write as _};
+        use std::os::unix::net::UnixListener;
+
+        use crate::constants::{capabilities, BUFFER_LEN, FLAGS_LEN};
+
+        let dir = std::env::temp_dir();
+        let socket_path = dir.join(format!("rustbee-gamut-{}.sock", std::process::id()));
+        let _ = std::fs::remove_file(&socket_path);
+        let listener = UnixListener::bind(&socket_path).unwrap();
+
+        // A gamut B light keeping the xy written: the write, the capabilities then the read
+        let fake_daemon = thread::spawn(move || {
+            let mut xy = [0; 4];
+            for _ in 0..3 {
+                let (mut conn, _) = listener.accept().unwrap();
+                let mut packet = [0; BUFFER_LEN];
+                conn.read_exact(&mut packet).unwrap();
+
+                let flags = MaskT::from_le_bytes(
+                    packet[ADDR_LEN..ADDR_LEN + FLAGS_LEN].try_into().unwrap(),
+                );
+                let set = packet[ADDR_LEN + FLAGS_LEN] == SET;
+                let data = &packet[ADDR_LEN + FLAGS_LEN + 1..];
+
+                let mut output = [0; OUTPUT_LEN];
+                output[0] = OutputCode::Success.into();
+                if flags & CAPABILITIES != 0 {
+                    output[1] = capabilities::COLOR;
+                    output[2] = Gamut::B.into();
+                } else if set {
+                    xy.copy_from_slice(&data[..4]);
+                } else {
+                    output[1..5].copy_from_slice(&xy);
+                }
+                conn.write_all(&output).unwrap();
+            }
+        });
+
+        let daemon = DaemonHandle {
+            socket_path: Some(socket_path.to_str().unwrap().to_owned()),
+        };
+        let device = new_device_with_daemon(&daemon, &[0; ADDR_LEN]);
+
+        // The green corner of gamut C, the light shows the green corner of gamut B
+        assert!(set_color_xy(device, 0.17, 0.7));
+        let mut rgb = [0; 3];
+        assert!(get_color_rgb_into(device, &mut rgb));
+
+        let expected = Xy::new(0.409, 0.518).to_rgb_in(Gamut::B, 1.);
+        assert_eq!(
+            rgb,
+            [
+                expected.r.round() as u8,
+                expected.g.round() as u8,
+                expected.b.round() as u8
+            ]
+        );
+
+        fake_daemon.join().unwrap();
+        free_device(device);
+        let _ = std::fs::remove_file(&socket_path);
+    }
+}
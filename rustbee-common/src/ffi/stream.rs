@@ -0,0 +1,172 @@
+use std::io::{self, Read, Write};
+use std::net::{TcpStream, ToSocketAddrs as _};
+use std::sync::Arc;
+use std::time::Duration;
+
+use interprocess::local_socket::{self, traits::Stream as _};
+
+use crate::constants::{OutputCode, TCP_ARG_MAX_LEN};
+
+/// Covers the connection and the token check of a remote daemon
+const TCP_CONNECT_TIMEOUT_SECS: u64 = 5;
+
+/// Connection to the daemon, its local socket or a daemon listening on TCP (see
+/// launch_daemon_tcp). Both take the same packets.
+pub enum Stream {
+    Local(local_socket::Stream),
+    Tcp(TcpStream),
+}
+
+pub enum RecvHalf {
+    Local(local_socket::RecvHalf),
+    Tcp(Arc<TcpStream>),
+}
+
+pub enum SendHalf {
+    Local(local_socket::SendHalf),
+    Tcp(Arc<TcpStream>),
+}
+
+impl Stream {
+    /// Connects to the daemon at addr and sends the token, the error is PermissionDenied if the
+    /// daemon rejected it
+    pub fn connect_tcp(addr: &str, token: &[u8]) -> io::Result<Self> {
+        if token.len() > TCP_ARG_MAX_LEN {
+            return Err(io::Error::new(
+                io::ErrorKind::InvalidInput,
+                "The token is too long",
+            ));
+        }
+
+        let timeout = Duration::from_secs(TCP_CONNECT_TIMEOUT_SECS);
+        let mut last_error = io::Error::new(io::ErrorKind::NotFound, "No address to connect to");
+        let mut stream = None;
+        for socket_addr in addr.to_socket_addrs()? {
+            match TcpStream::connect_timeout(&socket_addr, timeout) {
+                Ok(conn) => {
+                    stream = Some(conn);
+                    break;
+                }
+                Err(error) => last_error = error,
+            }
+        }
+        let Some(mut stream) = stream else {
+            return Err(last_error);
+        };
+
+        stream.set_nodelay(true)?;
+        stream.set_read_timeout(Some(timeout))?;
+        stream.write_all(&[token.len() as _])?;
+        stream.write_all(token)?;
+        stream.flush()?;
+
+        let mut code = [0];
+        stream.read_exact(&mut code)?;
+        if OutputCode::from(code[0]) != OutputCode::Success {
+            return Err(io::Error::new(
+                io::ErrorKind::PermissionDenied,
+                "The daemon rejected the token",
+            ));
+        }
+
+        // The exchanges have their own timeouts, see set_command_timeout
+        stream.set_read_timeout(None)?;
+
+        Ok(Self::Tcp(stream))
+    }
+
+    /// Timeout of each read, None blocks. Unsupported for the named pipes of Windows
+    pub fn set_read_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        match self {
+            #[cfg(unix)]
+            Self::Local(stream) => {
+                use std::os::fd::{AsFd as _, AsRawFd as _, FromRawFd as _};
+                use std::os::unix::net::UnixStream;
+
+                // interprocess has no timeouts so it's set on the Unix socket it wraps, which
+                // still owns the fd
+                let socket = std::mem::ManuallyDrop::new(unsafe {
+                    UnixStream::from_raw_fd(stream.as_fd().as_raw_fd())
+                });
+                socket.set_read_timeout(timeout)
+            }
+            #[cfg(not(unix))]
+            Self::Local(_) => Err(io::Error::new(
+                io::ErrorKind::Unsupported,
+                "Named pipes have no read timeout",
+            )),
+            Self::Tcp(stream) => stream.set_read_timeout(timeout),
+        }
+    }
+
+    pub fn split(self) -> (RecvHalf, SendHalf) {
+        match self {
+            Self::Local(stream) => {
+                let (receiver, sender) = stream.split();
+                (RecvHalf::Local(receiver), SendHalf::Local(sender))
+            }
+            Self::Tcp(stream) => {
+                let stream = Arc::new(stream);
+                (RecvHalf::Tcp(Arc::clone(&stream)), SendHalf::Tcp(stream))
+            }
+        }
+    }
+}
+
+impl From<local_socket::Stream> for Stream {
+    fn from(stream: local_socket::Stream) -> Self {
+        Self::Local(stream)
+    }
+}
+
+impl Read for Stream {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        match self {
+            Self::Local(stream) => stream.read(buf),
+            Self::Tcp(stream) => stream.read(buf),
+        }
+    }
+}
+
+impl Write for Stream {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        match self {
+            Self::Local(stream) => stream.write(buf),
+            Self::Tcp(stream) => stream.write(buf),
+        }
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        match self {
+            Self::Local(stream) => stream.flush(),
+            Self::Tcp(stream) => stream.flush(),
+        }
+    }
+}
+
+// &TcpStream is Read and Write so both halves can share it
+
+impl Read for RecvHalf {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        match self {
+            Self::Local(receiver) => receiver.read(buf),
+            Self::Tcp(stream) => (&**stream).read(buf),
+        }
+    }
+}
+
+impl Write for SendHalf {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        match self {
+            Self::Local(sender) => sender.write(buf),
+            Self::Tcp(stream) => (&**stream).write(buf),
+        }
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        match self {
+            Self::Local(sender) => sender.flush(),
+            Self::Tcp(stream) => (&**stream).flush(),
+        }
+    }
+}
@@ -1,7 +1,10 @@
+pub mod bonds;
 pub mod colors;
 pub mod constants;
 pub mod device;
 pub mod logger;
+pub mod quirks;
+pub mod scenes;
 pub mod storage;
 pub mod utils;
 
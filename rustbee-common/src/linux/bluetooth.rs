@@ -5,11 +5,13 @@ use std::time::Duration;
 use btleplug::api::{Central, CentralEvent, Manager as _, Peripheral as _};
 use btleplug::platform::Manager;
 use futures::{future, stream, StreamExt};
+use tokio::process::Command as AsyncCommand;
 use tokio::time;
 
 use crate::device::*;
 
 use crate::constants::ADDR_LEN;
+use crate::utils::parse_addr;
 
 const NO_ADAPTER_FOUND: &str = "Failed to get Bluetooth adapter. (maybe your Bluetooth is OFF ?)";
 
@@ -86,6 +88,27 @@ pub async fn search_devices_by_name(
     })))
 }
 
+/// The first adapter, the one the other fns use. None if there is none or BlueZ cannot be
+/// reached
+pub async fn get_adapter_info() -> Option<AdapterInfo> {
+    let manager = Manager::new().await.ok()?;
+    let adapter = manager.adapters().await.ok()?.into_iter().next()?;
+    let name = adapter.adapter_info().await.ok()?;
+
+    // btleplug doesn't expose the address, `bluetoothctl show` starts with
+    // "Controller E8:D4:EA:C4:62:00 (public)"
+    let address = match AsyncCommand::new("bluetoothctl").arg("show").output().await {
+        Ok(output) => String::from_utf8_lossy(&output.stdout)
+            .lines()
+            .find_map(|line| line.trim().strip_prefix("Controller "))
+            .and_then(|controller| controller.split_whitespace().next())
+            .and_then(parse_addr),
+        Err(_) => None,
+    };
+
+    Some(AdapterInfo { name, address })
+}
+
 pub async fn get_device(address: [u8; ADDR_LEN]) -> btleplug::Result<Option<HueDevice<Server>>> {
     let manager = Manager::new().await?;
     let adapters = manager.adapters().await?;
@@ -1,12 +1,18 @@
 use std::fs;
+use std::future::Future;
 use std::io;
 use std::process::{Command, Stdio};
-use std::time::Duration;
+use std::thread;
+use std::time::{Duration, Instant};
 
 use tokio::process::Command as AsyncCommand;
 use tokio::time;
 
-use crate::constants::SOCKET_PATH;
+use crate::constants::{DATA_DIR_ENV, SHUTDOWN_TIMEOUT_SECS, SIMULATE_ENV, SOCKET_PATH_ENV};
+use crate::utils::{
+    daemon_answers_ping, data_dir, launch_error, lock_launch, no_adapter_error, socket_path,
+    spawn_error,
+};
 
 fn get_daemon_process_id() -> io::Result<Option<String>> {
     let cmd = Command::new("ps").arg("-e").output()?;
@@ -29,6 +35,11 @@ fn get_daemon_process_id() -> io::Result<Option<String>> {
     Ok(Some(process[..offset].to_owned()))
 }
 
+/// Told by the socket path, the process of a daemon listening elsewhere doesn't count
+fn is_running(socket_path: &str) -> io::Result<bool> {
+    Ok(daemon_answers_ping(socket_path))
+}
+
 // get running process rustbee-daemon
 // if running process found:
 // - return
@@ -39,46 +50,99 @@ fn get_daemon_process_id() -> io::Result<Option<String>> {
 // get output status if process exited
 // if status is not 0:
 // - return err and exit 1
-pub async fn launch_daemon() -> io::Result<()> {
-    let pid_found = get_daemon_process_id()?;
+/// Returns false if the daemon was already running
+pub async fn launch_daemon() -> io::Result<bool> {
+    launch_daemon_at(&socket_path()).await
+}
+
+/// Same as launch_daemon for the daemon instance listening on socket_path, concurrent launches
+/// from several processes spawn a single daemon and the other ones return false
+pub async fn launch_daemon_at(socket_path: &str) -> io::Result<bool> {
+    let has_adapter = async { crate::bluetooth::get_adapter_info().await.is_some() };
+    spawn_daemon(socket_path, false, has_adapter).await
+}
+
+/// Same as launch_daemon_at for a daemon driving in memory virtual devices (see SIMULATE_ENV), it
+/// doesn't need a Bluetooth adapter. A daemon already running on socket_path is kept even if it
+/// isn't simulated
+pub async fn launch_simulated_daemon_at(socket_path: &str) -> io::Result<bool> {
+    spawn_daemon(socket_path, true, async { true }).await
+}
+
+/// A daemon that isn't simulated needs has_adapter, else it's a NoAdapter error (see
+/// utils::is_no_adapter). It's only checked when no daemon runs on socket_path, a running one is
+/// found even without an adapter
+pub(crate) async fn spawn_daemon(
+    socket_path: &str,
+    simulated: bool,
+    has_adapter: impl Future<Output = bool>,
+) -> io::Result<bool> {
+    // Without the lock when it's up, its directory may not be writable by this process
+    if is_running(socket_path)? {
+        return Ok(false);
+    }
+
+    // Until the daemon is up or exited, see lock_launch
+    let _lock = lock_launch(socket_path).await?;
+
+    // Another process may have launched it meanwhile
+    if is_running(socket_path)? {
+        return Ok(false);
+    }
+
+    // The daemon would exit with SOCKET_IN_USE, e.g. the socket of a daemon that crashed
+    if fs::exists(socket_path)? {
+        return Err(io::Error::new(
+            io::ErrorKind::AddrInUse,
+            format!(
+                "[ERROR] Socket {socket_path} is already in use but rustbee-daemon isn't running"
+            ),
+        ));
+    }
 
-    if pid_found.is_some() {
-        return Ok(());
+    if !simulated && !has_adapter.await {
+        return Err(no_adapter_error());
     }
 
-    let daemon = AsyncCommand::new("rustbee-daemon")
+    let mut command = AsyncCommand::new("rustbee-daemon");
+    command.env(SOCKET_PATH_ENV, socket_path);
+    command.env(DATA_DIR_ENV, data_dir());
+    if simulated {
+        command.env(SIMULATE_ENV, "1");
+    }
+
+    let daemon = command
         .stderr(Stdio::piped())
-        .spawn()?;
+        .spawn()
+        .map_err(spawn_error)?;
 
     let out = match time::timeout(Duration::from_secs(1), daemon.wait_with_output()).await {
         Ok(res) => res?,
-        Err(_) => return Ok(()),
+        Err(_) => return Ok(true),
     };
 
     if !out.status.success() {
         let stderr = String::from_utf8(out.stderr).unwrap();
-        let stderr = stderr.trim();
 
-        return Err(io::Error::new(
-            io::ErrorKind::Other,
-            format!("[ERROR] Failed to launch rustbee-daemon:\n{stderr}"),
-        ));
+        return Err(launch_error(out.status.code(), stderr.trim()));
     }
 
-    Ok(())
+    Ok(true)
 }
 
 // get running process rustbee-daemon
 // if the running process is not found:
 // - rm SOCKET_FILE
+// - return false
 //
 // if -f or --force:
 // - send SIGKILL to the the process
 // - rm SOCKET_FILE
-// - return
+// - return true
 //
 // send SIGINT to the running process for a graceful shutdown
-pub fn shutdown_daemon(force: bool) -> io::Result<()> {
+// wait for it to exit, else return a TimedOut err
+pub fn shutdown_daemon(force: bool) -> io::Result<bool> {
     let pid_found = get_daemon_process_id()?;
     if let Some(pid) = pid_found {
         if force {
@@ -87,20 +151,39 @@ pub fn shutdown_daemon(force: bool) -> io::Result<()> {
                 .output()
                 .unwrap();
 
-            if fs::exists(SOCKET_PATH)? {
-                fs::remove_file(SOCKET_PATH)?;
+            if fs::exists(socket_path())? {
+                fs::remove_file(socket_path())?;
             }
 
-            return Ok(());
+            return Ok(true);
         }
 
         Command::new("kill")
             .args(["-s", "INT", &pid])
             .output()
             .unwrap();
-    } else if fs::exists(SOCKET_PATH)? {
-        fs::remove_file(SOCKET_PATH)?;
+
+        // The daemon disconnects the devices and removes the socket itself
+        let deadline = Instant::now() + Duration::from_secs(SHUTDOWN_TIMEOUT_SECS);
+        while get_daemon_process_id()?.as_ref() == Some(&pid) {
+            if Instant::now() >= deadline {
+                return Err(io::Error::new(
+                    io::ErrorKind::TimedOut,
+                    format!(
+                        "[ERROR] rustbee-daemon didn't shutdown within {SHUTDOWN_TIMEOUT_SECS}s"
+                    ),
+                ));
+            }
+
+            thread::sleep(Duration::from_millis(100));
+        }
+    } else {
+        if fs::exists(socket_path())? {
+            fs::remove_file(socket_path())?;
+        }
+
+        return Ok(false);
     }
 
-    Ok(())
+    Ok(true)
 }
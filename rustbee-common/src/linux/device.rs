@@ -1,18 +1,30 @@
 use std::ops::Deref;
+use std::sync::atomic::Ordering;
 use std::time::Duration;
 
-use btleplug::api::WriteType;
+use btleplug::api::{CharPropFlags, WriteType};
+use futures::StreamExt as _;
 use log::*;
+use tokio::process::Command as AsyncCommand;
+use tokio::sync::mpsc;
 use tokio::time::sleep;
 use uuid::Uuid;
 
 use crate::constants::*;
 use crate::device::*;
+use crate::utils::format_addr;
 use crate::BluetoothPeripheralImpl as _;
 use crate::InnerDevice;
 
 const ATTEMPTS: u8 = 3;
 
+/// Error of a write dropped by the write rate, see set_write_rate
+fn dropped_write(uuid: &Uuid) -> btleplug::Error {
+    btleplug::Error::Other(Box::new(Error(format!(
+        "Write to {uuid} dropped, the write rate is exceeded"
+    ))))
+}
+
 impl HueDevice<Server>
 where
     HueDevice<Server>: Default + Deref<Target = InnerDevice> + std::fmt::Debug,
@@ -39,15 +51,94 @@ where
     ) -> btleplug::Result<bool> {
         if let Some(service) = self.services().iter().find(|&s| &s.uuid == service) {
             if let Some(charac) = service.characteristics.iter().find(|&c| &c.uuid == charac) {
-                self.write(charac, bytes, WriteType::WithoutResponse)
-                    .await?;
-                return Ok(true);
+                let write_type = if self.confirmed_writes == Some(true) {
+                    WriteType::WithResponse
+                } else {
+                    WriteType::WithoutResponse
+                };
+
+                let mut retries = self.write_retries;
+                loop {
+                    if !throttle_write(self.addr).await {
+                        return Err(dropped_write(&charac.uuid));
+                    }
+
+                    match self.write(charac, bytes, write_type).await {
+                        Ok(()) => return Ok(true),
+                        Err(error) if retries > 0 => {
+                            warn!(
+                                "Write to {} of {:?} failed, retrying: {error}",
+                                charac.uuid, self.addr
+                            );
+                            RETRIED_WRITES.fetch_add(1, Ordering::Relaxed);
+                            retries -= 1;
+                        }
+                        Err(error) => return Err(error),
+                    }
+                }
             }
         }
 
         Ok(false)
     }
 
+    /// Raw access to a characteristic of any service, None if the device doesn't have it
+    pub async fn read_raw_char(&self, uuid: [u8; 16]) -> btleplug::Result<Option<Vec<u8>>> {
+        let uuid = Uuid::from_bytes(uuid);
+
+        match self.characteristics().iter().find(|c| c.uuid == uuid) {
+            Some(charac) => Ok(Some(self.read(charac).await?)),
+            None => Ok(None),
+        }
+    }
+
+    /// Raw access to a characteristic of any service, false if the device doesn't have it. The
+    /// write is acknowledged when the characteristic supports it
+    pub async fn write_raw_char(&self, uuid: [u8; 16], bytes: &[u8]) -> btleplug::Result<bool> {
+        let uuid = Uuid::from_bytes(uuid);
+
+        let Some(charac) = self.characteristics().into_iter().find(|c| c.uuid == uuid) else {
+            return Ok(false);
+        };
+
+        let write_type = if charac.properties.contains(CharPropFlags::WRITE) {
+            WriteType::WithResponse
+        } else {
+            WriteType::WithoutResponse
+        };
+        if !throttle_write(self.addr).await {
+            return Err(dropped_write(&uuid));
+        }
+        self.write(&charac, bytes, write_type).await?;
+
+        Ok(true)
+    }
+
+    /// Whether the device has the light characteristic with a value of len bytes, for the UUIDs
+    /// guessed from the numbering of the others: a firmware that uses one for something else
+    /// isn't written to. Cached by device once read
+    pub async fn probe_char(&self, charac: &Uuid, len: usize) -> btleplug::Result<bool> {
+        if let Some(found) = probed_char(self.addr, charac) {
+            return Ok(found);
+        }
+
+        let found = self
+            .read_gatt_char(&LIGHT_SERVICES_UUID, charac)
+            .await?
+            .is_some_and(|bytes| bytes.len() == len);
+        set_probed_char(self.addr, *charac, found);
+
+        Ok(found)
+    }
+
+    /// The services are discovered on connect, it's false before
+    pub fn has_gatt_char(&self, service: &Uuid, charac: &Uuid) -> bool {
+        self.services()
+            .iter()
+            .find(|&s| &s.uuid == service)
+            .is_some_and(|s| s.characteristics.iter().any(|c| &c.uuid == charac))
+    }
+
     pub async fn try_connect(&self) -> btleplug::Result<()> {
         let mut retries = ATTEMPTS;
         loop {
@@ -107,6 +198,63 @@ where
         (*self).is_connected().await
     }
 
+    /// btleplug has no pairing API so it goes through bluetoothctl, BlueZ keeps the bond and
+    /// the connections after it don't pair again
+    pub async fn pair(&self) -> btleplug::Result<()> {
+        let output = AsyncCommand::new("bluetoothctl")
+            .args(["pair", &format_addr(&self.addr)])
+            .output()
+            .await
+            .map_err(|error| btleplug::Error::Other(Box::new(error)))?;
+
+        // bluetoothctl exits successfully even if the pairing failed
+        if !self.is_paired().await? {
+            return Err(btleplug::Error::Other(Box::new(Error(format!(
+                "Pairing failed: {}",
+                String::from_utf8_lossy(&output.stdout).trim()
+            )))));
+        }
+
+        Ok(())
+    }
+
+    pub async fn is_paired(&self) -> btleplug::Result<bool> {
+        let output = AsyncCommand::new("bluetoothctl")
+            .args(["info", &format_addr(&self.addr)])
+            .output()
+            .await
+            .map_err(|error| btleplug::Error::Other(Box::new(error)))?;
+
+        Ok(String::from_utf8_lossy(&output.stdout)
+            .lines()
+            .any(|line| line.trim() == "Paired: yes"))
+    }
+
+    /// Last signal strength in dBm measured by the adapter (e.g. from advertisements), it doesn't
+    /// connect the device
+    pub async fn get_rssi(&self) -> btleplug::Result<Option<i16>> {
+        Ok(self
+            .properties()
+            .await?
+            .and_then(|properties| properties.rssi))
+    }
+
+    /// Manufacturer specific data of the last advertisement, the company id (u16 little endian)
+    /// followed by the data. Empty if it had none, the lowest company id is kept if it had more
+    /// than one.
+    pub async fn get_manufacturer_data(&self) -> btleplug::Result<Vec<u8>> {
+        let Some(properties) = self.properties().await? else {
+            return Ok(Vec::new());
+        };
+
+        Ok(properties
+            .manufacturer_data
+            .into_iter()
+            .min_by_key(|(company_id, _)| *company_id)
+            .map(|(company_id, data)| [company_id.to_le_bytes().to_vec(), data].concat())
+            .unwrap_or_default())
+    }
+
     pub async fn get_power(&self) -> btleplug::Result<bool> {
         let read = self
             .read_gatt_char(&LIGHT_SERVICES_UUID, &POWER_UUID)
@@ -147,6 +295,33 @@ where
         Ok(())
     }
 
+    /// Blinks the light so it can be found physically, its power and brightness are restored
+    /// even if blinking failed
+    pub async fn identify(&self) -> btleplug::Result<()> {
+        let power = self.get_power().await?;
+        let brightness = self.get_brightness().await? as u8;
+        let interval = Duration::from_millis(IDENTIFY_INTERVAL_MS);
+
+        let blink = async {
+            self.set_power(true as _).await?;
+
+            for _ in 0..IDENTIFY_BLINKS {
+                self.set_brightness(MAX_BRIGHTNESS).await?;
+                sleep(interval).await;
+                self.set_brightness(MIN_BRIGHTNESS).await?;
+                sleep(interval).await;
+            }
+
+            Ok::<_, btleplug::Error>(())
+        }
+        .await;
+
+        self.set_brightness(brightness).await?;
+        self.set_power(power as _).await?;
+
+        blink
+    }
+
     pub async fn get_color(&self) -> btleplug::Result<[u8; 4]> {
         let mut buf = [0u8; 4];
         if let Some(bytes) = self
@@ -171,11 +346,311 @@ where
         Ok(())
     }
 
+    pub async fn get_temperature(&self) -> btleplug::Result<u16> {
+        let mut buf = [0u8; 2];
+        if let Some(bytes) = self
+            .read_gatt_char(&LIGHT_SERVICES_UUID, &TEMPERATURE_UUID)
+            .await?
+        {
+            let len = buf.len();
+            buf.copy_from_slice(&bytes[..len]);
+
+            Ok(u16::from_le_bytes(buf))
+        } else {
+            Err(btleplug::Error::Other(Box::new(Error(
+                format!("[ERROR] Service or Characteristic \"{TEMPERATURE_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr)
+            ))))
+        }
+    }
+
+    pub async fn set_temperature(&self, mireds: u16) -> btleplug::Result<()> {
+        let written = self
+            .write_gatt_char(
+                &LIGHT_SERVICES_UUID,
+                &TEMPERATURE_UUID,
+                &mireds.to_le_bytes(),
+            )
+            .await?;
+
+        // White only or color only lights don't have this characteristic
+        if !written {
+            return Err(btleplug::Error::Other(Box::new(Error(
+                format!("[ERROR] Service or Characteristic \"{TEMPERATURE_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr)
+            ))));
+        }
+
+        Ok(())
+    }
+
+    /// [warm, cool], only the tunable white variants with separate channels have it
+    pub async fn get_white_mix(&self) -> btleplug::Result<[u8; 2]> {
+        let mut buf = [0u8; WHITE_MIX_LEN];
+        let read = if self.probe_char(&WHITE_MIX_UUID, WHITE_MIX_LEN).await? {
+            self.read_gatt_char(&LIGHT_SERVICES_UUID, &WHITE_MIX_UUID)
+                .await?
+        } else {
+            None
+        };
+
+        if let Some(bytes) = read {
+            let len = buf.len().min(bytes.len());
+            buf[..len].copy_from_slice(&bytes[..len]);
+
+            Ok(buf)
+        } else {
+            Err(btleplug::Error::Other(Box::new(Error(
+                format!("[ERROR] Service or Characteristic \"{WHITE_MIX_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr)
+            ))))
+        }
+    }
+
+    pub async fn set_white_mix(&self, mix: [u8; 2]) -> btleplug::Result<()> {
+        let written = self.probe_char(&WHITE_MIX_UUID, WHITE_MIX_LEN).await?
+            && self
+                .write_gatt_char(&LIGHT_SERVICES_UUID, &WHITE_MIX_UUID, &mix)
+                .await?;
+
+        // Most lights only have TEMPERATURE_UUID
+        if !written {
+            return Err(btleplug::Error::Other(Box::new(Error(
+                format!("[ERROR] Service or Characteristic \"{WHITE_MIX_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr)
+            ))));
+        }
+
+        Ok(())
+    }
+
+    /// None if the light doesn't tell its range or if it's invalid
+    pub async fn get_brightness_range(&self) -> btleplug::Result<Option<(u8, u8)>> {
+        let read = self
+            .read_gatt_char(&LIGHT_SERVICES_UUID, &BRIGHTNESS_RANGE_UUID)
+            .await?;
+
+        Ok(read.and_then(|bytes| match bytes[..] {
+            [min, max, ..] if MIN_BRIGHTNESS <= min && min <= max && max <= MAX_BRIGHTNESS => {
+                Some((min, max))
+            }
+            _ => None,
+        }))
+    }
+
+    /// See `constants::capabilities`
+    pub async fn get_capabilities(&self) -> btleplug::Result<u8> {
+        let mut caps = 0;
+        for (charac, cap) in [
+            (COLOR_UUID, capabilities::COLOR),
+            (TEMPERATURE_UUID, capabilities::COLOR_TEMP),
+            (BRIGHTNESS_UUID, capabilities::DIMMING),
+        ] {
+            if self.has_gatt_char(&LIGHT_SERVICES_UUID, &charac) {
+                caps |= cap;
+            }
+        }
+        if self.probe_char(&WHITE_MIX_UUID, WHITE_MIX_LEN).await? {
+            caps |= capabilities::WHITE_MIX;
+        }
+
+        Ok(caps)
+    }
+
+    pub async fn get_power_on(&self) -> btleplug::Result<[u8; POWER_ON_LEN]> {
+        let mut buf = [0u8; POWER_ON_LEN];
+        if let Some(bytes) = self
+            .read_gatt_char(&LIGHT_SERVICES_UUID, &POWER_ON_UUID)
+            .await?
+        {
+            let len = buf.len().min(bytes.len());
+            buf[..len].copy_from_slice(&bytes[..len]);
+
+            Ok(buf)
+        } else {
+            Err(btleplug::Error::Other(Box::new(Error(
+                format!("[ERROR] Service or Characteristic \"{POWER_ON_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr)
+            ))))
+        }
+    }
+
+    pub async fn set_power_on(&self, buf: [u8; POWER_ON_LEN]) -> btleplug::Result<()> {
+        let written = self
+            .write_gatt_char(&LIGHT_SERVICES_UUID, &POWER_ON_UUID, &buf)
+            .await?;
+
+        // Older firmwares don't have this characteristic
+        if !written {
+            return Err(btleplug::Error::Other(Box::new(Error(
+                format!("[ERROR] Service or Characteristic \"{POWER_ON_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr)
+            ))));
+        }
+
+        Ok(())
+    }
+
+    /// See `constants::effect`
+    pub async fn get_effect(&self) -> btleplug::Result<u8> {
+        let read = if self.probe_char(&EFFECT_UUID, EFFECT_LEN).await? {
+            self.read_gatt_char(&LIGHT_SERVICES_UUID, &EFFECT_UUID)
+                .await?
+        } else {
+            None
+        };
+
+        if let Some(bytes) = read {
+            Ok(bytes.first().copied().unwrap_or(effect::NONE))
+        } else {
+            Err(btleplug::Error::Other(Box::new(Error(
+                format!("[ERROR] Service or Characteristic \"{EFFECT_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr)
+            ))))
+        }
+    }
+
+    /// BlueZ negotiates the connection parameters and the MTU itself, btleplug has no way to
+    /// request them so it's always Ok(false)
+    pub async fn request_connection_params(
+        &self,
+        _min_interval_ms: u16,
+        _max_interval_ms: u16,
+        _mtu: u16,
+    ) -> btleplug::Result<bool> {
+        Ok(false)
+    }
+
+    /// Firmware revision of the device information service, e.g. "1.104.2"
+    pub async fn get_firmware_version(&self) -> btleplug::Result<String> {
+        if let Some(bytes) = self
+            .read_gatt_char(&MISC_SERVICES_UUID, &FIRMWARE_UUID)
+            .await?
+        {
+            Ok(String::from_utf8_lossy(&bytes)
+                .trim_end_matches('\0')
+                .to_owned())
+        } else {
+            Err(btleplug::Error::Other(Box::new(Error(
+                format!("[ERROR] Service or Characteristic \"{FIRMWARE_UUID}\" for \"{MISC_SERVICES_UUID}\" not found for device {:?}", self.addr)
+            ))))
+        }
+    }
+
+    pub async fn set_effect(&self, effect: u8) -> btleplug::Result<()> {
+        let written = self.probe_char(&EFFECT_UUID, EFFECT_LEN).await?
+            && self
+                .write_gatt_char(&LIGHT_SERVICES_UUID, &EFFECT_UUID, &[effect])
+                .await?;
+
+        // Lights without effects don't have this characteristic
+        if !written {
+            return Err(btleplug::Error::Other(Box::new(Error(
+                format!("[ERROR] Service or Characteristic \"{EFFECT_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr)
+            ))));
+        }
+
+        Ok(())
+    }
+
+    /// Subscribes to the notifications of the state characteristics, a message is received on
+    /// every change. It lasts as long as the connection, the receiver can be dropped anytime.
+    ///
+    /// The characteristics stay subscribed since other clients may be subscribed to them too
+    pub async fn state_changes(&self) -> btleplug::Result<mpsc::UnboundedReceiver<()>> {
+        let uuids = [POWER_UUID, BRIGHTNESS_UUID, TEMPERATURE_UUID, COLOR_UUID];
+
+        for charac in self
+            .characteristics()
+            .iter()
+            .filter(|c| uuids.contains(&c.uuid) && c.properties.contains(CharPropFlags::NOTIFY))
+        {
+            self.subscribe(charac).await?;
+        }
+
+        let mut notifications = self.notifications().await?;
+        let (tx, rx) = mpsc::unbounded_channel();
+
+        tokio::spawn(async move {
+            while let Some(notification) = notifications.next().await {
+                if uuids.contains(&notification.uuid) && tx.send(()).is_err() {
+                    break;
+                }
+            }
+        });
+
+        Ok(rx)
+    }
+
+    /// The `constants::features` its characteristics tell, the capabilities included. See quirks
+    /// for the others
+    pub async fn get_features(&self) -> btleplug::Result<u32> {
+        let mut found = self.get_capabilities().await? as u32;
+        for (charac, feature) in [
+            (CONTROL_UUID, features::COMBINED_WRITE),
+            (POWER_ON_UUID, features::STARTUP_STATE),
+        ] {
+            if self.has_gatt_char(&LIGHT_SERVICES_UUID, &charac) {
+                found |= feature;
+            }
+        }
+        if self.probe_char(&EFFECT_UUID, EFFECT_LEN).await? {
+            found |= features::EFFECTS;
+        }
+
+        Ok(found)
+    }
+
+    /// Whether the device has the combined control characteristic of write_control
+    pub async fn has_control(&self) -> btleplug::Result<bool> {
+        Ok(self.has_gatt_char(&LIGHT_SERVICES_UUID, &CONTROL_UUID))
+    }
+
+    /// Writes a control characteristic payload, see `utils::control_payload`
+    pub async fn write_control(&self, payload: &[u8]) -> btleplug::Result<()> {
+        let written = self
+            .write_gatt_char(&LIGHT_SERVICES_UUID, &CONTROL_UUID, payload)
+            .await?;
+
+        if !written {
+            return Err(btleplug::Error::Other(Box::new(Error(
+                format!("[ERROR] Service or Characteristic \"{CONTROL_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr)
+            ))));
+        }
+
+        Ok(())
+    }
+
+    /// get_name_bytes with the invalid UTF-8 sequences replaced
     pub async fn get_name(&self) -> btleplug::Result<Option<String>> {
+        Ok(self
+            .get_name_bytes()
+            .await?
+            .map(|bytes| String::from_utf8_lossy(&bytes).into_owned()))
+    }
+
+    /// Reads the name characteristic when connected so a renamed device is up to date, the
+    /// advertised name (that may be cached) is used otherwise. The bytes are the ones of the
+    /// device, a bulb may return anything
+    pub async fn get_name_bytes(&self) -> btleplug::Result<Option<Vec<u8>>> {
+        if let Some(bytes) = self
+            .read_gatt_char(&CONFIG_SERVICES_UUID, &NAME_UUID)
+            .await?
+        {
+            return Ok(Some(bytes));
+        }
+
         Ok(self
             .properties()
             .await?
-            .map(|properties| properties.local_name)
-            .unwrap_or(None))
+            .and_then(|properties| properties.local_name)
+            .map(String::into_bytes))
+    }
+
+    pub async fn set_name(&self, name: &str) -> btleplug::Result<()> {
+        let written = self
+            .write_gatt_char(&CONFIG_SERVICES_UUID, &NAME_UUID, name.as_bytes())
+            .await?;
+
+        if !written {
+            return Err(btleplug::Error::Other(Box::new(Error(
+                format!("[ERROR] Service or Characteristic \"{NAME_UUID}\" for \"{CONFIG_SERVICES_UUID}\" not found for device {:?}", self.addr)
+            ))));
+        }
+
+        Ok(())
     }
 }
@@ -4,17 +4,22 @@ use std::io::{Read, SeekFrom, Write};
 use tokio::fs::File as AsyncFile;
 use tokio::io::{AsyncBufReadExt as _, AsyncSeekExt as _, BufReader as AsyncBufReader};
 
-use log::{Level, Log, Metadata, Record};
+use log::{Log, Metadata};
 
 use crate::constants::{LOG_LEVEL, LOG_PATH};
 
-pub use log::{debug, error, info, trace, warn};
+pub use log::{debug, error, info, trace, warn, Level, Record};
 
 const MAX_TAIL_LINES: usize = 50;
 
 pub struct Logger {
     name: &'static str,
     use_stdout_stderr: bool,
+    /// Called with the level and the message of every enabled record once it's written
+    forward: Option<fn(Level, &str)>,
+    /// Label written before the message of a record if it returns one, e.g. of the device the
+    /// record is about
+    context: Option<fn() -> Option<String>>,
 }
 
 impl Logger {
@@ -22,6 +27,22 @@ impl Logger {
         Self {
             name,
             use_stdout_stderr,
+            forward: None,
+            context: None,
+        }
+    }
+
+    pub const fn forwarding_to(self, forward: fn(Level, &str)) -> Self {
+        Self {
+            forward: Some(forward),
+            ..self
+        }
+    }
+
+    pub const fn with_context(self, context: fn() -> Option<String>) -> Self {
+        Self {
+            context: Some(context),
+            ..self
         }
     }
 
@@ -137,7 +158,11 @@ impl Log for Logger {
                 )
             });
 
-        let content = format!("{}\n", record.args());
+        let message = match self.context.and_then(|context| context()) {
+            Some(label) => format!("[{label}] {}", record.args()),
+            None => record.args().to_string(),
+        };
+        let content = format!("{message}\n");
         let log_content = format!(
             "[{}]<{}> {}: {}",
             self.name,
@@ -156,6 +181,10 @@ impl Log for Logger {
         file.write_all(log_content.as_bytes())
             .expect("Unexpected error: Failed to write to log file");
         file.flush().unwrap();
+
+        if let Some(forward) = self.forward {
+            forward(record.level(), &message);
+        }
     }
 
     fn flush(&self) {}
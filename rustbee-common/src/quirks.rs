@@ -0,0 +1,76 @@
+//! Features of the lights that their characteristics don't tell, by model and firmware version.
+//! A new quirk is an entry of QUIRKS, the daemon applies them to every FEATURES read
+
+use crate::constants::features;
+
+/// Applies to the models starting with `model` ("" matches every model) whose firmware version is
+/// below `below` (None matches every version, an unknown version only matches None)
+#[derive(Debug, Clone, Copy)]
+pub struct Quirk {
+    pub model: &'static str,
+    pub below: Option<[u16; 3]>,
+    /// The `constants::features` set, then the ones cleared
+    pub set: u32,
+    pub clear: u32,
+}
+
+pub const QUIRKS: &[Quirk] = &[
+    // The Bluetooth Hue lights refuse the writes of a central they aren't bonded with, by family of
+    // model id: color, GU10 color, lightstrip, gradient, white ambiance, GU10 white ambiance, white
+    bonded("LCA"),
+    bonded("LCG"),
+    bonded("LCL"),
+    bonded("LCX"),
+    bonded("LTA"),
+    bonded("LTG"),
+    bonded("LWA"),
+];
+
+const fn bonded(model: &'static str) -> Quirk {
+    Quirk {
+        model,
+        below: None,
+        set: features::NEEDS_BONDING,
+        clear: 0,
+    }
+}
+
+/// The features read from the characteristics with the matching quirks applied in order
+pub fn apply(quirks: &[Quirk], model: &str, firmware: &str, detected: u32) -> u32 {
+    let model = model.trim_end_matches('\0');
+    let version = parse_version(firmware);
+
+    quirks
+        .iter()
+        .filter(|quirk| model.starts_with(quirk.model))
+        .filter(|quirk| match (quirk.below, version) {
+            (None, _) => true,
+            (Some(below), Some(version)) => version < below,
+            (Some(_), None) => false,
+        })
+        .fold(detected, |features, quirk| {
+            (features | quirk.set) & !quirk.clear
+        })
+}
+
+/// The major, minor and patch numbers of a version like "1.104.2", the missing ones are 0. None
+/// if it doesn't start with a number
+pub fn parse_version(version: &str) -> Option<[u16; 3]> {
+    let mut numbers = [0; 3];
+    for (i, part) in version.trim().split('.').take(numbers.len()).enumerate() {
+        // Stops at a suffix like "1.104.2-beta"
+        let len = part
+            .find(|c: char| !c.is_ascii_digit())
+            .unwrap_or(part.len());
+        match part[..len].parse() {
+            Ok(number) => numbers[i] = number,
+            Err(_) if i > 0 => break,
+            Err(_) => return None,
+        }
+        if len < part.len() {
+            break;
+        }
+    }
+
+    Some(numbers)
+}
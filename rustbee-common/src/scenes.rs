@@ -0,0 +1,86 @@
+use std::collections::BTreeMap;
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+
+use log::*;
+
+use crate::constants::ADDR_LEN;
+
+/// State of a device in a scene, what capture_state of the FFI captures
+#[derive(Clone, Debug, PartialEq, serde::Serialize, serde::Deserialize)]
+pub struct SceneDevice {
+    pub addr: [u8; ADDR_LEN],
+    pub power: u8,
+    /// Raw brightness
+    pub brightness: u8,
+    /// Scaled xy (u16 little endian each), white only lights don't have a color
+    pub color: Option<[u8; 4]>,
+}
+
+/// Named scenes of the daemon persisted as JSON, the file is read and written as a whole
+#[derive(Default)]
+pub struct Scenes(BTreeMap<String, Vec<SceneDevice>>);
+
+impl Scenes {
+    /// A missing file has no scenes. A corrupt one is moved aside (see backup_path) so the scenes
+    /// start over instead of failing every time
+    pub fn load(path: impl AsRef<Path>) -> io::Result<Self> {
+        let path = path.as_ref();
+        let content = match fs::read_to_string(path) {
+            Ok(content) => content,
+            Err(error) if error.kind() == io::ErrorKind::NotFound => return Ok(Self::default()),
+            Err(error) => return Err(error),
+        };
+
+        match serde_json::from_str(&content) {
+            Ok(scenes) => Ok(Self(scenes)),
+            Err(error) => {
+                let backup = backup_path(path);
+                fs::rename(path, &backup)?;
+                warn!(
+                    "The scenes of {} are corrupt ({error}), moved to {}",
+                    path.display(),
+                    backup.display()
+                );
+
+                Ok(Self::default())
+            }
+        }
+    }
+
+    /// Creates the parent directories, the file is replaced at once so a crash can't leave it
+    /// half written
+    pub fn save(&self, path: impl AsRef<Path>) -> io::Result<()> {
+        let path = path.as_ref();
+        if let Some(dir) = path.parent() {
+            fs::create_dir_all(dir)?;
+        }
+
+        let tmp_path = path.with_extension("tmp");
+        fs::write(&tmp_path, serde_json::to_string(&self.0)?)?;
+        fs::rename(tmp_path, path)
+    }
+
+    pub fn get(&self, name: &str) -> Option<&[SceneDevice]> {
+        self.0.get(name).map(Vec::as_slice)
+    }
+
+    /// Replaces the scene if it already exists
+    pub fn insert(&mut self, name: String, devices: Vec<SceneDevice>) {
+        self.0.insert(name, devices);
+    }
+
+    /// Sorted
+    pub fn names(&self) -> impl Iterator<Item = &str> {
+        self.0.keys().map(String::as_str)
+    }
+}
+
+/// Where a corrupt scenes file is kept, next to it with a ".corrupt" suffix. A previous one is
+/// replaced
+pub fn backup_path(path: &Path) -> PathBuf {
+    let mut backup = path.as_os_str().to_owned();
+    backup.push(".corrupt");
+    backup.into()
+}
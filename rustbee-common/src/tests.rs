@@ -1,5 +1,18 @@
-use crate::constants::{OutputCode, HUE_BAR_1_ADDR};
-use crate::utils::{addr_to_uint, uint_to_addr};
+use std::time::{Duration, Instant};
+
+use crate::bonds::Bonds;
+use crate::constants::{
+    brightness_curve, control, features, OutputCode, EFFECT_UUID, HUE_BAR_1_ADDR, MAX_BRIGHTNESS,
+    MAX_MIREDS, MIN_BRIGHTNESS, MIN_MIREDS, POWER_ON_UUID,
+};
+use crate::device::{probed_char, reserve_write, set_probed_char, set_write_rate, WriteBucket};
+use crate::quirks::{self, Quirk};
+use crate::scenes::{self, SceneDevice, Scenes};
+use crate::utils::{
+    addr_to_uint, brightness_to_percent, brightness_to_percent_curved, control_payload,
+    format_addr, parse_addr, percent_to_brightness, temp_to_white_mix, uint_to_addr,
+    white_mix_to_temp,
+};
 
 #[test]
 fn output_codes_consistency() {
@@ -17,6 +30,9 @@ fn output_codes_consistency() {
 
     assert_eq!(u8::from(OutputCode::StreamEOF), 4);
     assert!(matches!(OutputCode::from(4), OutputCode::StreamEOF));
+
+    assert_eq!(u8::from(OutputCode::Timeout), 5);
+    assert!(matches!(OutputCode::from(5), OutputCode::Timeout));
 }
 
 #[test]
@@ -32,3 +48,462 @@ fn address_conversion() {
     let addr = addr_to_uint(&HUE_BAR_1_ADDR);
     assert_eq!(addr, uint);
 }
+
+#[test]
+fn address_parsing() {
+    assert_eq!(parse_addr("E8:D4:EA:C4:62:00"), Some(HUE_BAR_1_ADDR));
+    assert_eq!(parse_addr("e8:d4:ea:c4:62:00"), Some(HUE_BAR_1_ADDR));
+    assert_eq!(format_addr(&HUE_BAR_1_ADDR), "E8:D4:EA:C4:62:00");
+    assert_eq!(parse_addr(&format_addr(&[0x0a; 6])), Some([0x0a; 6]));
+
+    for malformed in [
+        "",
+        "E8D4EAC46200",
+        "E8:D4:EA:C4:62",
+        "E8:D4:EA:C4:62:00:01",
+        "E8:D4:EA:C4:62:0",
+        "E8:D4:EA:C4:62:000",
+        "E8-D4-EA-C4-62-00",
+        "E8:D4:EA:C4:62:0G",
+        "E8:D4:EA:C4:62:+0",
+        "E8:D4:EA:C4:62:00:",
+    ] {
+        assert_eq!(parse_addr(malformed), None, "{malformed:?}");
+    }
+}
+
+#[test]
+fn control_payload_transition() {
+    // Brightness 128 in 1.5s
+    assert_eq!(
+        control_payload(control::BRIGHTNESS, &[0x80], 15),
+        [0x02, 0x01, 0x80, 0x05, 0x02, 0x0f, 0x00]
+    );
+
+    // Little endian transition time
+    assert_eq!(
+        control_payload(control::POWER, &[1], 0x0102),
+        [0x01, 0x01, 0x01, 0x05, 0x02, 0x02, 0x01]
+    );
+}
+
+#[test]
+fn brightness_percent() {
+    assert_eq!(brightness_to_percent(MIN_BRIGHTNESS), 0);
+    assert_eq!(brightness_to_percent(127), 50);
+    assert_eq!(brightness_to_percent(MAX_BRIGHTNESS), 100);
+    assert_eq!(brightness_to_percent(u8::MAX), 100);
+}
+
+#[test]
+fn brightness_curves() {
+    assert_eq!(
+        percent_to_brightness(0, brightness_curve::LINEAR),
+        MIN_BRIGHTNESS
+    );
+    assert_eq!(percent_to_brightness(50, brightness_curve::LINEAR), 127);
+    assert_eq!(
+        percent_to_brightness(100, brightness_curve::LINEAR),
+        MAX_BRIGHTNESS
+    );
+    assert_eq!(
+        percent_to_brightness(200, brightness_curve::LINEAR),
+        MAX_BRIGHTNESS
+    );
+
+    // Half the perceived brightness is about a fifth of the raw one
+    assert_eq!(
+        percent_to_brightness(0, brightness_curve::GAMMA),
+        MIN_BRIGHTNESS
+    );
+    assert_eq!(percent_to_brightness(50, brightness_curve::GAMMA), 55);
+    assert_eq!(
+        percent_to_brightness(100, brightness_curve::GAMMA),
+        MAX_BRIGHTNESS
+    );
+
+    for curve in [brightness_curve::LINEAR, brightness_curve::GAMMA] {
+        for percent in [0, 25, 50, 75, 100] {
+            let raw = percent_to_brightness(percent, curve);
+            assert_eq!(
+                brightness_to_percent_curved(raw, curve),
+                percent,
+                "{curve} {percent}%"
+            );
+        }
+    }
+}
+
+#[test]
+fn white_mix_through_the_color_temp() {
+    assert_eq!(white_mix_to_temp(255, 0), (MAX_MIREDS, MAX_BRIGHTNESS));
+    assert_eq!(white_mix_to_temp(0, 255), (MIN_MIREDS, MAX_BRIGHTNESS));
+    assert_eq!(white_mix_to_temp(200, 100), (384, 199));
+    assert_eq!(white_mix_to_temp(0, 0), (MIN_MIREDS, MIN_BRIGHTNESS));
+
+    assert_eq!(temp_to_white_mix(MAX_MIREDS, MAX_BRIGHTNESS), (255, 0));
+    assert_eq!(temp_to_white_mix(MIN_MIREDS, MAX_BRIGHTNESS), (0, 255));
+    assert_eq!(temp_to_white_mix(1000, MAX_BRIGHTNESS), (255, 0));
+
+    // The mireds and the brightness lose at most 1 of each channel
+    for (warm, cool) in [(128, 128), (200, 100), (10, 255), (1, 0), (77, 3)] {
+        let (mireds, brightness) = white_mix_to_temp(warm, cool);
+        let (back_warm, back_cool) = temp_to_white_mix(mireds, brightness);
+        assert!(
+            back_warm.abs_diff(warm) <= 1 && back_cool.abs_diff(cool) <= 1,
+            "({warm}, {cool}) came back as ({back_warm}, {back_cool})"
+        );
+    }
+}
+
+#[test]
+fn scenes_persistence() {
+    let dir = std::env::temp_dir().join(format!("rustbee-scenes-{}", std::process::id()));
+    let path = dir.join("nested").join("scenes.json");
+
+    // A missing file has no scenes
+    let mut scenes = Scenes::load(&path).unwrap();
+    assert_eq!(scenes.names().count(), 0);
+
+    let movie = vec![SceneDevice {
+        addr: HUE_BAR_1_ADDR,
+        power: 1,
+        brightness: 40,
+        color: Some([0x10, 0x20, 0x30, 0x40]),
+    }];
+    scenes.insert("Movie".into(), movie.clone());
+    scenes.insert("Bright".into(), Vec::new());
+    scenes.save(&path).unwrap();
+
+    let scenes = Scenes::load(&path).unwrap();
+    assert_eq!(scenes.names().collect::<Vec<_>>(), ["Bright", "Movie"]);
+    assert_eq!(scenes.get("Movie"), Some(movie.as_slice()));
+    assert_eq!(scenes.get("Unknown"), None);
+
+    // A corrupt file is kept aside and the scenes start over
+    std::fs::write(&path, "{\"Movie\": [").unwrap();
+    let mut scenes = Scenes::load(&path).unwrap();
+    assert_eq!(scenes.names().count(), 0);
+    assert_eq!(
+        std::fs::read_to_string(scenes::backup_path(&path)).unwrap(),
+        "{\"Movie\": ["
+    );
+    scenes.insert("Movie".into(), movie.clone());
+    scenes.save(&path).unwrap();
+    assert_eq!(
+        Scenes::load(&path).unwrap().get("Movie"),
+        Some(movie.as_slice())
+    );
+
+    std::fs::remove_dir_all(dir).unwrap();
+}
+
+#[test]
+fn bonds_persistence() {
+    let dir = std::env::temp_dir().join(format!("rustbee-bonds-{}", std::process::id()));
+    let path = dir.join("nested").join("bonds.json");
+
+    // A missing file has no bonds
+    let mut bonds = Bonds::load(&path).unwrap();
+    assert!(!bonds.contains(&HUE_BAR_1_ADDR));
+
+    assert!(bonds.insert(HUE_BAR_1_ADDR));
+    assert!(!bonds.insert(HUE_BAR_1_ADDR));
+    bonds.save(&path).unwrap();
+
+    let bonds = Bonds::load(&path).unwrap();
+    assert!(bonds.contains(&HUE_BAR_1_ADDR));
+    assert!(!bonds.contains(&[0; 6]));
+
+    std::fs::remove_dir_all(dir).unwrap();
+}
+
+#[test]
+fn quirks_match_the_model_and_firmware() {
+    assert_eq!(quirks::parse_version("1.104.2"), Some([1, 104, 2]));
+    assert_eq!(quirks::parse_version("1.104.2-beta"), Some([1, 104, 2]));
+    assert_eq!(quirks::parse_version("2"), Some([2, 0, 0]));
+    assert_eq!(quirks::parse_version("simulated"), None);
+
+    let table = [
+        Quirk {
+            model: "LCA",
+            below: Some([1, 65, 0]),
+            set: 0,
+            clear: features::COMBINED_WRITE,
+        },
+        Quirk {
+            model: "",
+            below: None,
+            set: features::NEEDS_BONDING,
+            clear: 0,
+        },
+    ];
+    let detected = features::COMBINED_WRITE | 1;
+
+    assert_eq!(
+        quirks::apply(&table, "LCA001\0", "1.50.3", detected),
+        1 | features::NEEDS_BONDING
+    );
+    // Only the Bluetooth families need a bond
+    assert_eq!(
+        quirks::apply(quirks::QUIRKS, "LTA001", "1.104.2", 1),
+        1 | features::NEEDS_BONDING
+    );
+    assert_eq!(quirks::apply(quirks::QUIRKS, "", "1.104.2", 1), 1);
+    // Another model, a recent firmware or an unknown one
+    for (model, firmware) in [("LTA001", "1.50.3"), ("LCA001", "1.65.0"), ("LCA001", "")] {
+        assert_eq!(
+            quirks::apply(&table, model, firmware, detected),
+            detected | features::NEEDS_BONDING
+        );
+    }
+}
+
+#[test]
+fn write_bucket_throttles_past_a_second_of_writes() {
+    let now = Instant::now();
+    let mut bucket = WriteBucket::new(2, now);
+
+    assert_eq!(bucket.reserve(now), Some(Duration::ZERO));
+    assert_eq!(bucket.reserve(now), Some(Duration::ZERO));
+    assert_eq!(bucket.reserve(now), Some(Duration::from_millis(500)));
+    assert_eq!(bucket.reserve(now), Some(Duration::from_secs(1)));
+    // It would wait 1.5s
+    assert_eq!(bucket.reserve(now), None);
+
+    // Refilled by a token, the dropped write didn't take one
+    let later = now + Duration::from_millis(500);
+    assert_eq!(bucket.reserve(later), Some(Duration::from_secs(1)));
+
+    // It holds at most a second of writes
+    let idle = now + Duration::from_secs(60);
+    assert_eq!(bucket.reserve(idle), Some(Duration::ZERO));
+    assert_eq!(bucket.reserve(idle), Some(Duration::ZERO));
+    assert!(bucket.reserve(idle).unwrap() > Duration::ZERO);
+}
+
+#[test]
+fn every_device_has_its_own_write_rate() {
+    let (flooded, other) = ([0xd0, 0, 0, 0, 0, 1], [0xd0, 0, 0, 0, 0, 2]);
+    let now = Instant::now();
+    set_write_rate(1);
+
+    assert_eq!(reserve_write(flooded, now), Some(Duration::ZERO));
+    assert_eq!(reserve_write(flooded, now), Some(Duration::from_secs(1)));
+    assert_eq!(reserve_write(flooded, now), None);
+    // Not held back by the writes to the flooded device
+    assert_eq!(reserve_write(other, now), Some(Duration::ZERO));
+
+    set_write_rate(0);
+    assert_eq!(reserve_write(flooded, now), Some(Duration::ZERO));
+}
+
+#[test]
+fn a_probed_characteristic_is_cached_by_device() {
+    let (probed, other) = ([0xd1, 0, 0, 0, 0, 1], [0xd1, 0, 0, 0, 0, 2]);
+    assert_eq!(probed_char(probed, &EFFECT_UUID), None);
+
+    set_probed_char(probed, EFFECT_UUID, false);
+    assert_eq!(probed_char(probed, &EFFECT_UUID), Some(false));
+    assert_eq!(probed_char(probed, &POWER_ON_UUID), None);
+    assert_eq!(probed_char(other, &EFFECT_UUID), None);
+}
+
+/// Run in its own process by concurrent_launches_spawn_a_single_daemon, it launches the daemon
+/// then pings it
+#[cfg(target_os = "linux")]
+#[test]
+#[ignore]
+fn launch_daemon_from_another_process() {
+    let Ok(socket_path) = std::env::var("RUSTBEE_TEST_LAUNCH_SOCKET") else {
+        return;
+    };
+
+    let runtime = tokio::runtime::Builder::new_current_thread()
+        .enable_all()
+        .build()
+        .unwrap();
+    let launched = runtime
+        .block_on(crate::utils::launch_daemon_at(&socket_path))
+        .unwrap();
+
+    println!("launched: {launched}");
+    println!(
+        "pinged: {}",
+        crate::utils::daemon_answers_ping(&socket_path)
+    );
+}
+
+/// Spawned as rustbee-daemon by concurrent_launches_spawn_a_single_daemon, it records its pid and
+/// answers every request like a ping until it's killed
+#[cfg(target_os = "linux")]
+#[test]
+#[ignore]
+fn fake_daemon() {
+    use std::io::{Read as _, Write as _};
+    use std::os::unix::net::UnixListener;
+
+    use crate::constants::{BUFFER_LEN, OUTPUT_LEN, SOCKET_PATH_ENV};
+
+    let (Ok(socket_path), Ok(spawned_path)) = (
+        std::env::var(SOCKET_PATH_ENV),
+        std::env::var("RUSTBEE_TEST_SPAWNED"),
+    ) else {
+        return;
+    };
+
+    let mut spawned = std::fs::OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(spawned_path)
+        .unwrap();
+    writeln!(spawned, "{}", std::process::id()).unwrap();
+
+    let listener = UnixListener::bind(socket_path).unwrap();
+    for mut stream in listener.incoming().flatten() {
+        let mut packet = [0; BUFFER_LEN];
+        if stream.read_exact(&mut packet).is_ok() {
+            let mut output = [0; OUTPUT_LEN];
+            output[0] = OutputCode::Success.into();
+            let _ = stream.write_all(&output);
+        }
+    }
+}
+
+#[cfg(target_os = "linux")]
+#[test]
+fn concurrent_launches_spawn_a_single_daemon() {
+    use std::os::unix::fs::PermissionsExt as _;
+    use std::process::{Command, Stdio};
+
+    let dir = std::env::temp_dir().join(format!("rustbee-launch-{}", std::process::id()));
+    std::fs::create_dir_all(&dir).unwrap();
+    let socket_path = dir.join("rustbee-daemon.sock");
+    let spawned_path = dir.join("spawned");
+    let test_binary = std::env::current_exe().unwrap();
+
+    // Stands for the daemon, it's found by its socket (the process has another name) and runs
+    // until it's killed
+    let daemon = dir.join("rustbee-daemon");
+    std::fs::write(
+        &daemon,
+        format!(
+            "#!/bin/sh\nexec {} --exact tests::fake_daemon --ignored >/dev/null 2>&1\n",
+            test_binary.display(),
+        ),
+    )
+    .unwrap();
+    std::fs::set_permissions(&daemon, std::fs::Permissions::from_mode(0o755)).unwrap();
+
+    let path = format!(
+        "{}:{}",
+        dir.display(),
+        std::env::var("PATH").unwrap_or_default()
+    );
+    let children = (0..2)
+        .map(|_| {
+            Command::new(&test_binary)
+                .args([
+                    "--exact",
+                    "tests::launch_daemon_from_another_process",
+                    "--ignored",
+                    "--nocapture",
+                ])
+                .env("PATH", &path)
+                .env("RUSTBEE_TEST_LAUNCH_SOCKET", &socket_path)
+                .env("RUSTBEE_TEST_SPAWNED", &spawned_path)
+                .stdout(Stdio::piped())
+                .spawn()
+                .unwrap()
+        })
+        .collect::<Vec<_>>();
+    let outputs = children
+        .into_iter()
+        .map(|child| String::from_utf8(child.wait_with_output().unwrap().stdout).unwrap())
+        .collect::<Vec<_>>();
+
+    let spawned = std::fs::read_to_string(&spawned_path).unwrap_or_default();
+    for pid in spawned.lines() {
+        let _ = Command::new("kill").arg(pid).status();
+    }
+    std::fs::remove_dir_all(dir).unwrap();
+
+    assert_eq!(spawned.lines().count(), 1, "{outputs:?}");
+    for launched in ["launched: true", "launched: false"] {
+        let count = outputs.iter().filter(|out| out.contains(launched)).count();
+        assert_eq!(count, 1, "{outputs:?}");
+    }
+    // Both reach the single daemon
+    let pinged = outputs.iter().filter(|out| out.contains("pinged: true"));
+    assert_eq!(pinged.count(), 2, "{outputs:?}");
+}
+
+#[cfg(target_os = "linux")]
+#[test]
+fn a_held_launch_lock_is_waited_on_without_blocking() {
+    use crate::utils::lock_launch;
+
+    let socket_path =
+        std::env::temp_dir().join(format!("rustbee-lock-{}.sock", std::process::id()));
+    let socket_path = socket_path.to_str().unwrap().to_owned();
+    let runtime = tokio::runtime::Builder::new_current_thread()
+        .enable_all()
+        .build()
+        .unwrap();
+
+    // Released by a task of the same thread, it would never run if the wait blocked it
+    let held = runtime.block_on(lock_launch(&socket_path)).unwrap();
+    let release = async move {
+        tokio::time::sleep(Duration::from_millis(100)).await;
+        drop(held);
+    };
+    let (locked, ()) = runtime.block_on(async { tokio::join!(lock_launch(&socket_path), release) });
+    assert!(locked.is_ok());
+
+    let _ = std::fs::remove_file(format!("{socket_path}.lock"));
+}
+
+#[cfg(target_os = "linux")]
+#[test]
+fn running_daemon_is_found_without_an_adapter() {
+    use std::io::{Read as _, Write as _};
+    use std::os::unix::net::UnixListener;
+
+    use crate::constants::{BUFFER_LEN, OUTPUT_LEN};
+    use crate::utils::{is_no_adapter, spawn_daemon};
+
+    let socket_path =
+        std::env::temp_dir().join(format!("rustbee-adapter-{}.sock", std::process::id()));
+    let socket_path = socket_path.to_str().unwrap().to_owned();
+    let _ = std::fs::remove_file(&socket_path);
+    let runtime = tokio::runtime::Builder::new_current_thread()
+        .enable_all()
+        .build()
+        .unwrap();
+
+    // Nothing to find, the daemon isn't spawned
+    let error = runtime
+        .block_on(spawn_daemon(&socket_path, false, async { false }))
+        .unwrap_err();
+    assert!(is_no_adapter(&error), "{error}");
+    assert!(!std::fs::exists(&socket_path).unwrap());
+
+    // Answers the ping like a running daemon
+    let listener = UnixListener::bind(&socket_path).unwrap();
+    let daemon = std::thread::spawn(move || {
+        let (mut stream, _) = listener.accept().unwrap();
+        let mut packet = [0; BUFFER_LEN];
+        stream.read_exact(&mut packet).unwrap();
+        let mut output = [0; OUTPUT_LEN];
+        output[0] = OutputCode::Success.into();
+        stream.write_all(&output).unwrap();
+    });
+
+    let launched = runtime.block_on(spawn_daemon(&socket_path, false, async { false }));
+    assert!(!launched.unwrap());
+
+    daemon.join().unwrap();
+    let _ = std::fs::remove_file(&socket_path);
+    let _ = std::fs::remove_file(format!("{socket_path}.lock"));
+}
@@ -1,7 +1,213 @@
 // Re-exports
 pub use super::daemon::*;
 
-use crate::constants::ADDR_LEN;
+use std::io::{Read as _, Write as _};
+use std::path::{Path, PathBuf};
+use std::sync::{mpsc, RwLock};
+use std::time::{Duration, Instant};
+use std::{env, fs, io, thread};
+
+use interprocess::local_socket::{traits::Stream as _, GenericFilePath, Stream, ToFsName as _};
+
+use crate::constants::{
+    brightness_curve, control, exit_code, masks, OutputCode, ADDR_LEN, BONDS_FILE, BUFFER_LEN,
+    DATA_DIR, DATA_DIR_ENV, FLAGS_LEN, LAUNCH_LOCK_TIMEOUT_SECS, MAX_BRIGHTNESS, MAX_MIREDS,
+    MIN_BRIGHTNESS, MIN_MIREDS, OUTPUT_LEN, PING_TIMEOUT_MS, SCENES_FILE, SOCKET_PATH,
+    SOCKET_PATH_ENV,
+};
+
+/// Between the attempts of lock_launch
+const LAUNCH_LOCK_POLL_MS: u64 = 50;
+
+static SOCKET_PATH_OVERRIDE: RwLock<Option<String>> = RwLock::new(None);
+static DATA_DIR_OVERRIDE: RwLock<Option<PathBuf>> = RwLock::new(None);
+
+/// Overrides the daemon socket path of this process and of the daemons it launches
+pub fn set_socket_path(path: impl Into<String>) {
+    *SOCKET_PATH_OVERRIDE.write().unwrap() = Some(path.into());
+}
+
+#[cfg(test)]
+pub(crate) fn reset_socket_path() {
+    *SOCKET_PATH_OVERRIDE.write().unwrap() = None;
+}
+
+/// The overridden socket path, else the SOCKET_PATH_ENV env variable, else SOCKET_PATH
+pub fn socket_path() -> String {
+    if let Some(path) = SOCKET_PATH_OVERRIDE.read().unwrap().as_ref() {
+        return path.clone();
+    }
+
+    env::var(SOCKET_PATH_ENV).unwrap_or_else(|_| SOCKET_PATH.to_owned())
+}
+
+/// Overrides the data dir of the daemons launched by this process, see data_dir
+pub fn set_data_dir(path: impl Into<PathBuf>) {
+    *DATA_DIR_OVERRIDE.write().unwrap() = Some(path.into());
+}
+
+#[cfg(test)]
+pub(crate) fn reset_data_dir() {
+    *DATA_DIR_OVERRIDE.write().unwrap() = None;
+}
+
+/// The overridden data dir, else the DATA_DIR_ENV env variable, else DATA_DIR. It's absolute so
+/// it doesn't depend on the working directory of the daemon
+pub fn data_dir() -> PathBuf {
+    let dir = DATA_DIR_OVERRIDE
+        .read()
+        .unwrap()
+        .clone()
+        .or_else(|| env::var_os(DATA_DIR_ENV).map(PathBuf::from))
+        .unwrap_or_else(|| PathBuf::from(DATA_DIR));
+
+    std::path::absolute(&dir).unwrap_or(dir)
+}
+
+pub fn scenes_path() -> PathBuf {
+    data_dir().join(SCENES_FILE)
+}
+
+pub fn bonds_path() -> PathBuf {
+    data_dir().join(BONDS_FILE)
+}
+
+/// Tries to create (and remove) a file since permissions alone don't tell if this process can
+pub fn is_dir_writable(dir: &Path) -> bool {
+    let probe = dir.join(format!(".rustbee-{}", std::process::id()));
+
+    let writable = fs::OpenOptions::new()
+        .write(true)
+        .create_new(true)
+        .open(&probe)
+        .is_ok();
+    let _ = fs::remove_file(probe);
+
+    writable
+}
+
+/// Error of a daemon that exited with code right after its launch, the kind tells why (see
+/// exit_code)
+pub(crate) fn launch_error(code: Option<i32>, stderr: &str) -> io::Error {
+    let kind = match code {
+        Some(exit_code::SOCKET_IN_USE) => io::ErrorKind::AddrInUse,
+        Some(exit_code::PERMISSION_DENIED) => io::ErrorKind::PermissionDenied,
+        _ => io::ErrorKind::Other,
+    };
+
+    io::Error::new(
+        kind,
+        format!("[ERROR] Failed to launch rustbee-daemon:\n{stderr}"),
+    )
+}
+
+/// Held by a process while it checks for the daemon of socket_path and spawns it, so the launches
+/// of concurrent processes resolve to a single daemon: the next holder finds it running. It's
+/// released once dropped or when the process exits, the file is left since another process may
+/// be waiting on it. It waits without blocking the thread while another process is launching,
+/// about a second, and times out after LAUNCH_LOCK_TIMEOUT_SECS
+pub(crate) async fn lock_launch(socket_path: &str) -> io::Result<fs::File> {
+    let path = launch_lock_path(socket_path);
+    let lock = fs::OpenOptions::new()
+        .create(true)
+        .truncate(false)
+        .write(true)
+        .open(&path)
+        .map_err(|error| {
+            io::Error::new(
+                error.kind(),
+                format!(
+                    "[ERROR] Cannot open the launch lock {}: {error}",
+                    path.display()
+                ),
+            )
+        })?;
+
+    let deadline = Instant::now() + Duration::from_secs(LAUNCH_LOCK_TIMEOUT_SECS);
+    loop {
+        match lock.try_lock() {
+            Ok(()) => return Ok(lock),
+            Err(fs::TryLockError::WouldBlock) if Instant::now() < deadline => {
+                tokio::time::sleep(Duration::from_millis(LAUNCH_LOCK_POLL_MS)).await;
+            }
+            Err(fs::TryLockError::WouldBlock) => {
+                return Err(io::Error::new(
+                    io::ErrorKind::TimedOut,
+                    format!("[ERROR] Another launch took more than {LAUNCH_LOCK_TIMEOUT_SECS}s"),
+                ));
+            }
+            Err(fs::TryLockError::Error(error)) => return Err(error),
+        }
+    }
+}
+
+/// Next to the socket, a named pipe isn't a file so its lock goes to the temp dir
+fn launch_lock_path(socket_path: &str) -> PathBuf {
+    if cfg!(target_os = "windows") {
+        let name = socket_path.rsplit(['\\', '/']).next().unwrap_or_default();
+        return env::temp_dir().join(format!("{name}.lock"));
+    }
+
+    PathBuf::from(format!("{socket_path}.lock"))
+}
+
+/// Why a daemon wasn't spawned on a host without a Bluetooth adapter, it would run but none of its
+/// commands would. Carried by the io::Error of the launch fns, see is_no_adapter
+#[derive(Debug)]
+pub struct NoAdapter;
+
+impl std::fmt::Display for NoAdapter {
+    fn fmt(&self, f: &mut std::fmt::Formatter) -> std::fmt::Result {
+        f.write_str("No Bluetooth LE adapter found (maybe your Bluetooth is OFF ?)")
+    }
+}
+
+impl std::error::Error for NoAdapter {}
+
+pub(crate) fn no_adapter_error() -> io::Error {
+    io::Error::new(io::ErrorKind::NotFound, NoAdapter)
+}
+
+/// Whether the launch failed since there is no Bluetooth adapter
+pub fn is_no_adapter(error: &io::Error) -> bool {
+    error.get_ref().is_some_and(|inner| inner.is::<NoAdapter>())
+}
+
+/// Keeps the kind of the error, NotFound if the daemon isn't in the PATH
+pub(crate) fn spawn_error(error: io::Error) -> io::Error {
+    io::Error::new(
+        error.kind(),
+        format!("[ERROR] Cannot spawn rustbee-daemon, is it in the PATH? ({error})"),
+    )
+}
+
+/// Whether a daemon answers a ping on socket_path within PING_TIMEOUT_MS, so the daemons of other
+/// socket paths and a socket left by a daemon that crashed don't count. The ping is sent from
+/// another thread since a hung listener would never answer
+pub(crate) fn daemon_answers_ping(socket_path: &str) -> bool {
+    let Ok(mut stream) = socket_path
+        .to_fs_name::<GenericFilePath>()
+        .and_then(Stream::connect)
+    else {
+        return false;
+    };
+
+    let (tx, rx) = mpsc::channel();
+    thread::spawn(move || {
+        let mut packet = [0; BUFFER_LEN];
+        packet[ADDR_LEN..][..FLAGS_LEN].copy_from_slice(&masks::PING.to_le_bytes());
+        let mut output = [0; OUTPUT_LEN];
+
+        let answered = stream
+            .write_all(&packet)
+            .and_then(|_| stream.read_exact(&mut output))
+            .is_ok();
+        let _ = tx.send(answered && output[0] == u8::from(OutputCode::Success));
+    });
+
+    rx.recv_timeout(Duration::from_millis(PING_TIMEOUT_MS))
+        .unwrap_or(false)
+}
 
 pub fn addr_to_uint(addr: &[u8; ADDR_LEN]) -> u64 {
     let mut res: u64 = 0;
@@ -13,6 +219,30 @@ pub fn addr_to_uint(addr: &[u8; ADDR_LEN]) -> u64 {
     res
 }
 
+/// Parses a "E8:D4:EA:C4:62:00" address, case insensitive. None if it's not ADDR_LEN colon
+/// separated hex bytes
+pub fn parse_addr(addr: &str) -> Option<[u8; ADDR_LEN]> {
+    let mut res = [0; ADDR_LEN];
+    let mut parts = addr.split(':');
+
+    for byte in res.iter_mut() {
+        let part = parts.next()?;
+        // from_str_radix accepts a sign
+        if part.len() != 2 || !part.bytes().all(|b| b.is_ascii_hexdigit()) {
+            return None;
+        }
+
+        *byte = u8::from_str_radix(part, 16).ok()?;
+    }
+
+    parts.next().is_none().then_some(res)
+}
+
+/// The inverse of parse_addr, upper case
+pub fn format_addr(addr: &[u8; ADDR_LEN]) -> String {
+    addr.map(|byte| format!("{byte:02X}")).join(":")
+}
+
 pub fn uint_to_addr(addr: u64) -> [u8; ADDR_LEN] {
     let mut res = [0; ADDR_LEN];
 
@@ -22,3 +252,96 @@ pub fn uint_to_addr(addr: u64) -> [u8; ADDR_LEN] {
 
     res
 }
+
+/// Rounded percentage of a raw brightness value, values above MAX_BRIGHTNESS are 100%
+pub fn brightness_to_percent(raw: u8) -> u8 {
+    let raw = raw.min(MAX_BRIGHTNESS) as u16;
+    let max = MAX_BRIGHTNESS as u16;
+
+    ((raw * 100 + max / 2) / max) as _
+}
+
+/// Raw brightness of a percentage through a `brightness_curve`, percentages above 100 are 100%.
+/// The lowest ones are MIN_BRIGHTNESS since a brightness of 0 isn't off
+pub fn percent_to_brightness(percent: u8, curve: u8) -> u8 {
+    let mut level = percent.min(100) as f64 / 100.;
+    if curve == brightness_curve::GAMMA {
+        level = level.powf(brightness_curve::GAMMA_EXPONENT);
+    }
+
+    ((level * MAX_BRIGHTNESS as f64).round() as u8).max(MIN_BRIGHTNESS)
+}
+
+/// brightness_to_percent through a `brightness_curve`, the inverse of percent_to_brightness
+pub fn brightness_to_percent_curved(raw: u8, curve: u8) -> u8 {
+    if curve != brightness_curve::GAMMA {
+        return brightness_to_percent(raw);
+    }
+
+    // Like the linear curve, most of the low percentages end up there
+    if raw <= MIN_BRIGHTNESS {
+        return 0;
+    }
+
+    let level = raw.min(MAX_BRIGHTNESS) as f64 / MAX_BRIGHTNESS as f64;
+
+    (level.powf(1. / brightness_curve::GAMMA_EXPONENT) * 100.).round() as _
+}
+
+/// Color temperature (mireds) and raw brightness the closest to a mix of the warm and cool white
+/// channels: the share of warm white goes from MIN_MIREDS to MAX_MIREDS and the strongest channel
+/// is the brightness. Both at 0 is MIN_MIREDS at MIN_BRIGHTNESS
+pub fn white_mix_to_temp(warm: u8, cool: u8) -> (u16, u8) {
+    let total = warm as f64 + cool as f64;
+    let share = if total > 0. { warm as f64 / total } else { 0. };
+    let mireds = MIN_MIREDS as f64 + share * (MAX_MIREDS - MIN_MIREDS) as f64;
+    let level = warm.max(cool) as f64 / u8::MAX as f64;
+
+    (
+        mireds.round() as _,
+        ((level * MAX_BRIGHTNESS as f64).round() as u8).max(MIN_BRIGHTNESS),
+    )
+}
+
+/// The inverse of white_mix_to_temp, the mireds are clamped to MIN_MIREDS..=MAX_MIREDS
+pub fn temp_to_white_mix(mireds: u16, brightness: u8) -> (u8, u8) {
+    let share = (mireds.clamp(MIN_MIREDS, MAX_MIREDS) - MIN_MIREDS) as f64
+        / (MAX_MIREDS - MIN_MIREDS) as f64;
+    let level = brightness.min(MAX_BRIGHTNESS) as f64 / MAX_BRIGHTNESS as f64 * u8::MAX as f64;
+
+    // The strongest channel is at the level, the other one is its share of it
+    let (warm, cool) = if share >= 0.5 {
+        (level, level * (1. - share) / share)
+    } else {
+        (level * share / (1. - share), level)
+    };
+
+    (warm.round() as _, cool.round() as _)
+}
+
+/// Control characteristic payload of a value (`control::*` type) followed by the transition time
+/// in deciseconds
+pub fn control_payload(kind: u8, value: &[u8], transition_ds: u16) -> Vec<u8> {
+    let mut payload = vec![kind, value.len() as _];
+    payload.extend_from_slice(value);
+    payload.extend_from_slice(&[control::TRANSITION, 2]);
+    payload.extend_from_slice(&transition_ds.to_le_bytes());
+
+    payload
+}
+
+/// Control characteristic payload of several values (`control::*` type and value) written at
+/// once, the transition time in deciseconds is only added if it isn't 0
+pub fn combined_control_payload(entries: &[(u8, Vec<u8>)], transition_ds: u16) -> Vec<u8> {
+    let mut payload = Vec::new();
+    for (kind, value) in entries {
+        payload.extend_from_slice(&[*kind, value.len() as _]);
+        payload.extend_from_slice(value);
+    }
+    if transition_ds > 0 {
+        payload.extend_from_slice(&[control::TRANSITION, 2]);
+        payload.extend_from_slice(&transition_ds.to_le_bytes());
+    }
+
+    payload
+}
@@ -1,6 +1,7 @@
 use std::collections::{HashMap, HashSet};
 use std::future::Future;
 use std::pin::Pin;
+use std::sync::Mutex;
 use std::task::{Context, Poll};
 use std::time::Duration;
 
@@ -10,15 +11,20 @@ use log::*;
 use tokio::sync::mpsc::{self, Sender};
 use tokio::time::timeout;
 use windows::core::{Error as WinError, Result as WinResult, RuntimeType, HSTRING};
-use windows::Devices::Bluetooth::BluetoothLEDevice;
+use windows::Devices::Bluetooth::{BluetoothAdapter, BluetoothLEDevice};
 use windows::Foundation::{AsyncStatus, IAsyncOperation};
 
 use crate::constants::ADDR_LEN;
-use crate::device::{HueDevice, Server};
+use crate::device::{AdapterInfo, HueDevice, Server};
 use crate::utils::{addr_to_uint, uint_to_addr};
 
 const NO_ADAPTER_FOUND: &str = "Failed to get Bluetooth adapter. (maybe your Bluetooth is OFF ?)";
 
+/// WinRT doesn't keep the advertisements of a device, the search keeps the manufacturer data
+/// (company id first) of the last one of every device found
+pub(super) static ADVERTISED_MANUFACTURER_DATA: Mutex<Vec<([u8; ADDR_LEN], Vec<u8>)>> =
+    Mutex::new(Vec::new());
+
 async fn scan(adapter: Adapter, tx: Sender<AdvertisingDevice>) {
     let mut discovery = adapter.scan(&[]).await.unwrap();
 
@@ -73,10 +79,21 @@ pub async fn search_devices_by_name(
                             .await
                             .map(|ble_device| ble_device.BluetoothAddress())
                             {
-                                let hue_device = HueDevice::new_with_device(
-                                    uint_to_addr(address),
-                                    adv_device.device,
-                                );
+                                let addr = uint_to_addr(address);
+                                let manufacturer_data = adv_device
+                                    .adv_data
+                                    .manufacturer_data
+                                    .map(|data| {
+                                        [data.company_id.to_le_bytes().to_vec(), data.data].concat()
+                                    })
+                                    .unwrap_or_default();
+                                let mut advertised = ADVERTISED_MANUFACTURER_DATA.lock().unwrap();
+                                advertised.retain(|(known, _)| *known != addr);
+                                advertised.push((addr, manufacturer_data));
+                                drop(advertised);
+
+                                let hue_device =
+                                    HueDevice::new_with_device(addr, adv_device.device);
                                 return Some((hue_device, Some((discovery, name, seen_devices))));
                             }
                         }
@@ -94,6 +111,22 @@ pub async fn search_devices_by_name(
     })))
 }
 
+/// The default adapter, the one the other fns use. None if there is none or it doesn't support
+/// Bluetooth LE
+pub async fn get_adapter_info() -> Option<AdapterInfo> {
+    let async_op: AsyncOp<BluetoothAdapter> = BluetoothAdapter::GetDefaultAsync().ok()?.into();
+    // Null without an adapter
+    let adapter = async_op.await.ok()?;
+    if !adapter.IsLowEnergySupported().ok()? {
+        return None;
+    }
+
+    Some(AdapterInfo {
+        name: adapter.DeviceId().ok()?.to_string(),
+        address: adapter.BluetoothAddress().ok().map(uint_to_addr),
+    })
+}
+
 pub async fn get_device(address: [u8; ADDR_LEN]) -> bluest::Result<Option<HueDevice<Server>>> {
     let Some(adapter) = Adapter::default().await else {
         error!("{NO_ADAPTER_FOUND}");
@@ -176,7 +209,9 @@ pub async fn get_devices(addrs: &[[u8; ADDR_LEN]]) -> bluest::Result<Vec<HueDevi
     Ok(addresses.into_values().collect())
 }
 
-async fn get_windows_device_from_device_id(device_id: String) -> Option<BluetoothLEDevice> {
+pub(crate) async fn get_windows_device_from_device_id(
+    device_id: String,
+) -> Option<BluetoothLEDevice> {
     let async_op: AsyncOp<BluetoothLEDevice> =
         BluetoothLEDevice::FromIdAsync(&HSTRING::from(device_id.clone()))
             .unwrap_or_else(|err| {
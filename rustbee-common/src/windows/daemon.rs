@@ -1,4 +1,5 @@
 use std::ffi::CStr;
+use std::future::Future;
 use std::io;
 use std::mem::size_of;
 use std::process::Stdio;
@@ -14,6 +15,12 @@ use windows::Win32::System::Threading::{
     OpenProcess, TerminateProcess, CREATE_NEW_PROCESS_GROUP, DETACHED_PROCESS, PROCESS_TERMINATE,
 };
 
+use crate::constants::{DATA_DIR_ENV, SIMULATE_ENV, SOCKET_PATH_ENV};
+use crate::utils::{
+    daemon_answers_ping, data_dir, launch_error, lock_launch, no_adapter_error, socket_path,
+    spawn_error,
+};
+
 /// Maps a windows::core::Error into std::io::Error
 macro_rules! werr {
     ($res:expr) => {
@@ -54,39 +61,87 @@ fn get_daemon_process_id() -> io::Result<Option<u32>> {
     Ok(None)
 }
 
-pub async fn launch_daemon() -> io::Result<()> {
-    let pid_opt = get_daemon_process_id()?;
+/// Told by the pipe path, the process of a daemon listening elsewhere doesn't count
+fn is_running(socket_path: &str) -> io::Result<bool> {
+    Ok(daemon_answers_ping(socket_path))
+}
+
+/// Returns false if the daemon was already running
+pub async fn launch_daemon() -> io::Result<bool> {
+    launch_daemon_at(&socket_path()).await
+}
+
+/// Same as launch_daemon for the daemon instance listening on socket_path, concurrent launches
+/// from several processes spawn a single daemon and the other ones return false
+pub async fn launch_daemon_at(socket_path: &str) -> io::Result<bool> {
+    let has_adapter = async { crate::bluetooth::get_adapter_info().await.is_some() };
+    spawn_daemon(socket_path, false, has_adapter).await
+}
+
+/// Same as launch_daemon_at for a daemon driving in memory virtual devices (see SIMULATE_ENV), it
+/// doesn't need a Bluetooth adapter. A daemon already running on socket_path is kept even if it
+/// isn't simulated
+pub async fn launch_simulated_daemon_at(socket_path: &str) -> io::Result<bool> {
+    spawn_daemon(socket_path, true, async { true }).await
+}
+
+/// A daemon that isn't simulated needs has_adapter, else it's a NoAdapter error (see
+/// utils::is_no_adapter). It's only checked when no daemon runs on socket_path, a running one is
+/// found even without an adapter
+pub(crate) async fn spawn_daemon(
+    socket_path: &str,
+    simulated: bool,
+    has_adapter: impl Future<Output = bool>,
+) -> io::Result<bool> {
+    if is_running(socket_path)? {
+        return Ok(false);
+    }
+
+    // Until the daemon is up or exited, see lock_launch
+    let _lock = lock_launch(socket_path).await?;
+
+    // Another process may have launched it meanwhile
+    if is_running(socket_path)? {
+        return Ok(false);
+    }
+
+    if !simulated && !has_adapter.await {
+        return Err(no_adapter_error());
+    }
 
-    if pid_opt.is_some() {
-        return Ok(());
+    let mut command = AsyncCommand::new("rustbee-daemon.exe");
+    command.env(SOCKET_PATH_ENV, socket_path);
+    command.env(DATA_DIR_ENV, data_dir());
+    if simulated {
+        command.env(SIMULATE_ENV, "1");
     }
 
-    let daemon = AsyncCommand::new("rustbee-daemon.exe")
+    let daemon = command
         .creation_flags(DETACHED_PROCESS.0 | CREATE_NEW_PROCESS_GROUP.0)
         .stdin(Stdio::null())
         .stdout(Stdio::null())
         .stderr(Stdio::null())
-        .spawn()?;
+        .spawn()
+        .map_err(spawn_error)?;
 
     let out = match time::timeout(Duration::from_secs(1), daemon.wait_with_output()).await {
         Ok(res) => res?,
-        Err(_) => return Ok(()),
+        Err(_) => return Ok(true),
     };
 
     if !out.status.success() {
         let stderr = String::from_utf8(out.stderr).unwrap();
-        let stderr = stderr.trim();
 
-        return Err(io::Error::new(
-            io::ErrorKind::Other,
-            format!("[ERROR] Failed to launch rustbee-daemon:\n{stderr}"),
-        ));
+        return Err(launch_error(out.status.code(), stderr.trim()));
     }
 
-    Ok(())
+    Ok(true)
 }
 
-pub fn shutdown_daemon(_force: bool) -> io::Result<()> {
+/// Returns false if there was no running daemon to shutdown
+///
+/// The daemon has no way to be asked to stop yet, so it is always terminated
+pub fn shutdown_daemon(_force: bool) -> io::Result<bool> {
     let pid_opt = get_daemon_process_id()?;
 
     if let Some(pid) = pid_opt {
@@ -104,11 +159,11 @@ pub fn shutdown_daemon(_force: bool) -> io::Result<()> {
             werr!(CloseHandle(process_handle))?;
         }
 
-        return Ok(());
+        return Ok(true);
         // }
 
         // TODO: Impl a shutdown message on the daemon so it can gracefully kill itself, else, force ^
     }
 
-    Ok(())
+    Ok(false)
 }
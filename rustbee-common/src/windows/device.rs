@@ -1,12 +1,32 @@
 use std::ops::Deref;
+use std::sync::atomic::Ordering;
+use std::sync::Mutex;
+use std::time::Duration;
 
+use futures::StreamExt as _;
 use log::*;
+use tokio::sync::mpsc;
+use tokio::time::sleep;
 use uuid::Uuid;
+use windows::Devices::Bluetooth::{
+    BluetoothLEPreferredConnectionParameters, BluetoothLEPreferredConnectionParametersRequest,
+    BluetoothLEPreferredConnectionParametersRequestStatus,
+};
 
 use crate::constants::*;
 use crate::device::*;
 use crate::InnerDevice;
 
+use super::bluetooth::{get_windows_device_from_device_id, ADVERTISED_MANUFACTURER_DATA};
+
+/// Closing a request reverts its parameters so the last one of every device is kept
+static CONNECTION_PARAMS_REQUESTS: Mutex<
+    Vec<(
+        [u8; ADDR_LEN],
+        BluetoothLEPreferredConnectionParametersRequest,
+    )>,
+> = Mutex::new(Vec::new());
+
 impl HueDevice<Server>
 where
     HueDevice<Server>: Default + Deref<Target = InnerDevice> + std::fmt::Debug,
@@ -53,14 +73,123 @@ where
             })?;
 
             if let Some(charac) = characteristics.iter().find(|&c| &c.uuid() == charac) {
-                charac.write(bytes).await?;
-                return Ok(true);
+                let mut retries = self.write_retries;
+                loop {
+                    if !throttle_write(self.addr).await {
+                        warn!(
+                            "Write to {} dropped, the write rate is exceeded",
+                            charac.uuid()
+                        );
+                        return Err(bluest::error::ErrorKind::Other.into());
+                    }
+
+                    let written = if self.confirmed_writes == Some(false) {
+                        charac.write_without_response(bytes).await
+                    } else {
+                        charac.write(bytes).await
+                    };
+
+                    match written {
+                        Ok(()) => return Ok(true),
+                        Err(error) if retries > 0 => {
+                            warn!(
+                                "Write to {} of {:?} failed, retrying: {error}",
+                                charac.uuid(),
+                                self.addr
+                            );
+                            RETRIED_WRITES.fetch_add(1, Ordering::Relaxed);
+                            retries -= 1;
+                        }
+                        Err(error) => return Err(error),
+                    }
+                }
             }
         }
 
         Ok(false)
     }
 
+    /// Whether the device has the light characteristic with a value of len bytes, for the UUIDs
+    /// guessed from the numbering of the others: a firmware that uses one for something else
+    /// isn't written to. Cached by device once read
+    pub async fn probe_char(&self, charac: &Uuid, len: usize) -> bluest::Result<bool> {
+        if let Some(found) = probed_char(self.addr, charac) {
+            return Ok(found);
+        }
+
+        let found = self
+            .read_gatt_char(&LIGHT_SERVICES_UUID, charac)
+            .await?
+            .is_some_and(|bytes| bytes.len() == len);
+        set_probed_char(self.addr, *charac, found);
+
+        Ok(found)
+    }
+
+    pub async fn has_gatt_char(&self, service: &Uuid, charac: &Uuid) -> bluest::Result<bool> {
+        let services = self.services().await.map_err(|err| {
+            error!("Failed to get services {err}");
+            bluest::error::ErrorKind::NotFound
+        })?;
+
+        if let Some(service) = services.iter().find(|&s| &s.uuid() == service) {
+            let characteristics = service.characteristics().await.map_err(|err| {
+                error!("Failed to get characteristics {err} for service {service:?}");
+                bluest::error::ErrorKind::NotFound
+            })?;
+
+            return Ok(characteristics.iter().any(|c| &c.uuid() == charac));
+        }
+
+        Ok(false)
+    }
+
+    /// Raw access to a characteristic of any service, None if the device doesn't have it
+    pub async fn read_raw_char(&self, uuid: [u8; 16]) -> bluest::Result<Option<Vec<u8>>> {
+        match self.find_raw_char(Uuid::from_bytes(uuid)).await? {
+            Some(charac) => Ok(Some(charac.read().await?)),
+            None => Ok(None),
+        }
+    }
+
+    /// Raw access to a characteristic of any service, false if the device doesn't have it
+    pub async fn write_raw_char(&self, uuid: [u8; 16], bytes: &[u8]) -> bluest::Result<bool> {
+        match self.find_raw_char(Uuid::from_bytes(uuid)).await? {
+            Some(charac) => {
+                if !throttle_write(self.addr).await {
+                    warn!(
+                        "Write to {} dropped, the write rate is exceeded",
+                        charac.uuid()
+                    );
+                    return Err(bluest::error::ErrorKind::Other.into());
+                }
+                charac.write(bytes).await?;
+                Ok(true)
+            }
+            None => Ok(false),
+        }
+    }
+
+    async fn find_raw_char(&self, uuid: Uuid) -> bluest::Result<Option<bluest::Characteristic>> {
+        let services = self.services().await.map_err(|err| {
+            error!("Failed to get services {err}");
+            bluest::error::ErrorKind::NotFound
+        })?;
+
+        for service in services {
+            let characteristics = service.characteristics().await.map_err(|err| {
+                error!("Failed to get characteristics {err} for service {service:?}");
+                bluest::error::ErrorKind::NotFound
+            })?;
+
+            if let Some(charac) = characteristics.into_iter().find(|c| c.uuid() == uuid) {
+                return Ok(Some(charac));
+            }
+        }
+
+        Ok(None)
+    }
+
     /// This is no-op, Windows connects automatically when needed
     /// https://docs.rs/bluest/latest/bluest/struct.Adapter.html#method.connect_device
     pub async fn try_connect(&self) -> bluest::Result<()> {
@@ -77,6 +206,37 @@ where
         Ok((*self).is_connected().await)
     }
 
+    /// Windows keeps the bond, the connections after it don't pair again
+    pub async fn pair(&self) -> bluest::Result<()> {
+        (**self).pair().await
+    }
+
+    pub async fn is_paired(&self) -> bluest::Result<bool> {
+        (**self).is_paired().await
+    }
+
+    /// Signal strength in dBm, it doesn't connect the device. None if the adapter doesn't
+    /// support reading it
+    pub async fn get_rssi(&self) -> bluest::Result<Option<i16>> {
+        match self.rssi().await {
+            Ok(rssi) => Ok(Some(rssi)),
+            Err(error) if error.kind() == bluest::error::ErrorKind::NotSupported => Ok(None),
+            Err(error) => Err(error),
+        }
+    }
+
+    /// Manufacturer specific data of the advertisement seen by the last search, the company id
+    /// (u16 little endian) followed by the data. Empty if it had none or it wasn't searched.
+    pub async fn get_manufacturer_data(&self) -> bluest::Result<Vec<u8>> {
+        Ok(ADVERTISED_MANUFACTURER_DATA
+            .lock()
+            .unwrap()
+            .iter()
+            .find(|(addr, _)| *addr == self.addr)
+            .map(|(_, data)| data.clone())
+            .unwrap_or_default())
+    }
+
     pub async fn get_power(&self) -> bluest::Result<bool> {
         let read = self
             .read_gatt_char(&LIGHT_SERVICES_UUID, &POWER_UUID)
@@ -115,6 +275,33 @@ where
         Ok(())
     }
 
+    /// Blinks the light so it can be found physically, its power and brightness are restored
+    /// even if blinking failed
+    pub async fn identify(&self) -> bluest::Result<()> {
+        let power = self.get_power().await?;
+        let brightness = self.get_brightness().await? as u8;
+        let interval = Duration::from_millis(IDENTIFY_INTERVAL_MS);
+
+        let blink = async {
+            self.set_power(true as _).await?;
+
+            for _ in 0..IDENTIFY_BLINKS {
+                self.set_brightness(MAX_BRIGHTNESS).await?;
+                sleep(interval).await;
+                self.set_brightness(MIN_BRIGHTNESS).await?;
+                sleep(interval).await;
+            }
+
+            Ok::<_, bluest::Error>(())
+        }
+        .await;
+
+        self.set_brightness(brightness).await?;
+        self.set_power(power as _).await?;
+
+        blink
+    }
+
     pub async fn get_color(&self) -> bluest::Result<[u8; 4]> {
         let mut buf = [0u8; 4];
         if let Some(bytes) = self
@@ -138,7 +325,343 @@ where
         Ok(())
     }
 
+    pub async fn get_temperature(&self) -> bluest::Result<u16> {
+        let mut buf = [0u8; 2];
+        if let Some(bytes) = self
+            .read_gatt_char(&LIGHT_SERVICES_UUID, &TEMPERATURE_UUID)
+            .await?
+        {
+            let len = buf.len();
+            buf.copy_from_slice(&bytes[..len]);
+
+            Ok(u16::from_le_bytes(buf))
+        } else {
+            error!("Service or Characteristic \"{TEMPERATURE_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr);
+            Err(bluest::error::ErrorKind::Other.into())
+        }
+    }
+
+    pub async fn set_temperature(&self, mireds: u16) -> bluest::Result<()> {
+        let written = self
+            .write_gatt_char(
+                &LIGHT_SERVICES_UUID,
+                &TEMPERATURE_UUID,
+                &mireds.to_le_bytes(),
+            )
+            .await?;
+
+        // White only or color only lights don't have this characteristic
+        if !written {
+            error!("Service or Characteristic \"{TEMPERATURE_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr);
+            return Err(bluest::error::ErrorKind::Other.into());
+        }
+
+        Ok(())
+    }
+
+    /// [warm, cool], only the tunable white variants with separate channels have it
+    pub async fn get_white_mix(&self) -> bluest::Result<[u8; 2]> {
+        let mut buf = [0u8; WHITE_MIX_LEN];
+        let read = if self.probe_char(&WHITE_MIX_UUID, WHITE_MIX_LEN).await? {
+            self.read_gatt_char(&LIGHT_SERVICES_UUID, &WHITE_MIX_UUID)
+                .await?
+        } else {
+            None
+        };
+
+        if let Some(bytes) = read {
+            let len = buf.len().min(bytes.len());
+            buf[..len].copy_from_slice(&bytes[..len]);
+
+            Ok(buf)
+        } else {
+            error!("Service or Characteristic \"{WHITE_MIX_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr);
+            Err(bluest::error::ErrorKind::Other.into())
+        }
+    }
+
+    pub async fn set_white_mix(&self, mix: [u8; 2]) -> bluest::Result<()> {
+        let written = self.probe_char(&WHITE_MIX_UUID, WHITE_MIX_LEN).await?
+            && self
+                .write_gatt_char(&LIGHT_SERVICES_UUID, &WHITE_MIX_UUID, &mix)
+                .await?;
+
+        // Most lights only have TEMPERATURE_UUID
+        if !written {
+            error!("Service or Characteristic \"{WHITE_MIX_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr);
+            return Err(bluest::error::ErrorKind::Other.into());
+        }
+
+        Ok(())
+    }
+
+    /// The `constants::features` its characteristics tell, the capabilities included. See quirks
+    /// for the others
+    pub async fn get_features(&self) -> bluest::Result<u32> {
+        let mut found = self.get_capabilities().await? as u32;
+        for (charac, feature) in [
+            (CONTROL_UUID, features::COMBINED_WRITE),
+            (POWER_ON_UUID, features::STARTUP_STATE),
+        ] {
+            if self.has_gatt_char(&LIGHT_SERVICES_UUID, &charac).await? {
+                found |= feature;
+            }
+        }
+        if self.probe_char(&EFFECT_UUID, EFFECT_LEN).await? {
+            found |= features::EFFECTS;
+        }
+
+        Ok(found)
+    }
+
+    /// Whether the device has the combined control characteristic of write_control
+    pub async fn has_control(&self) -> bluest::Result<bool> {
+        self.has_gatt_char(&LIGHT_SERVICES_UUID, &CONTROL_UUID)
+            .await
+    }
+
+    /// Writes a control characteristic payload, see `utils::control_payload`
+    pub async fn write_control(&self, payload: &[u8]) -> bluest::Result<()> {
+        let written = self
+            .write_gatt_char(&LIGHT_SERVICES_UUID, &CONTROL_UUID, payload)
+            .await?;
+
+        if !written {
+            error!("Service or Characteristic \"{CONTROL_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr);
+            return Err(bluest::error::ErrorKind::Other.into());
+        }
+
+        Ok(())
+    }
+
+    /// None if the light doesn't tell its range or if it's invalid
+    pub async fn get_brightness_range(&self) -> bluest::Result<Option<(u8, u8)>> {
+        let read = self
+            .read_gatt_char(&LIGHT_SERVICES_UUID, &BRIGHTNESS_RANGE_UUID)
+            .await?;
+
+        Ok(read.and_then(|bytes| match bytes[..] {
+            [min, max, ..] if MIN_BRIGHTNESS <= min && min <= max && max <= MAX_BRIGHTNESS => {
+                Some((min, max))
+            }
+            _ => None,
+        }))
+    }
+
+    /// See `constants::capabilities`
+    pub async fn get_capabilities(&self) -> bluest::Result<u8> {
+        let mut caps = 0;
+        for (charac, cap) in [
+            (COLOR_UUID, capabilities::COLOR),
+            (TEMPERATURE_UUID, capabilities::COLOR_TEMP),
+            (BRIGHTNESS_UUID, capabilities::DIMMING),
+        ] {
+            if self.has_gatt_char(&LIGHT_SERVICES_UUID, &charac).await? {
+                caps |= cap;
+            }
+        }
+        if self.probe_char(&WHITE_MIX_UUID, WHITE_MIX_LEN).await? {
+            caps |= capabilities::WHITE_MIX;
+        }
+
+        Ok(caps)
+    }
+
+    pub async fn get_power_on(&self) -> bluest::Result<[u8; POWER_ON_LEN]> {
+        let mut buf = [0u8; POWER_ON_LEN];
+        if let Some(bytes) = self
+            .read_gatt_char(&LIGHT_SERVICES_UUID, &POWER_ON_UUID)
+            .await?
+        {
+            let len = buf.len().min(bytes.len());
+            buf[..len].copy_from_slice(&bytes[..len]);
+
+            Ok(buf)
+        } else {
+            error!("Service or Characteristic \"{POWER_ON_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr);
+            Err(bluest::error::ErrorKind::Other.into())
+        }
+    }
+
+    pub async fn set_power_on(&self, buf: [u8; POWER_ON_LEN]) -> bluest::Result<()> {
+        let written = self
+            .write_gatt_char(&LIGHT_SERVICES_UUID, &POWER_ON_UUID, &buf)
+            .await?;
+
+        // Older firmwares don't have this characteristic
+        if !written {
+            error!("Service or Characteristic \"{POWER_ON_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr);
+            return Err(bluest::error::ErrorKind::Other.into());
+        }
+
+        Ok(())
+    }
+
+    /// See `constants::effect`
+    pub async fn get_effect(&self) -> bluest::Result<u8> {
+        let read = if self.probe_char(&EFFECT_UUID, EFFECT_LEN).await? {
+            self.read_gatt_char(&LIGHT_SERVICES_UUID, &EFFECT_UUID)
+                .await?
+        } else {
+            None
+        };
+
+        if let Some(bytes) = read {
+            Ok(bytes.first().copied().unwrap_or(effect::NONE))
+        } else {
+            error!("Service or Characteristic \"{EFFECT_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr);
+            Err(bluest::error::ErrorKind::Other.into())
+        }
+    }
+
+    /// Windows only takes presets so the closest one to the intervals is requested, the MTU is
+    /// negotiated by Windows itself. Ok(false) if this Windows version cannot request them
+    /// (before Windows 11)
+    pub async fn request_connection_params(
+        &self,
+        min_interval_ms: u16,
+        max_interval_ms: u16,
+        _mtu: u16,
+    ) -> bluest::Result<bool> {
+        let Some(device) = get_windows_device_from_device_id(self.id().to_string()).await else {
+            error!("Failed to get the Windows device of {:?}", self.addr);
+            return Err(bluest::error::ErrorKind::NotFound.into());
+        };
+
+        let params = if max_interval_ms <= 15 {
+            BluetoothLEPreferredConnectionParameters::ThroughputOptimized()
+        } else if min_interval_ms >= 100 {
+            BluetoothLEPreferredConnectionParameters::PowerOptimized()
+        } else {
+            BluetoothLEPreferredConnectionParameters::Balanced()
+        };
+
+        let request =
+            match params.and_then(|params| device.RequestPreferredConnectionParameters(&params)) {
+                Ok(request) => request,
+                Err(error) => {
+                    warn!(
+                        "Connection parameters of {:?} cannot be requested: {error}",
+                        self.addr
+                    );
+                    return Ok(false);
+                }
+            };
+
+        if !request.Status().is_ok_and(|status| {
+            status == BluetoothLEPreferredConnectionParametersRequestStatus::Success
+        }) {
+            return Ok(false);
+        }
+
+        let mut requests = CONNECTION_PARAMS_REQUESTS.lock().unwrap();
+        requests.retain(|(addr, _)| *addr != self.addr);
+        requests.push((self.addr, request));
+
+        Ok(true)
+    }
+
+    /// Firmware revision of the device information service, e.g. "1.104.2"
+    pub async fn get_firmware_version(&self) -> bluest::Result<String> {
+        if let Some(bytes) = self
+            .read_gatt_char(&MISC_SERVICES_UUID, &FIRMWARE_UUID)
+            .await?
+        {
+            Ok(String::from_utf8_lossy(&bytes)
+                .trim_end_matches('\0')
+                .to_owned())
+        } else {
+            error!("Service or Characteristic \"{FIRMWARE_UUID}\" for \"{MISC_SERVICES_UUID}\" not found for device {:?}", self.addr);
+            Err(bluest::error::ErrorKind::Other.into())
+        }
+    }
+
+    pub async fn set_effect(&self, effect: u8) -> bluest::Result<()> {
+        let written = self.probe_char(&EFFECT_UUID, EFFECT_LEN).await?
+            && self
+                .write_gatt_char(&LIGHT_SERVICES_UUID, &EFFECT_UUID, &[effect])
+                .await?;
+
+        // Lights without effects don't have this characteristic
+        if !written {
+            error!("Service or Characteristic \"{EFFECT_UUID}\" for \"{LIGHT_SERVICES_UUID}\" not found for device {:?}", self.addr);
+            return Err(bluest::error::ErrorKind::Other.into());
+        }
+
+        Ok(())
+    }
+
+    /// Subscribes to the notifications of the state characteristics, a message is received on
+    /// every change. It lasts as long as the connection, the receiver can be dropped anytime
+    pub async fn state_changes(&self) -> bluest::Result<mpsc::UnboundedReceiver<()>> {
+        let uuids = [POWER_UUID, BRIGHTNESS_UUID, TEMPERATURE_UUID, COLOR_UUID];
+
+        let Some(service) = self
+            .services()
+            .await?
+            .into_iter()
+            .find(|s| s.uuid() == LIGHT_SERVICES_UUID)
+        else {
+            error!(
+                "Service \"{LIGHT_SERVICES_UUID}\" not found for device {:?}",
+                self.addr
+            );
+            return Err(bluest::error::ErrorKind::NotFound.into());
+        };
+
+        let (tx, rx) = mpsc::unbounded_channel();
+
+        for characteristic in service.characteristics().await? {
+            if !uuids.contains(&characteristic.uuid()) {
+                continue;
+            }
+
+            let tx = tx.clone();
+            tokio::spawn(async move {
+                let Ok(mut notifications) = characteristic.notify().await else {
+                    return;
+                };
+
+                while let Some(Ok(_)) = notifications.next().await {
+                    if tx.send(()).is_err() {
+                        break;
+                    }
+                }
+            });
+        }
+
+        Ok(rx)
+    }
+
+    /// get_name_bytes with the invalid UTF-8 sequences replaced
     pub async fn get_name(&self) -> bluest::Result<Option<String>> {
-        self.name_async().await.map(Some)
+        Ok(self
+            .get_name_bytes()
+            .await?
+            .map(|bytes| String::from_utf8_lossy(&bytes).into_owned()))
+    }
+
+    /// Reads the name characteristic so a renamed device is up to date, the advertised name (that
+    /// may be cached) is used otherwise. The bytes are the ones of the device, a bulb may return
+    /// anything
+    pub async fn get_name_bytes(&self) -> bluest::Result<Option<Vec<u8>>> {
+        if let Ok(Some(bytes)) = self.read_gatt_char(&CONFIG_SERVICES_UUID, &NAME_UUID).await {
+            return Ok(Some(bytes));
+        }
+
+        self.name_async().await.map(|name| Some(name.into_bytes()))
+    }
+
+    pub async fn set_name(&self, name: &str) -> bluest::Result<()> {
+        let written = self
+            .write_gatt_char(&CONFIG_SERVICES_UUID, &NAME_UUID, name.as_bytes())
+            .await?;
+
+        if !written {
+            error!("Service or Characteristic \"{NAME_UUID}\" for \"{CONFIG_SERVICES_UUID}\" not found for device {:?}", self.addr);
+            return Err(bluest::error::ErrorKind::Other.into());
+        }
+
+        Ok(())
     }
 }
@@ -0,0 +1,18 @@
+use std::process::Command;
+
+// Embeds the commit hash in the version reported to the clients when built from a git checkout
+fn main() {
+    let hash = Command::new("git")
+        .args(["rev-parse", "--short", "HEAD"])
+        .output()
+        .ok()
+        .filter(|out| out.status.success())
+        .and_then(|out| String::from_utf8(out.stdout).ok());
+
+    if let Some(hash) = hash {
+        println!("cargo:rustc-env=RUSTBEE_GIT_HASH={}", hash.trim());
+    }
+
+    println!("cargo:rerun-if-changed=../.git/HEAD");
+    println!("cargo:rerun-if-changed=../.git/refs/heads");
+}
@@ -1,34 +1,183 @@
-use std::path::Path;
-use std::sync::Arc;
-use std::time::Duration;
+use std::collections::{BTreeMap, BTreeSet};
+use std::future::Future;
+use std::hash::{BuildHasher as _, RandomState};
+use std::net::SocketAddr;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, AtomicU32, AtomicU64, AtomicUsize, Ordering};
+use std::sync::{Arc, LazyLock, Mutex as StdMutex, OnceLock};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
 use std::{collections::HashMap, io::Error};
 
 use futures::stream::StreamExt as _;
 use interprocess::local_socket::{
-    tokio::Stream, traits::tokio::Listener as _, GenericFilePath, ListenerNonblockingMode,
-    ListenerOptions, ToFsName as _,
+    traits::tokio::Listener as _, GenericFilePath, ListenerNonblockingMode, ListenerOptions,
+    ToFsName as _,
 };
 use tokio::fs;
-use tokio::sync::Mutex;
+use tokio::net::{self, TcpListener};
+use tokio::sync::{broadcast, mpsc, Mutex, Notify, OwnedRwLockWriteGuard, RwLock};
+use tokio::task::{self, JoinHandle, JoinSet};
 use tokio::{
-    io::{AsyncReadExt as _, AsyncWriteExt as _},
+    io::{AsyncRead, AsyncReadExt as _, AsyncWrite, AsyncWriteExt as _},
     signal,
-    time::{self, sleep},
+    time::{self, sleep, Instant},
 };
 
 use rustbee_common::bluetooth::*;
+use rustbee_common::bonds::Bonds;
+use rustbee_common::colors::Gamut;
 use rustbee_common::constants::{
-    MaskT, OutputCode, ADDR_LEN, BUFFER_LEN, OUTPUT_LEN, SET, SOCKET_PATH,
+    connect_stage, connection_params, control, exit_code, features, masks::WRITE_RETRIES_SHIFT,
+    scene_op, schedule_op, scheduled_state, MaskT, OutputCode, ADDR_LEN, ADV_CHUNK_LEN, BUFFER_LEN,
+    FLAGS_LEN, GATT_MAX_LEN, GATT_UNKNOWN_CHAR, LOG_CHUNK_LEN, MAX_BRIGHTNESS, MIN_BRIGHTNESS,
+    MODEL_UUID, OUTPUT_LEN, POWER_ON_LEN, POWER_ON_UUID, SCENE_UNKNOWN, SCHEDULE_UNKNOWN_JOB, SET,
+    SHUTDOWN_TIMEOUT_SECS, STATS_VERSION, TRANSITION_OFFSET,
 };
 use rustbee_common::device::*;
 use rustbee_common::logger::*;
+use rustbee_common::quirks;
+use rustbee_common::scenes::{SceneDevice, Scenes};
+use rustbee_common::utils::{
+    bonds_path, combined_control_payload, control_payload, data_dir, format_addr, is_dir_writable,
+    scenes_path, socket_path,
+};
 #[cfg(not(target_os = "windows"))]
 use rustbee_common::BluetoothPeripheralImpl as _;
 
+mod simulated;
+
 const TIMEOUT_SECS: u64 = 60 * 10;
 const FOUND_DEVICE_TIMEOUT_SECS: u64 = 30;
+/// Records kept for the clients that are late to stream them
+const LOG_RECORDS_CAPACITY: usize = 256;
+/// Time left to the in-flight requests on SIGINT
+const SHUTDOWN_DRAIN_SECS: u64 = 2;
+/// Covers the drain and the disconnection of every device on shutdown, see shutdown_devices
+const SHUTDOWN_DEVICES_MS: u64 = 2000;
+// The client waits for the whole shutdown
+const _: () =
+    assert!(SHUTDOWN_DRAIN_SECS * 1000 + SHUTDOWN_DEVICES_MS < SHUTDOWN_TIMEOUT_SECS * 1000);
+/// Connection checks of the subscribed devices when AUTO_RECONNECT is enabled
+const WATCHDOG_INTERVAL_SECS: u64 = 5;
+/// Default RECONNECT_POLICY
+const RECONNECT_BACKOFF_MS: u64 = 500;
+const RECONNECT_MAX_BACKOFF_SECS: u64 = 30;
+/// Connection checks of the devices watched with ConnectionEvents, the drops aren't notified
+const LINK_POLL_MS: u64 = 1000;
+/// Changes kept for the watchers that are late to read them, see link_changed
+const LINK_CHANGES_CAPACITY: usize = 64;
+/// A TCP client that didn't send its token by then is dropped
+const TCP_HANDSHAKE_TIMEOUT_SECS: u64 = 5;
+/// Longest sleep of a scheduled job before it checks the wall clock again
+const SCHEDULE_RECHECK_MS: u64 = 60 * 1000;
+/// Checks of the keep-alive reads that are due, see keep_alive
+const KEEPALIVE_TICK_MS: u64 = 100;
+
+static LOGGER: Logger = Logger::new("Rustbee-Daemon", false)
+    .forwarding_to(forward_log)
+    .with_context(log_context);
+/// Records of LOGGER for the clients streaming them, see stream_logs
+static LOG_RECORDS: LazyLock<broadcast::Sender<(Level, String)>> =
+    LazyLock::new(|| broadcast::channel(LOG_RECORDS_CAPACITY).0);
+/// Addresses of the devices connected or disconnected by the daemon, see stream_connection_changes
+static LINK_CHANGES: LazyLock<broadcast::Sender<[u8; ADDR_LEN]>> =
+    LazyLock::new(|| broadcast::channel(LINK_CHANGES_CAPACITY).0);
+/// The daemon doesn't time out while a client is subscribed
+static SUBSCRIPTIONS: AtomicUsize = AtomicUsize::new(0);
+/// Notified by the Shutdown command, it stops accepting connections like a SIGINT does
+static SHUTDOWN_REQUESTED: Notify = Notify::const_new();
+/// The client of a Shutdown command sent with SET, it's answered the devices shut down cleanly
+/// once they're all disconnected
+static SHUTDOWN_REPORT: StdMutex<Option<Stream>> = StdMutex::new(None);
+
+/// Accepts the TCP clients on its address, see listen_tcp. The daemon doesn't time out while it's
+/// listening
+static TCP_LISTENER: StdMutex<Option<(SocketAddr, JoinHandle<()>)>> = StdMutex::new(None);
+
+/// The TCP clients that sent the token, main runs them with the local connections so that they're
+/// drained on shutdown too
+static TCP_CONNS: OnceLock<mpsc::UnboundedSender<Stream>> = OnceLock::new();
+
+/// Subscribed devices that drop are reconnected and subscribed again, see resume_subscription
+static AUTO_RECONNECT: AtomicBool = AtomicBool::new(false);
+/// First and longest backoff between the reconnection attempts of a dropped device, see
+/// retry_with_backoff
+static RECONNECT_POLICY: StdMutex<(Duration, Duration)> = StdMutex::new((
+    Duration::from_millis(RECONNECT_BACKOFF_MS),
+    Duration::from_secs(RECONNECT_MAX_BACKOFF_SECS),
+));
+/// Current backoff of the devices being reconnected, see BackingOff
+static BACKOFFS: StdMutex<BTreeMap<[u8; ADDR_LEN], Duration>> = StdMutex::new(BTreeMap::new());
+
+/// Seconds a disconnected device stays connected in case it's connected again, 0 disables it,
+/// see close_cached_connections
+static CONNECTION_CACHE_TTL_SECS: AtomicU32 = AtomicU32::new(0);
+/// Devices disconnected by a client but still connected until the Instant, they're reported as
+/// disconnected and their next command uses the connection right away
+static CACHED: StdMutex<BTreeMap<[u8; ADDR_LEN], Instant>> = StdMutex::new(BTreeMap::new());
+/// Seconds without commands after which a device is disconnected, 0 disables it, see
+/// disconnect_idle_devices
+static IDLE_DISCONNECT_SECS: AtomicU32 = AtomicU32::new(0);
+/// Requests in flight per device, see InUse
+static ACTIVITY: StdMutex<BTreeMap<[u8; ADDR_LEN], Activity>> = StdMutex::new(BTreeMap::new());
+/// Devices disconnected for being idle, they're still reported as connected and are reconnected
+/// by their next command
+static IDLE_DISCONNECTED: StdMutex<BTreeSet<[u8; ADDR_LEN]>> = StdMutex::new(BTreeSet::new());
+/// Interval of the keep-alive reads per device and the Instant of the last one, see keep_alive
+static KEEPALIVES: StdMutex<BTreeMap<[u8; ADDR_LEN], (Duration, Instant)>> =
+    StdMutex::new(BTreeMap::new());
+
+/// Counters since the daemon started, see send_stats
+static STATS: Stats = Stats {
+    reconnects: AtomicU32::new(0),
+    failed_commands: AtomicU32::new(0),
+    timed_commands: AtomicU64::new(0),
+    total_latency_ms: AtomicU64::new(0),
+};
+
+/// In the data dir of the daemon, it's set by the client that launched it (see data_dir)
+static SCENES_PATH: LazyLock<PathBuf> = LazyLock::new(scenes_path);
+static BONDS_PATH: LazyLock<PathBuf> = LazyLock::new(bonds_path);
+
+/// Serializes the reads and writes of SCENES_PATH
+static SCENES_LOCK: StdMutex<()> = StdMutex::new(());
+/// Serializes the reads and writes of BONDS_PATH
+static BONDS_LOCK: StdMutex<()> = StdMutex::new(());
+
+/// Power state and raw brightness of the devices turned off by AllPower, restored when they're
+/// turned back on
+static SAVED_POWER: StdMutex<BTreeMap<[u8; ADDR_LEN], (u8, u8)>> = StdMutex::new(BTreeMap::new());
+
+/// Brightness range of the devices, read once since it doesn't change, see brightness_range
+static BRIGHTNESS_RANGES: StdMutex<BTreeMap<[u8; ADDR_LEN], Option<(u8, u8)>>> =
+    StdMutex::new(BTreeMap::new());
+/// Serializes the toggles of a device with each other only, the power writes don't take it. See
+/// toggle_power
+static TOGGLE_LOCKS: LazyLock<StdMutex<HashMap<[u8; ADDR_LEN], Arc<Mutex<()>>>>> =
+    LazyLock::new(Default::default);
+/// Shared by the requests of a device while they run, Flush takes it alone, see drain
+static WRITE_BARRIERS: LazyLock<StdMutex<HashMap<[u8; ADDR_LEN], Arc<RwLock<()>>>>> =
+    LazyLock::new(Default::default);
+/// See device_features, like the brightness ranges a firmware update is seen once the daemon
+/// restarts
+static DEVICE_FEATURES: StdMutex<BTreeMap<[u8; ADDR_LEN], u32>> = StdMutex::new(BTreeMap::new());
+
+/// The jobs waiting for their time, a job removes itself once it starts. See schedule
+static SCHEDULED: StdMutex<BTreeMap<u64, JoinHandle<()>>> = StdMutex::new(BTreeMap::new());
+
+/// Set by the clients, see device_label
+static TAGS: StdMutex<BTreeMap<[u8; ADDR_LEN], String>> = StdMutex::new(BTreeMap::new());
+/// Device of the tasks handling a device, see Labelled
+static LABELLED: LazyLock<StdMutex<HashMap<task::Id, [u8; ADDR_LEN]>>> =
+    LazyLock::new(|| StdMutex::new(HashMap::new()));
+static NEXT_JOB: AtomicU64 = AtomicU64::new(1);
+
+/// The local socket or a TCP connection (see listen_tcp), both take the same requests
+trait Conn: AsyncRead + AsyncWrite + Unpin + Send {}
 
-static LOGGER: Logger = Logger::new("Rustbee-Daemon", false);
+impl<T: AsyncRead + AsyncWrite + Unpin + Send> Conn for T {}
+
+type Stream = Box<dyn Conn>;
 
 #[derive(Debug, PartialEq)]
 enum Command {
@@ -41,6 +190,199 @@ enum Command {
     Disconnect,
     Name,
     SearchName,
+    Temperature,
+    /// [warm, cool] of the variants with separate white channels, see WHITE_MIX_UUID
+    WhiteMix,
+    Scan,
+    /// Modifier of Power, Brightness and colors to fade to the new value
+    Transition,
+    Identify,
+    Ping,
+    Version,
+    Rssi,
+    /// Power, brightness, color and name at once, see send_state
+    State,
+    /// Streams the state on every change, see stream_state_changes
+    Subscribe,
+    PowerOn,
+    /// Read only, the characteristics are known once connected
+    Capabilities,
+    /// Read only, the capabilities with what the firmware supports, see device_features
+    Features,
+    /// Modifier of Connect streaming the stages of the connection, see send_stage
+    ConnectProgress,
+    /// Powers every connected device off or back on, see switch_device
+    AllPower,
+    BrightnessRange,
+    /// Graceful shutdown of this daemon instance, the same as a SIGINT
+    Shutdown,
+    /// Raw read or write of any characteristic, see gatt_access
+    Gatt,
+    /// Modifiers of the writes of the command, without them it's the platform default
+    ConfirmedWrites,
+    UnconfirmedWrites,
+    Effect,
+    /// Read only, cut like the name if it doesn't fit in the output
+    Firmware,
+    /// See toggle_power
+    TogglePower,
+    /// Best effort, the platform may not honor them. It fails with `connection_params::UNSUPPORTED`
+    /// as data if the platform cannot request them at all
+    ConnectionParams,
+    /// See `schedule_op`, only the cancellation is daemon wide
+    Schedule,
+    /// A `scheduled_state` applied right away, see apply_state
+    ApplyState,
+    /// Streams the connection state of the device on every change, see stream_connection_changes
+    ConnectionEvents,
+    /// Modifier of Scan to send the manufacturer data of every device found after it
+    Advertisement,
+    /// Interval in ms of the keep-alive reads of the device, 0 stops them. See keep_alive
+    Keepalive,
+    /// Read of the power queued after the writes sent to the device, it's answered once they're
+    /// applied even if they're unconfirmed
+    Flush,
+    /// Daemon wide, see disconnect_idle_devices
+    IdleDisconnect,
+    /// Daemon wide, the GATT writes per second of every device, 0 doesn't throttle them
+    WriteRate,
+    /// See `scene_op`
+    Scene,
+    /// Daemon wide, see send_stats
+    Stats,
+    /// Daemon wide, see CACHED
+    ConnectionCache,
+    /// Every device known by the daemon, see send_devices
+    Devices,
+    /// Streams the log records, see stream_logs
+    Logs,
+    /// Modifier of Connect pairing the device (see ensure_paired), alone it's the bond status
+    Pair,
+    /// Daemon wide, see AUTO_RECONNECT
+    AutoReconnect,
+    /// Daemon wide, see listen_tcp
+    TcpListen,
+    /// Seeds a virtual device of a simulated daemon, see simulated::process_request
+    SimulatedDevice,
+    /// Daemon wide, the label of the device in the log records, see device_label
+    DeviceTag,
+    /// Daemon wide, see RECONNECT_POLICY
+    ReconnectPolicy,
+}
+
+impl Command {
+    /// The settings, logs and shutdown of the daemon and the simulated devices, refused to the
+    /// TCP clients that only drive the devices
+    fn is_local_only(&self) -> bool {
+        matches!(
+            self,
+            Self::Shutdown
+                | Self::IdleDisconnect
+                | Self::WriteRate
+                | Self::Stats
+                | Self::ConnectionCache
+                | Self::Logs
+                | Self::AutoReconnect
+                | Self::TcpListen
+                | Self::SimulatedDevice
+                | Self::DeviceTag
+                | Self::ReconnectPolicy
+        )
+    }
+}
+
+struct Stats {
+    /// Connections of devices that were already connected once
+    reconnects: AtomicU32,
+    /// Outputs with a failure code, a request can only fail once
+    failed_commands: AtomicU32,
+    /// Device requests and their total duration, see Timed
+    timed_commands: AtomicU64,
+    total_latency_ms: AtomicU64,
+}
+
+/// Adds the time it lived to the latency of the device requests
+struct Timed(Instant);
+
+impl Drop for Timed {
+    fn drop(&mut self) {
+        STATS.timed_commands.fetch_add(1, Ordering::Relaxed);
+        STATS
+            .total_latency_ms
+            .fetch_add(self.0.elapsed().as_millis() as _, Ordering::Relaxed);
+    }
+}
+
+struct Activity {
+    in_flight: usize,
+    last_used: Instant,
+}
+
+/// Marks a device as used for as long as it lives, an idle device is one without any since
+/// IDLE_DISCONNECT_SECS
+struct InUse([u8; ADDR_LEN]);
+
+impl InUse {
+    fn new(addr: [u8; ADDR_LEN]) -> Self {
+        ACTIVITY
+            .lock()
+            .unwrap()
+            .entry(addr)
+            .or_insert(Activity {
+                in_flight: 0,
+                last_used: Instant::now(),
+            })
+            .in_flight += 1;
+
+        Self(addr)
+    }
+}
+
+impl Drop for InUse {
+    fn drop(&mut self) {
+        if let Some(activity) = ACTIVITY.lock().unwrap().get_mut(&self.0) {
+            activity.in_flight -= 1;
+            activity.last_used = Instant::now();
+        }
+    }
+}
+
+/// Reports the backoff of the device in the stats for as long as it lives, see retry_with_backoff
+struct BackingOff([u8; ADDR_LEN]);
+
+impl BackingOff {
+    fn set(&self, backoff: Duration) {
+        BACKOFFS.lock().unwrap().insert(self.0, backoff);
+    }
+}
+
+impl Drop for BackingOff {
+    fn drop(&mut self) {
+        BACKOFFS.lock().unwrap().remove(&self.0);
+    }
+}
+
+/// Labels the records logged by the current task with the device for as long as it lives, see
+/// log_context
+struct Labelled(Option<task::Id>);
+
+impl Labelled {
+    fn new(addr: [u8; ADDR_LEN]) -> Self {
+        let id = task::try_id();
+        if let Some(id) = id {
+            LABELLED.lock().unwrap().insert(id, addr);
+        }
+
+        Self(id)
+    }
+}
+
+impl Drop for Labelled {
+    fn drop(&mut self) {
+        if let Some(id) = self.0 {
+            LABELLED.lock().unwrap().remove(&id);
+        }
+    }
 }
 
 /// converts Result<T, E> into SUCCESS or FAILURE (0 or 1)
@@ -52,20 +394,30 @@ macro_rules! res_to_u8 {
 
 #[tokio::main]
 async fn main() {
+    // Set by the client that launched the daemon if it uses a custom socket path
+    let socket_path = socket_path();
+
     #[cfg(not(target_os = "windows"))]
-    check_if_path_is_writable().await;
+    check_if_path_is_writable(&socket_path).await;
 
     LOGGER.init();
 
-    if Path::new(SOCKET_PATH).exists() {
+    info!("Data directory: {}", data_dir().display());
+
+    if *simulated::ENABLED {
+        info!("Simulated daemon, the devices are virtual and Bluetooth isn't used");
+    }
+
+    if Path::new(&socket_path).exists() {
         error!("Error: socket is already in use, an instance might already be running");
-        std::process::exit(2);
+        std::process::exit(exit_code::SOCKET_IN_USE);
     }
 
-    let fs_name = SOCKET_PATH
+    let fs_name = socket_path
+        .as_str()
         .to_fs_name::<GenericFilePath>()
         .unwrap_or_else(|error| {
-            error!("Error cannot create filesystem path name: {SOCKET_PATH} => {error}");
+            error!("Error cannot create filesystem path name: {socket_path} => {error}");
             std::process::exit(1);
         });
 
@@ -78,36 +430,142 @@ async fn main() {
         Ok(listener) => listener,
         Err(error) => {
             error!("Error on spawning local socket: {error}");
-            std::process::exit(1);
+            std::process::exit(match error.kind() {
+                std::io::ErrorKind::AddrInUse => exit_code::SOCKET_IN_USE,
+                std::io::ErrorKind::PermissionDenied => exit_code::PERMISSION_DENIED,
+                _ => 1,
+            });
         }
     };
 
     let devices: Arc<Mutex<HashMap<[u8; ADDR_LEN], HueDevice<Server>>>> =
         Arc::new(Mutex::new(HashMap::new()));
 
+    tokio::spawn(reap_connections(Arc::clone(&devices)));
+    tokio::spawn(keep_alive(Arc::clone(&devices)));
+
+    let mut conns = JoinSet::new();
+    let (tcp_conns, mut accepted) = mpsc::unbounded_channel();
+    TCP_CONNS.set(tcp_conns).unwrap();
+
     loop {
+        // Reaps the finished connections
+        while conns.try_join_next().is_some() {}
+
         tokio::select! {
             _ = signal::ctrl_c() => {
                 warn!("SIGINT received, disconnecting...");
                 break;
             },
+            _ = SHUTDOWN_REQUESTED.notified() => {
+                warn!("Shutdown requested, disconnecting...");
+                break;
+            },
             timeout = time::timeout(Duration::from_secs(TIMEOUT_SECS), listener.accept()) => {
                 let Ok(conn) = timeout else {
+                    if SUBSCRIPTIONS.load(Ordering::Relaxed) > 0
+                        || TCP_LISTENER.lock().unwrap().is_some()
+                        || !SCHEDULED.lock().unwrap().is_empty()
+                    {
+                        continue;
+                    }
+
                     // Timed out
                     break;
                 };
 
-                tokio::spawn(process_conn(conn, Arc::clone(&devices)));
+                let conn = conn.map(|stream| Box::new(stream) as Stream);
+                conns.spawn(process_conn(conn, Arc::clone(&devices), false));
+            }
+            Some(stream) = accepted.recv() => {
+                conns.spawn(process_conn(Ok(stream), Arc::clone(&devices), true));
             }
         }
     }
 
-    for (_, device) in devices.lock().await.iter() {
-        let _ = device.try_disconnect().await;
+    // Lets the pending writes reach the devices, subscriptions never end so they're aborted
+    let drain = async { while conns.join_next().await.is_some() {} };
+    if time::timeout(Duration::from_secs(SHUTDOWN_DRAIN_SECS), drain)
+        .await
+        .is_err()
+    {
+        warn!("{} connection(s) still running, aborting them", conns.len());
+        conns.shutdown().await;
+    }
+
+    let (clean, total) = shutdown_devices(&devices).await;
+    info!("{clean} of {total} device(s) shut down cleanly");
+
+    let report = SHUTDOWN_REPORT.lock().unwrap().take();
+    if let Some(mut stream) = report {
+        let mut buf = [0; OUTPUT_LEN];
+        buf[0] = OutputCode::Success.into();
+        buf[1..5].copy_from_slice(&clean.to_le_bytes());
+        buf[5..9].copy_from_slice(&total.to_le_bytes());
+
+        // The client may be gone already
+        if stream.write_all(&buf).await.is_ok() {
+            let _ = stream.flush().await;
+        }
     }
 
     #[cfg(not(target_os = "windows"))]
-    std::fs::remove_file(SOCKET_PATH).unwrap();
+    std::fs::remove_file(&socket_path).unwrap();
+}
+
+/// Drains then disconnects the devices at once, see teardown_in_order. A connected device is
+/// drained like Flush. Returns (clean, total), the others are logged
+async fn shutdown_devices(
+    devices: &Mutex<HashMap<[u8; ADDR_LEN], HueDevice<Server>>>,
+) -> (u32, u32) {
+    let known = devices
+        .lock()
+        .await
+        .iter()
+        .map(|(addr, device)| (*addr, device.clone()))
+        .collect::<Vec<_>>();
+    let total = known.len() as _;
+
+    let clean = teardown_in_order(known, |device| async move {
+        if matches!(device.is_device_connected().await, Ok(true)) && !drain(&device).await {
+            return Err("drain its writes");
+        }
+
+        device.try_disconnect().await.map_err(|_| "disconnect")
+    })
+    .await;
+
+    (clean, total)
+}
+
+/// Runs the teardown of every device concurrently, started in the order of their address and all
+/// within SHUTDOWN_DEVICES_MS. Returns how many succeeded, the others are logged in address order
+async fn teardown_in_order<T, F, Fut>(mut known: Vec<([u8; ADDR_LEN], T)>, teardown: F) -> u32
+where
+    F: Fn(T) -> Fut,
+    Fut: Future<Output = Result<(), &'static str>>,
+{
+    known.sort_unstable_by_key(|(addr, _)| *addr);
+
+    let deadline = time::Instant::now() + Duration::from_millis(SHUTDOWN_DEVICES_MS);
+    // Polled in order, so the first step of each teardown runs in address order
+    let teardowns = known.into_iter().map(|(addr, device)| {
+        let teardown = teardown(device);
+        async move { (addr, time::timeout_at(deadline, teardown).await) }
+    });
+
+    let mut clean = 0;
+    for (addr, result) in futures::future::join_all(teardowns).await {
+        match result {
+            Ok(Ok(())) => clean += 1,
+            Ok(Err(step)) => warn!("Device {addr:?} failed to {step} on shutdown"),
+            Err(_) => {
+                warn!("Timeout: device {addr:?} didn't shut down within {SHUTDOWN_DEVICES_MS}ms")
+            }
+        }
+    }
+
+    clean
 }
 
 /*
@@ -117,9 +575,11 @@ async fn main() {
  * - Multiple commands can be used at the same time like PAIR | CONNECT | POWER for example but do
  * not use multiple commands that returns data, the output could be corrupted
  */
+/// A remote connection is a TCP client, see listen_tcp
 async fn process_conn(
     conn: Result<Stream, Error>,
     devices: Arc<Mutex<HashMap<[u8; ADDR_LEN], HueDevice<Server>>>>,
+    remote: bool,
 ) {
     match conn {
         Ok(mut stream) => {
@@ -132,15 +592,18 @@ async fn process_conn(
             for (i, byte) in buf[..addr.len()].iter().enumerate() {
                 addr[i] = *byte;
             }
-            let flags = ((buf[7] as u16) << 8) | buf[6] as u16;
-            let set = buf[8] == SET;
-            let data = &buf[9..];
+            let flags = MaskT::from_le_bytes(buf[ADDR_LEN..][..FLAGS_LEN].try_into().unwrap());
+            let set = buf[ADDR_LEN + FLAGS_LEN] == SET;
+            let data = &buf[ADDR_LEN + FLAGS_LEN + 1..];
 
             let mut output_buf = [0; OUTPUT_LEN];
             output_buf[0] = u8::MAX;
 
             let mut commands = get_commands_from_flags(flags);
 
+            // The daemon wide requests don't have a device
+            let _labelled = (addr != [0; ADDR_LEN]).then(|| Labelled::new(addr));
+
             debug!("{buf:?}");
             debug!(
                 "addr: {:?} flags: {} set {} data: {:?}",
@@ -148,6 +611,145 @@ async fn process_conn(
             );
             debug!("addr: {addr:?} commands: {commands:?}");
 
+            // Liveness check of the daemon, answered right away
+            if commands.contains(&Command::Ping) {
+                send_output_code(&mut stream, OutputCode::Success).await;
+                return;
+            }
+
+            // The daemon itself is only managed by the clients of its host
+            if remote && commands.iter().any(Command::is_local_only) {
+                warn!("Refused the commands {commands:?} of a TCP client, they're local only");
+                send_output_code(&mut stream, OutputCode::Failure).await;
+                return;
+            }
+
+            // Answered before the shutdown so the client knows it was received
+            if commands.contains(&Command::Shutdown) {
+                send_output_code(&mut stream, OutputCode::Success).await;
+                if set {
+                    *SHUTDOWN_REPORT.lock().unwrap() = Some(stream);
+                }
+                SHUTDOWN_REQUESTED.notify_one();
+                return;
+            }
+
+            if commands.contains(&Command::IdleDisconnect) {
+                let secs = u32::from_le_bytes([data[0], data[1], data[2], data[3]]);
+                IDLE_DISCONNECT_SECS.store(secs, Ordering::Relaxed);
+
+                send_output_code(&mut stream, OutputCode::Success).await;
+                return;
+            }
+
+            if commands.contains(&Command::WriteRate) {
+                set_write_rate(u32::from_le_bytes([data[0], data[1], data[2], data[3]]));
+
+                send_output_code(&mut stream, OutputCode::Success).await;
+                return;
+            }
+
+            // The cached connections keep their expiry, they're closed by reap_connections
+            if commands.contains(&Command::ConnectionCache) {
+                let secs = u32::from_le_bytes([data[0], data[1], data[2], data[3]]);
+                CONNECTION_CACHE_TTL_SECS.store(secs, Ordering::Relaxed);
+
+                send_output_code(&mut stream, OutputCode::Success).await;
+                return;
+            }
+
+            // The running subscriptions are watched as well
+            if commands.contains(&Command::AutoReconnect) {
+                AUTO_RECONNECT.store(data[0] == true as u8, Ordering::Relaxed);
+
+                send_output_code(&mut stream, OutputCode::Success).await;
+                return;
+            }
+
+            // The devices already reconnecting keep the previous policy
+            if commands.contains(&Command::ReconnectPolicy) {
+                let base_ms = u32::from_le_bytes([data[0], data[1], data[2], data[3]]);
+                let max_ms = u32::from_le_bytes([data[4], data[5], data[6], data[7]]);
+
+                if base_ms == 0 || max_ms < base_ms {
+                    error!("Invalid reconnect policy of {base_ms}ms up to {max_ms}ms");
+                    send_output_code(&mut stream, OutputCode::Failure).await;
+                    return;
+                }
+
+                *RECONNECT_POLICY.lock().unwrap() = (
+                    Duration::from_millis(base_ms as _),
+                    Duration::from_millis(max_ms as _),
+                );
+
+                send_output_code(&mut stream, OutputCode::Success).await;
+                return;
+            }
+
+            // Scheduling needs the device, cancelling only needs the job
+            if commands.contains(&Command::Schedule) && data[0] == schedule_op::CANCEL {
+                let job = u64::from_le_bytes(data[1..9].try_into().unwrap());
+
+                output_buf[0] = if cancel_scheduled(job) {
+                    OutputCode::Success.into()
+                } else {
+                    output_buf[1] = SCHEDULE_UNKNOWN_JOB;
+                    OutputCode::Failure.into()
+                };
+
+                send_to_stream(&mut stream, output_buf).await;
+                return;
+            }
+
+            if commands.contains(&Command::TcpListen) {
+                let code = listen_tcp(&mut stream).await;
+                send_output_code(&mut stream, code).await;
+                return;
+            }
+
+            // The tag is nul padded, an empty one goes back to the address
+            if commands.contains(&Command::DeviceTag) {
+                let len = data.iter().position(|b| *b == b'\0').unwrap_or(data.len());
+                let tag = String::from_utf8_lossy(&data[..len]).into_owned();
+
+                let mut tags = TAGS.lock().unwrap();
+                if tag.is_empty() {
+                    tags.remove(&addr);
+                } else {
+                    tags.insert(addr, tag);
+                }
+                drop(tags);
+
+                send_output_code(&mut stream, OutputCode::Success).await;
+                return;
+            }
+
+            if commands.contains(&Command::Version) {
+                let mut buf = [0; OUTPUT_LEN];
+                buf[0] = OutputCode::Success.into();
+
+                for (i, byte) in daemon_version().bytes().take(OUTPUT_LEN - 1).enumerate() {
+                    buf[i + 1] = byte;
+                }
+
+                send_to_stream(&mut stream, buf).await;
+                return;
+            }
+
+            // Answered by the virtual devices, the daemon wide commands are left to the branches
+            // below
+            if *simulated::ENABLED
+                && simulated::process_request(&mut stream, addr, &commands, set, data).await
+            {
+                return;
+            }
+
+            if commands.contains(&Command::SimulatedDevice) {
+                warn!("Not a simulated daemon, the virtual device {addr:?} is ignored");
+                send_output_code(&mut stream, OutputCode::Failure).await;
+                return;
+            }
+
             // Commands that are executed alone and only alone without the need to fetch the device
             if commands.contains(&Command::SearchName) {
                 let name =
@@ -157,34 +759,7 @@ async fn process_conn(
                 let mut device_sent = 0;
 
                 while let Some(device) = stream_iter.next().await {
-                    let mut buf = [0; OUTPUT_LEN];
-                    buf[0] = OutputCode::Streaming.into();
-
-                    let addr = device.addr;
-                    for (i, byte) in addr.iter().enumerate() {
-                        buf[i + 1] = *byte;
-                    }
-
-                    for (i, byte) in device
-                        .get_name()
-                        .await
-                        .map_err(|_| Some(String::new()))
-                        .unwrap()
-                        .or_else(|| Some(String::new()))
-                        .unwrap()
-                        .as_bytes()
-                        .iter()
-                        .enumerate()
-                    {
-                        let offset = addr.len() + 1 + i;
-                        if offset >= buf.len() {
-                            break;
-                        }
-
-                        buf[offset] = *byte;
-                    }
-
-                    send_to_stream(&mut stream, buf).await;
+                    send_found_device(&mut stream, &device).await;
                     device_sent += 1;
                 }
 
@@ -197,110 +772,509 @@ async fn process_conn(
                 return;
             }
 
-            let mut devices = devices.lock().await;
-            if devices.get(&addr).is_none() {
-                match time::timeout(
-                    Duration::from_secs(FOUND_DEVICE_TIMEOUT_SECS),
-                    get_device(addr),
-                )
-                .await
-                {
-                    Err(elapsed) => {
-                        // Timed out
-                        warn!("Timeout: {elapsed} during device discovery, address: {addr:?}");
-                        send_output_code(&mut stream, OutputCode::DeviceNotFound).await;
+            // Streams every (named) device found until the duration in ms is elapsed or until the
+            // client sends anything, it's not an error to find none. With Advertisement, its
+            // manufacturer data follows every device.
+            if commands.contains(&Command::Scan) {
+                let advertisement = commands.contains(&Command::Advertisement);
+                let duration_ms = u32::from_le_bytes([data[0], data[1], data[2], data[3]]);
+                let deadline = Instant::now() + Duration::from_millis(duration_ms as _);
+                let idle_timeout_secs = (duration_ms as u64).div_ceil(1000).max(1);
+
+                let mut stream_iter = match search_devices_by_name("", idle_timeout_secs).await {
+                    Ok(stream_iter) => stream_iter,
+                    Err(error) => {
+                        error!("Cannot scan devices: {error}");
+                        send_output_code(&mut stream, OutputCode::Failure).await;
                         return;
                     }
-                    Ok(value) => {
-                        let myb_device = match value {
-                            Ok(myb_device) => myb_device,
-                            Err(err) => {
-                                error!("Cannot get device, address: {addr:?} {err:?}");
-                                send_output_code(&mut stream, OutputCode::Failure).await;
-                                return;
-                            }
-                        };
+                };
 
-                        let Some(device) = myb_device else {
-                            warn!("Device not found or not in range, address: {addr:?}");
-                            send_output_code(&mut stream, OutputCode::DeviceNotFound).await;
-                            return;
-                        };
+                let mut byte = [0; 1];
+                loop {
+                    let device = tokio::select! {
+                        found = time::timeout_at(deadline, stream_iter.next()) => match found {
+                            Ok(Some(device)) => device,
+                            _ => break,
+                        },
+                        _ = stream.read(&mut byte) => {
+                            debug!("Scan cancelled by the client");
+                            break;
+                        }
+                    };
 
-                        devices.insert(addr, device);
+                    send_found_device(&mut stream, &device).await;
+                    if advertisement {
+                        send_manufacturer_data(&mut stream, &device).await;
                     }
                 }
+
+                send_output_code(&mut stream, OutputCode::StreamEOF).await;
+                return;
             }
 
-            let hue_device = devices.get_mut(&addr).unwrap();
+            // Every connected device at once, it fails if any of them failed
+            if commands.contains(&Command::AllPower) {
+                let on = data[0] == true as u8;
+                let known = devices.lock().await.values().cloned().collect::<Vec<_>>();
+                let mut code = OutputCode::Success;
 
-            // If we only need to get connect status, avoid connecting to set services
-            if commands.len() == 1 && commands[0] == Command::Connect && !set {
-                if let Ok(state) = hue_device.is_device_connected().await {
-                    output_buf[0] = OutputCode::Success.into();
-                    output_buf[1] = state as _;
-                } else {
-                    output_buf[0] = OutputCode::Failure.into();
+                for mut hue_device in known {
+                    if !matches!(hue_device.is_device_connected().await, Ok(true)) {
+                        continue;
+                    }
+
+                    // The devices of the map don't retry, only the requests tell how much
+                    hue_device.write_retries = (flags >> WRITE_RETRIES_SHIFT) as _;
+                    if !switch_device(&hue_device, on).await {
+                        error!(
+                            "Cannot power {} device {:?}",
+                            if on { "on" } else { "off" },
+                            hue_device.addr
+                        );
+                        code = OutputCode::Failure;
+                    }
                 }
 
-                send_to_stream(&mut stream, output_buf).await;
+                send_output_code(&mut stream, code).await;
                 return;
             }
 
-            #[cfg(not(target_os = "windows"))]
-            if hue_device.services().is_empty() {
-                // if let Err(error) = hue_device.try_pair().await {
-                //     error!(
-                //         "Unexpected error trying to pair with device {}: {error}",
-                //         hue_device.addr
-                //     );
-                //     devices.remove(&addr).unwrap();
-                //     return;
-                // }
-                if let Err(error) = hue_device.try_connect().await {
-                    error!(
-                        "Unexpected error trying to connect with device {:?}: {error}",
-                        hue_device.addr
-                    );
-                    devices.remove(&addr).unwrap();
-                    return;
-                }
-                if let Err(error) = hue_device.discover_services().await {
-                    error!("Unexpected error trying get GATT characteristics and services with device {:?}: {error}", hue_device.addr);
-                    devices.remove(&addr).unwrap();
+            if commands.contains(&Command::Scene) {
+                let len = data[1..]
+                    .iter()
+                    .position(|b| *b == b'\0')
+                    .unwrap_or(data.len() - 1);
+                let Ok(name) = std::str::from_utf8(&data[1..][..len]) else {
+                    send_output_code(&mut stream, OutputCode::Failure).await;
                     return;
+                };
+
+                match data[0] {
+                    scene_op::SAVE => save_scene(&mut stream, &devices, name).await,
+                    scene_op::GET => send_scene(&mut stream, name).await,
+                    scene_op::LIST => send_scene_names(&mut stream).await,
+                    op => {
+                        error!("Unknown scene operation {op}");
+                        send_output_code(&mut stream, OutputCode::Failure).await;
+                    }
                 }
+                return;
             }
 
-            // Since we're not mutating the device internally, only the hashmap (above), we
-            // can clone the device and free the lock
-            let hue_device = hue_device.clone();
-            drop(devices);
+            if commands.contains(&Command::Stats) {
+                send_stats(&mut stream, &devices, data[0]).await;
+                return;
+            }
 
-            // Priority command
-            if commands.contains(&Command::Connect) {
-                let value = res_to_u8!(hue_device.try_connect().await);
-                output_buf[0] = u8::min(output_buf[0], value);
-                commands.retain(|cmd| *cmd != Command::Connect);
+            if commands.contains(&Command::Devices) {
+                send_devices(&mut stream, &devices).await;
+                return;
             }
 
-            for command in commands {
-                let value = match command {
-                    Command::Connect | Command::SearchName => continue,
-                    Command::Disconnect => res_to_u8!(hue_device.try_disconnect().await),
-                    Command::Power { .. } => {
-                        if set {
-                            res_to_u8!(hue_device.set_power(data[0]).await)
-                        } else if let Ok(state) = hue_device.get_power().await {
-                            output_buf[1] = state as _;
-                            OutputCode::Success.into()
-                        } else {
-                            OutputCode::Failure.into()
-                        }
+            // Unlike Subscribe, it doesn't keep the daemon from timing out
+            if commands.contains(&Command::Logs) {
+                stream_logs(&mut stream, data[0]).await;
+                return;
+            }
+
+            // Like Logs, an unknown device is watched without being discovered
+            if commands.contains(&Command::ConnectionEvents) {
+                stream_connection_changes(&mut stream, addr, &devices).await;
+                return;
+            }
+
+            // Subscriptions last until the client leaves, they would skew the average latency
+            let _timed = (!commands.contains(&Command::Subscribe)).then(|| Timed(Instant::now()));
+
+            // Removed so the connection checks below don't have to care about them
+            let progress = commands.contains(&Command::ConnectProgress);
+            let confirmed_writes = if commands.contains(&Command::ConfirmedWrites) {
+                Some(true)
+            } else if commands.contains(&Command::UnconfirmedWrites) {
+                Some(false)
+            } else {
+                None
+            };
+            commands.retain(|cmd| {
+                !matches!(
+                    cmd,
+                    Command::ConnectProgress
+                        | Command::ConfirmedWrites
+                        | Command::UnconfirmedWrites
+                )
+            });
+
+            let mut devices = devices.lock().await;
+
+            // Disconnecting an unknown or already disconnected device is a no-op so there is no
+            // need to discover or connect it first, the device is kept to be reconnected later
+            if commands.len() == 1 && commands[0] == Command::Disconnect {
+                IDLE_DISCONNECTED.lock().unwrap().remove(&addr);
+
+                let ttl_secs = CONNECTION_CACHE_TTL_SECS.load(Ordering::Relaxed);
+                let value = match devices.get(&addr) {
+                    // Kept connected for a next connect, only the client sees it disconnected
+                    Some(hue_device)
+                        if ttl_secs > 0
+                            && matches!(hue_device.is_device_connected().await, Ok(true)) =>
+                    {
+                        let expiry = Instant::now() + Duration::from_secs(ttl_secs as _);
+                        CACHED.lock().unwrap().insert(addr, expiry);
+
+                        OutputCode::Success.into()
                     }
-                    Command::Brightness { .. } => {
-                        if set {
-                            res_to_u8!(hue_device.set_brightness(data[0]).await)
+                    Some(hue_device) => res_to_u8!(hue_device.try_disconnect().await),
+                    None => OutputCode::Success.into(),
+                };
+                drop(devices);
+                link_changed(addr);
+
+                send_output_code(&mut stream, OutputCode::from(value)).await;
+                return;
+            }
+
+            // If we only need to get connect status, avoid discovering or connecting the device,
+            // an unknown device is obviously not connected
+            if commands.len() == 1 && commands[0] == Command::Connect && !set {
+                match devices.get(&addr) {
+                    Some(hue_device) => {
+                        if let Some(state) = reported_connected(hue_device).await {
+                            output_buf[0] = OutputCode::Success.into();
+                            output_buf[1] = state as _;
+                        } else {
+                            output_buf[0] = OutputCode::Failure.into();
+                        }
+                    }
+                    None => {
+                        output_buf[0] = OutputCode::Success.into();
+                        output_buf[1] = false as _;
+                    }
+                }
+                drop(devices);
+
+                send_to_stream(&mut stream, output_buf).await;
+                return;
+            }
+
+            // The last measured signal strength, it's only known for an already discovered device
+            // and reading it doesn't connect it
+            if commands.len() == 1 && commands[0] == Command::Rssi {
+                output_buf[0] = match devices.get(&addr) {
+                    Some(hue_device) => match hue_device.get_rssi().await {
+                        Ok(Some(rssi)) => {
+                            for (i, byte) in rssi.to_le_bytes().iter().enumerate() {
+                                output_buf[i + 1] = *byte;
+                            }
+
+                            OutputCode::Success.into()
+                        }
+                        Ok(None) => OutputCode::Failure.into(),
+                        Err(error) => {
+                            error!("Cannot read the RSSI of {addr:?}: {error}");
+                            OutputCode::Failure.into()
+                        }
+                    },
+                    None => OutputCode::DeviceNotFound.into(),
+                };
+                drop(devices);
+
+                send_to_stream(&mut stream, output_buf).await;
+                return;
+            }
+
+            // The bond status doesn't need the device to be connected nor even discovered
+            if commands.len() == 1 && commands[0] == Command::Pair && !set {
+                let hue_device = devices.get(&addr).cloned();
+                drop(devices);
+
+                output_buf[0] = match is_paired(addr, hue_device.as_ref()).await {
+                    Some(paired) => {
+                        output_buf[1] = paired as _;
+                        OutputCode::Success.into()
+                    }
+                    None => OutputCode::Failure.into(),
+                };
+
+                send_to_stream(&mut stream, output_buf).await;
+                return;
+            }
+
+            // Raw access is only for an already connected device, it's never connected for it
+            if commands.len() == 1 && commands[0] == Command::Gatt {
+                let hue_device = devices.get(&addr).cloned();
+                drop(devices);
+
+                gatt_access(&mut stream, hue_device, set, data).await;
+                return;
+            }
+
+            // When only connecting, the client can specify a timeout in ms (0 for the defaults)
+            // which covers both device discovery and connection
+            let deadline = if commands == [Command::Connect] && set {
+                let timeout_ms = u32::from_le_bytes([data[0], data[1], data[2], data[3]]);
+                (timeout_ms > 0).then(|| Instant::now() + Duration::from_millis(timeout_ms as _))
+            } else {
+                None
+            };
+
+            let known = devices.contains_key(&addr);
+            if !known {
+                if progress {
+                    send_stage(&mut stream, connect_stage::SCANNING).await;
+                }
+
+                let discovery_deadline =
+                    Instant::now() + Duration::from_secs(FOUND_DEVICE_TIMEOUT_SECS);
+
+                match time::timeout_at(
+                    deadline.map_or(discovery_deadline, |deadline| {
+                        deadline.min(discovery_deadline)
+                    }),
+                    get_device(addr),
+                )
+                .await
+                {
+                    Err(elapsed) => {
+                        // Timed out
+                        warn!("Timeout: {elapsed} during device discovery, address: {addr:?}");
+                        let code = if deadline.is_some_and(|deadline| Instant::now() >= deadline) {
+                            OutputCode::Timeout
+                        } else {
+                            OutputCode::DeviceNotFound
+                        };
+                        send_output_code(&mut stream, code).await;
+                        return;
+                    }
+                    Ok(value) => {
+                        let myb_device = match value {
+                            Ok(myb_device) => myb_device,
+                            Err(err) => {
+                                error!("Cannot get device, address: {addr:?} {err:?}");
+                                send_output_code(&mut stream, OutputCode::Failure).await;
+                                return;
+                            }
+                        };
+
+                        let Some(device) = myb_device else {
+                            warn!("Device not found or not in range, address: {addr:?}");
+                            send_output_code(&mut stream, OutputCode::DeviceNotFound).await;
+                            return;
+                        };
+
+                        devices.insert(addr, device);
+                    }
+                }
+            }
+
+            let hue_device = devices.get_mut(&addr).unwrap();
+
+            #[cfg(not(target_os = "windows"))]
+            if hue_device.services().is_empty() {
+                // if let Err(error) = hue_device.try_pair().await {
+                //     error!(
+                //         "Unexpected error trying to pair with device {}: {error}",
+                //         hue_device.addr
+                //     );
+                //     devices.remove(&addr).unwrap();
+                //     return;
+                // }
+                if progress {
+                    send_stage(&mut stream, connect_stage::CONNECTING).await;
+                }
+
+                match until_deadline(deadline, hue_device.try_connect()).await {
+                    Some(Ok(())) => (),
+                    Some(Err(error)) => {
+                        error!(
+                            "Unexpected error trying to connect with device {:?}: {error}",
+                            hue_device.addr
+                        );
+                        devices.remove(&addr).unwrap();
+                        return;
+                    }
+                    None => {
+                        warn!("Timeout: connecting to device {addr:?}");
+                        // Cancels the pending connection since dropping the future doesn't
+                        let _ = hue_device.disconnect().await;
+                        send_output_code(&mut stream, OutputCode::Timeout).await;
+                        return;
+                    }
+                }
+
+                if progress {
+                    send_stage(&mut stream, connect_stage::DISCOVERING_SERVICES).await;
+                }
+
+                if let Err(error) = hue_device.discover_services().await {
+                    error!("Unexpected error trying get GATT characteristics and services with device {:?}: {error}", hue_device.addr);
+                    devices.remove(&addr).unwrap();
+                    return;
+                }
+            }
+
+            // Taken with the lock so the device can't be disconnected for being idle in between
+            let _in_use = InUse::new(addr);
+
+            // Used again so its connection is no longer closed, connecting it is then instant
+            CACHED.lock().unwrap().remove(&addr);
+
+            // The client doesn't know it was disconnected so it's done even without Connect
+            let idle_disconnected = IDLE_DISCONNECTED.lock().unwrap().remove(&addr);
+            if idle_disconnected && !commands.contains(&Command::Connect) {
+                // The characteristics are discovered again like on a first connection
+                let reconnected = until_deadline(deadline, async {
+                    hue_device.try_connect().await?;
+                    hue_device.discover_services().await
+                })
+                .await;
+                match reconnected {
+                    Some(Ok(())) => {
+                        STATS.reconnects.fetch_add(1, Ordering::Relaxed);
+                    }
+                    Some(Err(error)) => {
+                        error!("Cannot reconnect idle device {addr:?}: {error}");
+                        send_output_code(&mut stream, OutputCode::Failure).await;
+                        return;
+                    }
+                    None => {
+                        warn!("Timeout: reconnecting to idle device {addr:?}");
+                        send_output_code(&mut stream, OutputCode::Timeout).await;
+                        return;
+                    }
+                }
+            }
+
+            // Since we're not mutating the device internally, only the hashmap (above), we
+            // can clone the device and free the lock
+            let mut hue_device = hue_device.clone();
+            drop(devices);
+
+            // Flush waits for the requests running before it, the ones after wait for it
+            let _requesting = if commands.contains(&Command::Flush) {
+                None
+            } else {
+                Some(write_barrier(addr).read_owned().await)
+            };
+
+            // Only for this request since it's a clone
+            hue_device.confirmed_writes = confirmed_writes;
+            hue_device.write_retries = (flags >> WRITE_RETRIES_SHIFT) as _;
+
+            // Priority command
+            if commands.contains(&Command::Connect) {
+                let reconnecting =
+                    known && !matches!(hue_device.is_device_connected().await, Ok(true));
+                let value = match until_deadline(deadline, hue_device.try_connect()).await {
+                    Some(res) => {
+                        if reconnecting && res.is_ok() {
+                            STATS.reconnects.fetch_add(1, Ordering::Relaxed);
+                        }
+                        if res.is_ok() {
+                            link_changed(addr);
+                        }
+
+                        if res.is_ok() && set && commands.contains(&Command::Pair) {
+                            u8::from(if ensure_paired(&hue_device).await {
+                                OutputCode::Success
+                            } else {
+                                OutputCode::Failure
+                            })
+                        } else {
+                            res_to_u8!(res)
+                        }
+                    }
+                    None => {
+                        warn!("Timeout: connecting to device {addr:?}");
+                        OutputCode::Timeout.into()
+                    }
+                };
+                output_buf[0] = u8::min(output_buf[0], value);
+                commands.retain(|cmd| *cmd != Command::Connect);
+            }
+
+            // The client times the commands from there (see get_last_command_latency_ms)
+            let connected =
+                output_buf[0] == u8::MAX || output_buf[0] == u8::from(OutputCode::Success);
+            if progress && connected {
+                send_stage(&mut stream, connect_stage::READY).await;
+            }
+
+            // Deciseconds, only set values can fade
+            let transition = (set && commands.contains(&Command::Transition)).then(|| {
+                u16::from_le_bytes([data[TRANSITION_OFFSET], data[TRANSITION_OFFSET + 1]])
+            });
+
+            for command in commands {
+                let value = match command {
+                    Command::Connect
+                    | Command::SearchName
+                    | Command::Scan
+                    | Command::Transition
+                    | Command::Advertisement
+                    | Command::Ping
+                    | Command::Version
+                    | Command::Rssi
+                    | Command::ConnectProgress
+                    | Command::AllPower
+                    | Command::Shutdown
+                    | Command::Gatt
+                    | Command::ConfirmedWrites
+                    | Command::UnconfirmedWrites
+                    | Command::IdleDisconnect
+                    | Command::WriteRate
+                    | Command::Scene
+                    | Command::Stats
+                    | Command::Devices
+                    | Command::Logs
+                    | Command::ConnectionEvents
+                    | Command::Pair
+                    | Command::AutoReconnect
+                    | Command::TcpListen
+                    | Command::SimulatedDevice
+                    | Command::DeviceTag
+                    | Command::ReconnectPolicy
+                    | Command::ConnectionCache => continue,
+                    Command::Disconnect => res_to_u8!(hue_device.try_disconnect().await),
+                    Command::Identify => res_to_u8!(hue_device.identify().await),
+                    Command::Power { .. } => {
+                        if let Some(transition) = transition {
+                            let payload = control_payload(control::POWER, &data[..1], transition);
+                            res_to_u8!(hue_device.write_control(&payload).await)
+                        } else if set {
+                            res_to_u8!(hue_device.set_power(data[0]).await)
+                        } else if let Ok(state) = hue_device.get_power().await {
+                            output_buf[1] = state as _;
+                            OutputCode::Success.into()
+                        } else {
+                            OutputCode::Failure.into()
+                        }
+                    }
+                    Command::TogglePower => {
+                        if let Some(on) = toggle_power(&hue_device).await {
+                            output_buf[1] = on as _;
+                            OutputCode::Success.into()
+                        } else {
+                            OutputCode::Failure.into()
+                        }
+                    }
+                    Command::Brightness { .. } => {
+                        // Below its minimum, a light may turn off
+                        let value = if set || transition.is_some() {
+                            let (min, max) = brightness_range(&hue_device)
+                                .await
+                                .unwrap_or((MIN_BRIGHTNESS, MAX_BRIGHTNESS));
+                            data[0].clamp(min, max)
+                        } else {
+                            data[0]
+                        };
+
+                        if let Some(transition) = transition {
+                            let payload =
+                                control_payload(control::BRIGHTNESS, &[value], transition);
+                            res_to_u8!(hue_device.write_control(&payload).await)
+                        } else if set {
+                            res_to_u8!(hue_device.set_brightness(value).await)
                         } else if let Ok(v) = hue_device.get_brightness().await {
                             output_buf[1] = v as _;
                             OutputCode::Success.into()
@@ -308,59 +1282,1641 @@ async fn process_conn(
                             OutputCode::Failure.into()
                         }
                     }
+                    Command::BrightnessRange => {
+                        // The defaults are sent along a failure so the client can still clamp
+                        let (code, (min, max)) = match brightness_range(&hue_device).await {
+                            Some(range) => (OutputCode::Success, range),
+                            None => (OutputCode::Failure, (MIN_BRIGHTNESS, MAX_BRIGHTNESS)),
+                        };
+                        output_buf[1] = min;
+                        output_buf[2] = max;
+
+                        code.into()
+                    }
+                    Command::Capabilities => {
+                        if let Ok(caps) = hue_device.get_capabilities().await {
+                            output_buf[1] = caps;
+                            // Followed by the gamut of the model, the lights that don't tell it
+                            // are recent ones
+                            output_buf[2] =
+                                Gamut::from_model(&read_model(&hue_device).await).into();
+
+                            OutputCode::Success.into()
+                        } else {
+                            OutputCode::Failure.into()
+                        }
+                    }
+                    Command::Features => {
+                        if let Some(features) = device_features(&hue_device).await {
+                            output_buf[1..5].copy_from_slice(&features.to_le_bytes());
+
+                            OutputCode::Success.into()
+                        } else {
+                            OutputCode::Failure.into()
+                        }
+                    }
+                    Command::PowerOn => {
+                        let done = if set {
+                            let mut buf = [0u8; POWER_ON_LEN];
+                            buf.copy_from_slice(&data[..POWER_ON_LEN]);
+
+                            hue_device.set_power_on(buf).await.is_ok()
+                        } else if let Ok(bytes) = hue_device.get_power_on().await {
+                            output_buf[1..][..POWER_ON_LEN].copy_from_slice(&bytes);
+
+                            true
+                        } else {
+                            false
+                        };
+
+                        // Older firmwares don't have the characteristic, the client tells it
+                        // apart from a failed read or write
+                        if done {
+                            OutputCode::Success.into()
+                        } else {
+                            let uuid = *POWER_ON_UUID.as_bytes();
+                            if matches!(hue_device.read_raw_char(uuid).await, Ok(None)) {
+                                output_buf[1] = GATT_UNKNOWN_CHAR;
+                            }
+
+                            OutputCode::Failure.into()
+                        }
+                    }
+                    Command::Effect => {
+                        if set {
+                            res_to_u8!(hue_device.set_effect(data[0]).await)
+                        } else if let Ok(effect) = hue_device.get_effect().await {
+                            output_buf[1] = effect;
+
+                            OutputCode::Success.into()
+                        } else {
+                            OutputCode::Failure.into()
+                        }
+                    }
+                    Command::ConnectionParams => {
+                        let [min, max, mtu] = [0, 2, 4]
+                            .map(|offset| u16::from_le_bytes([data[offset], data[offset + 1]]));
+
+                        match hue_device.request_connection_params(min, max, mtu).await {
+                            Ok(true) => OutputCode::Success.into(),
+                            Ok(false) => {
+                                output_buf[1] = connection_params::UNSUPPORTED;
+                                OutputCode::Failure.into()
+                            }
+                            Err(_) => OutputCode::Failure.into(),
+                        }
+                    }
+                    Command::Flush => u8::from(if drain(&hue_device).await {
+                        OutputCode::Success
+                    } else {
+                        OutputCode::Failure
+                    }),
+                    Command::Keepalive => {
+                        let ms = u32::from_le_bytes([data[0], data[1], data[2], data[3]]);
+                        let mut keepalives = KEEPALIVES.lock().unwrap();
+                        if ms == 0 {
+                            keepalives.remove(&addr);
+                        } else {
+                            keepalives
+                                .insert(addr, (Duration::from_millis(ms as _), Instant::now()));
+                        }
+
+                        OutputCode::Success.into()
+                    }
+                    Command::Schedule => {
+                        let at_unix_ms = u64::from_le_bytes(data[1..9].try_into().unwrap());
+                        let mut state = [0; scheduled_state::LEN];
+                        state.copy_from_slice(&data[9..][..scheduled_state::LEN]);
+
+                        if data[0] == schedule_op::ADD {
+                            let job = schedule(hue_device.clone(), at_unix_ms, state);
+                            output_buf[1..9].copy_from_slice(&job.to_le_bytes());
+
+                            OutputCode::Success.into()
+                        } else {
+                            error!("Unknown schedule operation {}", data[0]);
+                            OutputCode::Failure.into()
+                        }
+                    }
+                    Command::ApplyState => {
+                        let mut state = [0; scheduled_state::LEN];
+                        state.copy_from_slice(&data[..scheduled_state::LEN]);
+
+                        // The fields that failed, the others were applied
+                        output_buf[1] = apply_state(&hue_device, state).await;
+                        if output_buf[1] == 0 {
+                            OutputCode::Success.into()
+                        } else {
+                            OutputCode::Failure.into()
+                        }
+                    }
+                    Command::Firmware => {
+                        if let Ok(version) = hue_device.get_firmware_version().await {
+                            write_name(&mut output_buf, version.as_bytes());
+
+                            OutputCode::Success.into()
+                        } else {
+                            OutputCode::Failure.into()
+                        }
+                    }
+                    Command::Temperature => {
+                        if set {
+                            let mireds = u16::from_le_bytes([data[0], data[1]]);
+                            res_to_u8!(hue_device.set_temperature(mireds).await)
+                        } else if let Ok(mireds) = hue_device.get_temperature().await {
+                            for (i, byte) in mireds.to_le_bytes().iter().enumerate() {
+                                output_buf[i + 1] = *byte;
+                            }
+
+                            OutputCode::Success.into()
+                        } else {
+                            OutputCode::Failure.into()
+                        }
+                    }
+                    Command::WhiteMix => {
+                        if set {
+                            res_to_u8!(hue_device.set_white_mix([data[0], data[1]]).await)
+                        } else if let Ok(mix) = hue_device.get_white_mix().await {
+                            output_buf[1..3].copy_from_slice(&mix);
+
+                            OutputCode::Success.into()
+                        } else {
+                            OutputCode::Failure.into()
+                        }
+                    }
                     Command::ColorRgb { .. }
                     | Command::ColorHex { .. }
                     | Command::ColorXy { .. } => {
                         let mut buf = [0u8; 4];
                         buf.copy_from_slice(&data[..4]);
 
-                        if set {
-                            res_to_u8!(hue_device.set_color(buf).await)
-                        } else if let Ok(bytes) = hue_device.get_color().await {
-                            for (i, byte) in bytes.iter().enumerate() {
-                                output_buf[i + 1] = *byte;
-                            }
+                        if let Some(transition) = transition {
+                            let payload = control_payload(control::COLOR, &buf, transition);
+                            res_to_u8!(hue_device.write_control(&payload).await)
+                        } else if set {
+                            res_to_u8!(hue_device.set_color(buf).await)
+                        } else if let Ok(bytes) = hue_device.get_color().await {
+                            for (i, byte) in bytes.iter().enumerate() {
+                                output_buf[i + 1] = *byte;
+                            }
+
+                            OutputCode::Success.into()
+                        } else {
+                            OutputCode::Failure.into()
+                        }
+                    }
+                    Command::Name if set => {
+                        // Nul padded, the client validates it's UTF-8
+                        let len = data.iter().position(|b| *b == b'\0').unwrap_or(data.len());
+                        let name = String::from_utf8_lossy(&data[..len]);
+
+                        res_to_u8!(hue_device.set_name(&name).await)
+                    }
+                    Command::Name => {
+                        // As is, the client validates it's UTF-8 (see get_name_str)
+                        let res = hue_device.get_name_bytes().await;
+
+                        if let Ok(Some(ref name)) = res {
+                            write_name(&mut output_buf, name);
+                        }
+
+                        res_to_u8!(res)
+                    }
+                    Command::State => send_state(&mut stream, &hue_device, &mut output_buf).await,
+                    Command::Subscribe => stream_state_changes(&mut stream, &hue_device).await,
+                };
+                output_buf[0] = u8::min(output_buf[0], value);
+
+                // https://developers.meethue.com/develop/get-started-2/core-concepts/#limitations
+                sleep(Duration::from_millis(100)).await;
+            }
+
+            if output_buf[0] != u8::MAX {
+                send_to_stream(&mut stream, output_buf).await;
+            }
+        }
+        Err(error) => error!("Error on connection: {error}"),
+    }
+}
+
+/// Writes the name in the output data, truncated with "..." if it's too long
+fn write_name(output_buf: &mut [u8; OUTPUT_LEN], name: &[u8]) {
+    let max_len = OUTPUT_LEN - 1;
+    if name.len() <= max_len {
+        output_buf[1..][..name.len()].copy_from_slice(name);
+        return;
+    }
+
+    // Cut on a char boundary so that a non-ASCII name stays valid UTF-8, an invalid one is cut
+    // as is
+    let mut end = max_len - 3;
+    if let Ok(name) = std::str::from_utf8(name) {
+        while !name.is_char_boundary(end) {
+            end -= 1;
+        }
+    }
+
+    output_buf[1..][..end].copy_from_slice(&name[..end]);
+    output_buf[1..][end..][..3].copy_from_slice(b"...");
+}
+
+/// Streaming output with the connection state, power state, raw brightness, whether the device
+/// has a color and its scaled xy color. A device without color is not a failure
+async fn state_output(device: &HueDevice<Server>) -> Option<[u8; OUTPUT_LEN]> {
+    let (Ok(connected), Ok(power), Ok(brightness)) = (
+        device.is_device_connected().await,
+        device.get_power().await,
+        device.get_brightness().await,
+    ) else {
+        return None;
+    };
+    let color = device.get_color().await.ok();
+
+    let mut buf = [0; OUTPUT_LEN];
+    buf[0] = OutputCode::Streaming.into();
+    buf[1] = connected as _;
+    buf[2] = power as _;
+    buf[3] = brightness as _;
+    if let Some(color) = color {
+        buf[4] = true as _;
+        buf[5..9].copy_from_slice(&color);
+    }
+
+    Some(buf)
+}
+
+/// The state doesn't fit in one output so its state_output is sent first, the name is then
+/// written in the final output. Nothing is streamed on failure.
+async fn send_state(
+    stream: &mut Stream,
+    device: &HueDevice<Server>,
+    output_buf: &mut [u8; OUTPUT_LEN],
+) -> u8 {
+    let Some(state) = state_output(device).await else {
+        return OutputCode::Failure.into();
+    };
+    let Ok(name) = device.get_name().await else {
+        return OutputCode::Failure.into();
+    };
+
+    send_to_stream(stream, state).await;
+    write_name(output_buf, name.unwrap_or_default().as_bytes());
+
+    OutputCode::Success.into()
+}
+
+/// Streams the state_output right away then on every change until the client sends anything or
+/// closes the connection
+async fn stream_state_changes(stream: &mut Stream, device: &HueDevice<Server>) -> u8 {
+    let mut changes = match device.state_changes().await {
+        Ok(changes) => changes,
+        Err(error) => {
+            error!(
+                "Cannot subscribe to the state of {:?}: {error}",
+                device.addr
+            );
+            return OutputCode::Failure.into();
+        }
+    };
+
+    SUBSCRIPTIONS.fetch_add(1, Ordering::Relaxed);
+
+    let mut watchdog = time::interval(Duration::from_secs(WATCHDOG_INTERVAL_SECS));
+    watchdog.set_missed_tick_behavior(time::MissedTickBehavior::Delay);
+
+    let mut byte = [0; 1];
+    let code = 'stream: loop {
+        let Some(state) = state_output(device).await else {
+            if !dropped(device).await {
+                break OutputCode::Failure;
+            }
+
+            match resume_subscription(stream, device).await {
+                Some(resumed) => {
+                    changes = resumed;
+                    continue;
+                }
+                None => break OutputCode::StreamEOF,
+            }
+        };
+
+        if stream.write_all(&state).await.is_err() || stream.flush().await.is_err() {
+            break OutputCode::StreamEOF;
+        }
+
+        // Waits for a change or for the device to drop, a silent drop is caught by the watchdog
+        loop {
+            tokio::select! {
+                _ = stream.read(&mut byte) => break 'stream OutputCode::StreamEOF,
+                changed = changes.recv() => {
+                    if changed.is_some() {
+                        // A single change can notify several characteristics, the state is read
+                        // once
+                        while changes.try_recv().is_ok() {}
+                        continue 'stream;
+                    }
+
+                    if !dropped(device).await {
+                        break 'stream OutputCode::StreamEOF;
+                    }
+                }
+                _ = watchdog.tick(), if AUTO_RECONNECT.load(Ordering::Relaxed) => {
+                    if !dropped(device).await {
+                        continue;
+                    }
+                }
+            }
+
+            match resume_subscription(stream, device).await {
+                Some(resumed) => {
+                    changes = resumed;
+                    continue 'stream;
+                }
+                None => break 'stream OutputCode::StreamEOF,
+            }
+        }
+    };
+
+    SUBSCRIPTIONS.fetch_sub(1, Ordering::Relaxed);
+
+    code.into()
+}
+
+/// Reads the bind address and the token that follow the request then accepts the TCP clients
+/// that send the token, replacing the previous listener (if any) once the address is bound
+async fn listen_tcp(stream: &mut Stream) -> OutputCode {
+    let (Some(bind_addr), Some(token)) = (read_tcp_arg(stream).await, read_tcp_arg(stream).await)
+    else {
+        error!("Cannot read the bind address and the token to listen on TCP");
+        return OutputCode::Failure;
+    };
+    if token.is_empty() {
+        error!("Refusing to listen on TCP without a token");
+        return OutputCode::Failure;
+    }
+
+    let Ok(bind_addr) = String::from_utf8(bind_addr) else {
+        error!("The TCP bind address isn't UTF-8");
+        return OutputCode::Failure;
+    };
+    let (listener, local_addr) = match bind_tcp(&bind_addr).await {
+        Ok(listener) => listener,
+        Err(error) => {
+            error!("Cannot listen on TCP {bind_addr}: {error}");
+            return OutputCode::Failure;
+        }
+    };
+
+    info!("Listening on TCP {bind_addr}");
+    let accepting = tokio::spawn(accept_tcp(listener, token));
+    let previous = TCP_LISTENER
+        .lock()
+        .unwrap()
+        .replace((local_addr, accepting));
+    if let Some((_, previous)) = previous {
+        previous.abort();
+    }
+
+    OutputCode::Success
+}
+
+/// The previous listener keeps running if bind_addr cannot be bound, unless it's the one holding
+/// the address: it's stopped to bind it again
+async fn bind_tcp(bind_addr: &str) -> std::io::Result<(TcpListener, SocketAddr)> {
+    let error = match TcpListener::bind(bind_addr).await {
+        Ok(listener) => return listener.local_addr().map(|addr| (listener, addr)),
+        Err(error) => error,
+    };
+
+    let previous_addr = TCP_LISTENER.lock().unwrap().as_ref().map(|(addr, _)| *addr);
+    let Some(previous_addr) = previous_addr else {
+        return Err(error);
+    };
+    if error.kind() != std::io::ErrorKind::AddrInUse
+        || !net::lookup_host(bind_addr)
+            .await?
+            .any(|addr| addr == previous_addr)
+    {
+        return Err(error);
+    }
+
+    let previous = TCP_LISTENER.lock().unwrap().take();
+    if let Some((_, previous)) = previous {
+        previous.abort();
+        let _ = previous.await;
+    }
+
+    let listener = TcpListener::bind(bind_addr).await?;
+    listener.local_addr().map(|addr| (listener, addr))
+}
+
+/// The clients that send the token are run by main, see TCP_CONNS
+async fn accept_tcp(listener: TcpListener, token: Vec<u8>) {
+    let token = Arc::new(token);
+
+    loop {
+        let (mut stream, peer) = match listener.accept().await {
+            Ok(conn) => conn,
+            Err(error) => {
+                warn!("Cannot accept a TCP client: {error}");
+                continue;
+            }
+        };
+
+        let token = Arc::clone(&token);
+        tokio::spawn(async move {
+            let handshake = time::timeout(
+                Duration::from_secs(TCP_HANDSHAKE_TIMEOUT_SECS),
+                tcp_handshake(&mut stream, &token),
+            );
+            if !matches!(handshake.await, Ok(true)) {
+                warn!("Rejected the TCP client {peer}, it didn't send the token");
+                return;
+            }
+
+            let _ = stream.set_nodelay(true);
+            if let Some(conns) = TCP_CONNS.get() {
+                let _ = conns.send(Box::new(stream));
+            }
+        });
+    }
+}
+
+/// The client sends the token first, it's answered with Success or Failure
+async fn tcp_handshake(stream: &mut (impl AsyncRead + AsyncWrite + Unpin), token: &[u8]) -> bool {
+    let Some(received) = read_tcp_arg(stream).await else {
+        return false;
+    };
+
+    // Compares every byte so the time doesn't tell how much of the token matched
+    let valid = received.len() == token.len()
+        && received
+            .iter()
+            .zip(token)
+            .fold(0, |diff, (a, b)| diff | (a ^ b))
+            == 0;
+
+    let code = if valid {
+        OutputCode::Success
+    } else {
+        OutputCode::Failure
+    };
+    let _ = stream.write_all(&[code.into()]).await;
+
+    valid
+}
+
+/// Reads a length byte then as many bytes, see TCP_ARG_MAX_LEN
+async fn read_tcp_arg(stream: &mut (impl AsyncRead + Unpin)) -> Option<Vec<u8>> {
+    let len = stream.read_u8().await.ok()?;
+    let mut arg = vec![0; len as _];
+    stream.read_exact(&mut arg).await.ok()?;
+
+    Some(arg)
+}
+
+/// Whether the device lost its connection and has to be resumed, always false without
+/// AUTO_RECONNECT. A disconnection requested by another client counts as a drop
+async fn dropped(device: &HueDevice<Server>) -> bool {
+    AUTO_RECONNECT.load(Ordering::Relaxed)
+        && !matches!(device.is_device_connected().await, Ok(true))
+}
+
+/// Reconnects the dropped device and subscribes to its state again, logging the reconnection so
+/// the clients forwarding the logs see it. None if the client left first
+async fn resume_subscription(
+    stream: &mut Stream,
+    device: &HueDevice<Server>,
+) -> Option<mpsc::UnboundedReceiver<()>> {
+    resume_with(stream, device.addr, || resubscribe(device)).await
+}
+
+/// See resume_subscription, resubscribe is retried until it gives the state changes
+async fn resume_with<F: Future<Output = Option<mpsc::UnboundedReceiver<()>>>>(
+    stream: &mut Stream,
+    addr: [u8; ADDR_LEN],
+    resubscribe: impl FnMut() -> F,
+) -> Option<mpsc::UnboundedReceiver<()>> {
+    warn!("Subscribed device {addr:?} dropped, reconnecting");
+
+    let policy = *RECONNECT_POLICY.lock().unwrap();
+    let mut byte = [0; 1];
+    let changes = tokio::select! {
+        _ = stream.read(&mut byte) => return None,
+        changes = retry_with_backoff(addr, policy, resubscribe) => changes,
+    };
+
+    STATS.reconnects.fetch_add(1, Ordering::Relaxed);
+    link_changed(addr);
+    info!("Reconnected subscribed device {addr:?}, its state subscription resumed");
+
+    Some(changes)
+}
+
+async fn resubscribe(device: &HueDevice<Server>) -> Option<mpsc::UnboundedReceiver<()>> {
+    if let Err(error) = device.try_connect().await {
+        warn!("Cannot reconnect device {:?}: {error}", device.addr);
+        return None;
+    }
+
+    match device.state_changes().await {
+        Ok(changes) => Some(changes),
+        Err(error) => {
+            warn!(
+                "Cannot subscribe again to the state of {:?}: {error}",
+                device.addr
+            );
+            None
+        }
+    }
+}
+
+/// Calls attempt until it gives a value with a backoff starting at base, doubled after every
+/// failure up to max. Every attempt (the first one too) waits a random part of the backoff so the
+/// devices that dropped together, e.g. on an adapter reset, don't reconnect all at once
+async fn retry_with_backoff<T, F: Future<Output = Option<T>>>(
+    addr: [u8; ADDR_LEN],
+    (base, max): (Duration, Duration),
+    mut attempt: impl FnMut() -> F,
+) -> T {
+    let backing_off = BackingOff(addr);
+    let mut backoff = base;
+
+    loop {
+        backing_off.set(backoff);
+        sleep(jitter(backoff)).await;
+
+        if let Some(value) = attempt().await {
+            return value;
+        }
+
+        backoff = (backoff * 2).min(max);
+    }
+}
+
+/// Random wait up to max, the hashers of std are seeded randomly
+fn jitter(max: Duration) -> Duration {
+    let random = RandomState::new().hash_one(Instant::now());
+    Duration::from_millis(random % (max.as_millis() as u64 + 1))
+}
+
+/// Sends a Streaming output with the device address followed by its name (truncated if too long)
+async fn send_found_device(stream: &mut Stream, device: &HueDevice<Server>) {
+    let mut buf = [0; OUTPUT_LEN];
+    buf[0] = OutputCode::Streaming.into();
+
+    let addr = device.addr;
+    for (i, byte) in addr.iter().enumerate() {
+        buf[i + 1] = *byte;
+    }
+
+    let name = device.get_name().await.unwrap_or(None).unwrap_or_default();
+    for (i, byte) in name.as_bytes().iter().enumerate() {
+        let offset = addr.len() + 1 + i;
+        if offset >= buf.len() {
+            break;
+        }
+
+        buf[offset] = *byte;
+    }
+
+    send_to_stream(stream, buf).await;
+}
+
+/// ADV_CHUNK_LEN chunks of the manufacturer data, the last one is shorter (empty if the length is
+/// a multiple of it)
+async fn send_manufacturer_data(stream: &mut Stream, device: &HueDevice<Server>) {
+    let data = device
+        .get_manufacturer_data()
+        .await
+        .unwrap_or_else(|error| {
+            warn!(
+                "Cannot get the manufacturer data of {:?}: {error}",
+                device.addr
+            );
+            Vec::new()
+        });
+
+    let mut chunks = data.chunks(ADV_CHUNK_LEN).collect::<Vec<_>>();
+    if data.len() % ADV_CHUNK_LEN == 0 {
+        chunks.push(&[]);
+    }
+
+    for chunk in chunks {
+        let mut buf = [0; OUTPUT_LEN];
+        buf[0] = OutputCode::Streaming.into();
+        buf[1] = chunk.len() as _;
+        buf[2..2 + chunk.len()].copy_from_slice(chunk);
+
+        send_to_stream(stream, buf).await;
+    }
+}
+
+/// Semver followed by the commit hash (build metadata) if it's known at build time
+fn daemon_version() -> String {
+    use rustbee_common::constants::VERSION;
+
+    match option_env!("RUSTBEE_GIT_HASH") {
+        Some(hash) => format!("{VERSION}+{hash}"),
+        None => VERSION.to_owned(),
+    }
+}
+
+/// Returns None if the deadline is reached, the future is then dropped thus cancelled
+async fn until_deadline<F: Future>(deadline: Option<Instant>, future: F) -> Option<F::Output> {
+    match deadline {
+        Some(deadline) => time::timeout_at(deadline, future).await.ok(),
+        None => Some(future.await),
+    }
+}
+
+async fn send_to_stream(stream: &mut Stream, buf: [u8; OUTPUT_LEN]) {
+    let failures = [
+        OutputCode::Failure,
+        OutputCode::DeviceNotFound,
+        OutputCode::Timeout,
+    ];
+    if failures.map(u8::from).contains(&buf[0]) {
+        STATS.failed_commands.fetch_add(1, Ordering::Relaxed);
+    }
+
+    stream.write_all(&buf).await.unwrap();
+    stream.flush().await.unwrap();
+}
+
+/// Cached after the first read, a failed one too. None if the device doesn't tell its range
+async fn brightness_range(device: &HueDevice<Server>) -> Option<(u8, u8)> {
+    let cached = BRIGHTNESS_RANGES.lock().unwrap().get(&device.addr).copied();
+    if let Some(range) = cached {
+        return range;
+    }
+
+    // A failed read isn't retried on every write, the light keeps the full range
+    let range = device.get_brightness_range().await.unwrap_or_else(|error| {
+        warn!(
+            "Cannot read the brightness range of {:?}, the full range is used: {error}",
+            device.addr
+        );
+        None
+    });
+    BRIGHTNESS_RANGES.lock().unwrap().insert(device.addr, range);
+
+    range
+}
+
+/// Empty if the light doesn't tell it
+async fn read_model(device: &HueDevice<Server>) -> String {
+    match device.read_raw_char(*MODEL_UUID.as_bytes()).await {
+        Ok(Some(bytes)) => String::from_utf8_lossy(&bytes).into_owned(),
+        _ => String::new(),
+    }
+}
+
+/// The `constants::features` of its characteristics with the quirks of its model and firmware,
+/// cached after the first successful read. None if the characteristics cannot be read
+async fn device_features(device: &HueDevice<Server>) -> Option<u32> {
+    let cached = DEVICE_FEATURES.lock().unwrap().get(&device.addr).copied();
+    if cached.is_some() {
+        return cached;
+    }
+
+    let detected = device.get_features().await.ok()?;
+    let model = read_model(device).await;
+    let firmware = device.get_firmware_version().await.unwrap_or_default();
+
+    let features = quirks::apply(quirks::QUIRKS, &model, &firmware, detected);
+    DEVICE_FEATURES
+        .lock()
+        .unwrap()
+        .insert(device.addr, features);
+
+    Some(features)
+}
+
+fn write_barrier(addr: [u8; ADDR_LEN]) -> Arc<RwLock<()>> {
+    Arc::clone(WRITE_BARRIERS.lock().unwrap().entry(addr).or_default())
+}
+
+/// Returns once the requests running on the device are done, the ones that come after wait until
+/// the guard is dropped
+async fn wait_for_requests(addr: [u8; ADDR_LEN]) -> OwnedRwLockWriteGuard<()> {
+    write_barrier(addr).write_owned().await
+}
+
+/// Barrier of the writes of the device: it waits for the requests running on it then reads its
+/// power. The device answers in order, so the read comes back once the writes sent before it
+/// (unconfirmed ones included) are applied
+async fn drain(device: &HueDevice<Server>) -> bool {
+    let _drained = wait_for_requests(device.addr).await;
+
+    device.get_power().await.is_ok()
+}
+
+/// Reads the power then writes the inverse within the same request, so the window for another
+/// client to change it in between is a single GATT round trip. Only the toggles of a device are
+/// serialized, so two concurrent ones don't read the same state, a plain power write can still
+/// land in that window. Returns the new state
+async fn toggle_power(device: &HueDevice<Server>) -> Option<bool> {
+    let lock = Arc::clone(TOGGLE_LOCKS.lock().unwrap().entry(device.addr).or_default());
+    let _toggling = lock.lock().await;
+
+    let on = !device.get_power().await.ok()?;
+    device.set_power(on as _).await.ok()?;
+
+    Some(on)
+}
+
+/// Applies the scheduled_state to the device at the time in ms since the Unix epoch, right away if
+/// it's past. The job runs on its own so it outlives the client, it's lost if the daemon exits
+/// first
+fn schedule(device: HueDevice<Server>, at_unix_ms: u64, state: [u8; scheduled_state::LEN]) -> u64 {
+    let job = NEXT_JOB.fetch_add(1, Ordering::Relaxed);
+
+    // Held until the job is inserted so it cannot remove itself before
+    let mut scheduled = SCHEDULED.lock().unwrap();
+    let running = tokio::spawn(async move {
+        // Woken up regularly to follow the changes of the wall clock, e.g. after a suspend
+        loop {
+            let left_ms = ms_until(at_unix_ms);
+            if left_ms == 0 {
+                break;
+            }
+
+            sleep(Duration::from_millis(left_ms.min(SCHEDULE_RECHECK_MS))).await;
+        }
+        SCHEDULED.lock().unwrap().remove(&job);
+
+        run_scheduled(job, &device, state).await;
+    });
+    scheduled.insert(job, running);
+
+    job
+}
+
+/// 0 once the time in ms since the Unix epoch is past
+fn ms_until(at_unix_ms: u64) -> u64 {
+    let now_ms = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map_or(0, |elapsed| elapsed.as_millis() as u64);
+
+    at_unix_ms.saturating_sub(now_ms)
+}
+
+/// False if the job doesn't exist or already started
+fn cancel_scheduled(job: u64) -> bool {
+    let Some(waiting) = SCHEDULED.lock().unwrap().remove(&job) else {
+        return false;
+    };
+
+    waiting.abort();
+    true
+}
+
+/// Connects the device if its connection was closed meanwhile, see apply_state
+async fn run_scheduled(job: u64, device: &HueDevice<Server>, state: [u8; scheduled_state::LEN]) {
+    let _in_use = InUse::new(device.addr);
+    let _labelled = Labelled::new(device.addr);
+    info!("Running the scheduled job {job} of {:?}", device.addr);
+
+    // The connection may have been closed since it was scheduled
+    if !matches!(device.is_device_connected().await, Ok(true)) {
+        if let Err(error) = device.try_connect().await {
+            error!(
+                "Cannot connect device {:?} for the scheduled job {job}: {error}",
+                device.addr
+            );
+            return;
+        }
+    }
+
+    match apply_state(device, state).await {
+        0 => info!("Scheduled job {job} of {:?} done", device.addr),
+        failed => error!(
+            "The scheduled job {job} of {:?} failed (fields {failed:#b})",
+            device.addr
+        ),
+    }
+}
+
+/// A GATT write of a state, see state_writes
+#[derive(Debug, PartialEq)]
+enum StateWrite {
+    /// Payload of the combined control characteristic
+    Control(Vec<u8>),
+    /// A `control` value written by write_field
+    Field(u8, Vec<u8>),
+}
+
+impl StateWrite {
+    /// The `scheduled_state::bits` written, of the fields of the state for a combined write
+    fn fields(&self, state_fields: u8) -> u8 {
+        use scheduled_state::bits;
+
+        match self {
+            Self::Control(_) => state_fields & !bits::ON,
+            Self::Field(control::POWER, _) => bits::POWER,
+            Self::Field(control::BRIGHTNESS, _) => bits::BRIGHTNESS,
+            Self::Field(control::COLOR, _) => bits::COLOR,
+            Self::Field(control::TEMPERATURE, _) => bits::TEMPERATURE,
+            Self::Field(..) => 0,
+        }
+    }
+}
+
+/// Writes the set fields of the state at once if the device has the combined control
+/// characteristic (see state_writes), otherwise in the order of the FFI set_state: a light turned
+/// on is turned on first, a light turned off is turned off last. A failed write doesn't stop the
+/// next ones, returns the `scheduled_state::bits` of the fields that failed (0 if none did)
+async fn apply_state(device: &HueDevice<Server>, state: [u8; scheduled_state::LEN]) -> u8 {
+    use scheduled_state::bits;
+
+    let fields = state[0];
+    let transition = u16::from_le_bytes([state[8], state[9]]);
+    let power = (fields & bits::POWER != 0).then_some(fields & bits::ON != 0);
+
+    let mut writes = Vec::new();
+    if power == Some(true) {
+        writes.push((control::POWER, vec![true as u8]));
+    }
+    if fields & bits::BRIGHTNESS != 0 {
+        let (min, max) = brightness_range(device)
+            .await
+            .unwrap_or((MIN_BRIGHTNESS, MAX_BRIGHTNESS));
+        writes.push((control::BRIGHTNESS, vec![state[1].clamp(min, max)]));
+    }
+    if fields & bits::COLOR != 0 {
+        writes.push((control::COLOR, state[2..6].to_vec()));
+    }
+    if fields & bits::TEMPERATURE != 0 {
+        writes.push((control::TEMPERATURE, state[6..8].to_vec()));
+    }
+    if power == Some(false) {
+        writes.push((control::POWER, vec![false as u8]));
+    }
+
+    // Without the features (e.g. the firmware cannot be read) the characteristic still tells
+    let has_control = match device_features(device).await {
+        Some(bits) => bits & features::COMBINED_WRITE != 0,
+        None => device.has_control().await.unwrap_or(false),
+    };
+    let mut failed = 0;
+    for (i, write) in state_writes(writes, transition, has_control)
+        .into_iter()
+        .enumerate()
+    {
+        // https://developers.meethue.com/develop/get-started-2/core-concepts/#limitations
+        if i > 0 {
+            sleep(Duration::from_millis(100)).await;
+        }
+
+        let written = match &write {
+            StateWrite::Control(payload) => device.write_control(payload).await.is_ok(),
+            StateWrite::Field(kind, value) => write_field(device, *kind, value, transition).await,
+        };
+        if !written {
+            error!("Cannot apply {write:?} to device {:?}", device.addr);
+            failed |= write.fields(fields);
+        }
+    }
+
+    failed
+}
+
+/// A single write of the combined control characteristic if the device has it and the fields fit
+/// in it, otherwise a write per field
+fn state_writes(fields: Vec<(u8, Vec<u8>)>, transition: u16, has_control: bool) -> Vec<StateWrite> {
+    let payload = combined_control_payload(&fields, transition);
+    if has_control && !fields.is_empty() && payload.len() <= control::MAX_LEN {
+        return vec![StateWrite::Control(payload)];
+    }
+
+    fields
+        .into_iter()
+        .map(|(kind, value)| StateWrite::Field(kind, value))
+        .collect()
+}
+
+/// A `control` value of a state, the color temperature doesn't fade
+async fn write_field(device: &HueDevice<Server>, kind: u8, value: &[u8], transition: u16) -> bool {
+    if transition > 0 && kind != control::TEMPERATURE {
+        let payload = control_payload(kind, value, transition);
+        return device.write_control(&payload).await.is_ok();
+    }
+
+    match kind {
+        control::POWER => device.set_power(value[0]).await.is_ok(),
+        control::BRIGHTNESS => device.set_brightness(value[0]).await.is_ok(),
+        control::COLOR => device.set_color(value.try_into().unwrap()).await.is_ok(),
+        _ => device
+            .set_temperature(u16::from_le_bytes([value[0], value[1]]))
+            .await
+            .is_ok(),
+    }
+}
+
+/// Turns the device off after saving its power and brightness, or back on with the saved ones. A
+/// device that wasn't turned off is left as is, and turning it off again keeps the first ones
+async fn switch_device(device: &HueDevice<Server>, on: bool) -> bool {
+    if !on {
+        if let (Ok(power), Ok(brightness)) =
+            (device.get_power().await, device.get_brightness().await)
+        {
+            SAVED_POWER
+                .lock()
+                .unwrap()
+                .entry(device.addr)
+                .or_insert((power as _, brightness as _));
+        }
+
+        return device.set_power(false as _).await.is_ok();
+    }
+
+    let saved = SAVED_POWER.lock().unwrap().remove(&device.addr);
+    match saved {
+        Some((power, brightness)) => {
+            device.set_brightness(brightness).await.is_ok() && device.set_power(power).await.is_ok()
+        }
+        None => true,
+    }
+}
+
+/// [connected devices (u16), reconnects, failed commands, average latency in ms of the device
+/// requests, retried writes] then, for the clients of STATS_VERSION, a second output of [delayed
+/// writes, dropped writes, devices being reconnected, longest backoff in ms] since the first one
+/// is full, as u32 little endian unless specified
+async fn send_stats(
+    stream: &mut Stream,
+    devices: &Mutex<HashMap<[u8; ADDR_LEN], HueDevice<Server>>>,
+    version: u8,
+) {
+    let known = devices.lock().await.values().cloned().collect::<Vec<_>>();
+    let mut connected = 0u16;
+    for hue_device in known {
+        if matches!(hue_device.is_device_connected().await, Ok(true)) {
+            connected += 1;
+        }
+    }
+
+    let timed = STATS.timed_commands.load(Ordering::Relaxed);
+    let avg_latency_ms = STATS
+        .total_latency_ms
+        .load(Ordering::Relaxed)
+        .checked_div(timed)
+        .unwrap_or(0);
+
+    let mut buf = [0; OUTPUT_LEN];
+    buf[0] = OutputCode::Success.into();
+    buf[1..3].copy_from_slice(&connected.to_le_bytes());
+    buf[3..7].copy_from_slice(&STATS.reconnects.load(Ordering::Relaxed).to_le_bytes());
+    buf[7..11].copy_from_slice(&STATS.failed_commands.load(Ordering::Relaxed).to_le_bytes());
+    buf[11..15].copy_from_slice(&(avg_latency_ms.min(u32::MAX as _) as u32).to_le_bytes());
+    buf[15..19].copy_from_slice(&RETRIED_WRITES.load(Ordering::Relaxed).to_le_bytes());
+
+    send_to_stream(stream, buf).await;
+
+    // An older client would read it as the answer of its next request
+    if version < STATS_VERSION {
+        return;
+    }
+
+    let mut buf = [0; OUTPUT_LEN];
+    buf[0] = OutputCode::Success.into();
+    buf[1..5].copy_from_slice(&DELAYED_WRITES.load(Ordering::Relaxed).to_le_bytes());
+    buf[5..9].copy_from_slice(&DROPPED_WRITES.load(Ordering::Relaxed).to_le_bytes());
+
+    let backoffs = BACKOFFS.lock().unwrap();
+    let max_backoff_ms = backoffs.values().max().map_or(0, Duration::as_millis);
+    buf[9..13].copy_from_slice(&(backoffs.len() as u32).to_le_bytes());
+    buf[13..17].copy_from_slice(&(max_backoff_ms.min(u32::MAX as _) as u32).to_le_bytes());
+    drop(backoffs);
+
+    send_to_stream(stream, buf).await;
+}
+
+/// Hook of LOGGER, the records are only copied if a client streams them
+fn forward_log(level: Level, message: &str) {
+    if LOG_RECORDS.receiver_count() > 0 {
+        let _ = LOG_RECORDS.send((level, message.to_owned()));
+    }
+}
+
+/// Hook of LOGGER, the label of the device of the task logging the record (see Labelled)
+fn log_context() -> Option<String> {
+    let addr = *LABELLED.lock().unwrap().get(&task::try_id()?)?;
+
+    Some(device_label(addr))
+}
+
+/// The tag of the device (see DeviceTag) else its address
+fn device_label(addr: [u8; ADDR_LEN]) -> String {
+    TAGS.lock()
+        .unwrap()
+        .get(&addr)
+        .cloned()
+        .unwrap_or_else(|| format_addr(&addr))
+}
+
+/// Answers Success then streams the records of max_level (see log::Level) or more severe until the
+/// client sends anything or closes the connection. A record is sent in chunks of [level, last
+/// chunk, LOG_CHUNK_LEN bytes of the message nul padded], the records missed by a slow client are
+/// dropped
+async fn stream_logs(stream: &mut Stream, max_level: u8) {
+    let mut records = LOG_RECORDS.subscribe();
+    send_output_code(stream, OutputCode::Success).await;
+
+    let mut byte = [0; 1];
+    loop {
+        let (level, message) = tokio::select! {
+            _ = stream.read(&mut byte) => return,
+            record = records.recv() => match record {
+                Ok(record) => record,
+                Err(broadcast::error::RecvError::Lagged(_)) => continue,
+                Err(broadcast::error::RecvError::Closed) => return,
+            },
+        };
+
+        if level as u8 > max_level {
+            continue;
+        }
+
+        let message = message.as_bytes();
+        let chunks = message.len().div_ceil(LOG_CHUNK_LEN).max(1);
+        for i in 0..chunks {
+            let chunk =
+                &message[i * LOG_CHUNK_LEN..usize::min((i + 1) * LOG_CHUNK_LEN, message.len())];
+
+            let mut buf = [0; OUTPUT_LEN];
+            buf[0] = OutputCode::Streaming.into();
+            buf[1] = level as _;
+            buf[2] = (i == chunks - 1) as _;
+            buf[3..][..chunk.len()].copy_from_slice(chunk);
+
+            // Not send_to_stream since the client may leave at any time
+            if stream.write_all(&buf).await.is_err() || stream.flush().await.is_err() {
+                return;
+            }
+        }
+    }
+}
+
+/// Wakes up the watchers of the device, they check its connection state right away instead of on
+/// their next poll
+fn link_changed(addr: [u8; ADDR_LEN]) {
+    if LINK_CHANGES.receiver_count() > 0 {
+        let _ = LINK_CHANGES.send(addr);
+    }
+}
+
+/// Streams [connected] (the state the clients see, see reported_connected) right away then on
+/// every change until the client sends anything or closes the connection. The changes made by the
+/// daemon are sent right away, the drops once noticed by a poll every LINK_POLL_MS. An unknown
+/// device is disconnected
+async fn stream_connection_changes(
+    stream: &mut Stream,
+    addr: [u8; ADDR_LEN],
+    devices: &Mutex<HashMap<[u8; ADDR_LEN], HueDevice<Server>>>,
+) {
+    let mut changes = LINK_CHANGES.subscribe();
+    let mut poll = time::interval(Duration::from_millis(LINK_POLL_MS));
+    poll.set_missed_tick_behavior(time::MissedTickBehavior::Delay);
+
+    let mut byte = [0; 1];
+    let mut last = None;
+    loop {
+        let device = devices.lock().await.get(&addr).cloned();
+        let connected = match device {
+            // A failed read keeps the last state
+            Some(device) => reported_connected(&device).await.or(last),
+            None => Some(false),
+        };
+
+        if connected.is_some() && connected != last {
+            let mut buf = [0; OUTPUT_LEN];
+            buf[0] = OutputCode::Streaming.into();
+            buf[1] = connected.unwrap() as _;
+
+            // Not send_to_stream since the client may leave at any time
+            if stream.write_all(&buf).await.is_err() || stream.flush().await.is_err() {
+                return;
+            }
+            last = connected;
+        }
+
+        // The changes of the other devices are skipped
+        loop {
+            tokio::select! {
+                _ = stream.read(&mut byte) => return,
+                _ = poll.tick() => break,
+                changed = changes.recv() => match changed {
+                    Ok(changed) if changed != addr => {}
+                    Ok(_) | Err(broadcast::error::RecvError::Lagged(_)) => break,
+                    Err(broadcast::error::RecvError::Closed) => return,
+                },
+            }
+        }
+    }
+}
+
+/// Whether the clients see the device as connected, which isn't the connection state for the
+/// idle disconnected and cached devices. None if the connection state cannot be read
+async fn reported_connected(device: &HueDevice<Server>) -> Option<bool> {
+    let state = device.is_device_connected().await.ok()?;
+
+    Some(
+        (state || IDLE_DISCONNECTED.lock().unwrap().contains(&device.addr))
+            && !CACHED.lock().unwrap().contains_key(&device.addr),
+    )
+}
+
+/// Streams [address, connected] of every device known by the daemon sorted by address until
+/// StreamEOF, the connection state is the one the clients see
+async fn send_devices(
+    stream: &mut Stream,
+    devices: &Mutex<HashMap<[u8; ADDR_LEN], HueDevice<Server>>>,
+) {
+    let mut known = devices.lock().await.values().cloned().collect::<Vec<_>>();
+    known.sort_by_key(|hue_device| hue_device.addr);
+
+    for hue_device in known {
+        let Some(connected) = reported_connected(&hue_device).await else {
+            error!("Cannot get the connection state of {:?}", hue_device.addr);
+            send_output_code(stream, OutputCode::Failure).await;
+            return;
+        };
+
+        let mut buf = [0; OUTPUT_LEN];
+        buf[0] = OutputCode::Streaming.into();
+        buf[1..][..ADDR_LEN].copy_from_slice(&hue_device.addr);
+        buf[1 + ADDR_LEN] = connected as _;
+
+        send_to_stream(stream, buf).await;
+    }
+
+    send_output_code(stream, OutputCode::StreamEOF).await;
+}
+
+/// Pairs the device unless the daemon already paired it and the OS still has the bond, then
+/// records it in BONDS_PATH. A bond that cannot be recorded is only logged, the device is paired
+async fn ensure_paired(device: &HueDevice<Server>) -> bool {
+    let bonded = {
+        let _lock = BONDS_LOCK.lock().unwrap();
+        Bonds::load(&*BONDS_PATH)
+    };
+    let bonded = match bonded {
+        Ok(bonds) => bonds.contains(&device.addr),
+        Err(error) => {
+            error!(
+                "Cannot load the bonds from {}: {error}",
+                BONDS_PATH.display()
+            );
+            false
+        }
+    };
+
+    if bonded && matches!(device.is_paired().await, Ok(true)) {
+        return true;
+    }
+
+    if let Err(error) = device.pair().await {
+        error!("Cannot pair device {:?}: {error}", device.addr);
+        return false;
+    }
+
+    let saved = {
+        let _lock = BONDS_LOCK.lock().unwrap();
+        Bonds::load(&*BONDS_PATH).and_then(|mut bonds| {
+            bonds.insert(device.addr);
+            bonds.save(&*BONDS_PATH)
+        })
+    };
+    if let Err(error) = saved {
+        error!(
+            "Cannot save the bond of {:?} to {}: {error}",
+            device.addr,
+            BONDS_PATH.display()
+        );
+    }
+
+    true
+}
+
+/// Whether the OS has a bond with the device, an undiscovered one is paired if the daemon
+/// recorded its bond. None if the bond status cannot be read
+async fn is_paired(addr: [u8; ADDR_LEN], device: Option<&HueDevice<Server>>) -> Option<bool> {
+    if let Some(device) = device {
+        return match device.is_paired().await {
+            Ok(paired) => Some(paired),
+            Err(error) => {
+                error!("Cannot get the bond status of {addr:?}: {error}");
+                None
+            }
+        };
+    }
+
+    let _lock = BONDS_LOCK.lock().unwrap();
+    match Bonds::load(&*BONDS_PATH) {
+        Ok(bonds) => Some(bonds.contains(&addr)),
+        Err(error) => {
+            error!(
+                "Cannot load the bonds from {}: {error}",
+                BONDS_PATH.display()
+            );
+            None
+        }
+    }
+}
+
+/// Captures every connected device into the scene (replaced if it exists), it fails with
+/// DeviceNotFound if none is connected
+async fn save_scene(
+    stream: &mut Stream,
+    devices: &Mutex<HashMap<[u8; ADDR_LEN], HueDevice<Server>>>,
+    name: &str,
+) {
+    let known = devices.lock().await.values().cloned().collect::<Vec<_>>();
+    let mut scene = Vec::new();
+
+    for hue_device in known {
+        if !matches!(hue_device.is_device_connected().await, Ok(true)) {
+            continue;
+        }
+
+        let (Ok(power), Ok(brightness)) = (
+            hue_device.get_power().await,
+            hue_device.get_brightness().await,
+        ) else {
+            error!(
+                "Cannot read the state of device {:?} for scene {name:?}",
+                hue_device.addr
+            );
+            send_output_code(stream, OutputCode::Failure).await;
+            return;
+        };
 
-                            OutputCode::Success.into()
-                        } else {
-                            OutputCode::Failure.into()
-                        }
-                    }
-                    Command::Name => {
-                        let res = hue_device.get_name().await;
+        scene.push(SceneDevice {
+            addr: hue_device.addr,
+            power: power as _,
+            brightness: brightness as _,
+            color: hue_device.get_color().await.ok(),
+        });
+    }
 
-                        if let Ok(Some(ref name_str)) = res {
-                            let len = name_str.len();
-                            for (i, byte) in name_str.bytes().take(OUTPUT_LEN - 1).enumerate() {
-                                output_buf[i + 1] = byte;
-                            }
-                            if len > (OUTPUT_LEN - 1) {
-                                output_buf[OUTPUT_LEN - 3] = b'.';
-                                output_buf[OUTPUT_LEN - 2] = b'.';
-                                output_buf[OUTPUT_LEN - 1] = b'.';
-                            }
-                        }
+    if scene.is_empty() {
+        send_output_code(stream, OutputCode::DeviceNotFound).await;
+        return;
+    }
 
-                        res_to_u8!(res)
-                    }
-                };
-                output_buf[0] = u8::min(output_buf[0], value);
+    let saved = {
+        let _lock = SCENES_LOCK.lock().unwrap();
+        Scenes::load(&*SCENES_PATH).and_then(|mut scenes| {
+            scenes.insert(name.to_owned(), scene);
+            scenes.save(&*SCENES_PATH)
+        })
+    };
 
-                // https://developers.meethue.com/develop/get-started-2/core-concepts/#limitations
-                sleep(Duration::from_millis(100)).await;
+    let code = match saved {
+        Ok(()) => OutputCode::Success,
+        Err(error) => {
+            error!(
+                "Cannot save scene {name:?} to {}: {error}",
+                SCENES_PATH.display()
+            );
+            OutputCode::Failure
+        }
+    };
+    send_output_code(stream, code).await;
+}
+
+/// Streams the devices of the scene as [addr, power, raw brightness, has color, scaled xy] until
+/// StreamEOF, it fails with SCENE_UNKNOWN as data if there is no such scene
+async fn send_scene(stream: &mut Stream, name: &str) {
+    let scene = {
+        let _lock = SCENES_LOCK.lock().unwrap();
+        Scenes::load(&*SCENES_PATH).map(|scenes| scenes.get(name).map(<[_]>::to_vec))
+    };
+
+    let devices = match scene {
+        Ok(Some(devices)) => devices,
+        Ok(None) => {
+            let mut buf = [0; OUTPUT_LEN];
+            buf[0] = OutputCode::Failure.into();
+            buf[1] = SCENE_UNKNOWN;
+
+            send_to_stream(stream, buf).await;
+            return;
+        }
+        Err(error) => {
+            error!(
+                "Cannot load the scenes from {}: {error}",
+                SCENES_PATH.display()
+            );
+            send_output_code(stream, OutputCode::Failure).await;
+            return;
+        }
+    };
+
+    for device in devices {
+        let mut buf = [0; OUTPUT_LEN];
+        buf[0] = OutputCode::Streaming.into();
+        buf[1..][..ADDR_LEN].copy_from_slice(&device.addr);
+        buf[ADDR_LEN + 1] = device.power;
+        buf[ADDR_LEN + 2] = device.brightness;
+        if let Some(color) = device.color {
+            buf[ADDR_LEN + 3] = true as _;
+            buf[ADDR_LEN + 4..][..4].copy_from_slice(&color);
+        }
+
+        send_to_stream(stream, buf).await;
+    }
+
+    send_output_code(stream, OutputCode::StreamEOF).await;
+}
+
+/// Streams the (sorted) scene names nul padded until StreamEOF
+async fn send_scene_names(stream: &mut Stream) {
+    let names = {
+        let _lock = SCENES_LOCK.lock().unwrap();
+        Scenes::load(&*SCENES_PATH)
+            .map(|scenes| scenes.names().map(str::to_owned).collect::<Vec<_>>())
+    };
+
+    let names = match names {
+        Ok(names) => names,
+        Err(error) => {
+            error!(
+                "Cannot load the scenes from {}: {error}",
+                SCENES_PATH.display()
+            );
+            send_output_code(stream, OutputCode::Failure).await;
+            return;
+        }
+    };
+
+    for name in names {
+        let mut buf = [0; OUTPUT_LEN];
+        buf[0] = OutputCode::Streaming.into();
+        write_name(&mut buf, name.as_bytes());
+
+        send_to_stream(stream, buf).await;
+    }
+
+    send_output_code(stream, OutputCode::StreamEOF).await;
+}
+
+/// Every second, closes the expired cached connections then disconnects the idle devices. The
+/// devices are kept to be reconnected by process_conn
+async fn reap_connections(devices: Arc<Mutex<HashMap<[u8; ADDR_LEN], HueDevice<Server>>>>) {
+    let mut interval = time::interval(Duration::from_secs(1));
+
+    loop {
+        interval.tick().await;
+
+        // Held until they're disconnected so no request can use them meanwhile
+        let devices = devices.lock().await;
+
+        close_cached_connections(&devices).await;
+        disconnect_idle_devices(&devices).await;
+    }
+}
+
+async fn close_cached_connections(devices: &HashMap<[u8; ADDR_LEN], HueDevice<Server>>) {
+    let expired = {
+        let mut cached = CACHED.lock().unwrap();
+        let now = Instant::now();
+        let expired = cached
+            .iter()
+            .filter(|(_, expiry)| **expiry <= now)
+            .map(|(addr, _)| *addr)
+            .collect::<Vec<_>>();
+
+        for addr in &expired {
+            cached.remove(addr);
+        }
+
+        expired
+    };
+
+    for addr in expired {
+        let Some(hue_device) = devices.get(&addr) else {
+            continue;
+        };
+
+        if let Err(error) = hue_device.try_disconnect().await {
+            error!("Cannot close the cached connection of device {addr:?}: {error}");
+        }
+    }
+}
+
+/// Reads the power of the devices with a keep-alive that went without commands for their
+/// interval, so the link isn't dropped by the supervision timeout. The reads are done once the
+/// devices are unlocked, they're then queued with the commands like any other request. It doesn't
+/// count as a command for disconnect_idle_devices
+async fn keep_alive(devices: Arc<Mutex<HashMap<[u8; ADDR_LEN], HueDevice<Server>>>>) {
+    let mut interval = time::interval(Duration::from_millis(KEEPALIVE_TICK_MS));
+
+    loop {
+        interval.tick().await;
+
+        for hue_device in due_keepalives(&devices).await {
+            if !matches!(hue_device.is_device_connected().await, Ok(true)) {
+                continue;
             }
 
-            if output_buf[0] != u8::MAX {
-                send_to_stream(&mut stream, output_buf).await;
+            if let Err(error) = hue_device.get_power().await {
+                warn!(
+                    "Keep-alive read of device {:?} failed: {error}",
+                    hue_device.addr
+                );
             }
         }
-        Err(error) => error!("Error on connection: {error}"),
     }
 }
 
-async fn send_to_stream(stream: &mut Stream, buf: [u8; OUTPUT_LEN]) {
-    stream.write_all(&buf).await.unwrap();
-    stream.flush().await.unwrap();
+/// The devices due for a keep-alive read without a request in flight, cloned so the devices are
+/// only locked to pick them. Their interval restarts even if they're skipped
+async fn due_keepalives(
+    devices: &Mutex<HashMap<[u8; ADDR_LEN], HueDevice<Server>>>,
+) -> Vec<HueDevice<Server>> {
+    let due = KEEPALIVES
+        .lock()
+        .unwrap()
+        .iter()
+        .filter(|(_, (every, last_read))| last_read.elapsed() >= *every)
+        .map(|(addr, (every, _))| (*addr, *every))
+        .collect::<Vec<_>>();
+    if due.is_empty() {
+        return Vec::new();
+    }
+
+    let devices = devices.lock().await;
+
+    due.into_iter()
+        .filter_map(|(addr, every)| {
+            // A command keeps the link alive as well
+            let busy = ACTIVITY.lock().unwrap().get(&addr).is_some_and(|activity| {
+                activity.in_flight > 0 || activity.last_used.elapsed() < every
+            });
+            let disconnected = CACHED.lock().unwrap().contains_key(&addr)
+                || IDLE_DISCONNECTED.lock().unwrap().contains(&addr);
+
+            if let Some((_, last_read)) = KEEPALIVES.lock().unwrap().get_mut(&addr) {
+                *last_read = Instant::now();
+            }
+
+            if busy || disconnected {
+                return None;
+            }
+
+            devices.get(&addr).cloned()
+        })
+        .collect()
+}
+
+/// Disconnects the devices that went without commands for IDLE_DISCONNECT_SECS, the cached
+/// connections are left to close_cached_connections
+async fn disconnect_idle_devices(devices: &HashMap<[u8; ADDR_LEN], HueDevice<Server>>) {
+    let idle_secs = IDLE_DISCONNECT_SECS.load(Ordering::Relaxed);
+    if idle_secs == 0 {
+        return;
+    }
+
+    let idle = {
+        let cached = CACHED.lock().unwrap();
+        let mut activity = ACTIVITY.lock().unwrap();
+        let idle = activity
+            .iter()
+            .filter(|(addr, activity)| {
+                activity.in_flight == 0
+                    && activity.last_used.elapsed() >= Duration::from_secs(idle_secs as _)
+                    && !cached.contains_key(*addr)
+            })
+            .map(|(addr, _)| *addr)
+            .collect::<Vec<_>>();
+
+        for addr in &idle {
+            activity.remove(addr);
+        }
+
+        idle
+    };
+
+    for addr in idle {
+        let Some(hue_device) = devices.get(&addr) else {
+            continue;
+        };
+
+        if !matches!(hue_device.is_device_connected().await, Ok(true)) {
+            continue;
+        }
+
+        match hue_device.try_disconnect().await {
+            Ok(()) => {
+                info!("Device {addr:?} idle for {idle_secs}s, disconnected");
+                IDLE_DISCONNECTED.lock().unwrap().insert(addr);
+            }
+            Err(error) => error!("Cannot disconnect idle device {addr:?}: {error}"),
+        }
+    }
+}
+
+/// The data is [characteristic UUID (16 bytes), value len (u16 LE)] and a write is followed by
+/// the value on the stream. A read value is streamed in [len, bytes] chunks until StreamEOF.
+///
+/// It fails with GATT_UNKNOWN_CHAR as data if the device doesn't have the characteristic
+async fn gatt_access(
+    stream: &mut Stream,
+    hue_device: Option<HueDevice<Server>>,
+    set: bool,
+    data: &[u8],
+) {
+    let uuid: [u8; 16] = data[..16].try_into().unwrap();
+
+    let value = if set {
+        let len = u16::from_le_bytes([data[16], data[17]]) as usize;
+        if len > GATT_MAX_LEN {
+            send_output_code(stream, OutputCode::Failure).await;
+            return;
+        }
+
+        // Read before anything else, the client is writing it
+        let mut value = vec![0; len];
+        if let Err(error) = stream.read_exact(&mut value).await {
+            error!("Cannot read the GATT value to write: {error}");
+            return;
+        }
+
+        Some(value)
+    } else {
+        None
+    };
+
+    let Some(hue_device) = hue_device else {
+        send_output_code(stream, OutputCode::DeviceNotFound).await;
+        return;
+    };
+
+    if !matches!(hue_device.is_device_connected().await, Ok(true)) {
+        warn!(
+            "Raw GATT access to {:?} which isn't connected",
+            hue_device.addr
+        );
+        send_output_code(stream, OutputCode::Failure).await;
+        return;
+    }
+
+    let mut unknown = [0; OUTPUT_LEN];
+    unknown[0] = OutputCode::Failure.into();
+    unknown[1] = GATT_UNKNOWN_CHAR;
+
+    if let Some(value) = value {
+        match hue_device.write_raw_char(uuid, &value).await {
+            Ok(true) => send_output_code(stream, OutputCode::Success).await,
+            Ok(false) => send_to_stream(stream, unknown).await,
+            Err(error) => {
+                error!(
+                    "Cannot write GATT characteristic of {:?}: {error}",
+                    hue_device.addr
+                );
+                send_output_code(stream, OutputCode::Failure).await;
+            }
+        }
+
+        return;
+    }
+
+    let value = match hue_device.read_raw_char(uuid).await {
+        Ok(Some(value)) => value,
+        Ok(None) => {
+            send_to_stream(stream, unknown).await;
+            return;
+        }
+        Err(error) => {
+            error!(
+                "Cannot read GATT characteristic of {:?}: {error}",
+                hue_device.addr
+            );
+            send_output_code(stream, OutputCode::Failure).await;
+            return;
+        }
+    };
+
+    for chunk in value.chunks(OUTPUT_LEN - 2) {
+        let mut buf = [0; OUTPUT_LEN];
+        buf[0] = OutputCode::Streaming.into();
+        buf[1] = chunk.len() as _;
+        buf[2..][..chunk.len()].copy_from_slice(chunk);
+        send_to_stream(stream, buf).await;
+    }
+
+    send_output_code(stream, OutputCode::StreamEOF).await;
+}
+
+/// A Streaming output with the stage (see `connect_stage`) the connection is at
+async fn send_stage(stream: &mut Stream, stage: u8) {
+    let mut buf = [0; OUTPUT_LEN];
+    buf[0] = OutputCode::Streaming.into();
+    buf[1] = stage;
+    send_to_stream(stream, buf).await;
 }
 
 async fn send_output_code(stream: &mut Stream, output_code: OutputCode) {
@@ -369,25 +2925,24 @@ async fn send_output_code(stream: &mut Stream, output_code: OutputCode) {
     send_to_stream(stream, buf).await;
 }
 
-async fn check_if_path_is_writable() {
-    if fs::read_dir("/var/run").await.is_err() {
-        error!("Cannot find /var/run directory or lacking permissions to read it");
-        std::process::exit(2);
-    }
+async fn check_if_path_is_writable(socket_path: &str) {
+    let dir = Path::new(socket_path).parent().unwrap_or(Path::new("/"));
 
-    if fs::OpenOptions::new()
-        .write(true)
-        .create(true)
-        .truncate(false)
-        .open("/var/run/x")
-        .await
-        .is_err()
-    {
-        error!("Lacking permissions to write to /var/run directory");
-        std::process::exit(2);
+    if fs::read_dir(dir).await.is_err() {
+        error!(
+            "Cannot find {} directory or lacking permissions to read it",
+            dir.display()
+        );
+        std::process::exit(exit_code::PERMISSION_DENIED);
     }
 
-    let _ = fs::remove_file("/var/run/x").await;
+    if !is_dir_writable(dir) {
+        error!(
+            "Lacking permissions to write to {} directory",
+            dir.display()
+        );
+        std::process::exit(exit_code::PERMISSION_DENIED);
+    }
 }
 
 fn get_commands_from_flags(flags: MaskT) -> Vec<Command> {
@@ -423,6 +2978,445 @@ fn get_commands_from_flags(flags: MaskT) -> Vec<Command> {
     if (flags >> (SEARCH_NAME - 1)) & 1 == 1 {
         v.push(Command::SearchName)
     }
+    if (flags >> (TEMPERATURE - 1)) & 1 == 1 {
+        v.push(Command::Temperature)
+    }
+    if (flags >> (SCAN - 1)) & 1 == 1 {
+        v.push(Command::Scan)
+    }
+    if (flags >> (TRANSITION - 1)) & 1 == 1 {
+        v.push(Command::Transition)
+    }
+    if (flags >> (IDENTIFY - 1)) & 1 == 1 {
+        v.push(Command::Identify)
+    }
+    if (flags >> (PING - 1)) & 1 == 1 {
+        v.push(Command::Ping)
+    }
+    if (flags >> (VERSION - 1)) & 1 == 1 {
+        v.push(Command::Version)
+    }
+    if (flags >> (RSSI - 1)) & 1 == 1 {
+        v.push(Command::Rssi)
+    }
+    if (flags >> (STATE - 1)) & 1 == 1 {
+        v.push(Command::State)
+    }
+    if (flags >> (SUBSCRIBE - 1)) & 1 == 1 {
+        v.push(Command::Subscribe)
+    }
+    if (flags >> (POWER_ON - 1)) & 1 == 1 {
+        v.push(Command::PowerOn)
+    }
+    if (flags >> (CAPABILITIES - 1)) & 1 == 1 {
+        v.push(Command::Capabilities)
+    }
+    if (flags >> (CONNECT_PROGRESS - 1)) & 1 == 1 {
+        v.push(Command::ConnectProgress)
+    }
+    if (flags >> (ALL_POWER - 1)) & 1 == 1 {
+        v.push(Command::AllPower)
+    }
+    if (flags >> (BRIGHTNESS_RANGE - 1)) & 1 == 1 {
+        v.push(Command::BrightnessRange)
+    }
+    if (flags >> (SHUTDOWN - 1)) & 1 == 1 {
+        v.push(Command::Shutdown)
+    }
+    if (flags >> (GATT - 1)) & 1 == 1 {
+        v.push(Command::Gatt)
+    }
+    if (flags >> (CONFIRMED_WRITES - 1)) & 1 == 1 {
+        v.push(Command::ConfirmedWrites)
+    }
+    if (flags >> (UNCONFIRMED_WRITES - 1)) & 1 == 1 {
+        v.push(Command::UnconfirmedWrites)
+    }
+    if (flags >> (EFFECT - 1)) & 1 == 1 {
+        v.push(Command::Effect)
+    }
+    if (flags >> (IDLE_DISCONNECT - 1)) & 1 == 1 {
+        v.push(Command::IdleDisconnect)
+    }
+    if (flags >> (SCENE - 1)) & 1 == 1 {
+        v.push(Command::Scene)
+    }
+    if (flags >> (STATS - 1)) & 1 == 1 {
+        v.push(Command::Stats)
+    }
+    if (flags >> (CONNECTION_CACHE - 1)) & 1 == 1 {
+        v.push(Command::ConnectionCache)
+    }
+    if (flags >> (DEVICES - 1)) & 1 == 1 {
+        v.push(Command::Devices)
+    }
+    if (flags >> (LOGS - 1)) & 1 == 1 {
+        v.push(Command::Logs)
+    }
+    if (flags >> (PAIR - 1)) & 1 == 1 {
+        v.push(Command::Pair)
+    }
+    if (flags >> (AUTO_RECONNECT - 1)) & 1 == 1 {
+        v.push(Command::AutoReconnect)
+    }
+    if (flags >> (TCP_LISTEN - 1)) & 1 == 1 {
+        v.push(Command::TcpListen)
+    }
+    if (flags >> (FIRMWARE - 1)) & 1 == 1 {
+        v.push(Command::Firmware)
+    }
+    if (flags >> (TOGGLE_POWER - 1)) & 1 == 1 {
+        v.push(Command::TogglePower)
+    }
+    if (flags >> (CONNECTION_PARAMS - 1)) & 1 == 1 {
+        v.push(Command::ConnectionParams)
+    }
+    if (flags >> (SCHEDULE - 1)) & 1 == 1 {
+        v.push(Command::Schedule)
+    }
+    if (flags >> (ADVERTISEMENT - 1)) & 1 == 1 {
+        v.push(Command::Advertisement)
+    }
+    if (flags >> (KEEPALIVE - 1)) & 1 == 1 {
+        v.push(Command::Keepalive)
+    }
+    if (flags >> (FLUSH - 1)) & 1 == 1 {
+        v.push(Command::Flush)
+    }
+    if (flags >> (WRITE_RATE - 1)) & 1 == 1 {
+        v.push(Command::WriteRate)
+    }
+    if (flags >> (WHITE_MIX - 1)) & 1 == 1 {
+        v.push(Command::WhiteMix)
+    }
+    if (flags >> (APPLY_STATE - 1)) & 1 == 1 {
+        v.push(Command::ApplyState)
+    }
+    if (flags >> (CONNECTION_EVENTS - 1)) & 1 == 1 {
+        v.push(Command::ConnectionEvents)
+    }
+    if (flags >> (SIMULATED_DEVICE - 1)) & 1 == 1 {
+        v.push(Command::SimulatedDevice)
+    }
+    if (flags >> (DEVICE_TAG - 1)) & 1 == 1 {
+        v.push(Command::DeviceTag)
+    }
+    if (flags >> (FEATURES - 1)) & 1 == 1 {
+        v.push(Command::Features)
+    }
+    if (flags >> (RECONNECT_POLICY - 1)) & 1 == 1 {
+        v.push(Command::ReconnectPolicy)
+    }
 
     v
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn subscription_resumes_after_reconnect() {
+        let addr = [0xb1, 0, 0, 0, 0, 1];
+        let (tx, rx) = mpsc::unbounded_channel();
+        let mut subscription = Some(rx);
+        let mut attempts = 0;
+
+        let (_client, daemon) = tokio::io::duplex(OUTPUT_LEN);
+        let mut stream: Stream = Box::new(daemon);
+        let mut link_changes = LINK_CHANGES.subscribe();
+        let reconnects = STATS.reconnects.load(Ordering::Relaxed);
+
+        // The link is down for the first two attempts
+        *RECONNECT_POLICY.lock().unwrap() = (Duration::from_millis(1), Duration::from_millis(1));
+        let changes = resume_with(&mut stream, addr, || {
+            attempts += 1;
+            let resumed = if attempts > 2 {
+                subscription.take()
+            } else {
+                None
+            };
+
+            async move { resumed }
+        })
+        .await;
+        assert_eq!(attempts, 3);
+        assert!(STATS.reconnects.load(Ordering::Relaxed) > reconnects);
+        while link_changes.recv().await.unwrap() != addr {}
+
+        tx.send(()).unwrap();
+        assert_eq!(changes.unwrap().recv().await, Some(()));
+    }
+
+    #[tokio::test]
+    async fn a_subscription_isnt_resumed_once_the_client_left() {
+        let (client, daemon) = tokio::io::duplex(OUTPUT_LEN);
+        let mut stream: Stream = Box::new(daemon);
+        drop(client);
+
+        let resumed = resume_with(&mut stream, [0xb1, 0, 0, 0, 0, 2], || async { None }).await;
+        assert!(resumed.is_none());
+    }
+
+    #[tokio::test]
+    async fn simultaneous_drops_reconnect_staggered() {
+        const BACKOFF_MS: u64 = 200;
+
+        let start = Instant::now();
+        let policy = (
+            Duration::from_millis(BACKOFF_MS),
+            Duration::from_millis(BACKOFF_MS),
+        );
+
+        // Ten devices dropped at the same time, their first attempt reconnects them
+        let reconnects = futures::future::join_all((1..=10).map(|i| {
+            let addr = [0xb0, 0, 0, 0, 0, i];
+            retry_with_backoff(addr, policy, move || async move {
+                assert!(BACKOFFS.lock().unwrap().contains_key(&addr));
+                Some(start.elapsed())
+            })
+        }))
+        .await;
+
+        let first = reconnects.iter().min().unwrap();
+        let last = reconnects.iter().max().unwrap();
+        assert!(*last <= Duration::from_millis(BACKOFF_MS * 2));
+        assert!(
+            *last - *first >= Duration::from_millis(BACKOFF_MS / 4),
+            "expected staggered reconnects, got {reconnects:?}"
+        );
+
+        let backoffs = BACKOFFS.lock().unwrap();
+        assert!(!backoffs.keys().any(|addr| addr[0] == 0xb0));
+    }
+
+    #[test]
+    fn state_is_a_single_control_write() {
+        let fields = vec![
+            (control::POWER, vec![1]),
+            (control::BRIGHTNESS, vec![0x80]),
+            (control::COLOR, vec![0x12, 0x34, 0x56, 0x78]),
+        ];
+
+        assert_eq!(
+            state_writes(fields.clone(), 10, true),
+            [StateWrite::Control(vec![
+                0x01, 0x01, 0x01, 0x02, 0x01, 0x80, 0x04, 0x04, 0x12, 0x34, 0x56, 0x78, 0x05, 0x02,
+                0x0a, 0x00
+            ])]
+        );
+
+        // Without the combined characteristic
+        assert_eq!(
+            state_writes(fields, 10, false),
+            [
+                StateWrite::Field(control::POWER, vec![1]),
+                StateWrite::Field(control::BRIGHTNESS, vec![0x80]),
+                StateWrite::Field(control::COLOR, vec![0x12, 0x34, 0x56, 0x78]),
+            ]
+        );
+
+        assert!(state_writes(Vec::new(), 10, true).is_empty());
+    }
+
+    #[test]
+    fn a_failed_state_write_tells_its_fields() {
+        use scheduled_state::bits;
+
+        let fields = bits::POWER | bits::ON | bits::BRIGHTNESS | bits::COLOR;
+
+        let color = StateWrite::Field(control::COLOR, vec![0x12, 0x34, 0x56, 0x78]);
+        assert_eq!(color.fields(fields), bits::COLOR);
+
+        // Every field of a combined write, the power is set but ON isn't a field
+        let combined = StateWrite::Control(Vec::new());
+        assert_eq!(
+            combined.fields(fields),
+            bits::POWER | bits::BRIGHTNESS | bits::COLOR
+        );
+    }
+
+    #[tokio::test(start_paused = true)]
+    async fn devices_are_torn_down_at_once_in_address_order() {
+        let started = Arc::new(StdMutex::new(Vec::new()));
+        let start = time::Instant::now();
+
+        // A slow device past the deadline doesn't hold the others back
+        let known = [(3, 900), (1, 700), (4, SHUTDOWN_DEVICES_MS * 2), (2, 800)]
+            .into_iter()
+            .map(|(i, ms)| ([0xe0, 0, 0, 0, 0, i], ms))
+            .collect();
+        let clean = teardown_in_order(known, |ms| {
+            let started = Arc::clone(&started);
+            async move {
+                started.lock().unwrap().push(ms);
+                sleep(Duration::from_millis(ms)).await;
+                Ok(())
+            }
+        })
+        .await;
+
+        // One after the other, the third would be past the deadline
+        assert_eq!(clean, 3);
+        assert!(start.elapsed() < Duration::from_millis(SHUTDOWN_DEVICES_MS * 2));
+        assert_eq!(
+            *started.lock().unwrap(),
+            [700, 800, 900, SHUTDOWN_DEVICES_MS * 2]
+        );
+    }
+
+    #[tokio::test]
+    async fn drain_waits_for_the_requests_running() {
+        let addr = [0xd0, 0, 0, 0, 0, 1];
+
+        let running = write_barrier(addr).read_owned().await;
+        let mut drained = tokio::spawn(wait_for_requests(addr));
+        assert!(time::timeout(Duration::from_millis(50), &mut drained)
+            .await
+            .is_err());
+
+        // The requests sent meanwhile wait for the drain
+        let barrier = write_barrier(addr);
+        let mut next = tokio::spawn(async move {
+            let _requesting = barrier.read().await;
+        });
+        assert!(time::timeout(Duration::from_millis(50), &mut next)
+            .await
+            .is_err());
+
+        drop(running);
+        let guard = drained.await.unwrap();
+        assert!(!next.is_finished());
+
+        drop(guard);
+        next.await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn keepalives_are_picked_without_holding_the_devices() {
+        let idle = [0xc0, 0, 0, 0, 0, 1];
+        let busy = [0xc0, 0, 0, 0, 0, 2];
+        let recent = [0xc0, 0, 0, 0, 0, 3];
+        let unknown = [0xc0, 0, 0, 0, 0, 4];
+
+        let devices = Mutex::new(
+            [idle, busy, recent]
+                .into_iter()
+                .map(|addr| (addr, HueDevice::new(addr)))
+                .collect::<HashMap<_, _>>(),
+        );
+
+        let every = Duration::from_secs(5);
+        let long_ago = Instant::now() - Duration::from_secs(10);
+        {
+            let mut keepalives = KEEPALIVES.lock().unwrap();
+            for addr in [idle, busy, unknown] {
+                keepalives.insert(addr, (every, long_ago));
+            }
+            keepalives.insert(recent, (Duration::from_secs(60), Instant::now()));
+        }
+        ACTIVITY.lock().unwrap().insert(
+            busy,
+            Activity {
+                in_flight: 1,
+                last_used: long_ago,
+            },
+        );
+
+        let due = due_keepalives(&devices).await;
+        assert_eq!(
+            due.iter()
+                .map(|hue_device| hue_device.addr)
+                .collect::<Vec<_>>(),
+            [idle]
+        );
+        // The reads of the due devices don't wait for the lock
+        assert!(devices.try_lock().is_ok());
+
+        // Their interval restarted
+        assert!(due_keepalives(&devices).await.is_empty());
+
+        let mut keepalives = KEEPALIVES.lock().unwrap();
+        for addr in [idle, busy, recent, unknown] {
+            keepalives.remove(&addr);
+        }
+        ACTIVITY.lock().unwrap().remove(&busy);
+    }
+
+    #[tokio::test]
+    async fn tcp_handshake_checks_the_token() {
+        for (sent, valid) in [
+            (&b"secret"[..], true),
+            (b"secreT", false),
+            (b"secre", false),
+        ] {
+            let (mut client, mut daemon) = tokio::io::duplex(64);
+            client.write_u8(sent.len() as _).await.unwrap();
+            client.write_all(sent).await.unwrap();
+
+            assert_eq!(tcp_handshake(&mut daemon, b"secret").await, valid);
+
+            let expected = if valid {
+                OutputCode::Success
+            } else {
+                OutputCode::Failure
+            };
+            assert_eq!(client.read_u8().await.unwrap(), expected.into());
+        }
+    }
+
+    #[tokio::test]
+    async fn a_tcp_listener_is_replaced_once_the_address_is_bound() {
+        let (listener, addr) = bind_tcp("127.0.0.1:0").await.unwrap();
+        let accepting = tokio::spawn(accept_tcp(listener, b"secret".to_vec()));
+        *TCP_LISTENER.lock().unwrap() = Some((addr, accepting));
+
+        // Held by someone else, the previous listener keeps running
+        let taken = std::net::TcpListener::bind("127.0.0.1:0").unwrap();
+        let taken_addr = taken.local_addr().unwrap().to_string();
+        assert!(bind_tcp(&taken_addr).await.is_err());
+        assert!(!TCP_LISTENER
+            .lock()
+            .unwrap()
+            .as_ref()
+            .unwrap()
+            .1
+            .is_finished());
+
+        // Its own address is bound again once it's stopped
+        let (_listener, rebound) = bind_tcp(&addr.to_string()).await.unwrap();
+        assert_eq!(rebound, addr);
+        assert!(TCP_LISTENER.lock().unwrap().is_none());
+    }
+
+    #[test]
+    fn tcp_clients_only_drive_the_devices() {
+        assert!(!Command::Connect.is_local_only());
+        assert!(!Command::Scan.is_local_only());
+        assert!(Command::Shutdown.is_local_only());
+        assert!(Command::TcpListen.is_local_only());
+    }
+
+    #[tokio::test]
+    async fn records_are_labelled_with_the_device() {
+        let addr = [0xE8, 0xD4, 0xEA, 0xC4, 0x62, 0x01];
+
+        let labels = tokio::spawn(async move {
+            let _labelled = Labelled::new(addr);
+            let by_addr = log_context();
+
+            TAGS.lock().unwrap().insert(addr, String::from("kitchen"));
+            let by_tag = log_context();
+            TAGS.lock().unwrap().remove(&addr);
+
+            (by_addr, by_tag)
+        })
+        .await
+        .unwrap();
+
+        assert_eq!(labels.0.as_deref(), Some("E8:D4:EA:C4:62:01"));
+        assert_eq!(labels.1.as_deref(), Some("kitchen"));
+        // Not a task
+        assert_eq!(log_context(), None);
+    }
+}
@@ -0,0 +1,774 @@
+//! Virtual devices of a daemon launched with SIMULATE_ENV so that the clients can be tested
+//! without a Bluetooth adapter nor lights. They live in memory and answer the device commands like
+//! the lights would, the daemon wide commands are still handled by process_conn
+
+use std::collections::BTreeMap;
+use std::env;
+use std::sync::atomic::Ordering;
+use std::sync::{LazyLock, Mutex as StdMutex};
+
+use tokio::io::{AsyncReadExt as _, AsyncWriteExt as _};
+use tokio::sync::broadcast;
+
+use rustbee_common::colors::Gamut;
+use rustbee_common::constants::{
+    capabilities, connection_params, features, scheduled_state, simulated_device, OutputCode,
+    ADDR_LEN, GATT_UNKNOWN_CHAR, HUE_BAR_1_ADDR, HUE_BAR_2_ADDR, MAX_BRIGHTNESS, MAX_MIREDS,
+    MIN_BRIGHTNESS, MIN_MIREDS, OUTPUT_LEN, SIMULATE_ENV,
+};
+use rustbee_common::logger::*;
+use rustbee_common::quirks;
+
+use super::{
+    send_output_code, send_to_stream, write_name, Command, Stream, LINK_CHANGES_CAPACITY,
+    SUBSCRIPTIONS,
+};
+
+/// The signal strength of every virtual device
+const RSSI: i16 = -60;
+const FIRMWARE: &str = "simulated";
+/// The virtual devices are color lights, they get the quirks of the model
+const MODEL: &str = "LCA001";
+/// Scaled xy of the white point, the color of a new virtual device
+const WHITE: [u8; 4] = [0x0C, 0x50, 0x39, 0x54];
+const MIREDS: u16 = 366;
+
+/// Whether this daemon was launched with SIMULATE_ENV
+pub static ENABLED: LazyLock<bool> = LazyLock::new(|| env::var_os(SIMULATE_ENV).is_some());
+
+/// Known from the start like two discovered lights, SIMULATED_DEVICE adds or replaces them
+static DEVICES: LazyLock<StdMutex<BTreeMap<[u8; ADDR_LEN], VirtualDevice>>> = LazyLock::new(|| {
+    let devices = [(HUE_BAR_1_ADDR, "Hue bar 1"), (HUE_BAR_2_ADDR, "Hue bar 2")]
+        .map(|(addr, name)| (addr, VirtualDevice::new(name.as_bytes())));
+
+    StdMutex::new(BTreeMap::from(devices))
+});
+
+/// Addresses of the virtual devices that changed, for their subscriptions and connection watches
+static CHANGES: LazyLock<broadcast::Sender<[u8; ADDR_LEN]>> =
+    LazyLock::new(|| broadcast::channel(LINK_CHANGES_CAPACITY).0);
+
+#[derive(Clone, PartialEq)]
+struct VirtualDevice {
+    connected: bool,
+    paired: bool,
+    power: bool,
+    /// Raw, within MIN_BRIGHTNESS and MAX_BRIGHTNESS
+    brightness: u8,
+    /// Scaled xy, white only lights don't have a color
+    color: Option<[u8; 4]>,
+    mireds: u16,
+    effect: u8,
+    name: Vec<u8>,
+}
+
+impl VirtualDevice {
+    fn new(name: &[u8]) -> Self {
+        Self {
+            connected: false,
+            paired: false,
+            power: false,
+            brightness: MAX_BRIGHTNESS,
+            color: Some(WHITE),
+            mireds: MIREDS,
+            effect: 0,
+            name: name.to_vec(),
+        }
+    }
+
+    fn capabilities(&self) -> u8 {
+        let white = capabilities::DIMMING | capabilities::COLOR_TEMP;
+
+        if self.color.is_some() {
+            white | capabilities::COLOR
+        } else {
+            white
+        }
+    }
+
+    /// Same as the state_output of a light
+    fn state_output(&self) -> [u8; OUTPUT_LEN] {
+        let mut buf = [0; OUTPUT_LEN];
+        buf[0] = OutputCode::Streaming.into();
+        buf[1] = self.connected as _;
+        buf[2] = self.power as _;
+        buf[3] = self.brightness;
+        if let Some(color) = self.color {
+            buf[4] = true as _;
+            buf[5..9].copy_from_slice(&color);
+        }
+
+        buf
+    }
+
+    /// The fields set by the `scheduled_state`, returns the bits of the ones that failed like the
+    /// apply_state of a light: the color of a white only light
+    fn apply_state(&mut self, state: &[u8]) -> u8 {
+        use scheduled_state::bits;
+
+        let fields = state[0];
+        let failed = if self.color.is_none() {
+            fields & bits::COLOR
+        } else {
+            0
+        };
+
+        if fields & bits::POWER != 0 {
+            self.power = fields & bits::ON != 0;
+        }
+        if fields & bits::BRIGHTNESS != 0 {
+            self.brightness = state[1].clamp(MIN_BRIGHTNESS, MAX_BRIGHTNESS);
+        }
+        if fields & bits::COLOR != 0 && failed == 0 {
+            self.color = Some(state[2..6].try_into().unwrap());
+        }
+        if fields & bits::TEMPERATURE != 0 {
+            self.mireds = u16::from_le_bytes([state[6], state[7]]).clamp(MIN_MIREDS, MAX_MIREDS);
+        }
+
+        failed
+    }
+}
+
+fn changed(addr: [u8; ADDR_LEN]) {
+    if CHANGES.receiver_count() > 0 {
+        let _ = CHANGES.send(addr);
+    }
+}
+
+/// Adds or replaces the virtual device of addr with the `simulated_device` data
+fn seed(addr: [u8; ADDR_LEN], data: &[u8]) {
+    use simulated_device::NAME_OFFSET;
+
+    let name = &data[NAME_OFFSET..];
+    let len = name.iter().position(|b| *b == b'\0').unwrap_or(name.len());
+
+    let device = VirtualDevice {
+        connected: data[0] == true as u8,
+        power: data[1] == true as u8,
+        brightness: data[2].clamp(MIN_BRIGHTNESS, MAX_BRIGHTNESS),
+        color: (data[3] == true as u8).then(|| data[4..8].try_into().unwrap()),
+        ..VirtualDevice::new(&name[..len])
+    };
+    DEVICES.lock().unwrap().insert(addr, device);
+    debug!("Virtual device {addr:?} seeded");
+
+    changed(addr);
+}
+
+/// Answers the request with the virtual devices, false if it's left to process_conn (the daemon
+/// wide commands that don't involve devices). A device command connects the device first and
+/// an unknown device is never discovered
+pub async fn process_request(
+    stream: &mut Stream,
+    addr: [u8; ADDR_LEN],
+    commands: &[Command],
+    set: bool,
+    data: &[u8],
+) -> bool {
+    if commands
+        .iter()
+        .any(|cmd| matches!(cmd, Command::Scene | Command::Stats | Command::Logs))
+    {
+        return false;
+    }
+
+    if commands.contains(&Command::SimulatedDevice) {
+        seed(addr, data);
+        send_output_code(stream, OutputCode::Success).await;
+        return true;
+    }
+
+    if commands.contains(&Command::SearchName) {
+        let len = data.iter().position(|b| *b == b'\0').unwrap_or(data.len());
+        let name = String::from_utf8_lossy(&data[..len]).to_lowercase();
+
+        let found = found_outputs(|device| {
+            String::from_utf8_lossy(&device.name)
+                .to_lowercase()
+                .contains(&name)
+        });
+        let code = if found.is_empty() {
+            OutputCode::DeviceNotFound
+        } else {
+            OutputCode::StreamEOF
+        };
+
+        for buf in found {
+            send_to_stream(stream, buf).await;
+        }
+        send_output_code(stream, code).await;
+        return true;
+    }
+
+    // Every virtual device is found right away, without manufacturer data
+    if commands.contains(&Command::Scan) {
+        let advertisement = commands.contains(&Command::Advertisement);
+
+        for buf in found_outputs(|_| true) {
+            send_to_stream(stream, buf).await;
+            if advertisement {
+                let mut chunk = [0; OUTPUT_LEN];
+                chunk[0] = OutputCode::Streaming.into();
+                send_to_stream(stream, chunk).await;
+            }
+        }
+        send_output_code(stream, OutputCode::StreamEOF).await;
+        return true;
+    }
+
+    if commands.contains(&Command::AllPower) {
+        let on = data[0] == true as u8;
+        let switched = {
+            let mut devices = DEVICES.lock().unwrap();
+            devices
+                .iter_mut()
+                .filter(|(_, device)| device.connected && device.power != on)
+                .map(|(addr, device)| {
+                    device.power = on;
+                    *addr
+                })
+                .collect::<Vec<_>>()
+        };
+
+        switched.into_iter().for_each(changed);
+        send_output_code(stream, OutputCode::Success).await;
+        return true;
+    }
+
+    if commands.contains(&Command::Devices) {
+        let known = DEVICES
+            .lock()
+            .unwrap()
+            .iter()
+            .map(|(addr, device)| {
+                let mut buf = [0; OUTPUT_LEN];
+                buf[0] = OutputCode::Streaming.into();
+                buf[1..][..ADDR_LEN].copy_from_slice(addr);
+                buf[1 + ADDR_LEN] = device.connected as _;
+
+                buf
+            })
+            .collect::<Vec<_>>();
+
+        for buf in known {
+            send_to_stream(stream, buf).await;
+        }
+        send_output_code(stream, OutputCode::StreamEOF).await;
+        return true;
+    }
+
+    if commands.contains(&Command::ConnectionEvents) {
+        stream_connection_changes(stream, addr).await;
+        return true;
+    }
+
+    let commands = commands
+        .iter()
+        .filter(|cmd| {
+            !matches!(
+                cmd,
+                Command::ConnectProgress | Command::ConfirmedWrites | Command::UnconfirmedWrites
+            )
+        })
+        .collect::<Vec<_>>();
+
+    if let Some(buf) = single_command_output(addr, &commands, set) {
+        send_to_stream(stream, buf).await;
+        return true;
+    }
+
+    let Some((streamed, mut output_buf)) = run_commands(addr, &commands, set, data) else {
+        warn!("Virtual device not found, address: {addr:?}");
+        send_output_code(stream, OutputCode::DeviceNotFound).await;
+        return true;
+    };
+
+    for buf in streamed {
+        send_to_stream(stream, buf).await;
+    }
+
+    if commands.contains(&&Command::Subscribe) {
+        let value = stream_state_changes(stream, addr).await;
+        output_buf[0] = u8::min(output_buf[0], value);
+    }
+
+    if output_buf[0] != u8::MAX {
+        send_to_stream(stream, output_buf).await;
+    }
+
+    true
+}
+
+/// Streaming outputs with the address and the name of the matching devices
+fn found_outputs(is_found: impl Fn(&VirtualDevice) -> bool) -> Vec<[u8; OUTPUT_LEN]> {
+    DEVICES
+        .lock()
+        .unwrap()
+        .iter()
+        .filter(|(_, device)| is_found(device))
+        .map(|(addr, device)| {
+            let mut buf = [0; OUTPUT_LEN];
+            buf[0] = OutputCode::Streaming.into();
+            buf[1..][..ADDR_LEN].copy_from_slice(addr);
+
+            let len = device.name.len().min(OUTPUT_LEN - 1 - ADDR_LEN);
+            buf[1 + ADDR_LEN..][..len].copy_from_slice(&device.name[..len]);
+
+            buf
+        })
+        .collect()
+}
+
+/// The commands that process_conn answers without connecting the device, None for the others
+fn single_command_output(
+    addr: [u8; ADDR_LEN],
+    commands: &[&Command],
+    set: bool,
+) -> Option<[u8; OUTPUT_LEN]> {
+    let [command] = commands else {
+        return None;
+    };
+
+    let mut devices = DEVICES.lock().unwrap();
+    let device = devices.get_mut(&addr);
+
+    let mut output_buf = [0; OUTPUT_LEN];
+    output_buf[0] = match (command, device) {
+        // Disconnecting an unknown device is a no-op
+        (Command::Disconnect, Some(device)) => {
+            if device.connected {
+                device.connected = false;
+                drop(devices);
+                changed(addr);
+            }
+
+            OutputCode::Success.into()
+        }
+        (Command::Disconnect, None) => OutputCode::Success.into(),
+        (Command::Connect | Command::Pair, device) if !set => {
+            output_buf[1] = device.is_some_and(|device| match command {
+                Command::Connect => device.connected,
+                _ => device.paired,
+            }) as _;
+
+            OutputCode::Success.into()
+        }
+        (Command::Rssi, Some(_)) => {
+            output_buf[1..3].copy_from_slice(&RSSI.to_le_bytes());
+
+            OutputCode::Success.into()
+        }
+        (Command::Rssi, None) => OutputCode::DeviceNotFound.into(),
+        (Command::Gatt, _) => {
+            warn!("Raw GATT access isn't simulated, address: {addr:?}");
+            OutputCode::Failure.into()
+        }
+        _ => return None,
+    };
+
+    Some(output_buf)
+}
+
+/// Same as the commands loop of process_conn on the virtual device of addr, connected first. The
+/// outputs streamed before the final one come first. None if the device is unknown
+fn run_commands(
+    addr: [u8; ADDR_LEN],
+    commands: &[&Command],
+    set: bool,
+    data: &[u8],
+) -> Option<(Vec<[u8; OUTPUT_LEN]>, [u8; OUTPUT_LEN])> {
+    let mut devices = DEVICES.lock().unwrap();
+    let device = devices.get_mut(&addr)?;
+    let before = device.clone();
+
+    let mut streamed = Vec::new();
+    let mut output_buf = [0; OUTPUT_LEN];
+    output_buf[0] = u8::MAX;
+
+    device.connected = true;
+    if commands.contains(&&Command::Connect) {
+        if set && commands.contains(&&Command::Pair) {
+            device.paired = true;
+        }
+        output_buf[0] = OutputCode::Success.into();
+    }
+
+    for command in commands {
+        let value = match command {
+            Command::Disconnect => {
+                device.connected = false;
+                OutputCode::Success.into()
+            }
+            Command::Identify | Command::Flush | Command::Keepalive => OutputCode::Success.into(),
+            Command::Power if set => {
+                device.power = data[0] == true as u8;
+                OutputCode::Success.into()
+            }
+            Command::Power => {
+                output_buf[1] = device.power as _;
+                OutputCode::Success.into()
+            }
+            Command::TogglePower => {
+                device.power = !device.power;
+                output_buf[1] = device.power as _;
+                OutputCode::Success.into()
+            }
+            Command::Brightness if set => {
+                device.brightness = data[0].clamp(MIN_BRIGHTNESS, MAX_BRIGHTNESS);
+                OutputCode::Success.into()
+            }
+            Command::Brightness => {
+                output_buf[1] = device.brightness;
+                OutputCode::Success.into()
+            }
+            Command::BrightnessRange => {
+                output_buf[1] = MIN_BRIGHTNESS;
+                output_buf[2] = MAX_BRIGHTNESS;
+                OutputCode::Success.into()
+            }
+            Command::Capabilities => {
+                output_buf[1] = device.capabilities();
+                output_buf[2] = Gamut::default().into();
+                OutputCode::Success.into()
+            }
+            // Without the startup state, like the firmwares without the characteristic
+            Command::Features => {
+                let detected =
+                    device.capabilities() as u32 | features::COMBINED_WRITE | features::EFFECTS;
+                let features = quirks::apply(quirks::QUIRKS, MODEL, FIRMWARE, detected);
+                output_buf[1..5].copy_from_slice(&features.to_le_bytes());
+                OutputCode::Success.into()
+            }
+            Command::ColorRgb | Command::ColorHex | Command::ColorXy => match device.color {
+                None => OutputCode::Failure.into(),
+                Some(_) if set => {
+                    device.color = Some(data[..4].try_into().unwrap());
+                    OutputCode::Success.into()
+                }
+                Some(color) => {
+                    output_buf[1..5].copy_from_slice(&color);
+                    OutputCode::Success.into()
+                }
+            },
+            Command::Temperature if set => {
+                device.mireds =
+                    u16::from_le_bytes([data[0], data[1]]).clamp(MIN_MIREDS, MAX_MIREDS);
+                OutputCode::Success.into()
+            }
+            Command::Temperature => {
+                output_buf[1..3].copy_from_slice(&device.mireds.to_le_bytes());
+                OutputCode::Success.into()
+            }
+            Command::Effect if set => {
+                device.effect = data[0];
+                OutputCode::Success.into()
+            }
+            Command::Effect => {
+                output_buf[1] = device.effect;
+                OutputCode::Success.into()
+            }
+            Command::Name if set => {
+                let len = data.iter().position(|b| *b == b'\0').unwrap_or(data.len());
+                device.name = data[..len].to_vec();
+                OutputCode::Success.into()
+            }
+            Command::Name => {
+                write_name(&mut output_buf, &device.name);
+                OutputCode::Success.into()
+            }
+            Command::Firmware => {
+                write_name(&mut output_buf, FIRMWARE.as_bytes());
+                OutputCode::Success.into()
+            }
+            Command::State => {
+                streamed.push(device.state_output());
+                write_name(&mut output_buf, &device.name);
+                OutputCode::Success.into()
+            }
+            Command::ApplyState => {
+                output_buf[1] = device.apply_state(&data[..scheduled_state::LEN]);
+                if output_buf[1] == 0 {
+                    OutputCode::Success.into()
+                } else {
+                    OutputCode::Failure.into()
+                }
+            }
+            // Like the firmwares without the characteristic
+            Command::PowerOn => {
+                output_buf[1] = GATT_UNKNOWN_CHAR;
+                OutputCode::Failure.into()
+            }
+            Command::ConnectionParams => {
+                output_buf[1] = connection_params::UNSUPPORTED;
+                OutputCode::Failure.into()
+            }
+            // Like the lights without separate white channels
+            Command::WhiteMix => OutputCode::Failure.into(),
+            Command::Schedule => {
+                warn!("Scheduled commands aren't simulated, address: {addr:?}");
+                OutputCode::Failure.into()
+            }
+            // Subscribe is streamed by process_request once the lock is released, the others are
+            // modifiers or daemon wide
+            _ => continue,
+        };
+        output_buf[0] = u8::min(output_buf[0], value);
+    }
+
+    if *device != before {
+        drop(devices);
+        changed(addr);
+    }
+
+    Some((streamed, output_buf))
+}
+
+/// Same as the stream_state_changes of a light, a virtual device never drops
+async fn stream_state_changes(stream: &mut Stream, addr: [u8; ADDR_LEN]) -> u8 {
+    let mut changes = CHANGES.subscribe();
+    SUBSCRIPTIONS.fetch_add(1, Ordering::Relaxed);
+
+    let mut byte = [0; 1];
+    let code = 'stream: loop {
+        let Some(state) = DEVICES
+            .lock()
+            .unwrap()
+            .get(&addr)
+            .map(VirtualDevice::state_output)
+        else {
+            break OutputCode::Failure;
+        };
+
+        if stream.write_all(&state).await.is_err() || stream.flush().await.is_err() {
+            break OutputCode::StreamEOF;
+        }
+
+        // The changes of the other devices are skipped
+        loop {
+            tokio::select! {
+                _ = stream.read(&mut byte) => break 'stream OutputCode::StreamEOF,
+                changed = changes.recv() => match changed {
+                    Ok(changed) if changed != addr => {}
+                    Ok(_) | Err(broadcast::error::RecvError::Lagged(_)) => continue 'stream,
+                    Err(broadcast::error::RecvError::Closed) => break 'stream OutputCode::StreamEOF,
+                },
+            }
+        }
+    };
+
+    SUBSCRIPTIONS.fetch_sub(1, Ordering::Relaxed);
+
+    code.into()
+}
+
+/// Same as the stream_connection_changes of process_conn, an unknown device is disconnected
+async fn stream_connection_changes(stream: &mut Stream, addr: [u8; ADDR_LEN]) {
+    let mut changes = CHANGES.subscribe();
+
+    let mut byte = [0; 1];
+    let mut last = None;
+    loop {
+        let connected = DEVICES
+            .lock()
+            .unwrap()
+            .get(&addr)
+            .is_some_and(|device| device.connected);
+
+        if last != Some(connected) {
+            let mut buf = [0; OUTPUT_LEN];
+            buf[0] = OutputCode::Streaming.into();
+            buf[1] = connected as _;
+
+            // Not send_to_stream since the client may leave at any time
+            if stream.write_all(&buf).await.is_err() || stream.flush().await.is_err() {
+                return;
+            }
+            last = Some(connected);
+        }
+
+        loop {
+            tokio::select! {
+                _ = stream.read(&mut byte) => return,
+                changed = changes.recv() => match changed {
+                    Ok(changed) if changed != addr => {}
+                    Ok(_) | Err(broadcast::error::RecvError::Lagged(_)) => break,
+                    Err(broadcast::error::RecvError::Closed) => return,
+                },
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use rustbee_common::constants::DATA_LEN;
+
+    #[test]
+    fn a_state_is_applied_to_the_virtual_device() {
+        use scheduled_state::bits;
+
+        let mut device = VirtualDevice::new(b"Hue bar");
+        let mut state = [0; scheduled_state::LEN];
+        state[0] = bits::POWER | bits::ON | bits::BRIGHTNESS | bits::TEMPERATURE;
+        state[1] = 0;
+        state[6..8].copy_from_slice(&1000u16.to_le_bytes());
+
+        assert_eq!(device.apply_state(&state), 0);
+        assert!(device.power);
+        assert_eq!(device.brightness, MIN_BRIGHTNESS);
+        assert_eq!(device.mireds, MAX_MIREDS);
+        assert_eq!(device.color, Some(WHITE));
+
+        // The other fields are still applied
+        device.color = None;
+        state[0] = bits::COLOR | bits::POWER;
+        assert_eq!(device.apply_state(&state), bits::COLOR);
+        assert!(!device.power);
+    }
+
+    /// The outputs of a request sent by a client on the other end of the daemon socket
+    async fn request(
+        addr: [u8; ADDR_LEN],
+        commands: &[Command],
+        set: bool,
+        data: &[u8],
+    ) -> Vec<[u8; OUTPUT_LEN]> {
+        let (mut client, daemon) = tokio::io::duplex(OUTPUT_LEN * 8);
+        let mut daemon: Stream = Box::new(daemon);
+
+        assert!(process_request(&mut daemon, addr, commands, set, data).await);
+        drop(daemon);
+
+        let mut outputs = Vec::new();
+        client.read_to_end(&mut outputs).await.unwrap();
+
+        outputs
+            .chunks(OUTPUT_LEN)
+            .map(|buf| buf.try_into().unwrap())
+            .collect()
+    }
+
+    /// A disconnected and powered color virtual device of addr named name, seeded like SIMULATED_DEVICE does
+    async fn seed_device(addr: [u8; ADDR_LEN], name: &[u8]) {
+        let mut data = [0; DATA_LEN];
+        data[1] = true as _;
+        data[2] = MAX_BRIGHTNESS;
+        data[3] = true as _;
+        data[4..8].copy_from_slice(&WHITE);
+        data[simulated_device::NAME_OFFSET..][..name.len()].copy_from_slice(name);
+
+        let outputs = request(addr, &[Command::SimulatedDevice], true, &data).await;
+        assert_eq!(outputs, [output(OutputCode::Success, &[])]);
+    }
+
+    fn output(code: OutputCode, data: &[u8]) -> [u8; OUTPUT_LEN] {
+        let mut buf = [0; OUTPUT_LEN];
+        buf[0] = code.into();
+        buf[1..][..data.len()].copy_from_slice(data);
+        buf
+    }
+
+    #[tokio::test]
+    async fn a_client_scans_connects_and_reads_the_state() {
+        let addr = [0xC1, 0, 0, 0, 0, 1];
+        seed_device(addr, b"Socket bar").await;
+
+        let outputs = request(addr, &[Command::Scan], false, &[0; DATA_LEN]).await;
+        let (eof, found) = outputs.split_last().unwrap();
+        assert_eq!(*eof, output(OutputCode::StreamEOF, &[]));
+        assert!(found.contains(&output(
+            OutputCode::Streaming,
+            &[&addr[..], &b"Socket bar"[..]].concat()
+        )));
+
+        let connected = request(addr, &[Command::Connect], false, &[0; DATA_LEN]).await;
+        assert_eq!(connected, [output(OutputCode::Success, &[false as _])]);
+
+        let outputs = request(addr, &[Command::Connect], true, &[0; DATA_LEN]).await;
+        assert_eq!(outputs, [output(OutputCode::Success, &[])]);
+
+        let connected = request(addr, &[Command::Connect], false, &[0; DATA_LEN]).await;
+        assert_eq!(connected, [output(OutputCode::Success, &[true as _])]);
+
+        let mut data = [0; DATA_LEN];
+        data[0] = 50;
+        let outputs = request(addr, &[Command::Brightness], true, &data).await;
+        assert_eq!(outputs, [output(OutputCode::Success, &[])]);
+
+        let outputs = request(addr, &[Command::State], false, &[0; DATA_LEN]).await;
+        let [state, name] = outputs.as_slice() else {
+            panic!("Unexpected outputs: {outputs:?}");
+        };
+        assert_eq!(state[..5], [OutputCode::Streaming.into(), 1, 1, 50, 1]);
+        assert_eq!(state[5..9], WHITE);
+        assert_eq!(*name, output(OutputCode::Success, b"Socket bar"));
+    }
+
+    #[tokio::test]
+    async fn a_color_on_a_white_light_fails_the_state() {
+        use scheduled_state::bits;
+
+        let addr = [0xC1, 0, 0, 0, 0, 3];
+        let mut data = [0; DATA_LEN];
+        data[2] = MAX_BRIGHTNESS;
+        let outputs = request(addr, &[Command::SimulatedDevice], true, &data).await;
+        assert_eq!(outputs, [output(OutputCode::Success, &[])]);
+
+        let mut state = [0; DATA_LEN];
+        state[0] = bits::BRIGHTNESS | bits::COLOR;
+        state[1] = 50;
+        state[2..6].copy_from_slice(&WHITE);
+        let outputs = request(addr, &[Command::ApplyState], true, &state).await;
+        assert_eq!(outputs, [output(OutputCode::Failure, &[bits::COLOR])]);
+
+        // The brightness is still applied
+        let outputs = request(addr, &[Command::Brightness], false, &[0; DATA_LEN]).await;
+        assert_eq!(outputs, [output(OutputCode::Success, &[50])]);
+    }
+
+    #[tokio::test]
+    async fn a_subscription_streams_the_changes_until_the_client_stops_it() {
+        let addr = [0xC1, 0, 0, 0, 0, 2];
+        seed_device(addr, b"Subscribed bar").await;
+
+        let (mut client, daemon) = tokio::io::duplex(OUTPUT_LEN * 8);
+        let subscription = tokio::spawn(async move {
+            let mut daemon: Stream = Box::new(daemon);
+            process_request(
+                &mut daemon,
+                addr,
+                &[Command::Subscribe],
+                false,
+                &[0; DATA_LEN],
+            )
+            .await
+        });
+
+        let mut state = [0; OUTPUT_LEN];
+        client.read_exact(&mut state).await.unwrap();
+        assert_eq!(
+            state[..4],
+            [OutputCode::Streaming.into(), 1, 1, MAX_BRIGHTNESS]
+        );
+
+        let outputs = request(addr, &[Command::Power], true, &[false as _; DATA_LEN]).await;
+        assert_eq!(outputs, [output(OutputCode::Success, &[])]);
+
+        client.read_exact(&mut state).await.unwrap();
+        assert_eq!(
+            state[..4],
+            [OutputCode::Streaming.into(), 1, 0, MAX_BRIGHTNESS]
+        );
+
+        // Any byte stops the subscription, then the final output is sent
+        client.write_all(&[0]).await.unwrap();
+        assert!(subscription.await.unwrap());
+
+        let mut outputs = Vec::new();
+        client.read_to_end(&mut outputs).await.unwrap();
+        assert_eq!(outputs, output(OutputCode::StreamEOF, &[]));
+    }
+}
@@ -0,0 +1,87 @@
+//go:build rustbee_ffi
+
+package rustbee
+
+/*
+#include "librustbee.h"
+*/
+import "C"
+
+import (
+	"runtime/cgo"
+	"unsafe"
+)
+
+// rustbeeAsyncDone is the callback of the librustbee async calls, it runs on
+// the librustbee thread that made the call so its last error can be read
+//
+//export rustbeeAsyncDone
+func rustbeeAsyncDone(ctx unsafe.Pointer, ok C.bool) {
+	h := cgo.Handle(uintptr(ctx))
+	done := h.Value().(func(error))
+	h.Delete()
+
+	if ok {
+		done(nil)
+		return
+	}
+
+	done(lastError())
+}
+
+// rustbeeStateChanged is the callback of subscribe_state, a nil state means the
+// subscription ended
+//
+//export rustbeeStateChanged
+func rustbeeStateChanged(ctx unsafe.Pointer, cstate *C.DeviceState) {
+	h := cgo.Handle(uintptr(ctx))
+	onState := h.Value().(func(*DeviceState))
+
+	if cstate == nil {
+		h.Delete()
+		onState(nil)
+		return
+	}
+
+	state := goState(cstate)
+	onState(&state)
+}
+
+// rustbeeConnectionChanged is the callback of set_connection_callback, it's
+// called a last time with RUSTBEE_CONNECTION_ENDED
+//
+//export rustbeeConnectionChanged
+func rustbeeConnectionChanged(ctx unsafe.Pointer, state C.uint8_t) {
+	h := cgo.Handle(uintptr(ctx))
+	onChange := h.Value().(func(connected, ended bool))
+
+	if state == C.RUSTBEE_CONNECTION_ENDED {
+		h.Delete()
+		onChange(false, true)
+		return
+	}
+
+	onChange(state == 1, false)
+}
+
+// rustbeeLog is the callback of set_log_callback, it runs on the librustbee
+// thread forwarding the daemon logs
+//
+//export rustbeeLog
+func rustbeeLog(ctx unsafe.Pointer, level C.int, cmsg *C.char) {
+	onLog := cgo.Handle(uintptr(ctx)).Value().(func(int, string))
+	onLog(int(level), C.GoString(cmsg))
+}
+
+// rustbeeScanFound is the callback of scan_devices_cb, it runs on the thread
+// of the scan and returns false to stop it
+//
+//export rustbeeScanFound
+func rustbeeScanFound(ctx unsafe.Pointer, caddr *C.uint8_t, cname *C.char) C.bool {
+	onFound := cgo.Handle(uintptr(ctx)).Value().(func(Discovered) bool)
+
+	found := Discovered{Name: C.GoString(cname)}
+	copy(found.Addr[:], unsafe.Slice((*byte)(unsafe.Pointer(caddr)), len(found.Addr)))
+
+	return C.bool(onFound(found))
+}
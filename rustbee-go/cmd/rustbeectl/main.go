@@ -0,0 +1,243 @@
+// Command rustbeectl drives Hue lights from the shell through the rustbee
+// package, it launches the daemon if it isn't running. It's built with the
+// rustbee_ffi tag like any user of the package:
+//
+//	go build -tags rustbee_ffi ./cmd/rustbeectl
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Snoupix/rustbee/rustbee-go"
+)
+
+// connectTimeout covers the discovery and the connection of a device
+const connectTimeout = 30 * time.Second
+
+const usage = `Usage: rustbeectl <command> [args]
+
+Commands:
+  scan [seconds]             List the named devices found (5s by default)
+  connect <mac>              Connect the device
+  on <mac>                   Power the device on
+  off <mac>                  Power the device off
+  toggle <mac>               Power the device off if it's on, else on
+  brightness <mac> <pct>     Set the brightness from 0 to 100
+  color <mac> <color>        Set the color, #rrggbb, #rgb or r,g,b
+  state <mac>                Print the state of the device
+  adapter                    Print the Bluetooth adapter in use
+
+A mac is like E8:D4:EA:C4:62:00
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err := run(os.Args[1], os.Args[2:]); err != nil {
+		// The daemon cannot run without an adapter, launching it tells
+		if errors.Is(err, rustbee.ErrNoAdapter) {
+			err = errors.New("no Bluetooth LE adapter found, plug one in or turn Bluetooth on")
+		}
+		// The errors of the package carry the last error message of librustbee
+		fmt.Fprintf(os.Stderr, "rustbeectl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(command string, args []string) error {
+	if command == "adapter" {
+		return printAdapter()
+	}
+
+	// The first command that needs the daemon launches it
+	if err := rustbee.SetAutoLaunchDaemon(true); err != nil {
+		return err
+	}
+
+	if command == "scan" {
+		return scan(args)
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("%s expects a mac address\n\n%s", command, usage)
+	}
+
+	var action func(*rustbee.Device, []string) error
+	switch command {
+	case "connect":
+		action = func(*rustbee.Device, []string) error { return nil }
+	case "on", "off":
+		action = func(d *rustbee.Device, _ []string) error { return d.SetPower(command == "on") }
+	case "toggle":
+		action = togglePower
+	case "brightness":
+		action = setBrightness
+	case "color":
+		action = setColor
+	case "state":
+		action = printState
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", command, usage)
+	}
+
+	device, err := connect(args[0])
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	return action(device, args[1:])
+}
+
+func scan(args []string) error {
+	duration := 5 * time.Second
+	if len(args) > 0 {
+		seconds, err := strconv.ParseUint(args[0], 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid scan duration %q, expected seconds", args[0])
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+
+	found, err := rustbee.Scan(context.Background(), duration)
+	if err != nil {
+		return err
+	}
+
+	for device := range found {
+		fmt.Printf("%s %s\n", formatMAC(device.Addr), device.Name)
+	}
+
+	return nil
+}
+
+// connect opens and connects the device, it must be closed
+func connect(mac string) (*rustbee.Device, error) {
+	addr, err := parseMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := rustbee.NewDevice(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+
+	if err := device.Connect(ctx); err != nil {
+		device.Close()
+		return nil, err
+	}
+
+	return device, nil
+}
+
+func togglePower(device *rustbee.Device, _ []string) error {
+	on, err := device.TogglePower()
+	if err != nil {
+		return err
+	}
+
+	if on {
+		fmt.Println("on")
+	} else {
+		fmt.Println("off")
+	}
+
+	return nil
+}
+
+func setBrightness(device *rustbee.Device, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("brightness expects a percentage\n\n%s", usage)
+	}
+
+	percent, err := strconv.ParseUint(strings.TrimSuffix(args[0], "%"), 10, 8)
+	if err != nil || percent > 100 {
+		return fmt.Errorf("invalid brightness %q, expected 0 to 100", args[0])
+	}
+
+	return device.SetBrightnessPercent(uint8(percent))
+}
+
+func setColor(device *rustbee.Device, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("color expects a color\n\n%s", usage)
+	}
+
+	color, err := rustbee.ParseColor(args[0])
+	if err != nil {
+		return err
+	}
+
+	return device.SetColor(color)
+}
+
+func printState(device *rustbee.Device, _ []string) error {
+	state, err := device.State()
+	if err != nil {
+		return err
+	}
+
+	power := "off"
+	if state.Power {
+		power = "on"
+	}
+
+	percent, err := device.BrightnessPercent()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Name:       %s\n", state.Name)
+	fmt.Printf("Connected:  %t\n", state.Connected)
+	fmt.Printf("Power:      %s\n", power)
+	fmt.Printf("Brightness: %d%%\n", percent)
+	if state.HasColor {
+		fmt.Printf("Color:      %s\n", state.RGB)
+	}
+
+	return nil
+}
+
+func printAdapter() error {
+	adapter, err := rustbee.DefaultAdapter()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Name:    %s\n", adapter.Name)
+	if adapter.HasAddr {
+		fmt.Printf("Address: %s\n", formatMAC(adapter.Addr))
+	}
+
+	return nil
+}
+
+func parseMAC(mac string) ([6]byte, error) {
+	var addr [6]byte
+
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != len(addr) {
+		return addr, fmt.Errorf("invalid mac address %q, expected AA:BB:CC:DD:EE:FF", mac)
+	}
+
+	copy(addr[:], hw)
+	return addr, nil
+}
+
+func formatMAC(addr [6]byte) string {
+	return strings.ToUpper(net.HardwareAddr(addr[:]).String())
+}
@@ -0,0 +1,227 @@
+package rustbee
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Color is an sRGB color. As text (e.g. in JSON) it's "#rrggbb", it's parsed
+// from "#rrggbb", "#rgb" or "r,g,b" with decimal components.
+type Color struct {
+	R, G, B uint8
+}
+
+func (c Color) String() string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func (c Color) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *Color) UnmarshalText(text []byte) error {
+	parsed, err := ParseColor(string(text))
+	if err != nil {
+		return err
+	}
+
+	*c = parsed
+	return nil
+}
+
+// ParseColor parses the text forms of Color, the spaces around the decimal
+// components are ignored
+func ParseColor(s string) (Color, error) {
+	if hexColor, ok := strings.CutPrefix(s, "#"); ok {
+		// #rgb is #rrggbb with doubled digits
+		if len(hexColor) == 3 {
+			hexColor = string([]byte{
+				hexColor[0], hexColor[0],
+				hexColor[1], hexColor[1],
+				hexColor[2], hexColor[2],
+			})
+		}
+
+		rgb, err := hex.DecodeString(hexColor)
+		if err != nil || len(rgb) != 3 {
+			return Color{}, fmt.Errorf("rustbee: invalid hex color %q", s)
+		}
+
+		return Color{rgb[0], rgb[1], rgb[2]}, nil
+	}
+
+	components := strings.Split(s, ",")
+	if len(components) != 3 {
+		return Color{}, fmt.Errorf("rustbee: invalid color %q, expected #rrggbb, #rgb or r,g,b", s)
+	}
+
+	var rgb [3]uint8
+	for i, component := range components {
+		value, err := strconv.ParseUint(strings.TrimSpace(component), 10, 8)
+		if err != nil {
+			return Color{}, fmt.Errorf("rustbee: invalid color component %q, expected 0 to 255", component)
+		}
+		rgb[i] = uint8(value)
+	}
+
+	return Color{rgb[0], rgb[1], rgb[2]}, nil
+}
+
+// HSV returns the hue in degrees from 0 to 360 (excluded), the saturation and
+// the value from 0 to 1
+func (c Color) HSV() (h, s, v float64) {
+	r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+	v = max(r, g, b)
+	delta := v - min(r, g, b)
+
+	if v > 0 {
+		s = delta / v
+	}
+	if delta == 0 {
+		return 0, s, v
+	}
+
+	switch v {
+	case r:
+		h = math.Mod((g-b)/delta, 6)
+	case g:
+		h = (b-r)/delta + 2
+	default:
+		h = (r-g)/delta + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+
+	return h, s, v
+}
+
+// ColorFromHSV is the inverse of Color.HSV, the hue wraps around and the
+// saturation and value are clamped
+func ColorFromHSV(h, s, v float64) Color {
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+	s, v = clamp01(s), clamp01(v)
+
+	chroma := v * s
+	x := chroma * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := v - chroma
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g = chroma, x
+	case h < 120:
+		r, g = x, chroma
+	case h < 180:
+		g, b = chroma, x
+	case h < 240:
+		g, b = x, chroma
+	case h < 300:
+		r, b = x, chroma
+	default:
+		r, b = chroma, x
+	}
+
+	return Color{to8Bits(r + m), to8Bits(g + m), to8Bits(b + m)}
+}
+
+// XY returns the CIE 1931 chromaticity of the color, the lights bring it back
+// within their gamut. Black has no chromaticity, it's the D65 white point.
+func (c Color) XY() (x, y float64) {
+	r, g, b := linear(c.R), linear(c.G), linear(c.B)
+
+	// sRGB D65, the matrix librustbee uses
+	bigX := r*0.4124 + g*0.3576 + b*0.1805
+	bigY := r*0.2126 + g*0.7152 + b*0.0722
+	bigZ := r*0.0193 + g*0.1192 + b*0.9505
+
+	sum := bigX + bigY + bigZ
+	if sum == 0 {
+		return 0.3127, 0.3290
+	}
+
+	return bigX / sum, bigY / sum
+}
+
+// ColorPayloadLen is the length of the value of the color characteristic
+const ColorPayloadLen = 4
+
+// colorUUID is the color characteristic of the Hue lights,
+// 932c32bd-0005-47a2-835a-a8d455b859dd
+var colorUUID = [16]byte{
+	0x93, 0x2c, 0x32, 0xbd, 0x00, 0x05, 0x47, 0xa2,
+	0x83, 0x5a, 0xa8, 0xd4, 0x55, 0xb8, 0x59, 0xdd,
+}
+
+// ColorPayload is the value of the color characteristic for the chromaticity
+// (x/0xFFFF, y/0xFFFF), both little endian, see Device.SetColorRaw
+func ColorPayload(x, y uint16) []byte {
+	payload := make([]byte, 0, ColorPayloadLen)
+	payload = binary.LittleEndian.AppendUint16(payload, x)
+
+	return binary.LittleEndian.AppendUint16(payload, y)
+}
+
+// ScaleXY scales the chromaticity to the color characteristic like librustbee
+// does (truncated), the coordinates are clamped from 0 to 1
+func ScaleXY(x, y float64) (uint16, uint16) {
+	return uint16(clamp01(x) * 0xFFFF), uint16(clamp01(y) * 0xFFFF)
+}
+
+// ColorFromXY is the brightest color of the chromaticity, the components that
+// are out of the sRGB gamut are clamped
+func ColorFromXY(x, y float64) Color {
+	if y <= 0 {
+		return Color{}
+	}
+
+	// XYZ at full luminance
+	bigX := x / y
+	bigZ := (1 - x - y) / y
+
+	r := bigX*3.2406 - 1.5372 - bigZ*0.4986
+	g := -bigX*0.9689 + 1.8758 + bigZ*0.0415
+	b := bigX*0.0557 - 0.2040 + bigZ*1.0570
+
+	r, g, b = max(r, 0), max(g, 0), max(b, 0)
+	if brightest := max(r, g, b); brightest > 0 {
+		r, g, b = r/brightest, g/brightest, b/brightest
+	}
+
+	return Color{gamma(r), gamma(g), gamma(b)}
+}
+
+// linear removes the sRGB gamma of a component
+func linear(component uint8) float64 {
+	c := float64(component) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// gamma is the inverse of linear
+func gamma(c float64) uint8 {
+	if c <= 0.0031308 {
+		return to8Bits(12.92 * c)
+	}
+
+	return to8Bits(1.055*math.Pow(c, 1/2.4) - 0.055)
+}
+
+func to8Bits(c float64) uint8 {
+	return uint8(math.Round(clamp01(c) * 255))
+}
+
+func clamp01(v float64) float64 {
+	return min(max(v, 0), 1)
+}
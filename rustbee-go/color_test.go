@@ -0,0 +1,168 @@
+package rustbee
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected Color
+		invalid  bool
+	}{
+		{text: "#ff8000", expected: Color{255, 128, 0}},
+		{text: "#FF8000", expected: Color{255, 128, 0}},
+		{text: "#f80", expected: Color{255, 136, 0}},
+		{text: "#000", expected: Color{}},
+		{text: "255,128,0", expected: Color{255, 128, 0}},
+		{text: " 255, 128 ,0 ", expected: Color{255, 128, 0}},
+		{text: "0,0,0", expected: Color{}},
+		{text: "#ff80", invalid: true},
+		{text: "#ff80000", invalid: true},
+		{text: "#gg8000", invalid: true},
+		{text: "ff8000", invalid: true},
+		{text: "#", invalid: true},
+		{text: "", invalid: true},
+		{text: "256,0,0", invalid: true},
+		{text: "-1,0,0", invalid: true},
+		{text: "255,128", invalid: true},
+		{text: "255,128,0,0", invalid: true},
+		{text: "255,,0", invalid: true},
+		{text: "0x10,0,0", invalid: true},
+	}
+
+	for _, test := range tests {
+		color, err := ParseColor(test.text)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.text, color)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", test.text, err)
+		} else if color != test.expected {
+			t.Errorf("%q: expected %v, got %v", test.text, test.expected, color)
+		}
+	}
+}
+
+func TestColorRoundTripsThroughJSON(t *testing.T) {
+	type config struct {
+		Color Color
+	}
+
+	data, err := json.Marshal(config{Color{255, 128, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const expected = `{"Color":"#ff8000"}`
+	if string(data) != expected {
+		t.Fatalf("expected %s, got %s", expected, data)
+	}
+
+	var decoded config
+	if err := json.Unmarshal([]byte(`{"Color":"255,128,0"}`), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Color != (Color{255, 128, 0}) {
+		t.Fatalf("expected #ff8000, got %v", decoded.Color)
+	}
+
+	if err := json.Unmarshal([]byte(`{"Color":"#12345"}`), &decoded); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestColorHSV(t *testing.T) {
+	tests := []struct {
+		color   Color
+		h, s, v float64
+	}{
+		{Color{}, 0, 0, 0},
+		{Color{255, 255, 255}, 0, 0, 1},
+		{Color{255, 0, 0}, 0, 1, 1},
+		{Color{0, 255, 0}, 120, 1, 1},
+		{Color{0, 0, 255}, 240, 1, 1},
+		{Color{255, 0, 255}, 300, 1, 1},
+		{Color{255, 128, 0}, 30.1, 1, 1},
+	}
+
+	for _, test := range tests {
+		h, s, v := test.color.HSV()
+		if !near(h, test.h, 0.1) || !near(s, test.s, 0.01) || !near(v, test.v, 0.01) {
+			t.Errorf("%v: expected (%v, %v, %v), got (%v, %v, %v)", test.color, test.h, test.s, test.v, h, s, v)
+		}
+
+		if back := ColorFromHSV(h, s, v); back != test.color {
+			t.Errorf("%v: expected it back from HSV, got %v", test.color, back)
+		}
+	}
+
+	// The hue wraps around, the saturation and value are clamped
+	if c := ColorFromHSV(-240, 2, 1.5); c != (Color{0, 255, 0}) {
+		t.Errorf("expected #00ff00, got %v", c)
+	}
+}
+
+func TestColorXY(t *testing.T) {
+	tests := []struct {
+		color Color
+		x, y  float64
+	}{
+		// The sRGB primaries and the D65 white point
+		{Color{255, 0, 0}, 0.64, 0.33},
+		{Color{0, 255, 0}, 0.30, 0.60},
+		{Color{0, 0, 255}, 0.15, 0.06},
+		{Color{255, 255, 255}, 0.3127, 0.3290},
+	}
+
+	for _, test := range tests {
+		x, y := test.color.XY()
+		if !near(x, test.x, 0.001) || !near(y, test.y, 0.001) {
+			t.Errorf("%v: expected (%v, %v), got (%v, %v)", test.color, test.x, test.y, x, y)
+		}
+
+		if back := ColorFromXY(x, y); back != test.color {
+			t.Errorf("%v: expected it back from xy, got %v", test.color, back)
+		}
+	}
+
+	if x, y := (Color{}).XY(); x != 0.3127 || y != 0.3290 {
+		t.Errorf("expected the white point for black, got (%v, %v)", x, y)
+	}
+	if c := ColorFromXY(0.3, 0); c != (Color{}) {
+		t.Errorf("expected black for y = 0, got %v", c)
+	}
+}
+
+func TestColorPayload(t *testing.T) {
+	payload := ColorPayload(0x1234, 0xabcd)
+	if expected := []byte{0x34, 0x12, 0xcd, 0xab}; !bytes.Equal(payload, expected) {
+		t.Fatalf("expected %x, got %x", expected, payload)
+	}
+
+	tests := []struct {
+		x, y             float64
+		scaledX, scaledY uint16
+	}{
+		{0, 0, 0, 0},
+		{1, 1, 0xffff, 0xffff},
+		{0.3127, 0.3290, 20492, 21561},
+		{-0.5, 2, 0, 0xffff},
+	}
+	for _, test := range tests {
+		if x, y := ScaleXY(test.x, test.y); x != test.scaledX || y != test.scaledY {
+			t.Errorf("(%v, %v): expected (%d, %d), got (%d, %d)", test.x, test.y, test.scaledX, test.scaledY, x, y)
+		}
+	}
+}
+
+func near(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
@@ -0,0 +1,188 @@
+package rustbee
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrorCode mirrors the RustbeeError enum of librustbee.h
+type ErrorCode int
+
+const (
+	CodeOK ErrorCode = iota
+	CodeNullPointer
+	CodeInvalidArg
+	CodeDaemonUnreachable
+	CodeDeviceNotFound
+	CodeNotConnected
+	CodeGattError
+	CodeDaemonError
+	CodeTimeout
+	CodeNoAdapter
+	CodeUnsupported
+	CodeSocketInUse
+	CodePermissionDenied
+	CodeSpawnFailed
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeOK:
+		return "ok"
+	case CodeNullPointer:
+		return "null pointer"
+	case CodeInvalidArg:
+		return "invalid argument"
+	case CodeDaemonUnreachable:
+		return "daemon unreachable"
+	case CodeDeviceNotFound:
+		return "device not found"
+	case CodeNotConnected:
+		return "not connected"
+	case CodeGattError:
+		return "gatt error"
+	case CodeDaemonError:
+		return "daemon error"
+	case CodeTimeout:
+		return "timeout"
+	case CodeNoAdapter:
+		return "no Bluetooth adapter"
+	case CodeUnsupported:
+		return "unsupported"
+	case CodeSocketInUse:
+		return "socket in use"
+	case CodePermissionDenied:
+		return "permission denied"
+	case CodeSpawnFailed:
+		return "daemon spawn failed"
+	default:
+		return fmt.Sprintf("unknown error code %d", int(c))
+	}
+}
+
+// Error is the last error reported by librustbee after a failed call
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return "rustbee: " + e.Code.String()
+	}
+
+	return "rustbee: " + e.Message
+}
+
+// Is matches any *Error with the same code so the sentinels below can be used
+// with errors.Is regardless of the message
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+
+	return ok && e.Code == t.Code
+}
+
+var (
+	ErrNullPointer       = &Error{Code: CodeNullPointer}
+	ErrInvalidArg        = &Error{Code: CodeInvalidArg}
+	ErrDaemonUnreachable = &Error{Code: CodeDaemonUnreachable}
+	ErrDeviceNotFound    = &Error{Code: CodeDeviceNotFound}
+	ErrNotConnected      = &Error{Code: CodeNotConnected}
+	ErrGattError         = &Error{Code: CodeGattError}
+	ErrDaemonError       = &Error{Code: CodeDaemonError}
+	ErrTimeout           = &Error{Code: CodeTimeout}
+	ErrNoAdapter         = &Error{Code: CodeNoAdapter}
+	ErrUnsupported       = &Error{Code: CodeUnsupported}
+	ErrSocketInUse       = &Error{Code: CodeSocketInUse}
+	ErrPermissionDenied  = &Error{Code: CodePermissionDenied}
+	ErrSpawnFailed       = &Error{Code: CodeSpawnFailed}
+
+	// ErrClosed is returned by the methods of a Device after Close
+	ErrClosed = errors.New("rustbee: device is closed")
+
+	// ErrFFIUnavailable is returned by every call when the package is built
+	// without the rustbee_ffi build tag
+	ErrFFIUnavailable = errors.New("rustbee: FFI not available, build with -tags rustbee_ffi")
+)
+
+// DeviceError is a failure of one device among others, e.g. in a Group
+type DeviceError struct {
+	Addr [6]byte
+	Err  error
+}
+
+func (e *DeviceError) Error() string {
+	return fmt.Sprintf("rustbee: device %X: %v", e.Addr, e.Err)
+}
+
+func (e *DeviceError) Unwrap() error {
+	return e.Err
+}
+
+// GroupError is the error of a Group method when some of its devices failed,
+// Failed has the error of each of them (not wrapped in a DeviceError). Its
+// message is the one of every DeviceError, one per line, and errors.Is and
+// errors.As see them
+type GroupError struct {
+	Failed map[*Device]error
+	// DeviceErrors in the order of the members
+	errs []error
+}
+
+func (e *GroupError) Error() string {
+	return errors.Join(e.errs...).Error()
+}
+
+func (e *GroupError) Unwrap() []error {
+	return e.errs
+}
+
+// groupError is nil if none of the devices failed, failed[i] is the error of
+// devices[i]
+func groupError(devices []*Device, failed []error) error {
+	groupErr := &GroupError{Failed: map[*Device]error{}}
+	for i, err := range failed {
+		if err != nil {
+			groupErr.Failed[devices[i]] = err
+			groupErr.errs = append(groupErr.errs, &DeviceError{Addr: devices[i].addr, Err: err})
+		}
+	}
+	if len(groupErr.errs) == 0 {
+		return nil
+	}
+
+	return groupErr
+}
+
+// StateError is returned by SetState when some fields of the state weren't
+// applied, the others were. Err is the error of the failed writes, e.g.
+// ErrGattError or ErrTimeout (the fields may have been applied then)
+type StateError struct {
+	Failed StateFields
+	Err    error
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("rustbee: %s not applied: %v", e.Failed, e.Err)
+}
+
+func (e *StateError) Unwrap() error {
+	return e.Err
+}
+
+// AmbiguousNameError is returned by ConnectByName when several devices have
+// the name
+type AmbiguousNameError struct {
+	Name  string
+	Addrs [][6]byte
+}
+
+func (e *AmbiguousNameError) Error() string {
+	addrs := make([]string, len(e.Addrs))
+	for i, addr := range e.Addrs {
+		addrs[i] = fmt.Sprintf("%X", addr)
+	}
+
+	return fmt.Sprintf("rustbee: %d devices are named %q: %s", len(e.Addrs), e.Name, strings.Join(addrs, ", "))
+}
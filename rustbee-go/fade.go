@@ -0,0 +1,81 @@
+package rustbee
+
+import (
+	"context"
+	"time"
+)
+
+// fadeMinStep is the shortest time between two writes of FadeBrightness, the
+// link and the light fall behind faster writes
+const fadeMinStep = 50 * time.Millisecond
+
+// FadeBrightness fades the raw brightness from the current one to target over
+// dur with SetBrightness writes, for the lights that cannot transition by
+// themselves. target is clamped to the range of the light (see
+// BrightnessRange) and the writes are at least 50ms apart, so a step may skip
+// raw values. The steps follow the elapsed time, a slow write shortens the
+// next ones. A dur of 0 or less writes target at once.
+//
+// If ctx is done first, ctx.Err() is returned and the light stays at the last
+// step
+func (d *Device) FadeBrightness(ctx context.Context, target uint8, dur time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	low, high, err := d.BrightnessRange()
+	if err != nil {
+		return err
+	}
+	target = min(max(target, low), high)
+
+	from, err := d.Brightness()
+	if err != nil {
+		return err
+	}
+
+	distance := int(target) - int(from)
+	if distance == 0 {
+		return nil
+	}
+
+	interval := max(dur/time.Duration(abs(distance)), fadeMinStep)
+	if dur <= interval {
+		return d.SetBrightness(target)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	start, last := time.Now(), from
+	for last != target {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		value := target
+		if elapsed := time.Since(start); elapsed < dur {
+			value = uint8(int(from) + int(int64(distance)*int64(elapsed)/int64(dur)))
+		}
+		if value == last {
+			continue
+		}
+
+		if err := d.SetBrightness(value); err != nil {
+			return err
+		}
+		last = value
+	}
+
+	return nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+
+	return n
+}
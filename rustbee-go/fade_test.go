@@ -0,0 +1,100 @@
+package rustbee
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFadeBrightness(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if err := device.SetBrightness(254); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var steps []uint8
+	// Called after every write, nil once the device is freed
+	fake.mu.Lock()
+	fake.device(device.handle).onState = func(state *DeviceState) {
+		if state == nil {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		steps = append(steps, state.Brightness)
+	}
+	fake.mu.Unlock()
+
+	if err := device.FadeBrightness(context.Background(), 1, 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// How many depends on the scheduling, they only go one way
+	if len(steps) == 0 {
+		t.Fatal("expected the fade to write")
+	}
+	for i := 1; i < len(steps); i++ {
+		if steps[i] >= steps[i-1] {
+			t.Fatalf("expected the steps to go down, got %v", steps)
+		}
+	}
+	if last := steps[len(steps)-1]; last != 1 {
+		t.Fatalf("expected to end at 1, got %v", steps)
+	}
+}
+
+func TestFadeBrightnessClampsAndCancels(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	fake.mu.Lock()
+	fake.device(device.handle).minBrightness = 20
+	fake.device(device.handle).maxBrightness = 200
+	fake.mu.Unlock()
+
+	// No time to step, the clamped target is written at once
+	if err := device.FadeBrightness(context.Background(), 254, 0); err != nil {
+		t.Fatal(err)
+	}
+	if brightness := fake.inspect(device).brightness; brightness != 200 {
+		t.Fatalf("expected the max of the range, got %d", brightness)
+	}
+
+	// Cancelled once the first step is written, far from the end of the fade
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake.mu.Lock()
+	fake.device(device.handle).onState = func(state *DeviceState) {
+		if state != nil {
+			cancel()
+		}
+	}
+	fake.mu.Unlock()
+
+	err = device.FadeBrightness(ctx, 1, 10*time.Second)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancellation, got %v", err)
+	}
+	if brightness := fake.inspect(device).brightness; brightness <= 20 || brightness >= 200 {
+		t.Fatalf("expected the fade to stop midway, got %d", brightness)
+	}
+}
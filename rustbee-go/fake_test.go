@@ -0,0 +1,1148 @@
+package rustbee
+
+import (
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
+)
+
+type fakeDevice struct {
+	addr       [6]byte
+	identified int
+	connects   int
+	connected  bool
+	paired     bool
+	retries    uint8
+	power      bool
+	brightness uint8
+	rssi       int16
+	color      Color
+	effect     uint8
+	whiteMix   [2]uint8
+	colorTemp  uint16
+	name       string
+	curve      BrightnessCurve
+	// Raw brightness range, the full 1 to 254 one if 0
+	minBrightness, maxBrightness uint8
+	tag                          string
+	// Features set by the firmware quirks, see fakeLib.features
+	quirks Features
+
+	// The light boots off with startupOff, else with these values
+	startupOff        bool
+	startupBrightness uint8
+	startupColor      Color
+
+	// Writes in progress and done, see fakeLib.write
+	writing int
+	writes  int
+	// Of the last write, rounded up like librustbee does
+	latencyMs uint32
+	// Of the last requestConnectionParams
+	minIntervalMs, maxIntervalMs, mtu uint16
+	// Of the last setKeepalive
+	keepaliveMs uint32
+	// Writes done when the last flush ran
+	flushedWrites int
+	// Values written by gattWrite
+	gatt map[[16]byte][]byte
+
+	// Called after every write while subscribed
+	onState func(*DeviceState)
+	// Called on every change of connected while watched
+	onConnection func(connected, ended bool)
+}
+
+// setConnected calls the watcher back if it changed, like the daemon
+func (d *fakeDevice) setConnected(connected bool) {
+	changed := d.connected != connected
+	d.connected = connected
+
+	if changed && d.onConnection != nil {
+		d.onConnection(connected, false)
+	}
+}
+
+func (d *fakeDevice) state() DeviceState {
+	return DeviceState{
+		Connected:  d.connected,
+		Power:      d.power,
+		Brightness: d.brightness,
+		HasColor:   true,
+		RGB:        d.color,
+		Name:       d.name,
+	}
+}
+
+// fakeLib is an in-memory librustbee, it reports double frees and unknown
+// handles as test failures
+type fakeLib struct {
+	t *testing.T
+
+	mu      sync.Mutex
+	devices map[unsafe.Pointer]*fakeDevice
+	frees   int
+
+	// Connecting to these addresses times out like the daemon would, after
+	// daemonTimeout when connecting without a timeout
+	unreachable   map[[6]byte]bool
+	daemonTimeout time.Duration
+
+	// When they're set, every connect signals connectStarted then waits for
+	// connectRelease. maxConnecting is the most connects that were in flight
+	// at once
+	connectStarted, connectRelease chan struct{}
+	connecting, maxConnecting      int
+
+	// Every write takes writeDelay more
+	writeDelay time.Duration
+
+	// Writes and power reads of these addresses fail with the given error
+	failing map[[6]byte]error
+
+	// Returned by scan, startScan runs until stopScan with scanRunning and
+	// stoppedScans is how many were stopped
+	found        []Discovered
+	scanRunning  bool
+	stoppedScans int
+	// The duration given to every scan
+	scanMs []uint32
+
+	// Returned by daemonStats
+	stats DaemonStats
+
+	// Returned by managedDevices
+	managed []ManagedDevice
+
+	// Set by setLogCallback
+	onLog    func(level int, msg string)
+	logLevel int
+
+	// Set by setConnectionCacheTTL
+	cacheTTLSeconds uint32
+
+	// Set by setGlobalWriteRate
+	writeRate uint32
+
+	// Set by setAutoReconnect
+	autoReconnect bool
+
+	// Set by setReconnectPolicy
+	reconnectBaseMs, reconnectMaxMs uint32
+
+	// Set by setAutoLaunchDaemon
+	autoLaunch bool
+
+	// Set by setDataDir, the default directory if empty
+	dataDir string
+
+	// Set by launchDaemonTCP and connectDaemonTCP
+	listenAddr, remoteAddr, token string
+
+	// Set by launchDaemonSimulated, newDevice opens the seeded devices with
+	// their seeded state
+	simulated bool
+	seeded    map[[6]byte]DeviceState
+
+	// The host has no Bluetooth adapter, the daemon cannot be launched
+	noAdapter bool
+
+	// The platform cannot request connection parameters, like Linux
+	noConnectionParams bool
+
+	// The fields of setState that fail to be written
+	failingFields StateFields
+
+	// The lights don't have a configurable startup, like older firmwares
+	noStartup bool
+
+	// The jobs of schedule that aren't cancelled, they never run
+	scheduled map[uint64]fakeJob
+	lastJob   uint64
+}
+
+type fakeJob struct {
+	addr     [6]byte
+	state    DesiredState
+	atUnixMs uint64
+}
+
+// fakeDaemonTimeout is the default daemonTimeout
+const fakeDaemonTimeout = 2 * time.Second
+
+// useFakeLib swaps the cgo bindings with a fakeLib for the duration of the test
+func useFakeLib(t *testing.T) *fakeLib {
+	t.Helper()
+
+	fake := &fakeLib{
+		t:             t,
+		devices:       map[unsafe.Pointer]*fakeDevice{},
+		unreachable:   map[[6]byte]bool{},
+		failing:       map[[6]byte]error{},
+		scheduled:     map[uint64]fakeJob{},
+		daemonTimeout: fakeDaemonTimeout,
+	}
+	previous := lib
+	lib = fake
+	t.Cleanup(func() { lib = previous })
+
+	return fake
+}
+
+func (f *fakeLib) live() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.devices)
+}
+
+func (f *fakeLib) freed() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.frees
+}
+
+func (f *fakeLib) connects(d *Device) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.device(d.handle).connects
+}
+
+func (f *fakeLib) device(handle unsafe.Pointer) *fakeDevice {
+	device, ok := f.devices[handle]
+	if !ok {
+		f.t.Errorf("unknown or freed device handle %p", handle)
+		return &fakeDevice{}
+	}
+
+	return device
+}
+
+func (f *fakeLib) newDevice(addr [6]byte) (unsafe.Pointer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device := &fakeDevice{addr: addr, name: "Hue fake"}
+	if state, ok := f.seeded[addr]; ok {
+		device.connected, device.power, device.brightness = state.Connected, state.Power, state.Brightness
+		device.color, device.name = state.RGB, state.Name
+	}
+	handle := unsafe.Pointer(device)
+	f.devices[handle] = device
+
+	return handle, nil
+}
+
+// cloneDevice keeps the settings and the name, not the connection nor the
+// light state
+func (f *fakeLib) cloneDevice(handle unsafe.Pointer) (unsafe.Pointer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device := f.device(handle)
+	clone := &fakeDevice{
+		addr:    device.addr,
+		name:    device.name,
+		retries: device.retries,
+		curve:   device.curve,
+	}
+	f.devices[unsafe.Pointer(clone)] = clone
+
+	return unsafe.Pointer(clone), nil
+}
+
+func (f *fakeLib) freeDevice(handle unsafe.Pointer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device, ok := f.devices[handle]
+	if !ok {
+		f.t.Errorf("double free of device handle %p", handle)
+		return
+	}
+	if device.writing > 0 {
+		f.t.Errorf("device handle %p freed during a write", handle)
+	}
+
+	if device.onState != nil {
+		device.onState(nil)
+	}
+	if device.onConnection != nil {
+		device.onConnection(false, true)
+	}
+
+	delete(f.devices, handle)
+	f.frees++
+}
+
+func (f *fakeLib) connect(handle unsafe.Pointer, timeoutMs uint32) error {
+	f.mu.Lock()
+	device := f.device(handle)
+	device.connects++
+	unreachable := f.unreachable[device.addr]
+	daemonTimeout := f.daemonTimeout
+	started, release := f.connectStarted, f.connectRelease
+	f.connecting++
+	f.maxConnecting = max(f.maxConnecting, f.connecting)
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		f.connecting--
+		f.mu.Unlock()
+	}()
+	if started != nil {
+		started <- struct{}{}
+		<-release
+	}
+
+	if unreachable {
+		if timeoutMs == 0 {
+			time.Sleep(daemonTimeout)
+			return ErrDeviceNotFound
+		}
+
+		time.Sleep(time.Duration(timeoutMs) * time.Millisecond)
+		return ErrTimeout
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device.setConnected(true)
+
+	return nil
+}
+
+func (f *fakeLib) disconnect(handle unsafe.Pointer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.device(handle).setConnected(false)
+
+	return nil
+}
+
+func (f *fakeLib) isConnected(handle unsafe.Pointer) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.device(handle).connected, nil
+}
+
+func (f *fakeLib) connectPaired(handle unsafe.Pointer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device := f.device(handle)
+	device.connects++
+	device.setConnected(true)
+	device.paired = true
+
+	return nil
+}
+
+func (f *fakeLib) isPaired(handle unsafe.Pointer) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.device(handle).paired, nil
+}
+
+// requestConnectionParams checks the bounds of librustbee
+func (f *fakeLib) requestConnectionParams(handle unsafe.Pointer, minIntervalMs, maxIntervalMs, mtu uint16) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	validInterval := func(ms uint16) bool { return ms >= 8 && ms <= 4000 }
+	if !validInterval(minIntervalMs) || !validInterval(maxIntervalMs) || minIntervalMs > maxIntervalMs {
+		return &Error{Code: CodeInvalidArg}
+	}
+	if mtu != 0 && (mtu < 23 || mtu > 517) {
+		return &Error{Code: CodeInvalidArg}
+	}
+	if f.noConnectionParams {
+		return &Error{Code: CodeUnsupported}
+	}
+
+	device := f.device(handle)
+	device.minIntervalMs, device.maxIntervalMs, device.mtu = minIntervalMs, maxIntervalMs, mtu
+
+	return nil
+}
+
+func (f *fakeLib) setKeepalive(handle unsafe.Pointer, intervalMs uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.device(handle).keepaliveMs = intervalMs
+	return nil
+}
+
+func (f *fakeLib) identify(handle unsafe.Pointer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.device(handle).identified++
+
+	return nil
+}
+
+func (f *fakeLib) setWriteRetries(handle unsafe.Pointer, retries uint8) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.device(handle).retries = retries
+}
+
+func (f *fakeLib) setDeviceTag(handle unsafe.Pointer, tag string) error {
+	if len(tag) > 19 {
+		return &Error{Code: CodeInvalidArg}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.device(handle).tag = tag
+	return nil
+}
+
+func (f *fakeLib) lastCommandLatencyMs(handle unsafe.Pointer) uint32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.device(handle).latencyMs
+}
+
+func (f *fakeLib) flush(handle unsafe.Pointer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device := f.device(handle)
+	device.flushedWrites = device.writes
+
+	return nil
+}
+
+// write simulates a GATT write that takes some time, concurrent writes on the
+// same device are reported since they would corrupt its state
+func (f *fakeLib) write(handle unsafe.Pointer, apply func(*fakeDevice)) error {
+	f.mu.Lock()
+	device := f.device(handle)
+	if err := f.failing[device.addr]; err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	device.writing++
+	concurrent := device.writing > 1
+	writeDelay := f.writeDelay
+	f.mu.Unlock()
+
+	if concurrent {
+		f.t.Errorf("concurrent writes on device %x", device.addr)
+	}
+
+	start := time.Now()
+	time.Sleep(50*time.Microsecond + writeDelay)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	apply(device)
+	device.writing--
+	device.writes++
+	device.latencyMs = uint32(max(time.Since(start).Milliseconds(), 1))
+
+	if device.onState != nil {
+		state := device.state()
+		device.onState(&state)
+	}
+
+	return nil
+}
+
+// notify changes the device like another app would, the subscriber is called
+// back without a write of the package
+func (f *fakeLib) notify(d *Device, apply func(*fakeDevice)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device := f.device(d.handle)
+	apply(device)
+
+	if device.onState != nil {
+		state := device.state()
+		device.onState(&state)
+	}
+}
+
+func (f *fakeLib) inspect(d *Device) fakeDevice {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return *f.device(d.handle)
+}
+
+func (f *fakeLib) writes(d *Device) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.device(d.handle).writes
+}
+
+func (f *fakeLib) setPower(handle unsafe.Pointer, on bool) error {
+	return f.write(handle, func(device *fakeDevice) { device.power = on })
+}
+
+func (f *fakeLib) togglePower(handle unsafe.Pointer) (bool, error) {
+	var on bool
+	err := f.write(handle, func(device *fakeDevice) {
+		device.power = !device.power
+		on = device.power
+	})
+
+	return on, err
+}
+
+func (f *fakeLib) setPowerAsync(handle unsafe.Pointer, on bool, done func(error)) {
+	go func() { done(f.setPower(handle, on)) }()
+}
+
+func (f *fakeLib) setBrightness(handle unsafe.Pointer, value uint8) error {
+	return f.write(handle, func(device *fakeDevice) { device.brightness = value })
+}
+
+// setBrightnessPercent maps the percentage like librustbee does
+func (f *fakeLib) setBrightnessPercent(handle unsafe.Pointer, percent uint8) error {
+	if percent > 100 {
+		return &Error{Code: CodeInvalidArg}
+	}
+
+	return f.write(handle, func(device *fakeDevice) {
+		level := float64(percent) / 100
+		if device.curve == BrightnessGamma {
+			level = math.Pow(level, 2.2)
+		}
+		device.brightness = max(uint8(math.Round(level*254)), 1)
+	})
+}
+
+func (f *fakeLib) setBrightnessCurve(handle unsafe.Pointer, curve BrightnessCurve) error {
+	if curve > BrightnessGamma {
+		return &Error{Code: CodeInvalidArg}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.device(handle).curve = curve
+	return nil
+}
+
+func (f *fakeLib) setColor(handle unsafe.Pointer, r, g, b uint8) error {
+	return f.write(handle, func(device *fakeDevice) { device.color = Color{r, g, b} })
+}
+
+// gattWrite needs the device connected like librustbee
+func (f *fakeLib) gattWrite(handle unsafe.Pointer, uuid128 [16]byte, value []byte) error {
+	f.mu.Lock()
+	connected := f.device(handle).connected
+	f.mu.Unlock()
+
+	if !connected {
+		return ErrNotConnected
+	}
+
+	return f.write(handle, func(device *fakeDevice) {
+		if device.gatt == nil {
+			device.gatt = map[[16]byte][]byte{}
+		}
+		device.gatt[uuid128] = slices.Clone(value)
+	})
+}
+
+func (f *fakeLib) setEffect(handle unsafe.Pointer, effect uint8) error {
+	return f.write(handle, func(device *fakeDevice) { device.effect = effect })
+}
+
+// setWhiteMix writes the channels as is, the fake has them
+func (f *fakeLib) setWhiteMix(handle unsafe.Pointer, warm, cool uint8) error {
+	if warm == 0 && cool == 0 {
+		return ErrInvalidArg
+	}
+
+	return f.write(handle, func(device *fakeDevice) { device.whiteMix = [2]uint8{warm, cool} })
+}
+
+func (f *fakeLib) whiteMix(handle unsafe.Pointer) (uint8, uint8, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mix := f.device(handle).whiteMix
+	return mix[0], mix[1], nil
+}
+
+// setState is a single write, the fake has no order to keep. The
+// failingFields aren't applied, the others are
+func (f *fakeLib) setState(handle unsafe.Pointer, state DesiredState) (StateFields, error) {
+	if state.RGB != nil && state.ColorTemp != nil {
+		return 0, ErrInvalidArg
+	}
+
+	f.mu.Lock()
+	failing := f.failingFields
+	f.mu.Unlock()
+
+	var failed StateFields
+	err := f.write(handle, func(device *fakeDevice) {
+		apply := func(field StateFields, set bool, write func()) {
+			if set && failing&field != 0 {
+				failed |= field
+			} else if set {
+				write()
+			}
+		}
+
+		apply(FieldPower, state.Power != nil, func() { device.power = *state.Power })
+		apply(FieldBrightness, state.Brightness != nil, func() { device.brightness = *state.Brightness })
+		apply(FieldColor, state.RGB != nil, func() { device.color = *state.RGB })
+		apply(FieldColorTemp, state.ColorTemp != nil, func() { device.colorTemp = *state.ColorTemp })
+	})
+	if err == nil && failed != 0 {
+		err = &Error{Code: CodeGattError, Message: "Failed to set the state"}
+	}
+
+	return failed, err
+}
+
+func (f *fakeLib) startupState(handle unsafe.Pointer) (DesiredState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device := f.device(handle)
+	if f.noStartup {
+		return DesiredState{}, ErrUnsupported
+	}
+
+	power := !device.startupOff
+	if device.startupOff {
+		return DesiredState{Power: &power}, nil
+	}
+
+	brightness, color := device.startupBrightness, device.startupColor
+	return DesiredState{Power: &power, Brightness: &brightness, RGB: &color}, nil
+}
+
+func (f *fakeLib) setStartupState(handle unsafe.Pointer, state DesiredState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device := f.device(handle)
+	if f.noStartup {
+		return ErrUnsupported
+	}
+	if state.ColorTemp != nil {
+		return ErrInvalidArg
+	}
+
+	device.startupOff = state.Power != nil && !*state.Power
+	if state.Brightness != nil {
+		device.startupBrightness = *state.Brightness
+	}
+	if state.RGB != nil {
+		device.startupColor = *state.RGB
+	}
+
+	return nil
+}
+
+func (f *fakeLib) schedule(handle unsafe.Pointer, state DesiredState, atUnixMs uint64) (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device := f.device(handle)
+	if err := f.failing[device.addr]; err != nil {
+		return 0, err
+	}
+	if state.RGB != nil && state.ColorTemp != nil {
+		return 0, ErrInvalidArg
+	}
+
+	f.lastJob++
+	f.scheduled[f.lastJob] = fakeJob{device.addr, state, atUnixMs}
+
+	return f.lastJob, nil
+}
+
+func (f *fakeLib) cancelScheduled(job uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.scheduled[job]; !ok {
+		return ErrInvalidArg
+	}
+
+	delete(f.scheduled, job)
+	return nil
+}
+
+func (f *fakeLib) power(handle unsafe.Pointer) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device := f.device(handle)
+	if err := f.failing[device.addr]; err != nil {
+		return false, err
+	}
+
+	return device.power, nil
+}
+
+func (f *fakeLib) brightness(handle unsafe.Pointer, percent bool) (uint8, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device := f.device(handle)
+	value := device.brightness
+	if percent && device.curve == BrightnessGamma {
+		if value <= 1 {
+			return 0, nil
+		}
+		return uint8(math.Round(math.Pow(float64(value)/254, 1/2.2) * 100)), nil
+	}
+	if percent {
+		return uint8((uint16(value)*100 + 127) / 254), nil
+	}
+
+	return value, nil
+}
+
+func (f *fakeLib) brightnessRange(handle unsafe.Pointer) (low, high uint8, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device := f.device(handle)
+	if device.minBrightness == 0 {
+		return 1, 254, nil
+	}
+
+	return device.minBrightness, device.maxBrightness, nil
+}
+
+func (f *fakeLib) rssi(handle unsafe.Pointer) (int16, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if rssi := f.device(handle).rssi; rssi < 0 {
+		return rssi, nil
+	}
+
+	return 0, ErrGattError
+}
+
+func (f *fakeLib) capabilities(handle unsafe.Pointer) (Capabilities, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Only reports unknown handles, the fake devices support everything
+	f.device(handle)
+
+	return SupportsColor | SupportsColorTemp | SupportsDimming, nil
+}
+
+func (f *fakeLib) features(handle unsafe.Pointer) (Features, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	caps := Features(SupportsColor | SupportsColorTemp | SupportsDimming)
+	return caps | FeatureCombinedWrite | FeatureEffects | f.device(handle).quirks, nil
+}
+
+func (f *fakeLib) scan(durationMs uint32, onFound func(Discovered) bool) error {
+	f.mu.Lock()
+	found := slices.Clone(f.found)
+	f.scanMs = append(f.scanMs, durationMs)
+	f.mu.Unlock()
+
+	for _, device := range found {
+		// Only the device lists carry it
+		device.ManufacturerData = nil
+		if !onFound(device) {
+			break
+		}
+	}
+
+	return nil
+}
+
+type fakeScan struct {
+	pending []Discovered
+}
+
+func (f *fakeLib) startScan(durationMs uint32) (unsafe.Pointer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.scanMs = append(f.scanMs, durationMs)
+
+	scan := &fakeScan{}
+	for _, device := range f.found {
+		// Only the device lists carry it
+		device.ManufacturerData = nil
+		scan.pending = append(scan.pending, device)
+	}
+
+	return unsafe.Pointer(scan), nil
+}
+
+func (f *fakeLib) pollScan(scan unsafe.Pointer, timeoutMs uint32) (Discovered, bool, error) {
+	f.mu.Lock()
+	running := f.scanRunning
+	f.mu.Unlock()
+
+	s := (*fakeScan)(scan)
+	if len(s.pending) > 0 {
+		device := s.pending[0]
+		s.pending = s.pending[1:]
+		return device, true, nil
+	}
+
+	if running {
+		time.Sleep(time.Duration(timeoutMs) * time.Millisecond)
+		return Discovered{}, false, ErrTimeout
+	}
+
+	return Discovered{}, false, nil
+}
+
+func (f *fakeLib) stopScan(scan unsafe.Pointer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stoppedScans++
+	return nil
+}
+
+func (f *fakeLib) scanAdvertised(durationMs uint32) ([]Discovered, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.scanMs = append(f.scanMs, durationMs)
+
+	return slices.Clone(f.found), nil
+}
+
+func (f *fakeLib) adapterAvailable() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.noAdapter {
+		return &Error{Code: CodeNoAdapter}
+	}
+
+	return nil
+}
+
+func (f *fakeLib) adapterInfo() (Adapter, error) {
+	if err := f.adapterAvailable(); err != nil {
+		return Adapter{}, err
+	}
+
+	return Adapter{Name: "hci0 (fake)", Addr: [6]byte{0xE8, 0xD4, 0xEA, 0, 0, 1}, HasAddr: true}, nil
+}
+
+func (f *fakeLib) daemonAlive() error {
+	return nil
+}
+
+func (f *fakeLib) state(handle unsafe.Pointer) (DeviceState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.device(handle).state(), nil
+}
+
+func (f *fakeLib) subscribe(handle unsafe.Pointer, onState func(*DeviceState)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device := f.device(handle)
+	if device.onState != nil {
+		return ErrInvalidArg
+	}
+
+	device.onState = onState
+	state := device.state()
+	onState(&state)
+
+	return nil
+}
+
+func (f *fakeLib) unsubscribe(handle unsafe.Pointer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device := f.device(handle)
+	if device.onState == nil {
+		return ErrInvalidArg
+	}
+
+	device.onState(nil)
+	device.onState = nil
+
+	return nil
+}
+
+func (f *fakeLib) watchConnection(handle unsafe.Pointer, onChange func(connected, ended bool)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device := f.device(handle)
+	if device.onConnection != nil {
+		device.onConnection(false, true)
+	}
+
+	device.onConnection = onChange
+	if onChange != nil {
+		onChange(device.connected, false)
+	}
+
+	return nil
+}
+
+func (f *fakeLib) firmwareVersion(handle unsafe.Pointer) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device := f.device(handle)
+	if err := f.failing[device.addr]; err != nil {
+		return "", err
+	}
+
+	return "1.104.2", nil
+}
+
+// name is valid UTF-8 like the names of get_name_into: a run of invalid
+// sequences is replaced by one U+FFFD and an invalid tail is dropped
+func (f *fakeLib) name(handle unsafe.Pointer) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := f.device(handle).name
+	for len(name) > 0 {
+		r, size := utf8.DecodeLastRuneInString(name)
+		if r != utf8.RuneError || size > 1 {
+			break
+		}
+		name = name[:len(name)-size]
+	}
+
+	return strings.TrimRightFunc(strings.ToValidUTF8(name, "\uFFFD"), unicode.IsSpace), nil
+}
+
+func (f *fakeLib) nameBytes(handle unsafe.Pointer) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return []byte(f.device(handle).name), nil
+}
+
+func (f *fakeLib) launchDaemon() (bool, error) {
+	if err := f.adapterAvailable(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (f *fakeLib) launchDaemonTCP(bindAddr, token string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.listenAddr, f.token = bindAddr, token
+
+	return nil
+}
+
+// launchDaemonSimulated doesn't need an adapter
+func (f *fakeLib) launchDaemonSimulated() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.simulated = true
+
+	return nil
+}
+
+func (f *fakeLib) seedSimulatedDevice(addr [6]byte, state DeviceState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.simulated {
+		return ErrUnsupported
+	}
+
+	if f.seeded == nil {
+		f.seeded = map[[6]byte]DeviceState{}
+	}
+	f.seeded[addr] = state
+
+	return nil
+}
+
+func (f *fakeLib) connectDaemonTCP(addr, token string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Stands for the handshake and the ping of the remote daemon
+	if addr != "" && addr != f.listenAddr {
+		return &Error{Code: CodeDaemonUnreachable}
+	}
+	if addr != "" && token != f.token {
+		return &Error{Code: CodeDaemonError}
+	}
+	f.remoteAddr = addr
+
+	return nil
+}
+
+// shutdownDaemon shuts the open devices down cleanly, the fake has no queue
+func (f *fakeLib) shutdownDaemon(force bool) (int, error) {
+	if force {
+		return 0, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.devices), nil
+}
+
+func (f *fakeLib) daemonVersion() (string, error) {
+	return "0.1.0+fake", nil
+}
+
+func (f *fakeLib) daemonDataDir() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.dataDir == "" {
+		return "/var/lib/rustbee", nil
+	}
+
+	return f.dataDir, nil
+}
+
+func (f *fakeLib) setDataDir(path string) error {
+	if path == "" {
+		return &Error{Code: CodeInvalidArg}
+	}
+
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.dataDir = dir
+	return nil
+}
+
+func (f *fakeLib) setConnectionCacheTTL(seconds uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.cacheTTLSeconds = seconds
+
+	return nil
+}
+
+func (f *fakeLib) setGlobalWriteRate(writesPerSec uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.writeRate = writesPerSec
+
+	return nil
+}
+
+func (f *fakeLib) setAutoReconnect(enabled bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.autoReconnect = enabled
+
+	return nil
+}
+
+func (f *fakeLib) setReconnectPolicy(baseMs, maxMs uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if baseMs == 0 || maxMs < baseMs {
+		return &Error{Code: CodeInvalidArg, Message: "invalid backoff"}
+	}
+	f.reconnectBaseMs, f.reconnectMaxMs = baseMs, maxMs
+
+	return nil
+}
+
+func (f *fakeLib) setAutoLaunchDaemon(enabled bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.autoLaunch = enabled
+
+	return nil
+}
+
+func (f *fakeLib) daemonStats() (DaemonStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.stats, nil
+}
+
+func (f *fakeLib) managedDevices() ([]ManagedDevice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return slices.Clone(f.managed), nil
+}
+
+// The managed devices play the found ones, the disconnected ones failed to
+// connect
+func (f *fakeLib) discoverAndConnect(scanMs, connectMs uint32) ([]ManagedDevice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var connected []ManagedDevice
+	for _, m := range f.managed {
+		if m.Connected {
+			connected = append(connected, m)
+		}
+	}
+
+	return connected, nil
+}
+
+func (f *fakeLib) setLogCallback(onLog func(level int, msg string), minLevel int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.onLog = onLog
+	f.logLevel = minLevel
+
+	return nil
+}
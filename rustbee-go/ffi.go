@@ -0,0 +1,960 @@
+//go:build rustbee_ffi
+
+package rustbee
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../rustbee-common
+#cgo LDFLAGS: -L${SRCDIR}/../rustbee-common/target/release -lrustbee_common
+
+#include <stdlib.h>
+
+#include "librustbee.h"
+
+// Exported by async.go, the handle of the Go callback is passed as context
+extern void rustbeeAsyncDone(void*, bool);
+
+static void set_power_async_handle(RustbeeDevice* device, uint8_t state, uintptr_t handle) {
+	set_power_async(device, state, rustbeeAsyncDone, (void*)handle);
+}
+
+extern void rustbeeStateChanged(void*, DeviceState*);
+
+static bool subscribe_state_handle(RustbeeDevice* device, uintptr_t handle) {
+	return subscribe_state(device, (RustbeeStateCallback)rustbeeStateChanged, (void*)handle);
+}
+
+extern void rustbeeConnectionChanged(void*, uint8_t);
+
+static void set_connection_callback_handle(RustbeeDevice* device, uintptr_t handle) {
+	set_connection_callback(device, rustbeeConnectionChanged, (void*)handle);
+}
+
+extern bool rustbeeScanFound(void*, uint8_t*, char*);
+
+static bool scan_devices_cb_handle(uint32_t duration_ms, uintptr_t handle) {
+	return scan_devices_cb(duration_ms, (RustbeeScanCallback)rustbeeScanFound, (void*)handle);
+}
+
+extern void rustbeeLog(void*, int, char*);
+
+static void set_log_callback_handle(uintptr_t handle, int min_level) {
+	set_log_callback((RustbeeLogCallback)rustbeeLog, (void*)handle, min_level);
+}
+*/
+import "C"
+
+import (
+	"runtime"
+	"runtime/cgo"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+var lib native = cgoLib{}
+
+type cgoLib struct{}
+
+// call runs fn on a locked OS thread since the last error of librustbee is
+// stored per thread and must be read right after the failed call
+func call(fn func() bool) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if fn() {
+		return nil
+	}
+
+	return lastError()
+}
+
+// lastError must be called on the thread of the failed call
+func lastError() error {
+	err := &Error{Code: ErrorCode(C.rustbee_last_error())}
+
+	if message := C.rustbee_last_error_message(); message != nil {
+		err.Message = C.GoString(message)
+		C.free_error_message(message)
+	}
+
+	return err
+}
+
+func device(handle unsafe.Pointer) *C.RustbeeDevice {
+	return (*C.RustbeeDevice)(handle)
+}
+
+func (cgoLib) newDevice(addr [6]byte) (unsafe.Pointer, error) {
+	var handle *C.RustbeeDevice
+
+	err := call(func() bool {
+		handle = C.new_device((*C.uint8_t)(unsafe.Pointer(&addr[0])))
+		return handle != nil
+	})
+
+	return unsafe.Pointer(handle), err
+}
+
+func (cgoLib) cloneDevice(handle unsafe.Pointer) (unsafe.Pointer, error) {
+	var clone *C.RustbeeDevice
+
+	err := call(func() bool {
+		clone = C.clone_device(device(handle))
+		return clone != nil
+	})
+
+	return unsafe.Pointer(clone), err
+}
+
+func (cgoLib) freeDevice(handle unsafe.Pointer) {
+	C.free_device(device(handle))
+}
+
+func (cgoLib) connect(handle unsafe.Pointer, timeoutMs uint32) error {
+	return call(func() bool {
+		return bool(C.try_connect_timeout(device(handle), C.uint32_t(timeoutMs)))
+	})
+}
+
+func (cgoLib) disconnect(handle unsafe.Pointer) error {
+	return call(func() bool {
+		return bool(C.try_disconnect(device(handle)))
+	})
+}
+
+func (cgoLib) isConnected(handle unsafe.Pointer) (bool, error) {
+	var connected bool
+
+	// false is either disconnected or a failure, only the last error can tell
+	err := call(func() bool {
+		connected = bool(C.is_connected(device(handle)))
+		return connected || C.rustbee_last_error() == C.RUSTBEE_OK
+	})
+
+	return connected, err
+}
+
+func (cgoLib) setWriteRetries(handle unsafe.Pointer, retries uint8) {
+	C.set_write_retries(device(handle), C.uint8_t(retries))
+}
+
+func (cgoLib) setDeviceTag(handle unsafe.Pointer, tag string) error {
+	ctag := C.CString(tag)
+	defer C.free(unsafe.Pointer(ctag))
+
+	return call(func() bool {
+		C.set_device_tag(device(handle), ctag)
+		return C.rustbee_last_error() == C.RUSTBEE_OK
+	})
+}
+
+func (cgoLib) flush(handle unsafe.Pointer) error {
+	return call(func() bool {
+		return bool(C.flush(device(handle)))
+	})
+}
+
+func (cgoLib) lastCommandLatencyMs(handle unsafe.Pointer) uint32 {
+	return uint32(C.get_last_command_latency_ms(device(handle)))
+}
+
+func (cgoLib) connectPaired(handle unsafe.Pointer) error {
+	return call(func() bool {
+		return bool(C.try_connect_paired(device(handle), 1))
+	})
+}
+
+func (cgoLib) isPaired(handle unsafe.Pointer) (bool, error) {
+	var paired bool
+
+	// Same as isConnected, false is either not paired or a failure
+	err := call(func() bool {
+		paired = bool(C.is_paired(device(handle)))
+		return paired || C.rustbee_last_error() == C.RUSTBEE_OK
+	})
+
+	return paired, err
+}
+
+func (cgoLib) requestConnectionParams(handle unsafe.Pointer, minIntervalMs, maxIntervalMs, mtu uint16) error {
+	return call(func() bool {
+		return bool(C.request_connection_params(
+			device(handle),
+			C.uint16_t(minIntervalMs),
+			C.uint16_t(maxIntervalMs),
+			C.uint16_t(mtu),
+		))
+	})
+}
+
+func (cgoLib) setKeepalive(handle unsafe.Pointer, intervalMs uint32) error {
+	// Same as setConnectionCacheTTL
+	return call(func() bool {
+		C.set_keepalive(device(handle), C.uint32_t(intervalMs))
+		return C.rustbee_last_error() == C.RUSTBEE_OK
+	})
+}
+
+func (cgoLib) identify(handle unsafe.Pointer) error {
+	return call(func() bool {
+		return bool(C.identify(device(handle)))
+	})
+}
+
+func (cgoLib) setPower(handle unsafe.Pointer, on bool) error {
+	state := C.uint8_t(0)
+	if on {
+		state = 1
+	}
+
+	return call(func() bool {
+		return bool(C.set_power(device(handle), &state))
+	})
+}
+
+func (cgoLib) setPowerAsync(handle unsafe.Pointer, on bool, done func(error)) {
+	state := C.uint8_t(0)
+	if on {
+		state = 1
+	}
+
+	// Deleted by rustbeeAsyncDone
+	h := cgo.NewHandle(done)
+	C.set_power_async_handle(device(handle), state, C.uintptr_t(h))
+}
+
+func (cgoLib) setBrightness(handle unsafe.Pointer, value uint8) error {
+	v := C.uint8_t(value)
+
+	return call(func() bool {
+		return bool(C.set_brightness(device(handle), &v))
+	})
+}
+
+func (cgoLib) setBrightnessPercent(handle unsafe.Pointer, percent uint8) error {
+	return call(func() bool {
+		return bool(C.set_brightness_percent(device(handle), C.uint8_t(percent)))
+	})
+}
+
+func (cgoLib) setBrightnessCurve(handle unsafe.Pointer, curve BrightnessCurve) error {
+	return call(func() bool {
+		C.set_brightness_curve(device(handle), C.uint8_t(curve))
+		return C.rustbee_last_error() == C.RUSTBEE_OK
+	})
+}
+
+func (cgoLib) setColor(handle unsafe.Pointer, r, g, b uint8) error {
+	return call(func() bool {
+		return bool(C.set_color_rgb(device(handle), C.uint8_t(r), C.uint8_t(g), C.uint8_t(b)))
+	})
+}
+
+func (cgoLib) gattWrite(handle unsafe.Pointer, uuid128 [16]byte, value []byte) error {
+	// The bytes are copied by librustbee, a nil value is an empty one
+	var data *C.uint8_t
+	if len(value) > 0 {
+		data = (*C.uint8_t)(unsafe.Pointer(&value[0]))
+	}
+
+	return call(func() bool {
+		return bool(C.gatt_write(
+			device(handle),
+			(*C.uint8_t)(unsafe.Pointer(&uuid128[0])),
+			data,
+			C.size_t(len(value)),
+		))
+	})
+}
+
+func (cgoLib) setEffect(handle unsafe.Pointer, effect uint8) error {
+	return call(func() bool {
+		return bool(C.set_effect(device(handle), C.uint8_t(effect)))
+	})
+}
+
+func (cgoLib) setWhiteMix(handle unsafe.Pointer, warm, cool uint8) error {
+	return call(func() bool {
+		return bool(C.set_white_mix(device(handle), C.uint8_t(warm), C.uint8_t(cool)))
+	})
+}
+
+func (cgoLib) whiteMix(handle unsafe.Pointer) (uint8, uint8, error) {
+	var warm, cool C.uint8_t
+
+	err := call(func() bool {
+		return bool(C.get_white_mix(device(handle), &warm, &cool))
+	})
+
+	return uint8(warm), uint8(cool), err
+}
+
+func (cgoLib) setState(handle unsafe.Pointer, state DesiredState) (StateFields, error) {
+	cstate := cDesiredState(state)
+	var failed C.uint8_t
+
+	err := call(func() bool {
+		return bool(C.set_state_ex(device(handle), &cstate, &failed))
+	})
+
+	return StateFields(failed), err
+}
+
+func (cgoLib) schedule(handle unsafe.Pointer, state DesiredState, atUnixMs uint64) (uint64, error) {
+	cstate := cDesiredState(state)
+	var job C.uint64_t
+
+	err := call(func() bool {
+		job = C.schedule_command(device(handle), &cstate, C.uint64_t(atUnixMs))
+		return job != 0
+	})
+
+	return uint64(job), err
+}
+
+func (cgoLib) cancelScheduled(job uint64) error {
+	return call(func() bool {
+		return bool(C.cancel_scheduled(C.uint64_t(job)))
+	})
+}
+
+func (cgoLib) startupState(handle unsafe.Pointer) (DesiredState, error) {
+	var cstate C.DesiredState
+
+	err := call(func() bool {
+		return bool(C.get_startup_state(device(handle), &cstate))
+	})
+	if err != nil {
+		return DesiredState{}, err
+	}
+
+	var state DesiredState
+	if cstate.has_power {
+		power := bool(cstate.power)
+		state.Power = &power
+	}
+	if cstate.has_brightness {
+		brightness := uint8(cstate.brightness)
+		state.Brightness = &brightness
+	}
+	if cstate.has_rgb {
+		state.RGB = &Color{uint8(cstate.rgb[0]), uint8(cstate.rgb[1]), uint8(cstate.rgb[2])}
+	}
+
+	return state, nil
+}
+
+func (cgoLib) setStartupState(handle unsafe.Pointer, state DesiredState) error {
+	cstate := cDesiredState(state)
+
+	return call(func() bool {
+		return bool(C.set_startup_state(device(handle), &cstate))
+	})
+}
+
+func cDesiredState(state DesiredState) C.DesiredState {
+	cstate := C.DesiredState{transition_ds: C.uint16_t(deciseconds(state.Transition))}
+	if state.Power != nil {
+		cstate.has_power = true
+		cstate.power = C.bool(*state.Power)
+	}
+	if state.Brightness != nil {
+		cstate.has_brightness = true
+		cstate.brightness = C.uint8_t(*state.Brightness)
+	}
+	if state.RGB != nil {
+		cstate.has_rgb = true
+		cstate.rgb = [3]C.uint8_t{C.uint8_t(state.RGB.R), C.uint8_t(state.RGB.G), C.uint8_t(state.RGB.B)}
+	}
+	if state.ColorTemp != nil {
+		cstate.has_color_temp = true
+		cstate.color_temp = C.uint16_t(*state.ColorTemp)
+	}
+
+	return cstate
+}
+
+func (cgoLib) power(handle unsafe.Pointer) (bool, error) {
+	var state C.int
+
+	// Unlike get_power, a failure isn't reported as off
+	err := call(func() bool {
+		state = C.get_power_state(device(handle))
+		return state != -1
+	})
+
+	return state == 1, err
+}
+
+func (cgoLib) togglePower(handle unsafe.Pointer) (bool, error) {
+	var state C.int
+
+	err := call(func() bool {
+		state = C.toggle_power(device(handle))
+		return state != -1
+	})
+
+	return state == 1, err
+}
+
+func (cgoLib) brightness(handle unsafe.Pointer, percent bool) (uint8, error) {
+	var value C.uint8_t
+
+	// 0 is only returned on failure, the raw minimum is 1
+	err := call(func() bool {
+		if percent {
+			value = C.get_brightness_percent(device(handle))
+		} else {
+			value = C.get_brightness(device(handle))
+		}
+
+		return value != 0 || C.rustbee_last_error() == C.RUSTBEE_OK
+	})
+
+	return uint8(value), err
+}
+
+func (cgoLib) brightnessRange(handle unsafe.Pointer) (low, high uint8, err error) {
+	var clow, chigh C.uint8_t
+
+	err = call(func() bool {
+		return bool(C.get_brightness_range(device(handle), &clow, &chigh))
+	})
+
+	return uint8(clow), uint8(chigh), err
+}
+
+func (cgoLib) rssi(handle unsafe.Pointer) (int16, error) {
+	var rssi C.int16_t
+
+	err := call(func() bool {
+		rssi = C.get_rssi(device(handle))
+		return rssi != C.RUSTBEE_RSSI_UNAVAILABLE
+	})
+
+	return int16(rssi), err
+}
+
+func (cgoLib) capabilities(handle unsafe.Pointer) (Capabilities, error) {
+	var caps C.uint8_t
+
+	err := call(func() bool {
+		caps = C.get_capabilities(device(handle))
+		return caps != 0 || C.rustbee_last_error() == C.RUSTBEE_OK
+	})
+
+	return Capabilities(caps), err
+}
+
+func (cgoLib) features(handle unsafe.Pointer) (Features, error) {
+	var features C.uint32_t
+
+	err := call(func() bool {
+		features = C.feature_flags(device(handle))
+		return features != 0 || C.rustbee_last_error() == C.RUSTBEE_OK
+	})
+
+	return Features(features), err
+}
+
+func (cgoLib) state(handle unsafe.Pointer) (DeviceState, error) {
+	var cstate C.DeviceState
+
+	err := call(func() bool {
+		return bool(C.get_device_state(device(handle), &cstate))
+	})
+	if err != nil {
+		return DeviceState{}, err
+	}
+
+	return goState(&cstate), nil
+}
+
+func goState(cstate *C.DeviceState) DeviceState {
+	return DeviceState{
+		Connected:  bool(cstate.connected),
+		Power:      bool(cstate.power),
+		Brightness: uint8(cstate.brightness),
+		HasColor:   bool(cstate.has_color),
+		RGB:        Color{uint8(cstate.rgb[0]), uint8(cstate.rgb[1]), uint8(cstate.rgb[2])},
+		Name:       C.GoString(&cstate.name[0]),
+	}
+}
+
+func (cgoLib) subscribe(handle unsafe.Pointer, onState func(*DeviceState)) error {
+	// Deleted by rustbeeStateChanged once the subscription ended
+	h := cgo.NewHandle(onState)
+
+	err := call(func() bool {
+		return bool(C.subscribe_state_handle(device(handle), C.uintptr_t(h)))
+	})
+	if err != nil {
+		h.Delete()
+	}
+
+	return err
+}
+
+func (cgoLib) unsubscribe(handle unsafe.Pointer) error {
+	return call(func() bool {
+		return bool(C.unsubscribe_state(device(handle)))
+	})
+}
+
+func (cgoLib) watchConnection(handle unsafe.Pointer, onChange func(connected, ended bool)) error {
+	// Only the last error tells if it failed
+	return call(func() bool {
+		if onChange == nil {
+			C.set_connection_callback(device(handle), nil, nil)
+			return C.rustbee_last_error() == C.RUSTBEE_OK
+		}
+
+		// Deleted by rustbeeConnectionChanged once the watch ended
+		h := cgo.NewHandle(onChange)
+		C.set_connection_callback_handle(device(handle), C.uintptr_t(h))
+		if C.rustbee_last_error() != C.RUSTBEE_OK {
+			h.Delete()
+			return false
+		}
+
+		return true
+	})
+}
+
+func (cgoLib) scan(durationMs uint32, onFound func(Discovered) bool) error {
+	h := cgo.NewHandle(onFound)
+	defer h.Delete()
+
+	return call(func() bool {
+		return bool(C.scan_devices_cb_handle(C.uint32_t(durationMs), C.uintptr_t(h)))
+	})
+}
+
+func (cgoLib) startScan(durationMs uint32) (unsafe.Pointer, error) {
+	var scan *C.ScanHandle
+
+	err := call(func() bool {
+		scan = C.start_scan(C.uint32_t(durationMs))
+		return scan != nil
+	})
+
+	return unsafe.Pointer(scan), err
+}
+
+func (cgoLib) pollScan(scan unsafe.Pointer, timeoutMs uint32) (Discovered, bool, error) {
+	var device Discovered
+	var cname [20]C.char
+
+	err := call(func() bool {
+		return bool(C.scan_poll(
+			(*C.ScanHandle)(scan),
+			C.uint32_t(timeoutMs),
+			(*C.uint8_t)(unsafe.Pointer(&device.Addr[0])),
+			&cname[0],
+		))
+	})
+	// The scan ended, it's not a failure
+	if e, ok := err.(*Error); ok && e.Code == CodeOK {
+		return Discovered{}, false, nil
+	}
+	if err != nil {
+		return Discovered{}, false, err
+	}
+
+	device.Name = C.GoString(&cname[0])
+	return device, true, nil
+}
+
+func (cgoLib) stopScan(scan unsafe.Pointer) error {
+	return call(func() bool {
+		return bool(C.stop_scan((*C.ScanHandle)(scan)))
+	})
+}
+
+func (cgoLib) scanAdvertised(durationMs uint32) ([]Discovered, error) {
+	var list *C.DeviceList
+
+	err := call(func() bool {
+		list = C.scan_devices(C.uint32_t(durationMs))
+		return list != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer C.free_device_list(list)
+
+	found := make([]Discovered, C.device_list_len(list))
+	for i := range found {
+		var name [19]C.uint8_t
+		// Cannot fail, the index is in bounds
+		C.device_list_get(
+			list,
+			C.size_t(i),
+			(*C.uint8_t)(unsafe.Pointer(&found[i].Addr[0])),
+			&name[0],
+		)
+		found[i].Name = C.GoString((*C.char)(unsafe.Pointer(&name[0])))
+
+		// Only fails if the data doesn't fit, len is then the one needed
+		var size C.size_t
+		if !C.device_list_get_adv(list, C.size_t(i), nil, &size) {
+			found[i].ManufacturerData = make([]byte, size)
+			C.device_list_get_adv(
+				list,
+				C.size_t(i),
+				(*C.uint8_t)(unsafe.Pointer(&found[i].ManufacturerData[0])),
+				&size,
+			)
+		}
+	}
+
+	return found, nil
+}
+
+func (cgoLib) daemonAlive() error {
+	return call(func() bool {
+		return bool(C.daemon_is_alive())
+	})
+}
+
+func (cgoLib) name(handle unsafe.Pointer) (string, error) {
+	var cname [20]C.char
+
+	err := call(func() bool {
+		return bool(C.get_name_into(device(handle), &cname[0]))
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return C.GoString(&cname[0]), nil
+}
+
+func (cgoLib) nameBytes(handle unsafe.Pointer) ([]byte, error) {
+	var cname *C.char
+
+	err := call(func() bool {
+		cname = C.get_name(device(handle))
+		return cname != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer C.free_name(cname)
+
+	return []byte(C.GoString(cname)), nil
+}
+
+func (cgoLib) firmwareVersion(handle unsafe.Pointer) (string, error) {
+	var cversion *C.char
+
+	err := call(func() bool {
+		cversion = C.get_firmware_version(device(handle))
+		return cversion != nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer C.free_firmware_version(cversion)
+
+	return C.GoString(cversion), nil
+}
+
+func (cgoLib) adapterAvailable() error {
+	return call(func() bool {
+		return bool(C.adapter_available())
+	})
+}
+
+func (cgoLib) adapterInfo() (Adapter, error) {
+	var cinfo C.AdapterInfo
+
+	err := call(func() bool {
+		return bool(C.get_adapter_info(&cinfo))
+	})
+	if err != nil {
+		return Adapter{}, err
+	}
+
+	adapter := Adapter{
+		Name:    C.GoString(&cinfo.name[0]),
+		HasAddr: bool(cinfo.has_address),
+	}
+	for i, b := range cinfo.address {
+		adapter.Addr[i] = byte(b)
+	}
+
+	return adapter, nil
+}
+
+func (cgoLib) launchDaemon() (bool, error) {
+	var status C.int
+
+	err := call(func() bool {
+		status = C.launch_daemon_ex()
+		return status != C.RUSTBEE_LAUNCH_FAILED
+	})
+
+	return status == C.RUSTBEE_LAUNCH_STARTED, err
+}
+
+func (cgoLib) launchDaemonTCP(bindAddr, token string) error {
+	cbind, ctoken := C.CString(bindAddr), C.CString(token)
+	defer C.free(unsafe.Pointer(cbind))
+	defer C.free(unsafe.Pointer(ctoken))
+
+	return call(func() bool {
+		return bool(C.launch_daemon_tcp(cbind, ctoken))
+	})
+}
+
+func (cgoLib) launchDaemonSimulated() error {
+	return call(func() bool {
+		return bool(C.launch_daemon_simulated())
+	})
+}
+
+func (cgoLib) seedSimulatedDevice(addr [6]byte, state DeviceState) error {
+	cstate := C.DeviceState{
+		connected:  C.bool(state.Connected),
+		power:      C.bool(state.Power),
+		brightness: C.uint8_t(state.Brightness),
+		has_color:  C.bool(state.HasColor),
+	}
+	cstate.rgb = [3]C.uint8_t{C.uint8_t(state.RGB.R), C.uint8_t(state.RGB.G), C.uint8_t(state.RGB.B)}
+	// Cut by librustbee anyway, the last byte stays the nul terminator
+	for i := 0; i < len(state.Name) && i < len(cstate.name)-1; i++ {
+		cstate.name[i] = C.char(state.Name[i])
+	}
+
+	return call(func() bool {
+		return bool(C.seed_simulated_device((*C.uint8_t)(unsafe.Pointer(&addr[0])), &cstate))
+	})
+}
+
+func (cgoLib) connectDaemonTCP(addr, token string) error {
+	if addr == "" {
+		return call(func() bool {
+			return bool(C.connect_daemon_tcp(nil, nil))
+		})
+	}
+
+	caddr, ctoken := C.CString(addr), C.CString(token)
+	defer C.free(unsafe.Pointer(caddr))
+	defer C.free(unsafe.Pointer(ctoken))
+
+	return call(func() bool {
+		return bool(C.connect_daemon_tcp(caddr, ctoken))
+	})
+}
+
+func (cgoLib) shutdownDaemon(force bool) (int, error) {
+	f := C.uint8_t(0)
+	if force {
+		f = 1
+	}
+
+	var clean C.uint32_t
+
+	err := call(func() bool {
+		return bool(C.shutdown_daemon_ex(f, &clean))
+	})
+
+	return int(clean), err
+}
+
+func (cgoLib) daemonVersion() (string, error) {
+	var cversion [20]C.char
+
+	err := call(func() bool {
+		return bool(C.daemon_version_into(&cversion[0]))
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return C.GoString(&cversion[0]), nil
+}
+
+func (cgoLib) daemonDataDir() (string, error) {
+	var cdir *C.char
+
+	err := call(func() bool {
+		cdir = C.daemon_data_dir()
+		return cdir != nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer C.free_data_dir(cdir)
+
+	return C.GoString(cdir), nil
+}
+
+func (cgoLib) setDataDir(path string) error {
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+
+	return call(func() bool {
+		return bool(C.set_data_dir(cpath))
+	})
+}
+
+func (cgoLib) setConnectionCacheTTL(seconds uint32) error {
+	// Only the last error tells if it failed
+	return call(func() bool {
+		C.set_connection_cache_ttl(C.uint32_t(seconds))
+		return C.rustbee_last_error() == C.RUSTBEE_OK
+	})
+}
+
+func (cgoLib) setGlobalWriteRate(writesPerSec uint32) error {
+	// Same as setConnectionCacheTTL
+	return call(func() bool {
+		C.set_global_write_rate(C.uint32_t(writesPerSec))
+		return C.rustbee_last_error() == C.RUSTBEE_OK
+	})
+}
+
+func (cgoLib) setAutoReconnect(enabled bool) error {
+	var value C.uint8_t
+	if enabled {
+		value = 1
+	}
+
+	// Same as setConnectionCacheTTL
+	return call(func() bool {
+		C.set_auto_reconnect(value)
+		return C.rustbee_last_error() == C.RUSTBEE_OK
+	})
+}
+
+func (cgoLib) setReconnectPolicy(baseMs, maxMs uint32) error {
+	// Same as setConnectionCacheTTL
+	return call(func() bool {
+		C.set_reconnect_policy(C.uint32_t(baseMs), C.uint32_t(maxMs))
+		return C.rustbee_last_error() == C.RUSTBEE_OK
+	})
+}
+
+func (cgoLib) setAutoLaunchDaemon(enabled bool) error {
+	var value C.uint8_t
+	if enabled {
+		value = 1
+	}
+
+	return call(func() bool {
+		C.set_auto_launch_daemon(value)
+		return C.rustbee_last_error() == C.RUSTBEE_OK
+	})
+}
+
+func (cgoLib) daemonStats() (DaemonStats, error) {
+	var cstats C.DaemonStats
+
+	err := call(func() bool {
+		return bool(C.get_daemon_stats(&cstats))
+	})
+	if err != nil {
+		return DaemonStats{}, err
+	}
+
+	return DaemonStats{
+		Connected:      int(cstats.connected_count),
+		Reconnects:     int(cstats.total_reconnects),
+		FailedCommands: int(cstats.failed_commands),
+		AvgLatency:     time.Duration(cstats.avg_latency_ms) * time.Millisecond,
+		WriteRetries:   int(cstats.write_retries),
+		DelayedWrites:  int(cstats.delayed_writes),
+		DroppedWrites:  int(cstats.dropped_writes),
+		Reconnecting:   int(cstats.reconnecting_count),
+		MaxBackoff:     time.Duration(cstats.max_backoff_ms) * time.Millisecond,
+	}, nil
+}
+
+// logHandle is the handle of the callback passed to set_log_callback, it's
+// deleted once another one replaced it
+var (
+	logMu     sync.Mutex
+	logHandle cgo.Handle
+)
+
+func (cgoLib) setLogCallback(onLog func(level int, msg string), minLevel int) error {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	var h cgo.Handle
+	// Only the last error tells if it failed
+	err := call(func() bool {
+		if onLog == nil {
+			C.set_log_callback(nil, nil, 0)
+		} else {
+			h = cgo.NewHandle(onLog)
+			C.set_log_callback_handle(C.uintptr_t(h), C.int(minLevel))
+		}
+		return C.rustbee_last_error() == C.RUSTBEE_OK
+	})
+
+	// The previous callback is done even if it failed
+	if logHandle != 0 {
+		logHandle.Delete()
+		logHandle = 0
+	}
+	if err != nil {
+		if h != 0 {
+			h.Delete()
+		}
+		return err
+	}
+	logHandle = h
+
+	return nil
+}
+
+func (cgoLib) managedDevices() ([]ManagedDevice, error) {
+	var list *C.ManagedDeviceList
+
+	err := call(func() bool {
+		list = C.daemon_list_devices()
+		return list != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer C.free_managed_device_list(list)
+
+	return managedList(list), nil
+}
+
+func (cgoLib) discoverAndConnect(scanMs, connectMs uint32) ([]ManagedDevice, error) {
+	var list *C.ManagedDeviceList
+
+	err := call(func() bool {
+		list = C.discover_and_connect(C.uint32_t(scanMs), C.uint32_t(connectMs))
+		return list != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer C.free_managed_device_list(list)
+
+	return managedList(list), nil
+}
+
+// managedList copies the devices of the list, it must still be freed
+func managedList(list *C.ManagedDeviceList) []ManagedDevice {
+	managed := make([]ManagedDevice, C.managed_device_list_len(list))
+	for i := range managed {
+		var connected C.bool
+		// Cannot fail, the index is in bounds
+		C.managed_device_list_get(
+			list,
+			C.size_t(i),
+			(*C.uint8_t)(unsafe.Pointer(&managed[i].Addr[0])),
+			&connected,
+		)
+		managed[i].Connected = bool(connected)
+	}
+
+	return managed
+}
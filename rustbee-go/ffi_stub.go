@@ -0,0 +1,287 @@
+//go:build !rustbee_ffi
+
+package rustbee
+
+import "unsafe"
+
+// stubLib lets the package build without librustbee, every call fails with
+// ErrFFIUnavailable
+var lib native = stubLib{}
+
+type stubLib struct{}
+
+func (stubLib) cloneDevice(handle unsafe.Pointer) (unsafe.Pointer, error) {
+	return nil, ErrFFIUnavailable
+}
+
+func (stubLib) newDevice(addr [6]byte) (unsafe.Pointer, error) {
+	return nil, ErrFFIUnavailable
+}
+
+func (stubLib) freeDevice(handle unsafe.Pointer) {}
+
+func (stubLib) connect(handle unsafe.Pointer, timeoutMs uint32) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) disconnect(handle unsafe.Pointer) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) isConnected(handle unsafe.Pointer) (bool, error) {
+	return false, ErrFFIUnavailable
+}
+
+func (stubLib) setWriteRetries(handle unsafe.Pointer, retries uint8) {}
+
+func (stubLib) setDeviceTag(handle unsafe.Pointer, tag string) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) flush(handle unsafe.Pointer) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) lastCommandLatencyMs(handle unsafe.Pointer) uint32 {
+	return 0
+}
+
+func (stubLib) connectPaired(handle unsafe.Pointer) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) isPaired(handle unsafe.Pointer) (bool, error) {
+	return false, ErrFFIUnavailable
+}
+
+func (stubLib) requestConnectionParams(handle unsafe.Pointer, minIntervalMs, maxIntervalMs, mtu uint16) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) setKeepalive(handle unsafe.Pointer, intervalMs uint32) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) identify(handle unsafe.Pointer) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) setPower(handle unsafe.Pointer, on bool) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) setPowerAsync(handle unsafe.Pointer, on bool, done func(error)) {
+	go done(ErrFFIUnavailable)
+}
+
+func (stubLib) setBrightness(handle unsafe.Pointer, value uint8) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) setBrightnessPercent(handle unsafe.Pointer, percent uint8) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) setBrightnessCurve(handle unsafe.Pointer, curve BrightnessCurve) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) brightnessRange(handle unsafe.Pointer) (low, high uint8, err error) {
+	return 1, 254, ErrFFIUnavailable
+}
+
+func (stubLib) setColor(handle unsafe.Pointer, r, g, b uint8) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) gattWrite(handle unsafe.Pointer, uuid128 [16]byte, value []byte) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) setEffect(handle unsafe.Pointer, effect uint8) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) setWhiteMix(handle unsafe.Pointer, warm, cool uint8) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) whiteMix(handle unsafe.Pointer) (uint8, uint8, error) {
+	return 0, 0, ErrFFIUnavailable
+}
+
+func (stubLib) power(handle unsafe.Pointer) (bool, error) {
+	return false, ErrFFIUnavailable
+}
+
+func (stubLib) togglePower(handle unsafe.Pointer) (bool, error) {
+	return false, ErrFFIUnavailable
+}
+
+func (stubLib) brightness(handle unsafe.Pointer, percent bool) (uint8, error) {
+	return 0, ErrFFIUnavailable
+}
+
+func (stubLib) rssi(handle unsafe.Pointer) (int16, error) {
+	return 0, ErrFFIUnavailable
+}
+
+func (stubLib) capabilities(handle unsafe.Pointer) (Capabilities, error) {
+	return 0, ErrFFIUnavailable
+}
+
+func (stubLib) features(handle unsafe.Pointer) (Features, error) {
+	return 0, ErrFFIUnavailable
+}
+
+func (stubLib) state(handle unsafe.Pointer) (DeviceState, error) {
+	return DeviceState{}, ErrFFIUnavailable
+}
+
+func (stubLib) subscribe(handle unsafe.Pointer, onState func(*DeviceState)) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) unsubscribe(handle unsafe.Pointer) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) watchConnection(handle unsafe.Pointer, onChange func(connected, ended bool)) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) firmwareVersion(handle unsafe.Pointer) (string, error) {
+	return "", ErrFFIUnavailable
+}
+
+func (stubLib) name(handle unsafe.Pointer) (string, error) {
+	return "", ErrFFIUnavailable
+}
+
+func (stubLib) nameBytes(handle unsafe.Pointer) ([]byte, error) {
+	return nil, ErrFFIUnavailable
+}
+
+func (stubLib) scan(durationMs uint32, onFound func(Discovered) bool) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) startScan(durationMs uint32) (unsafe.Pointer, error) {
+	return nil, ErrFFIUnavailable
+}
+
+func (stubLib) pollScan(scan unsafe.Pointer, timeoutMs uint32) (Discovered, bool, error) {
+	return Discovered{}, false, ErrFFIUnavailable
+}
+
+func (stubLib) stopScan(scan unsafe.Pointer) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) scanAdvertised(durationMs uint32) ([]Discovered, error) {
+	return nil, ErrFFIUnavailable
+}
+
+func (stubLib) adapterAvailable() error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) adapterInfo() (Adapter, error) {
+	return Adapter{}, ErrFFIUnavailable
+}
+
+func (stubLib) daemonAlive() error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) launchDaemon() (bool, error) {
+	return false, ErrFFIUnavailable
+}
+
+func (stubLib) launchDaemonTCP(bindAddr, token string) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) launchDaemonSimulated() error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) seedSimulatedDevice(addr [6]byte, state DeviceState) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) connectDaemonTCP(addr, token string) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) shutdownDaemon(force bool) (int, error) {
+	return 0, ErrFFIUnavailable
+}
+
+func (stubLib) daemonVersion() (string, error) {
+	return "", ErrFFIUnavailable
+}
+
+func (stubLib) daemonDataDir() (string, error) {
+	return "", ErrFFIUnavailable
+}
+
+func (stubLib) setDataDir(path string) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) daemonStats() (DaemonStats, error) {
+	return DaemonStats{}, ErrFFIUnavailable
+}
+
+func (stubLib) setState(handle unsafe.Pointer, state DesiredState) (StateFields, error) {
+	return 0, ErrFFIUnavailable
+}
+
+func (stubLib) startupState(handle unsafe.Pointer) (DesiredState, error) {
+	return DesiredState{}, ErrFFIUnavailable
+}
+
+func (stubLib) setStartupState(handle unsafe.Pointer, state DesiredState) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) schedule(handle unsafe.Pointer, state DesiredState, atUnixMs uint64) (uint64, error) {
+	return 0, ErrFFIUnavailable
+}
+
+func (stubLib) cancelScheduled(job uint64) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) managedDevices() ([]ManagedDevice, error) {
+	return nil, ErrFFIUnavailable
+}
+
+func (stubLib) discoverAndConnect(scanMs, connectMs uint32) ([]ManagedDevice, error) {
+	return nil, ErrFFIUnavailable
+}
+
+func (stubLib) setLogCallback(onLog func(level int, msg string), minLevel int) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) setConnectionCacheTTL(seconds uint32) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) setGlobalWriteRate(writesPerSec uint32) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) setAutoReconnect(enabled bool) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) setReconnectPolicy(baseMs, maxMs uint32) error {
+	return ErrFFIUnavailable
+}
+
+func (stubLib) setAutoLaunchDaemon(enabled bool) error {
+	return ErrFFIUnavailable
+}
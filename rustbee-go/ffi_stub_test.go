@@ -0,0 +1,18 @@
+//go:build !rustbee_ffi
+
+package rustbee
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStubFailsWithFFIUnavailable(t *testing.T) {
+	if _, err := NewDevice(testAddr); !errors.Is(err, ErrFFIUnavailable) {
+		t.Fatalf("expected ErrFFIUnavailable, got %v", err)
+	}
+
+	if _, err := ShutdownDaemon(false); !errors.Is(err, ErrFFIUnavailable) {
+		t.Fatalf("expected ErrFFIUnavailable, got %v", err)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/Snoupix/rustbee/rustbee-go
+
+go 1.22
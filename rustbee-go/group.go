@@ -0,0 +1,107 @@
+package rustbee
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// Group applies commands to all of its devices concurrently, e.g. the lights
+// of a room. It doesn't own the devices, they must still be closed.
+//
+// The methods of a Group return nil if every device succeeded, else a
+// *GroupError telling which devices failed.
+type Group struct {
+	mu      sync.Mutex
+	devices []*Device
+}
+
+func NewGroup(devices ...*Device) *Group {
+	g := &Group{}
+	for _, d := range devices {
+		g.Add(d)
+	}
+
+	return g
+}
+
+// Add is a no-op if the device is already in the group
+func (g *Group) Add(d *Device) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !slices.Contains(g.devices, d) {
+		g.devices = append(g.devices, d)
+	}
+}
+
+func (g *Group) Remove(d *Device) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.devices = slices.DeleteFunc(g.devices, func(member *Device) bool {
+		return member == d
+	})
+}
+
+// Devices returns a copy of the members
+func (g *Group) Devices() []*Device {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return slices.Clone(g.devices)
+}
+
+func (g *Group) SetPower(on bool) error {
+	return g.each(func(d *Device) error { return d.SetPower(on) })
+}
+
+// SetBrightness takes the raw brightness, from 1 to 254
+func (g *Group) SetBrightness(value uint8) error {
+	return g.each(func(d *Device) error { return d.SetBrightness(value) })
+}
+
+func (g *Group) SetColor(c Color) error {
+	return g.each(func(d *Device) error { return d.SetColor(c) })
+}
+
+// SetState applies the whole state to every member (see Device.SetState), each
+// one until ctx is done. Every member has its error in the result, nil if it
+// got the state. The members that didn't get it by then fail with ctx.Err(),
+// those still waiting for their calls in progress are left as is.
+func (g *Group) SetState(ctx context.Context, state DesiredState) map[*Device]error {
+	devices, failed := g.run(func(d *Device) error { return d.setStateContext(ctx, state) })
+
+	results := make(map[*Device]error, len(devices))
+	for i, d := range devices {
+		results[d] = failed[i]
+	}
+
+	return results
+}
+
+// each runs fn on every member, see run
+func (g *Group) each(fn func(*Device) error) error {
+	return groupError(g.run(fn))
+}
+
+// run runs fn on every member in its own goroutine, a Device serializes its
+// own calls so the devices are the only parallelism. failed[i] is the error of
+// devices[i]
+func (g *Group) run(fn func(*Device) error) (devices []*Device, failed []error) {
+	devices = g.Devices()
+	failed = make([]error, len(devices))
+
+	var wg sync.WaitGroup
+	for i, d := range devices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			failed[i] = fn(d)
+		}()
+	}
+	wg.Wait()
+
+	return devices, failed
+}
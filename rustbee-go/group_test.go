@@ -0,0 +1,147 @@
+package rustbee
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGroupAggregatesDeviceErrors(t *testing.T) {
+	fake := useFakeLib(t)
+
+	failingAddr := [6]byte{0xec, 0x27, 0xa7, 0xd6, 0x5a, 0x9c}
+	fake.failing[failingAddr] = ErrGattError
+
+	var devices []*Device
+	for _, addr := range [][6]byte{testAddr, failingAddr, {1, 2, 3, 4, 5, 6}} {
+		device, err := NewDevice(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer device.Close()
+
+		devices = append(devices, device)
+	}
+
+	group := NewGroup(devices...)
+	group.Add(devices[0])
+	if n := len(group.Devices()); n != 3 {
+		t.Fatalf("expected 3 members after adding a member again, got %d", n)
+	}
+
+	err := group.SetPower(true)
+
+	var deviceErr *DeviceError
+	if !errors.As(err, &deviceErr) || deviceErr.Addr != failingAddr {
+		t.Fatalf("expected a DeviceError of %X, got %v", failingAddr, err)
+	}
+
+	if !errors.Is(err, ErrGattError) {
+		t.Fatalf("expected ErrGattError, got %v", err)
+	}
+
+	for _, d := range []*Device{devices[0], devices[2]} {
+		if !fake.inspect(d).power {
+			t.Fatalf("device %X wasn't powered on", d.addr)
+		}
+	}
+
+	group.Remove(devices[1])
+	if err := group.SetBrightness(254); err != nil {
+		t.Fatalf("expected no error without the failing device, got %v", err)
+	}
+}
+
+func TestGroupErrorTellsWhichDevicesFailed(t *testing.T) {
+	fake := useFakeLib(t)
+
+	unreachableAddr := [6]byte{0xec, 0x27, 0xa7, 0xd6, 0x5a, 0x9c}
+	fake.failing[unreachableAddr] = ErrDeviceNotFound
+
+	var devices []*Device
+	for _, addr := range [][6]byte{testAddr, unreachableAddr, {1, 2, 3, 4, 5, 6}} {
+		device, err := NewDevice(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer device.Close()
+
+		devices = append(devices, device)
+	}
+
+	err := NewGroup(devices...).SetBrightness(127)
+
+	var groupErr *GroupError
+	if !errors.As(err, &groupErr) {
+		t.Fatalf("expected a GroupError, got %v", err)
+	}
+	if len(groupErr.Failed) != 1 || !errors.Is(groupErr.Failed[devices[1]], ErrDeviceNotFound) {
+		t.Fatalf("expected only %X to fail with ErrDeviceNotFound, got %v", unreachableAddr, groupErr.Failed)
+	}
+
+	for _, d := range []*Device{devices[0], devices[2]} {
+		if brightness := fake.inspect(d).brightness; brightness != 127 {
+			t.Fatalf("expected %X at 127, got %d", d.addr, brightness)
+		}
+	}
+}
+
+func TestGroupSetStateStopsWhenTheContextIsDone(t *testing.T) {
+	fake := useFakeLib(t)
+
+	var devices []*Device
+	for _, addr := range [][6]byte{testAddr, {1, 2, 3, 4, 5, 6}} {
+		device, err := NewDevice(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer device.Close()
+
+		devices = append(devices, device)
+	}
+	group := NewGroup(devices...)
+
+	on, brightness := true, uint8(76)
+	state := DesiredState{Power: &on, Brightness: &brightness}
+	results := group.SetState(context.Background(), state)
+	if len(results) != len(devices) {
+		t.Fatalf("expected a result per member, got %v", results)
+	}
+	for d, err := range results {
+		if err != nil {
+			t.Fatalf("%X: %v", d.addr, err)
+		}
+	}
+	for _, d := range devices {
+		if device := fake.inspect(d); !device.power || device.brightness != 76 {
+			t.Fatalf("expected %X on at 76, got %v at %d", d.addr, device.power, device.brightness)
+		}
+	}
+
+	// The first device is busy past the deadline so its state is never written
+	fake.mu.Lock()
+	fake.writeDelay = 100 * time.Millisecond
+	fake.mu.Unlock()
+	busy := devices[0].SetPowerAsync(false)
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	results = group.SetState(ctx, state)
+	for _, d := range devices {
+		if !errors.Is(results[d], context.DeadlineExceeded) {
+			t.Fatalf("expected %X to fail with context.DeadlineExceeded, got %v", d.addr, results[d])
+		}
+	}
+
+	if err := <-busy; err != nil {
+		t.Fatal(err)
+	}
+	// The dropped state would be written right after the busy write
+	time.Sleep(10 * time.Millisecond)
+	if device := fake.inspect(devices[0]); device.power {
+		t.Fatal("expected the state of the busy device to be dropped")
+	}
+}
@@ -0,0 +1,24 @@
+package rustbee
+
+import "context"
+
+// Light is the set of Device methods a controller usually needs, *Device
+// implements it. Code that takes a Light instead of a *Device can be tested
+// without librustbee nor a light, with the Light of the rustbeetest package
+type Light interface {
+	Connect(ctx context.Context) error
+	Disconnect() error
+	IsConnected() (bool, error)
+	SetPower(on bool) error
+	Power() (bool, error)
+	TogglePower() (bool, error)
+	SetBrightness(value uint8) error
+	Brightness() (uint8, error)
+	SetColor(c Color) error
+	SetState(state DesiredState) error
+	State() (DeviceState, error)
+	Name() (string, error)
+	Close() error
+}
+
+var _ Light = (*Device)(nil)
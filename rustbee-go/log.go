@@ -0,0 +1,64 @@
+package rustbee
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Levels of the daemon log records, see set_log_callback
+const (
+	logError = 1 + iota
+	logWarn
+	logInfo
+	logDebug
+	logTrace
+)
+
+// SetLogger forwards the log records of the daemon at level or above to
+// logger, they're still written to the daemon log file. A nil logger stops
+// it, the previous logger isn't called anymore once SetLogger returned so its
+// handler must not call SetLogger.
+//
+// The forwarding ends when the daemon exits, SetLogger must be called again
+// once it's relaunched.
+func SetLogger(logger *slog.Logger, level slog.Level) error {
+	if logger == nil {
+		return lib.setLogCallback(nil, 0)
+	}
+
+	return lib.setLogCallback(func(level int, msg string) {
+		logger.Log(context.Background(), slogLevel(level), msg)
+	}, daemonLogLevel(level))
+}
+
+func slogLevel(level int) slog.Level {
+	switch level {
+	case logError:
+		return slog.LevelError
+	case logWarn:
+		return slog.LevelWarn
+	case logInfo:
+		return slog.LevelInfo
+	case logDebug:
+		return slog.LevelDebug
+	default:
+		return slog.LevelDebug - 4
+	}
+}
+
+// daemonLogLevel is the least severe daemon level whose records are all at
+// least level
+func daemonLogLevel(level slog.Level) int {
+	switch {
+	case level > slog.LevelWarn:
+		return logError
+	case level > slog.LevelInfo:
+		return logWarn
+	case level > slog.LevelDebug:
+		return logInfo
+	case level > slog.LevelDebug-4:
+		return logDebug
+	default:
+		return logTrace
+	}
+}
@@ -0,0 +1,64 @@
+package rustbee
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+)
+
+func TestSetLoggerForwardsTheDaemonRecords(t *testing.T) {
+	fake := useFakeLib(t)
+
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	if err := SetLogger(logger, slog.LevelWarn); err != nil {
+		t.Fatal(err)
+	}
+	if fake.logLevel != logWarn {
+		t.Fatalf("expected the daemon level %d, got %d", logWarn, fake.logLevel)
+	}
+
+	fake.onLog(logError, "Cannot connect")
+	const expected = "level=ERROR msg=\"Cannot connect\"\n"
+	if s := out.String(); s != expected {
+		t.Fatalf("expected %q, got %q", expected, s)
+	}
+
+	if err := SetLogger(nil, slog.LevelWarn); err != nil {
+		t.Fatal(err)
+	}
+	if fake.onLog != nil {
+		t.Fatal("expected the callback to be removed")
+	}
+}
+
+func TestDaemonLogLevel(t *testing.T) {
+	tests := []struct {
+		level    slog.Level
+		expected int
+	}{
+		{slog.LevelError, logError},
+		{slog.LevelWarn + 1, logError},
+		{slog.LevelWarn, logWarn},
+		{slog.LevelInfo + 1, logWarn},
+		{slog.LevelInfo, logInfo},
+		{slog.LevelDebug, logDebug},
+		{slog.LevelDebug - 1, logDebug},
+		{slog.LevelDebug - 4, logTrace},
+	}
+
+	for _, test := range tests {
+		if level := daemonLogLevel(test.level); level != test.expected {
+			t.Errorf("%v: expected %d, got %d", test.level, test.expected, level)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package rustbee
+
+import "time"
+
+// ManagedDevice is a device known by the daemon, it may have been connected by
+// another process
+type ManagedDevice struct {
+	Addr [6]byte
+	// As reported by Device.IsConnected
+	Connected bool
+}
+
+// Open creates a handle to control the device, see NewDevice
+func (m ManagedDevice) Open() (*Device, error) {
+	return NewDevice(m.Addr)
+}
+
+// ManagedDevices lists the devices of the running daemon sorted by address, it
+// fails with ErrDaemonUnreachable if there is none
+func ManagedDevices() ([]ManagedDevice, error) {
+	return lib.managedDevices()
+}
+
+// DiscoverAndConnect scans for scanFor then connects every device found at
+// once, each within connectWithin (0 keeps the daemon default timeouts). It
+// returns the connected devices, Open gives a handle to control each one. The
+// ones that failed to connect are printed to stderr by librustbee and left out.
+func DiscoverAndConnect(scanFor, connectWithin time.Duration) ([]ManagedDevice, error) {
+	return lib.discoverAndConnect(uint32(scanFor.Milliseconds()), uint32(connectWithin.Milliseconds()))
+}
@@ -0,0 +1,43 @@
+package rustbee
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManagedDevicesCanBeOpened(t *testing.T) {
+	fake := useFakeLib(t)
+	fake.managed = []ManagedDevice{{Addr: testAddr, Connected: true}}
+
+	managed, err := ManagedDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(managed) != 1 || managed[0].Addr != testAddr || !managed[0].Connected {
+		t.Fatalf("expected the connected %v, got %v", testAddr, managed)
+	}
+
+	d, err := managed[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.SetPower(true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiscoverAndConnectLeavesTheFailuresOut(t *testing.T) {
+	fake := useFakeLib(t)
+	failed := [6]byte{0xe8, 0xd4, 0xea, 0xc4, 0x62, 0x01}
+	fake.managed = []ManagedDevice{{Addr: testAddr, Connected: true}, {Addr: failed}}
+
+	connected, err := DiscoverAndConnect(time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(connected) != 1 || connected[0].Addr != testAddr {
+		t.Fatalf("expected only %v, got %v", testAddr, connected)
+	}
+}
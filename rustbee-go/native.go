@@ -0,0 +1,91 @@
+package rustbee
+
+import "unsafe"
+
+// native is the set of librustbee calls used by the package, implemented by
+// cgoLib (or stubLib without the rustbee_ffi build tag) and swapped with a fake
+// in tests
+type native interface {
+	newDevice(addr [6]byte) (unsafe.Pointer, error)
+	cloneDevice(handle unsafe.Pointer) (unsafe.Pointer, error)
+	freeDevice(handle unsafe.Pointer)
+	connect(handle unsafe.Pointer, timeoutMs uint32) error
+	disconnect(handle unsafe.Pointer) error
+	isConnected(handle unsafe.Pointer) (bool, error)
+	connectPaired(handle unsafe.Pointer) error
+	isPaired(handle unsafe.Pointer) (bool, error)
+	requestConnectionParams(handle unsafe.Pointer, minIntervalMs, maxIntervalMs, mtu uint16) error
+	setKeepalive(handle unsafe.Pointer, intervalMs uint32) error
+	identify(handle unsafe.Pointer) error
+	setWriteRetries(handle unsafe.Pointer, retries uint8)
+	setDeviceTag(handle unsafe.Pointer, tag string) error
+	flush(handle unsafe.Pointer) error
+	lastCommandLatencyMs(handle unsafe.Pointer) uint32
+	setPower(handle unsafe.Pointer, on bool) error
+	// done is called from another goroutine
+	setPowerAsync(handle unsafe.Pointer, on bool, done func(error))
+	setBrightness(handle unsafe.Pointer, value uint8) error
+	setBrightnessPercent(handle unsafe.Pointer, percent uint8) error
+	setBrightnessCurve(handle unsafe.Pointer, curve BrightnessCurve) error
+	// The full 1 to 254 range on failure
+	brightnessRange(handle unsafe.Pointer) (low, high uint8, err error)
+	setColor(handle unsafe.Pointer, r, g, b uint8) error
+	gattWrite(handle unsafe.Pointer, uuid128 [16]byte, value []byte) error
+	setEffect(handle unsafe.Pointer, effect uint8) error
+	setWhiteMix(handle unsafe.Pointer, warm, cool uint8) error
+	whiteMix(handle unsafe.Pointer) (warm, cool uint8, err error)
+	// failed is the fields that weren't applied, the others were
+	setState(handle unsafe.Pointer, state DesiredState) (failed StateFields, err error)
+	schedule(handle unsafe.Pointer, state DesiredState, atUnixMs uint64) (uint64, error)
+	startupState(handle unsafe.Pointer) (DesiredState, error)
+	setStartupState(handle unsafe.Pointer, state DesiredState) error
+	cancelScheduled(job uint64) error
+	power(handle unsafe.Pointer) (bool, error)
+	togglePower(handle unsafe.Pointer) (bool, error)
+	brightness(handle unsafe.Pointer, percent bool) (uint8, error)
+	rssi(handle unsafe.Pointer) (int16, error)
+	capabilities(handle unsafe.Pointer) (Capabilities, error)
+	features(handle unsafe.Pointer) (Features, error)
+	state(handle unsafe.Pointer) (DeviceState, error)
+	// onState is called one at a time with every state then nil once it ended
+	subscribe(handle unsafe.Pointer, onState func(*DeviceState)) error
+	unsubscribe(handle unsafe.Pointer) error
+	// onChange is called one at a time with every connection state then with
+	// ended once it ended, nil stops the watch
+	watchConnection(handle unsafe.Pointer, onChange func(connected, ended bool)) error
+	name(handle unsafe.Pointer) (string, error)
+	nameBytes(handle unsafe.Pointer) ([]byte, error)
+	firmwareVersion(handle unsafe.Pointer) (string, error)
+	// onFound is called on the calling goroutine until it returns false
+	scan(durationMs uint32, onFound func(Discovered) bool) error
+	// The scan runs in the background until stopScan, pollScan fails with
+	// ErrTimeout while it's running and returns false once it ended
+	startScan(durationMs uint32) (unsafe.Pointer, error)
+	pollScan(scan unsafe.Pointer, timeoutMs uint32) (Discovered, bool, error)
+	stopScan(scan unsafe.Pointer) error
+	scanAdvertised(durationMs uint32) ([]Discovered, error)
+	adapterAvailable() error
+	adapterInfo() (Adapter, error)
+	daemonAlive() error
+	launchDaemon() (bool, error)
+	launchDaemonTCP(bindAddr, token string) error
+	launchDaemonSimulated() error
+	seedSimulatedDevice(addr [6]byte, state DeviceState) error
+	// An empty addr goes back to the local daemon
+	connectDaemonTCP(addr, token string) error
+	// clean is the devices drained and disconnected, none if forced
+	shutdownDaemon(force bool) (clean int, err error)
+	daemonVersion() (string, error)
+	daemonDataDir() (string, error)
+	setDataDir(path string) error
+	daemonStats() (DaemonStats, error)
+	managedDevices() ([]ManagedDevice, error)
+	discoverAndConnect(scanMs, connectMs uint32) ([]ManagedDevice, error)
+	// onLog is called one at a time from another goroutine, nil stops it
+	setLogCallback(onLog func(level int, msg string), minLevel int) error
+	setConnectionCacheTTL(seconds uint32) error
+	setGlobalWriteRate(writesPerSec uint32) error
+	setAutoReconnect(enabled bool) error
+	setReconnectPolicy(baseMs, maxMs uint32) error
+	setAutoLaunchDaemon(enabled bool) error
+}
@@ -0,0 +1,129 @@
+package rustbee
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// Pool owns the devices of several lights and limits how many of them connect
+// at once, many adapters fail to connect more than a handful of devices at the
+// same time. The Connect calls past the limit wait for a connect to end.
+type Pool struct {
+	connecting chan struct{}
+
+	mu      sync.Mutex
+	devices map[[6]byte]*Device
+	closed  bool
+}
+
+// NewPool lets maxConnects devices connect at once, at least 1
+func NewPool(maxConnects int) *Pool {
+	return &Pool{
+		connecting: make(chan struct{}, max(maxConnects, 1)),
+		devices:    map[[6]byte]*Device{},
+	}
+}
+
+// Connect connects the device of addr, it's opened the first time. It waits
+// (until the context is done) while maxConnects devices are connecting. The
+// device belongs to the pool, it must not be closed, see Remove.
+func (p *Pool) Connect(ctx context.Context, addr [6]byte) (*Device, error) {
+	d, err := p.device(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case p.connecting <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-p.connecting }()
+
+	if err := d.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// device opens the device of addr if the pool doesn't have it yet
+func (p *Pool) device(addr [6]byte) (*Device, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, ErrClosed
+	}
+
+	if d, ok := p.devices[addr]; ok {
+		return d, nil
+	}
+
+	d, err := NewDevice(addr)
+	if err != nil {
+		return nil, err
+	}
+	p.devices[addr] = d
+
+	return d, nil
+}
+
+// Device returns the device of addr, nil if the pool doesn't have it
+func (p *Pool) Device(addr [6]byte) *Device {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.devices[addr]
+}
+
+// Devices returns the devices of the pool, connected or not
+func (p *Pool) Devices() []*Device {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	devices := make([]*Device, 0, len(p.devices))
+	for _, d := range p.devices {
+		devices = append(devices, d)
+	}
+	slices.SortFunc(devices, func(a, b *Device) int {
+		return slices.Compare(a.addr[:], b.addr[:])
+	})
+
+	return devices
+}
+
+// Remove takes the device of addr out of the pool and closes it, it's a no-op
+// if the pool doesn't have it
+func (p *Pool) Remove(addr [6]byte) error {
+	p.mu.Lock()
+	d, ok := p.devices[addr]
+	delete(p.devices, addr)
+	p.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return d.Close()
+}
+
+// Close closes every device, the pool cannot connect devices anymore. It
+// returns a *GroupError if some of them failed to close.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	devices := p.devices
+	p.devices = map[[6]byte]*Device{}
+	p.closed = true
+	p.mu.Unlock()
+
+	closed := make([]*Device, 0, len(devices))
+	failed := make([]error, 0, len(devices))
+	for _, d := range devices {
+		closed = append(closed, d)
+		failed = append(failed, d.Close())
+	}
+
+	return groupError(closed, failed)
+}
@@ -0,0 +1,118 @@
+package rustbee
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestPoolLimitsTheConnectsInFlight(t *testing.T) {
+	fake := useFakeLib(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	fake.connectStarted, fake.connectRelease = started, release
+
+	pool := NewPool(3)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 20)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, errs[i] = pool.Connect(context.Background(), [6]byte{5: byte(i)})
+		}()
+	}
+
+	// The 3 slots are taken, then every connect that ends lets another start
+	for range 3 {
+		<-started
+	}
+	for i := range errs {
+		release <- struct{}{}
+		if i+3 < len(errs) {
+			<-started
+		}
+	}
+	wg.Wait()
+
+	fake.mu.Lock()
+	fake.connectStarted, fake.connectRelease = nil, nil
+	fake.mu.Unlock()
+
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+	if fake.maxConnecting != 3 {
+		t.Fatalf("expected at most 3 connects in flight, got %d", fake.maxConnecting)
+	}
+
+	devices := pool.Devices()
+	if len(devices) != len(errs) {
+		t.Fatalf("expected %d devices, got %d", len(errs), len(devices))
+	}
+	for _, d := range devices {
+		if !fake.inspect(d).connected {
+			t.Fatalf("device %X isn't connected", d.addr)
+		}
+	}
+
+	// A connected device is reused
+	d, err := pool.Connect(context.Background(), [6]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != pool.Device([6]byte{}) || fake.connects(d) != 2 {
+		t.Fatalf("expected the device of the pool to be connected again")
+	}
+
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range devices {
+		if _, err := d.IsConnected(); !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected ErrClosed once the pool is closed, got %v", err)
+		}
+	}
+	if _, err := pool.Connect(context.Background(), testAddr); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestPoolConnectWaitsUntilTheContextIsDone(t *testing.T) {
+	fake := useFakeLib(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	fake.connectStarted, fake.connectRelease = started, release
+
+	pool := NewPool(1)
+	defer pool.Close()
+
+	first := make(chan error)
+	go func() {
+		_, err := pool.Connect(context.Background(), testAddr)
+		first <- err
+	}()
+
+	// The first connect holds the only slot until it's released
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := pool.Connect(ctx, [6]byte{1}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled while waiting, got %v", err)
+	}
+
+	release <- struct{}{}
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pool.Remove([6]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if pool.Device([6]byte{1}) != nil {
+		t.Fatal("the device is still in the pool")
+	}
+}
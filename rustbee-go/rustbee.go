@@ -0,0 +1,1348 @@
+// Package rustbee controls Philips Hue BLE lights through librustbee, the C
+// dynamic library of rustbee-common, and the rustbee daemon.
+//
+// The bindings are only built with the rustbee_ffi build tag:
+//
+//	go build -tags rustbee_ffi
+//
+// The library is then built with `just build-lib` and must be found at runtime
+// (e.g. LD_LIBRARY_PATH=rustbee-common/target/release). Without the tag, the
+// package doesn't need cgo nor librustbee and every call fails with
+// ErrFFIUnavailable, e.g. to build and test code that only needs the types.
+package rustbee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// Device is a handle to a light, it should be closed to free the underlying
+// librustbee device but a finalizer frees it if it's garbage collected first.
+//
+// A Device is safe for concurrent use, its calls are serialized since
+// concurrent GATT writes would corrupt the device state. Different Device
+// instances are independent and can be used in parallel.
+type Device struct {
+	addr [6]byte
+
+	// Guards handle and is held for the whole librustbee call
+	mu     sync.Mutex
+	handle unsafe.Pointer
+
+	// Calls still running on the daemon side after their context was done,
+	// Close waits for them before freeing the handle
+	pending sync.WaitGroup
+
+	// Latest SetBrightnessDebounced value, a timer only writes it if no other
+	// value came after it (see writeDebounced)
+	debounceMu      sync.Mutex
+	debounceTimer   *time.Timer
+	debounceSeq     uint64
+	debounced       uint8
+	debouncePending bool
+}
+
+// NewDevice doesn't connect to the device nor checks that it exists
+func NewDevice(addr [6]byte) (*Device, error) {
+	handle, err := lib.newDevice(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Device{addr: addr, handle: handle}
+	runtime.SetFinalizer(d, (*Device).Close)
+
+	return d, nil
+}
+
+// Address is the MAC address of the light, it's still known after Close
+func (d *Device) Address() [6]byte {
+	return d.addr
+}
+
+// Equal tells whether both devices are the same light, e.g. a Clone is equal to
+// its source
+func (d *Device) Equal(other *Device) bool {
+	if d == nil || other == nil {
+		return d == other
+	}
+
+	return d.addr == other.addr
+}
+
+// Clone returns a new Device of the same light, e.g. to rebuild one after a
+// dropped connection. It keeps the librustbee settings of d (write retries,
+// brightness curve...) and its name and capabilities so they aren't read
+// again. Both are independent and must be closed, the clone isn't subscribed.
+func (d *Device) Clone() (*Device, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return nil, ErrClosed
+	}
+
+	handle, err := lib.cloneDevice(d.handle)
+	if err != nil {
+		return nil, err
+	}
+
+	clone := &Device{addr: d.addr, handle: handle}
+	runtime.SetFinalizer(clone, (*Device).Close)
+
+	return clone, nil
+}
+
+// Close frees the device handle, the device stays connected on the daemon
+// side. It waits for the calls in progress (SetPowerAsync included) and the
+// calls made after it fail with ErrClosed. It is safe to call it more than
+// once, from any goroutine.
+func (d *Device) Close() error {
+	// The pending debounced brightness is written before the handle is freed
+	d.debounceMu.Lock()
+	if d.debounceTimer != nil {
+		d.debounceTimer.Stop()
+	}
+	seq := d.debounceSeq
+	d.debounceMu.Unlock()
+	d.writeDebounced(seq)
+
+	d.mu.Lock()
+	handle := d.handle
+	d.handle = nil
+	d.mu.Unlock()
+
+	if handle == nil {
+		return nil
+	}
+
+	runtime.SetFinalizer(d, nil)
+	// The pending calls hold the lock, it must be released first
+	d.pending.Wait()
+	lib.freeDevice(handle)
+
+	return nil
+}
+
+// Connect discovers and connects the device, the context deadline is sent to
+// the daemon so it aborts the discovery and the connection itself (without a
+// deadline, the daemon default timeouts are used).
+//
+// If the context is done first, ctx.Err() is returned right away and the
+// device is disconnected if the pending attempt succeeds anyway.
+func (d *Device) Connect(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// 0 means no timeout for the daemon, so an almost elapsed deadline is 1ms
+	var timeoutMs uint32
+	if deadline, ok := ctx.Deadline(); ok {
+		timeoutMs = uint32(max(time.Until(deadline).Milliseconds(), 1))
+	}
+
+	d.mu.Lock()
+	handle := d.handle
+	if handle == nil {
+		d.mu.Unlock()
+		return ErrClosed
+	}
+	d.pending.Add(1)
+	d.mu.Unlock()
+
+	done := make(chan error, 1)
+
+	go func() {
+		defer d.pending.Done()
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		err := lib.connect(handle, timeoutMs)
+		if err == nil && ctx.Err() != nil {
+			_ = lib.disconnect(handle)
+		}
+
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		// The daemon timeout comes from the context deadline so it's done or
+		// about to be
+		if _, ok := ctx.Deadline(); ok && errors.Is(err, ErrTimeout) {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RetryConnect calls Connect up to attempts times, waiting backoff before the
+// first retry then doubling it each time. The device is checked between
+// attempts in case a previous one succeeded late. The last Connect error is
+// returned once all the attempts failed, ctx.Err() if ctx is done first.
+func (d *Device) RetryConnect(ctx context.Context, attempts int, backoff time.Duration) error {
+	var err error
+
+	for attempt := range attempts {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff << (attempt - 1)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			if connected, _ := d.IsConnected(); connected {
+				return nil
+			}
+		}
+
+		err = d.Connect(ctx)
+		if err == nil || ctx.Err() != nil || errors.Is(err, ErrClosed) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// Disconnect closes the BLE connection, the device can be connected again
+func (d *Device) Disconnect() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	return lib.disconnect(d.handle)
+}
+
+// IsConnected never tries to connect the device
+func (d *Device) IsConnected() (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return false, ErrClosed
+	}
+
+	return lib.isConnected(d.handle)
+}
+
+// ConnectPaired connects the device and pairs it, the daemon keeps the bond so
+// the next ConnectPaired don't pair again. Pairing can take as long as the OS
+// needs, there is no timeout.
+func (d *Device) ConnectPaired() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	return lib.connectPaired(d.handle)
+}
+
+// IsPaired reports whether the OS has a bond with the device, it never
+// connects it
+func (d *Device) IsPaired() (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return false, ErrClosed
+	}
+
+	return lib.isPaired(d.handle)
+}
+
+// RequestConnectionParams asks for connection intervals from minInterval to
+// maxInterval (7.5ms to 4s, rounded up to the millisecond) and an MTU from 23
+// to 517, 0 keeps the negotiated one. It's best effort: the OS and the light
+// may pick other values. Windows maps the intervals to its closest preset and
+// negotiates the MTU itself, it fails with ErrUnsupported if the platform
+// cannot request them at all (Linux, Windows 10)
+func (d *Device) RequestConnectionParams(minInterval, maxInterval time.Duration, mtu uint16) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	return lib.requestConnectionParams(d.handle, intervalMs(minInterval), intervalMs(maxInterval), mtu)
+}
+
+// intervalMs rounds up to the millisecond, an out of range interval stays out
+// of range so librustbee rejects it
+func intervalMs(interval time.Duration) uint16 {
+	ms := (interval + time.Millisecond - 1) / time.Millisecond
+	if ms > math.MaxUint16 {
+		return math.MaxUint16
+	}
+
+	return uint16(max(ms, 0))
+}
+
+// SetKeepalive makes the daemon read the power of the device every interval
+// (rounded up to the millisecond) it goes without commands, so an idle
+// connection isn't dropped by the BLE supervision timeout. 0 or less stops it.
+// The reads wait for the commands in flight and don't count as commands for
+// the idle disconnect of the daemon, it's reset when the daemon restarts
+func (d *Device) SetKeepalive(interval time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	ms := (max(interval, 0) + time.Millisecond - 1) / time.Millisecond
+	return lib.setKeepalive(d.handle, uint32(min(ms, math.MaxUint32)))
+}
+
+// SetWriteRetries sets how many times the setters retry a failed GATT write
+// before they fail, it's 2 by default and 0 fails on the first failure. The
+// retries are counted in DaemonStats.WriteRetries
+func (d *Device) SetWriteRetries(retries uint8) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	lib.setWriteRetries(d.handle, retries)
+	return nil
+}
+
+// SetTag prefixes the error messages of the device and its records in the
+// daemon logs with [tag] instead of its address, e.g. to tell the lights apart.
+// "" goes back to the address. A tag longer than 19 bytes or with a nul byte
+// fails with ErrInvalidArg and the tag is unchanged
+func (d *Device) SetTag(tag string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	if strings.IndexByte(tag, 0) >= 0 {
+		return &Error{Code: CodeInvalidArg, Message: "the tag has a nul byte"}
+	}
+
+	return lib.setDeviceTag(d.handle, tag)
+}
+
+// Flush returns once the light applied the writes the daemon got before it,
+// from this process or another one: the daemon waits for the requests it's
+// running on the device then reads it. It's a barrier for the writes the light
+// doesn't acknowledge, a getter called after it reads the new values. If ctx is
+// done first, ctx.Err() is returned and the flush ends in the background.
+func (d *Device) Flush(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	handle := d.handle
+	if handle == nil {
+		d.mu.Unlock()
+		return ErrClosed
+	}
+	d.pending.Add(1)
+	d.mu.Unlock()
+
+	done := make(chan error, 1)
+
+	go func() {
+		defer d.pending.Done()
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		done <- lib.flush(handle)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// LastCommandLatency is the round trip of the last command of the device, the
+// GATT operation with its retries and the exchange with the daemon (a timed
+// out one counts as its timeout), from once the device is ready. Connecting
+// and disconnecting aren't timed, it's 0 until a command ran. With
+// DaemonStats, it helps adapting a debounce window (see SetBrightnessDebounced)
+// to the speed of the link
+func (d *Device) LastCommandLatency() (time.Duration, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return 0, ErrClosed
+	}
+
+	return time.Duration(lib.lastCommandLatencyMs(d.handle)) * time.Millisecond, nil
+}
+
+// Identify blinks the light for a few seconds to find it physically, its power
+// and brightness are restored afterwards
+func (d *Device) Identify() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	return lib.identify(d.handle)
+}
+
+func (d *Device) SetPower(on bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	return lib.setPower(d.handle, on)
+}
+
+// TogglePower turns the light off if it's on and on otherwise, it returns the
+// new state. Unlike Power then SetPower, it's a single request to the daemon so
+// there is no round trip for another client to slip in between, and the
+// concurrent toggles of a light are serialized with each other (not with
+// SetPower)
+func (d *Device) TogglePower() (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return false, ErrClosed
+	}
+
+	return lib.togglePower(d.handle)
+}
+
+// Power reads whether the light is on, a failed read is an error rather than
+// off so e.g. a disconnected light isn't shown as off
+func (d *Device) Power() (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return false, ErrClosed
+	}
+
+	return lib.power(d.handle)
+}
+
+// SetPowerAsync returns right away, the result is sent to the channel once the
+// daemon is done. The device is locked until then so the other calls wait for
+// it.
+func (d *Device) SetPowerAsync(on bool) <-chan error {
+	done := make(chan error, 1)
+
+	d.mu.Lock()
+	if d.handle == nil {
+		d.mu.Unlock()
+		done <- ErrClosed
+		return done
+	}
+	d.pending.Add(1)
+
+	lib.setPowerAsync(d.handle, on, func(err error) {
+		d.mu.Unlock()
+		d.pending.Done()
+		done <- err
+	})
+
+	return done
+}
+
+// SetBrightness takes the raw brightness, from 1 to 254, other values fail with
+// ErrInvalidArg
+func (d *Device) SetBrightness(value uint8) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	return lib.setBrightness(d.handle, value)
+}
+
+// BrightnessCurve maps the brightness percentages of a device to the raw
+// brightness, see Device.SetBrightnessCurve
+type BrightnessCurve uint8
+
+const (
+	// BrightnessLinear is the default, a percentage is the same share of the
+	// raw brightness. The low percentages look like big steps and the high
+	// ones barely change.
+	BrightnessLinear BrightnessCurve = iota
+	// BrightnessGamma raises the percentage to 2.2 (gamma correction) so the
+	// eye sees even steps, e.g. for a slider. 50% is a raw 55.
+	BrightnessGamma
+)
+
+// SetBrightnessPercent sets the brightness from 0 to 100 through the curve of
+// the device, other values fail with ErrInvalidArg. 0 is the lowest brightness
+// of the light, not off.
+func (d *Device) SetBrightnessPercent(percent uint8) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	return lib.setBrightnessPercent(d.handle, percent)
+}
+
+// SetBrightnessCurve applies to SetBrightnessPercent and BrightnessPercent, an
+// unknown curve fails with ErrInvalidArg
+func (d *Device) SetBrightnessCurve(curve BrightnessCurve) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	return lib.setBrightnessCurve(d.handle, curve)
+}
+
+// SetBrightnessDebounced coalesces rapid updates, e.g. from a slider: only the
+// latest value is written once no other value came for window. It returns
+// right away and the final value is always written, at the latest by Close.
+//
+// The error of the write is dropped since the caller has moved on, Brightness
+// tells the value that was written.
+func (d *Device) SetBrightnessDebounced(value uint8, window time.Duration) {
+	d.debounceMu.Lock()
+	defer d.debounceMu.Unlock()
+
+	d.debounceSeq++
+	d.debounced = value
+	d.debouncePending = true
+
+	if d.debounceTimer != nil {
+		d.debounceTimer.Stop()
+	}
+	seq := d.debounceSeq
+	d.debounceTimer = time.AfterFunc(window, func() { d.writeDebounced(seq) })
+}
+
+// writeDebounced writes the debounced value if seq is still the latest. The
+// device lock is taken first so a superseded timer that was already firing
+// cannot write after the newer value.
+func (d *Device) writeDebounced(seq uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.debounceMu.Lock()
+	value, latest := d.debounced, d.debouncePending && seq == d.debounceSeq
+	if latest {
+		d.debouncePending = false
+	}
+	d.debounceMu.Unlock()
+
+	if !latest || d.handle == nil {
+		return
+	}
+
+	_ = lib.setBrightness(d.handle, value)
+}
+
+// Brightness is the raw value from 1 to 254, the scale of SetBrightness
+func (d *Device) Brightness() (uint8, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return 0, ErrClosed
+	}
+
+	return lib.brightness(d.handle, false)
+}
+
+// BrightnessRange is the raw brightness range supported by the light, some
+// can't be dimmed as low as others. SetBrightness already clamps to it. On
+// failure, it's the full 1 to 254 range with the error
+func (d *Device) BrightnessRange() (low, high uint8, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return 1, 254, ErrClosed
+	}
+
+	return lib.brightnessRange(d.handle)
+}
+
+// BrightnessPercent is Brightness from 0 to 100 through the curve of the
+// device, the inverse of SetBrightnessPercent
+func (d *Device) BrightnessPercent() (uint8, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return 0, ErrClosed
+	}
+
+	return lib.brightness(d.handle, true)
+}
+
+// DeviceState is the whole state of a device, see Device.State. As JSON the
+// fields are snake_case like device_state_json, rgb is left out without a color.
+type DeviceState struct {
+	Connected bool
+	Power     bool
+	// Raw brightness from 1 to 254
+	Brightness uint8
+	// White only lights don't have a color, RGB is then black
+	HasColor bool
+	// At full brightness
+	RGB  Color
+	Name string
+}
+
+// State reads the whole state of the device at once, it's cheaper than a call
+// per getter when polling many devices
+func (d *Device) State() (DeviceState, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return DeviceState{}, ErrClosed
+	}
+
+	return lib.state(d.handle)
+}
+
+// Subscribe sends the current state then every change (e.g. made by another
+// app or a physical switch) to the returned channel until Unsubscribe, it's
+// closed once the subscription ended (also if the device disconnected). A slow
+// reader only misses the intermediate states, the channel always ends up with
+// the latest one. Close also ends the subscription.
+func (d *Device) Subscribe() (<-chan DeviceState, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return nil, ErrClosed
+	}
+
+	states := make(chan DeviceState, 1)
+
+	err := lib.subscribe(d.handle, func(state *DeviceState) {
+		if state == nil {
+			close(states)
+			return
+		}
+
+		// The callbacks are not concurrent so it's the only sender, replacing
+		// the pending state never blocks
+		select {
+		case <-states:
+		default:
+		}
+		states <- *state
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return states, nil
+}
+
+// Unsubscribe returns once the channel of Subscribe is closed
+func (d *Device) Unsubscribe() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	return lib.unsubscribe(d.handle)
+}
+
+// ConnectionChanges sends whether the device is connected then every change to
+// the returned channel, e.g. to gray out the controls of a light as soon as it
+// drops instead of on the next failed call. The drops are noticed within a
+// second, the connections and reconnections made by the daemon (see
+// SetAutoReconnect) right away. The device doesn't have to be connected.
+//
+// The channel is closed once the watch ended, by StopConnectionChanges, Close
+// or the daemon exiting. A slow reader only misses the intermediate states, the
+// channel always ends up with the latest one. A new call replaces the previous
+// watch, its channel is closed.
+func (d *Device) ConnectionChanges() (<-chan bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return nil, ErrClosed
+	}
+
+	changes := make(chan bool, 1)
+
+	err := lib.watchConnection(d.handle, func(connected, ended bool) {
+		if ended {
+			close(changes)
+			return
+		}
+
+		// The callbacks are not concurrent so it's the only sender, replacing
+		// the pending state never blocks
+		select {
+		case <-changes:
+		default:
+		}
+		changes <- connected
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// StopConnectionChanges returns once the channel of ConnectionChanges is
+// closed, it's a no-op if the device isn't watched
+func (d *Device) StopConnectionChanges() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	return lib.watchConnection(d.handle, nil)
+}
+
+// observeBuffer is the capacity of the channel of Observe
+const observeBuffer = 16
+
+// Observe sends the current state then every change to the returned channel
+// until the context is done, it's closed once the subscription ended (also if
+// the device disconnected or was closed). Unlike Subscribe it keeps the last
+// observeBuffer states, a slow reader misses the oldest ones so librustbee is
+// never blocked. It's one subscription with Subscribe, only one of them can be
+// active at a time.
+func (d *Device) Observe(ctx context.Context) (<-chan DeviceState, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return nil, ErrClosed
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	states := make(chan DeviceState, observeBuffer)
+	ended := make(chan struct{})
+
+	err := lib.subscribe(d.handle, func(state *DeviceState) {
+		if state == nil {
+			close(states)
+			close(ended)
+			return
+		}
+
+		// The callbacks are not concurrent so it's the only sender, once the
+		// oldest state is dropped there is room for this one. The reader may
+		// have drained the channel meanwhile, dropping never blocks
+		select {
+		case states <- *state:
+		default:
+			select {
+			case <-states:
+			default:
+			}
+			states <- *state
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-ended:
+			return
+		}
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		// A new subscription cannot start before this one ended, lib.subscribe
+		// needs the lock
+		select {
+		case <-ended:
+		default:
+			lib.unsubscribe(d.handle)
+		}
+	}()
+
+	return states, nil
+}
+
+// RSSI is the last measured signal strength in dBm, it doesn't connect the
+// device so it fails if the daemon hasn't discovered it yet
+func (d *Device) RSSI() (int16, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return 0, ErrClosed
+	}
+
+	rssi, err := lib.rssi(d.handle)
+	if err != nil {
+		return 0, err
+	}
+
+	return rssi, nil
+}
+
+func (d *Device) SetColor(c Color) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	return lib.setColor(d.handle, c.R, c.G, c.B)
+}
+
+// SetColorRaw writes payload as is to the color characteristic, see
+// ColorPayload. Unlike SetColor, the chromaticity isn't converted through
+// floats so the light gets the exact values. The device must be connected
+// (ErrNotConnected) and it's ErrInvalidArg if payload isn't ColorPayloadLen
+// bytes long
+func (d *Device) SetColorRaw(payload []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	if len(payload) != ColorPayloadLen {
+		return &Error{
+			Code:    CodeInvalidArg,
+			Message: fmt.Sprintf("the color payload is %d bytes, expected %d", len(payload), ColorPayloadLen),
+		}
+	}
+
+	return lib.gattWrite(d.handle, colorUUID, payload)
+}
+
+// DesiredState is applied at once by SetState, the nil fields are left as is.
+// As JSON (e.g. a preset in a config file) the nil fields are left out and
+// stay nil once decoded, the transition is a duration string like "1.5s".
+type DesiredState struct {
+	Power *bool
+	// Raw brightness from 1 to 254
+	Brightness *uint8
+	// Exclusive with ColorTemp
+	RGB *Color
+	// Mireds, clamped to the range of the white ambiance lights
+	ColorTemp *uint16
+	// Of the power, brightness and color changes, rounded up to 100ms and
+	// capped to about 1h49m
+	Transition time.Duration
+}
+
+// StateFields are bits of the fields of a DesiredState, the values of the
+// RUSTBEE_FIELD_ defines of librustbee
+type StateFields uint8
+
+const (
+	FieldPower      StateFields = 1 << 0
+	FieldBrightness StateFields = 1 << 1
+	FieldColor      StateFields = 1 << 2
+	FieldColorTemp  StateFields = 1 << 3
+)
+
+var stateFieldNames = []struct {
+	field StateFields
+	name  string
+}{
+	{FieldPower, "power"},
+	{FieldBrightness, "brightness"},
+	{FieldColor, "color"},
+	{FieldColorTemp, "color temperature"},
+}
+
+// String lists the fields, e.g. "brightness, color"
+func (f StateFields) String() string {
+	var names []string
+	for _, field := range stateFieldNames {
+		if f&field.field != 0 {
+			names = append(names, field.name)
+		}
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// SetState validates the whole state (ErrInvalidArg) before writing its fields,
+// in a single write for the lights that have the combined control
+// characteristic. For the others, a light turned on is turned on before the
+// other fields so it shows them, a light turned off is turned off after them.
+// A failed write doesn't stop the next ones, the error is then a *StateError
+// telling the fields that weren't applied so the caller can reconcile the
+// light. The command timeout covers the whole state.
+func (d *Device) SetState(state DesiredState) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	return stateError(lib.setState(d.handle, state))
+}
+
+// stateError wraps err in a *StateError if some fields failed
+func stateError(failed StateFields, err error) error {
+	if err != nil && failed != 0 {
+		return &StateError{Failed: failed, Err: err}
+	}
+
+	return err
+}
+
+// setStateContext is SetState bounded by ctx. A state still waiting for the
+// calls in progress on the device when ctx is done isn't written, one already
+// sent to the light cannot be aborted and ends in the background.
+func (d *Device) setStateContext(ctx context.Context, state DesiredState) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+
+	// The lock is taken in the goroutine since it's held by the calls in
+	// progress, Close takes it too so the handle cannot be freed meanwhile
+	go func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		if d.handle == nil {
+			done <- ErrClosed
+			return
+		}
+		if err := ctx.Err(); err != nil {
+			done <- err
+			return
+		}
+
+		done <- stateError(lib.setState(d.handle, state))
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StartupState returns the values the light boots with, e.g. after a power
+// loss behind a switch: Power (true), Brightness and RGB if it boots with fixed
+// values, only Power (false) if it boots off and none if it boots as it was.
+// It fails with ErrUnsupported if the light doesn't have a configurable
+// startup.
+func (d *Device) StartupState() (DesiredState, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return DesiredState{}, ErrClosed
+	}
+
+	return lib.startupState(d.handle)
+}
+
+// SetStartupState writes the non nil fields of the values the light boots
+// with, the others are kept, and makes it boot with them (or off if Power is
+// false). The live state is left as is. ColorTemp is ErrInvalidArg, the
+// light only stores a color, and Transition is ignored.
+func (d *Device) SetStartupState(state DesiredState) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	return lib.setStartupState(d.handle, state)
+}
+
+// deciseconds is the transition time of librustbee
+func deciseconds(transition time.Duration) uint16 {
+	const ds = 100 * time.Millisecond
+
+	return uint16(min((max(transition, 0)+ds-1)/ds, math.MaxUint16))
+}
+
+// Effects of librustbee, in sync with its RUSTBEE_EFFECT_* values
+const (
+	effectNone uint8 = iota
+	effectColorLoop
+)
+
+// StartColorLoop cycles the light through the colors until StopColorLoop or
+// another effect, it fails if the light doesn't support effects
+func (d *Device) StartColorLoop() error {
+	return d.setEffect(effectColorLoop)
+}
+
+func (d *Device) StopColorLoop() error {
+	return d.setEffect(effectNone)
+}
+
+func (d *Device) setEffect(effect uint8) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	return lib.setEffect(d.handle, effect)
+}
+
+// Capabilities is a bitflag of what a light supports, in sync with the
+// RUSTBEE_SUPPORTS_* flags of librustbee
+type Capabilities uint8
+
+const (
+	SupportsColor Capabilities = 1 << iota
+	SupportsColorTemp
+	SupportsDimming
+	// Separate warm and cool white channels, see Device.SetWhiteMix
+	SupportsWhiteMix
+)
+
+// Has reports whether c has all the capabilities of other
+func (c Capabilities) Has(other Capabilities) bool {
+	return c&other == other
+}
+
+// Capabilities connects the device to know what it supports, e.g. a UI can
+// hide the color controls of a white only light
+func (d *Device) Capabilities() (Capabilities, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return 0, ErrClosed
+	}
+
+	return lib.capabilities(d.handle)
+}
+
+// Features is a bitflag of what a light supports once its firmware quirks are
+// applied, in sync with the RUSTBEE_FEATURE_* flags of librustbee. The low byte
+// holds its Capabilities.
+type Features uint32
+
+const (
+	// A single write sets the power, brightness and color, see Device.SetState
+	FeatureCombinedWrite Features = 1 << (iota + 8)
+	FeatureEffects
+	// The startup behavior can be set, see Device.SetStartupState
+	FeatureStartupState
+	// The light must be paired before it accepts writes, see Device.ConnectPaired
+	FeatureNeedsBonding
+)
+
+// Has reports whether f has all the features of other
+func (f Features) Has(other Features) bool {
+	return f&other == other
+}
+
+// Capabilities returns the capabilities part of f
+func (f Features) Capabilities() Capabilities {
+	return Capabilities(f & 0xff)
+}
+
+// Features connects the device to know what it supports, unlike Capabilities
+// it accounts for the known quirks of its model and firmware version. It's
+// read once per device.
+func (d *Device) Features() (Features, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return 0, ErrClosed
+	}
+
+	return lib.features(d.handle)
+}
+
+// SetWhiteMix sets the levels of the warm and cool white channels, the lights
+// without them (see SupportsWhiteMix) get the closest color temperature and
+// brightness. It fails with ErrUnsupported if the light has no color
+// temperature either and with ErrInvalidArg if both are 0, see SetPower
+func (d *Device) SetWhiteMix(warm, cool uint8) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return ErrClosed
+	}
+
+	return lib.setWhiteMix(d.handle, warm, cool)
+}
+
+// WhiteMix is the inverse of SetWhiteMix
+func (d *Device) WhiteMix() (warm, cool uint8, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return 0, 0, ErrClosed
+	}
+
+	return lib.whiteMix(d.handle)
+}
+
+// Name is at most 19 bytes long, longer names end with "...". It's valid
+// UTF-8, the invalid sequences returned by the device are replaced by U+FFFD
+// and an invalid tail is dropped, see NameBytes
+func (d *Device) Name() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return "", ErrClosed
+	}
+
+	name, err := lib.name(d.handle)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToValidUTF8(name, "\uFFFD"), nil
+}
+
+// NameBytes is the name as the device returned it, it may not be UTF-8
+func (d *Device) NameBytes() ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return nil, ErrClosed
+	}
+
+	return lib.nameBytes(d.handle)
+}
+
+// FirmwareVersion is the firmware revision of the device information service,
+// e.g. "1.104.2", since some behaviors differ between versions. It fails with
+// ErrGattError if the light doesn't expose it
+func (d *Device) FirmwareVersion() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return "", ErrClosed
+	}
+
+	return lib.firmwareVersion(d.handle)
+}
+
+// Adapter is the Bluetooth adapter of this host that the daemon uses
+type Adapter struct {
+	// hci0 and its bus on Linux, the device id on Windows
+	Name string
+	// Only set if HasAddr, not every platform tells it
+	Addr    [6]byte
+	HasAddr bool
+}
+
+// AdapterAvailable tells whether this host has a usable Bluetooth LE adapter,
+// LaunchDaemon fails with ErrNoAdapter without one. It doesn't need the
+// daemon so it can be checked upfront to tell the user to plug or turn on
+// their adapter
+func AdapterAvailable() bool {
+	return lib.adapterAvailable() == nil
+}
+
+// DefaultAdapter returns the adapter the daemon uses, it fails with
+// ErrNoAdapter if there is none
+func DefaultAdapter() (Adapter, error) {
+	return lib.adapterInfo()
+}
+
+// LaunchDaemon is a no-op if the daemon is already running, started tells if
+// it was spawned by this call in which case the caller owns it and should
+// ShutdownDaemon when done. It fails with ErrNoAdapter if it isn't running and
+// this host has no usable Bluetooth LE adapter, ErrSocketInUse if another
+// process holds the socket of the daemon, ErrPermissionDenied if its directory
+// isn't writable and ErrSpawnFailed if rustbee-daemon couldn't be started (e.g.
+// not in the PATH)
+func LaunchDaemon() (started bool, err error) {
+	return lib.launchDaemon()
+}
+
+// LaunchDaemonTCP launches the daemon (see LaunchDaemon) and makes it also
+// listen on TCP at bindAddr, e.g. "0.0.0.0:9740", so the clients of another
+// host that ConnectDaemonTCP with the same token can drive the lights in range
+// of this one. The previous listener is replaced once bindAddr is bound and
+// the daemon doesn't time out while listening. The remote clients only drive
+// the devices, the settings, logs, stats and shutdown of the daemon fail with
+// ErrDaemonError.
+//
+// The connection isn't encrypted, the token (1 to 255 bytes) only keeps out
+// the clients that don't know it
+func LaunchDaemonTCP(bindAddr, token string) error {
+	return lib.launchDaemonTCP(bindAddr, token)
+}
+
+// LaunchDaemonSimulated launches a daemon with in memory virtual devices
+// instead of Bluetooth ones, to test a program without an adapter nor lights.
+// Scan finds them, NewDevice and Connect work against them and their state
+// changes like a light's. E8:D4:EA:C4:62:00 and EC:27:A7:D6:5A:9C are known
+// from the start, see SeedSimulatedDevice for others. A daemon already running
+// is kept even if it isn't simulated
+func LaunchDaemonSimulated() error {
+	return lib.launchDaemonSimulated()
+}
+
+// SeedSimulatedDevice adds or replaces the virtual device of addr with the
+// connection, power, brightness, color and name of state (cut to 11 bytes), a
+// state without color is a white only light. It fails with ErrUnsupported if
+// the daemon isn't simulated, see LaunchDaemonSimulated
+func SeedSimulatedDevice(addr [6]byte, state DeviceState) error {
+	return lib.seedSimulatedDevice(addr, state)
+}
+
+// ConnectDaemonTCP sends every later call of the process to the daemon that
+// listens on TCP at addr (see LaunchDaemonTCP), it's checked with a ping and
+// the previous daemon is kept on failure, ErrDaemonError if it rejected the
+// token. An empty addr goes back to the local daemon. LaunchDaemon still
+// launches a local daemon
+func ConnectDaemonTCP(addr, token string) error {
+	return lib.connectDaemonTCP(addr, token)
+}
+
+// ShutdownDaemon is optional since the daemon closes itself after a timeout
+// without requests, it fails with ErrDaemonError if no daemon is running.
+//
+// Unless forced, the daemon drains the writes of every device and disconnects
+// them at once in the order of their address, clean is how many of them it did
+// within 2 seconds (the others are logged by the daemon). It fails with
+// ErrTimeout if the daemon doesn't exit 5 seconds after. A forced shutdown has
+// no clean devices.
+func ShutdownDaemon(force bool) (clean int, err error) {
+	return lib.shutdownDaemon(force)
+}
+
+// SetConnectionCacheTTL makes the daemon keep the connection of a disconnected
+// device open for ttl (rounded up to the second) so connecting it again is
+// instant, e.g. for repeated short-lived runs. 0 disables it, it's the default
+// and it's reset when the daemon restarts
+func SetConnectionCacheTTL(ttl time.Duration) error {
+	seconds := (max(ttl, 0) + time.Second - 1) / time.Second
+	return lib.setConnectionCacheTTL(uint32(min(seconds, math.MaxUint32)))
+}
+
+// SetGlobalWriteRate throttles the GATT writes of the daemon to each device to
+// writesPerSec, e.g. for a light that chokes on a flood of writes. Every device
+// has its own budget so a flooded one doesn't hold back the others. Bursts of
+// up to a second of writes go through at once, the next writes wait and the
+// ones that would wait more than a second fail. See the DelayedWrites
+// and DroppedWrites of Stats. 0 disables it, it's the default and it's reset
+// when the daemon restarts
+func SetGlobalWriteRate(writesPerSec uint32) error {
+	return lib.setGlobalWriteRate(writesPerSec)
+}
+
+// SetAutoReconnect makes the daemon reconnect the subscribed devices that drop
+// and subscribe to their state again, so the Subscribe channels keep getting
+// the states. Each reconnection is logged (see SetLogger). It's disabled by
+// default and reset when the daemon restarts
+func SetAutoReconnect(enabled bool) error {
+	return lib.setAutoReconnect(enabled)
+}
+
+// SetReconnectPolicy sets the backoff between the reconnection attempts of a
+// dropped device (see SetAutoReconnect), it starts at base and doubles after
+// every failure up to maxBackoff, both rounded up to the millisecond. Every attempt
+// waits a random part of it so the devices that dropped together, e.g. on an
+// adapter reset, don't all reconnect at once. It's 500ms up to 30s by default
+// and reset when the daemon restarts, it fails with ErrInvalidArg if base is 0
+// or longer than maxBackoff
+func SetReconnectPolicy(base, maxBackoff time.Duration) error {
+	return lib.setReconnectPolicy(backoffMs(base), backoffMs(maxBackoff))
+}
+
+// backoffMs rounds up to the millisecond, a backoff of 0 or less stays 0 so
+// librustbee rejects it
+func backoffMs(backoff time.Duration) uint32 {
+	ms := (max(backoff, 0) + time.Millisecond - 1) / time.Millisecond
+	return uint32(min(ms, math.MaxUint32))
+}
+
+// SetAutoLaunchDaemon makes the calls that need the daemon launch it (see
+// LaunchDaemon) if it isn't running, e.g. the first Device.Connect, instead of
+// failing with ErrDaemonUnreachable. It's disabled by default and never
+// launches the remote daemon of ConnectDaemonTCP
+func SetAutoLaunchDaemon(enabled bool) error {
+	return lib.setAutoLaunchDaemon(enabled)
+}
+
+// DaemonDataDir returns the absolute directory where the daemons launched by
+// this process keep their scenes and bonds, e.g. to back them up. It's
+// /var/lib/rustbee by default, the RUSTBEE_DATA_DIR env variable or
+// SetDataDir overrides it. A daemon launched by another process may use
+// another one
+func DaemonDataDir() (string, error) {
+	return lib.daemonDataDir()
+}
+
+// SetDataDir must be called before LaunchDaemon, a running daemon keeps its
+// directory. It's created with the first scene or bond, it fails with
+// ErrInvalidArg if path isn't a directory and ErrPermissionDenied if the
+// existing directory isn't writable
+func SetDataDir(path string) error {
+	return lib.setDataDir(path)
+}
+
+// DaemonVersion returns the version of the running daemon, e.g. "0.1.0+1a2b3c4"
+// when it knows its commit hash, or an empty string if it cannot be reached
+func DaemonVersion() string {
+	version, _ := lib.daemonVersion()
+	return version
+}
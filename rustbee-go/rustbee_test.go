@@ -0,0 +1,1284 @@
+package rustbee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testAddr = [6]byte{0xe8, 0xd4, 0xea, 0xc4, 0x62, 0x00}
+
+// waitFreed forces GCs until the finalizers freed n devices or fails after 1s
+func waitFreed(t *testing.T, fake *fakeLib, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for fake.freed() < n && time.Now().Before(deadline) {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if freed := fake.freed(); freed != n {
+		t.Fatalf("expected %d freed devices, got %d", n, freed)
+	}
+}
+
+func TestFinalizerFreesUnclosedDevices(t *testing.T) {
+	fake := useFakeLib(t)
+
+	for range 10 {
+		if _, err := NewDevice(testAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFreed(t, fake, 10)
+
+	if live := fake.live(); live != 0 {
+		t.Fatalf("%d devices leaked", live)
+	}
+}
+
+func TestCloseIsIdempotentWithFinalizer(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		if err := device.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := device.SetPower(true); err != ErrClosed {
+		t.Fatalf("expected ErrClosed after Close, got %v", err)
+	}
+
+	device = nil
+	// A double free would be reported by the fake
+	waitFreed(t, fake, 1)
+}
+
+func TestCloneKeepsTheSettings(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := device.SetWriteRetries(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	clone, err := device.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clone.Close()
+
+	if fake.inspect(clone).retries != 5 {
+		t.Fatal("expected the clone to keep the write retries")
+	}
+	if fake.inspect(clone).connected {
+		t.Fatal("expected the clone to be disconnected")
+	}
+
+	// The original stays usable after the clone, and the other way around
+	device.Close()
+	if err := clone.SetPower(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := device.Clone(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed after Close, got %v", err)
+	}
+	if live := fake.live(); live != 1 {
+		t.Fatalf("expected only the clone to be left, got %d devices", live)
+	}
+}
+
+func TestConnectHonorsContextDeadline(t *testing.T) {
+	fake := useFakeLib(t)
+	fake.unreachable[testAddr] = true
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = device.Connect(ctx)
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	if elapsed > 500*time.Millisecond {
+		t.Fatalf("Connect returned after %s", elapsed)
+	}
+}
+
+func TestRetryConnectBacksOff(t *testing.T) {
+	fake := useFakeLib(t)
+	fake.unreachable[testAddr] = true
+	fake.daemonTimeout = time.Millisecond
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	start := time.Now()
+	err = device.RetryConnect(context.Background(), 4, 10*time.Millisecond)
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, ErrDeviceNotFound) {
+		t.Fatalf("expected the last error ErrDeviceNotFound, got %v", err)
+	}
+
+	if connects := fake.connects(device); connects != 4 {
+		t.Fatalf("expected 4 attempts, got %d", connects)
+	}
+
+	// 10ms + 20ms + 40ms between the attempts
+	if elapsed < 70*time.Millisecond {
+		t.Fatalf("RetryConnect returned after %s, the backoff wasn't respected", elapsed)
+	}
+}
+
+func TestConcurrentCallsOnOneDeviceAreSerialized(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	// Writes on another device must not be reported as concurrent
+	other, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	const goroutines, calls = 8, 30
+
+	var wg sync.WaitGroup
+	for g := range goroutines {
+		for _, d := range []*Device{device, other} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for i := range calls {
+					var err error
+					switch i % 3 {
+					case 0:
+						err = d.SetPower(i%2 == 0)
+					case 1:
+						err = d.SetBrightness(uint8(g * i))
+					case 2:
+						err = d.SetColor(Color{uint8(g), uint8(i), 0})
+					}
+
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	for _, d := range []*Device{device, other} {
+		if writes := fake.writes(d); writes != goroutines*calls {
+			t.Fatalf("expected %d writes, got %d", goroutines*calls, writes)
+		}
+	}
+}
+
+func TestConnectPairedPairsTheDevice(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if paired, err := device.IsPaired(); err != nil || paired {
+		t.Fatalf("expected an unpaired device, got %v, %v", paired, err)
+	}
+
+	if err := device.ConnectPaired(); err != nil {
+		t.Fatal(err)
+	}
+	if paired, err := device.IsPaired(); err != nil || !paired {
+		t.Fatalf("expected a paired device, got %v, %v", paired, err)
+	}
+	if !fake.inspect(device).connected {
+		t.Fatal("expected the device to be connected")
+	}
+
+	device.Close()
+	if err := device.ConnectPaired(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if _, err := device.IsPaired(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestDeviceAddressAndEqual(t *testing.T) {
+	useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	clone, err := device.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clone.Close()
+
+	other, err := NewDevice([6]byte{1, 2, 3, 4, 5, 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if !device.Equal(clone) || device.Equal(other) || device.Equal(nil) {
+		t.Fatal("expected only the clone to be equal to the device")
+	}
+
+	device.Close()
+	if addr := device.Address(); addr != testAddr {
+		t.Fatalf("expected %X after Close, got %X", testAddr, addr)
+	}
+}
+
+func TestSetWriteRetries(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if err := device.SetWriteRetries(5); err != nil {
+		t.Fatal(err)
+	}
+	if retries := fake.inspect(device).retries; retries != 5 {
+		t.Fatalf("expected 5 retries, got %d", retries)
+	}
+
+	device.Close()
+	if err := device.SetWriteRetries(1); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestSetTag(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if err := device.SetTag("kitchen"); err != nil {
+		t.Fatal(err)
+	}
+	if tag := fake.inspect(device).tag; tag != "kitchen" {
+		t.Fatalf("expected the kitchen tag, got %q", tag)
+	}
+
+	for _, tag := range []string{"kit\x00chen", strings.Repeat("a", 20)} {
+		if err := device.SetTag(tag); !errors.Is(err, ErrInvalidArg) {
+			t.Fatalf("%q: expected ErrInvalidArg, got %v", tag, err)
+		}
+	}
+	if tag := fake.inspect(device).tag; tag != "kitchen" {
+		t.Fatalf("expected the tag to be unchanged, got %q", tag)
+	}
+
+	device.Close()
+	if err := device.SetTag(""); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	fake.mu.Lock()
+	fake.device(device.handle).quirks = FeatureNeedsBonding
+	fake.mu.Unlock()
+
+	features, err := device.Features()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !features.Has(FeatureCombinedWrite | FeatureNeedsBonding) {
+		t.Fatalf("expected the combined write and bonding features, got %#x", features)
+	}
+	if features.Has(FeatureStartupState) {
+		t.Fatalf("expected no startup state feature, got %#x", features)
+	}
+	if caps := features.Capabilities(); caps != SupportsColor|SupportsColorTemp|SupportsDimming {
+		t.Fatalf("expected the capabilities in the low byte, got %#x", caps)
+	}
+
+	device.Close()
+	if _, err := device.Features(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestLastCommandLatency(t *testing.T) {
+	useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if latency, err := device.LastCommandLatency(); err != nil || latency != 0 {
+		t.Fatalf("expected no latency before a command, got %v (%v)", latency, err)
+	}
+
+	if err := device.SetPower(true); err != nil {
+		t.Fatal(err)
+	}
+	if latency, err := device.LastCommandLatency(); err != nil || latency < time.Millisecond {
+		t.Fatalf("expected the latency of the write, got %v (%v)", latency, err)
+	}
+
+	device.Close()
+	if _, err := device.LastCommandLatency(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestBrightnessCurve(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	tests := []struct {
+		curve BrightnessCurve
+		raw   uint8
+	}{
+		{BrightnessLinear, 127},
+		{BrightnessGamma, 55},
+	}
+	for _, test := range tests {
+		if err := device.SetBrightnessCurve(test.curve); err != nil {
+			t.Fatal(err)
+		}
+		if err := device.SetBrightnessPercent(50); err != nil {
+			t.Fatal(err)
+		}
+		if raw := fake.inspect(device).brightness; raw != test.raw {
+			t.Errorf("curve %d: expected 50%% to be a raw %d, got %d", test.curve, test.raw, raw)
+		}
+		if percent, err := device.BrightnessPercent(); err != nil || percent != 50 {
+			t.Errorf("curve %d: expected 50%% back, got %d (%v)", test.curve, percent, err)
+		}
+	}
+
+	if err := device.SetBrightnessPercent(101); !errors.Is(err, ErrInvalidArg) {
+		t.Fatalf("expected ErrInvalidArg, got %v", err)
+	}
+	if err := device.SetBrightnessCurve(BrightnessGamma + 1); !errors.Is(err, ErrInvalidArg) {
+		t.Fatalf("expected ErrInvalidArg, got %v", err)
+	}
+}
+
+func TestTogglePower(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	for _, expected := range []bool{true, false, true} {
+		on, err := device.TogglePower()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if on != expected || fake.inspect(device).power != expected {
+			t.Fatalf("expected the light to be toggled to %v, got %v", expected, on)
+		}
+	}
+
+	fake.failing[testAddr] = ErrGattError
+	if _, err := device.TogglePower(); !errors.Is(err, ErrGattError) {
+		t.Fatalf("expected ErrGattError, got %v", err)
+	}
+	if !fake.inspect(device).power {
+		t.Fatal("expected a failed toggle to leave the light on")
+	}
+}
+
+func TestSetColorRawWritesThePayloadAsIs(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	payload := ColorPayload(ScaleXY(0.3127, 0.3290))
+	if err := device.SetColorRaw(payload); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+
+	if err := device.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.SetColorRaw(payload); err != nil {
+		t.Fatal(err)
+	}
+	if written := fake.inspect(device).gatt[colorUUID]; !slices.Equal(written, payload) {
+		t.Fatalf("expected %x, got %x", payload, written)
+	}
+
+	if err := device.SetColorRaw(payload[:3]); !errors.Is(err, ErrInvalidArg) {
+		t.Fatalf("expected ErrInvalidArg, got %v", err)
+	}
+
+	device.Close()
+	if err := device.SetColorRaw(payload); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestFlushRunsAfterTheWrites(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if err := device.SetPower(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-device.SetPowerAsync(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := device.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if flushed := fake.inspect(device).flushedWrites; flushed != 2 {
+		t.Fatalf("expected the flush after 2 writes, got %d", flushed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := device.Flush(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	device.Close()
+	if err := device.Flush(context.Background()); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestRequestConnectionParams(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	// 7.5ms is rounded up to 8
+	if err := device.RequestConnectionParams(7500*time.Microsecond, 30*time.Millisecond, 247); err != nil {
+		t.Fatal(err)
+	}
+	if d := fake.inspect(device); d.minIntervalMs != 8 || d.maxIntervalMs != 30 || d.mtu != 247 {
+		t.Fatalf("expected 8ms to 30ms and an MTU of 247, got %dms to %dms and %d", d.minIntervalMs, d.maxIntervalMs, d.mtu)
+	}
+
+	invalid := []struct {
+		min, max time.Duration
+		mtu      uint16
+	}{
+		{5 * time.Millisecond, 30 * time.Millisecond, 0},
+		{-time.Millisecond, 30 * time.Millisecond, 0},
+		{15 * time.Millisecond, time.Hour, 0},
+		{30 * time.Millisecond, 15 * time.Millisecond, 0},
+		{15 * time.Millisecond, 30 * time.Millisecond, 22},
+	}
+	for _, test := range invalid {
+		if err := device.RequestConnectionParams(test.min, test.max, test.mtu); !errors.Is(err, ErrInvalidArg) {
+			t.Errorf("%v to %v with an MTU of %d: expected ErrInvalidArg, got %v", test.min, test.max, test.mtu, err)
+		}
+	}
+
+	fake.noConnectionParams = true
+	if err := device.RequestConnectionParams(15*time.Millisecond, 30*time.Millisecond, 0); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestSetKeepaliveRoundsUpToTheMillisecond(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	tests := []struct {
+		interval time.Duration
+		ms       uint32
+	}{
+		{30 * time.Second, 30000},
+		{1500 * time.Microsecond, 2},
+		{0, 0},
+		{-time.Second, 0},
+	}
+	for _, test := range tests {
+		if err := device.SetKeepalive(test.interval); err != nil {
+			t.Fatal(err)
+		}
+		if ms := fake.inspect(device).keepaliveMs; ms != test.ms {
+			t.Errorf("%v: expected %dms, got %dms", test.interval, test.ms, ms)
+		}
+	}
+
+	device.Close()
+	if err := device.SetKeepalive(time.Second); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestFirmwareVersion(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if version, err := device.FirmwareVersion(); err != nil || version != "1.104.2" {
+		t.Fatalf("expected 1.104.2, got %q (%v)", version, err)
+	}
+
+	fake.failing[testAddr] = ErrGattError
+	if _, err := device.FirmwareVersion(); !errors.Is(err, ErrGattError) {
+		t.Fatalf("expected ErrGattError, got %v", err)
+	}
+}
+
+func TestNameIsValidUTF8(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	// A bulb returning garbage in the name characteristic
+	raw := "Sa\xfe\xfflon\xc3"
+	fake.notify(device, func(d *fakeDevice) { d.name = raw })
+
+	name, err := device.Name()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Like a char cut by the daemon, the invalid tail is dropped
+	if name != "Sa\uFFFDlon" {
+		t.Fatalf("expected the invalid sequences replaced and the tail dropped, got %q", name)
+	}
+	if _, err := json.Marshal(name); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes, err := device.NameBytes(); err != nil || string(bytes) != raw {
+		t.Fatalf("expected %q, got %q (%v)", raw, bytes, err)
+	}
+}
+
+func TestPowerFailureIsNotOff(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if err := device.SetPower(true); err != nil {
+		t.Fatal(err)
+	}
+	if on, err := device.Power(); err != nil || !on {
+		t.Fatalf("expected on, got %v, %v", on, err)
+	}
+
+	fake.failing[testAddr] = ErrNotConnected
+	if _, err := device.Power(); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+}
+
+func TestColorLoopStartsAndStops(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if err := device.StartColorLoop(); err != nil {
+		t.Fatal(err)
+	}
+	if effect := fake.inspect(device).effect; effect != effectColorLoop {
+		t.Fatalf("expected the color loop, got effect %d", effect)
+	}
+
+	if err := device.StopColorLoop(); err != nil {
+		t.Fatal(err)
+	}
+	if effect := fake.inspect(device).effect; effect != effectNone {
+		t.Fatalf("expected no effect, got effect %d", effect)
+	}
+
+	device.Close()
+	if err := device.StartColorLoop(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestSetWhiteMix(t *testing.T) {
+	useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if err := device.SetWhiteMix(200, 40); err != nil {
+		t.Fatal(err)
+	}
+	if warm, cool, err := device.WhiteMix(); err != nil || warm != 200 || cool != 40 {
+		t.Fatalf("expected (200, 40), got (%d, %d, %v)", warm, cool, err)
+	}
+
+	if err := device.SetWhiteMix(0, 0); !errors.Is(err, ErrInvalidArg) {
+		t.Fatalf("expected ErrInvalidArg, got %v", err)
+	}
+
+	device.Close()
+	if _, _, err := device.WhiteMix(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestSetStateOnlyWritesTheSetFields(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if err := device.SetColor(Color{B: 255}); err != nil {
+		t.Fatal(err)
+	}
+
+	on, brightness := true, uint8(200)
+	if err := device.SetState(DesiredState{Power: &on, Brightness: &brightness}); err != nil {
+		t.Fatal(err)
+	}
+
+	state := fake.inspect(device)
+	if !state.power || state.brightness != brightness || state.color != (Color{B: 255}) {
+		t.Fatalf("expected on at %d and still blue, got %+v", brightness, state)
+	}
+
+	rgb, mireds := Color{R: 255}, uint16(300)
+	if err := device.SetState(DesiredState{RGB: &rgb, ColorTemp: &mireds}); !errors.Is(err, ErrInvalidArg) {
+		t.Fatalf("expected ErrInvalidArg, got %v", err)
+	}
+}
+
+func TestSetStateTellsTheFailedFields(t *testing.T) {
+	fake := useFakeLib(t)
+	fake.failingFields = FieldColor
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	// The power is applied after the color
+	on, brightness, rgb := false, uint8(200), Color{R: 255}
+	err = device.SetState(DesiredState{Power: &on, Brightness: &brightness, RGB: &rgb})
+
+	var stateErr *StateError
+	if !errors.As(err, &stateErr) || stateErr.Failed != FieldColor {
+		t.Fatalf("expected a StateError for the color, got %v", err)
+	}
+	if !errors.Is(err, ErrGattError) {
+		t.Fatalf("expected ErrGattError, got %v", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "color not applied") {
+		t.Fatalf("expected the failed field in %q", msg)
+	}
+
+	state := fake.inspect(device)
+	if state.brightness != brightness || state.color == rgb || state.power {
+		t.Fatalf("expected the brightness and power applied but not the color, got %+v", state)
+	}
+}
+
+func TestStartupStateIsKeptApartFromTheLiveState(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	brightness, rgb := uint8(100), Color{R: 255, G: 128}
+	if err := device.SetStartupState(DesiredState{Brightness: &brightness, RGB: &rgb}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.inspect(device).power {
+		t.Fatal("the live state was changed")
+	}
+
+	// The brightness is kept
+	off := false
+	if err := device.SetStartupState(DesiredState{Power: &off}); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := device.StartupState(); err != nil || *state.Power || state.Brightness != nil {
+		t.Fatalf("expected to boot off, got %+v (%v)", state, err)
+	}
+
+	on := true
+	if err := device.SetStartupState(DesiredState{Power: &on}); err != nil {
+		t.Fatal(err)
+	}
+	state, err := device.StartupState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !*state.Power || *state.Brightness != brightness || *state.RGB != rgb {
+		t.Fatalf("expected to boot on at %d in %v, got %+v", brightness, rgb, state)
+	}
+
+	mireds := uint16(300)
+	if err := device.SetStartupState(DesiredState{ColorTemp: &mireds}); !errors.Is(err, ErrInvalidArg) {
+		t.Fatalf("expected ErrInvalidArg, got %v", err)
+	}
+
+	fake.noStartup = true
+	if _, err := device.StartupState(); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestDeciseconds(t *testing.T) {
+	tests := []struct {
+		transition time.Duration
+		expected   uint16
+	}{
+		{-time.Second, 0},
+		{0, 0},
+		{time.Millisecond, 1},
+		{1500 * time.Millisecond, 15},
+		{24 * time.Hour, math.MaxUint16},
+	}
+
+	for _, test := range tests {
+		if ds := deciseconds(test.transition); ds != test.expected {
+			t.Errorf("%v: expected %d, got %d", test.transition, test.expected, ds)
+		}
+	}
+}
+
+func TestSetConnectionCacheTTLRoundsUpToTheSecond(t *testing.T) {
+	fake := useFakeLib(t)
+
+	for ttl, seconds := range map[time.Duration]uint32{
+		-time.Second:               0,
+		0:                          0,
+		time.Millisecond:           1,
+		90 * time.Second:           90,
+		90*time.Second + 1:         91,
+		200 * 365 * 24 * time.Hour: math.MaxUint32,
+	} {
+		if err := SetConnectionCacheTTL(ttl); err != nil {
+			t.Fatal(err)
+		}
+
+		if fake.cacheTTLSeconds != seconds {
+			t.Fatalf("expected %ds for %v, got %ds", seconds, ttl, fake.cacheTTLSeconds)
+		}
+	}
+}
+
+func TestSetAutoReconnect(t *testing.T) {
+	fake := useFakeLib(t)
+
+	for _, enabled := range []bool{true, false} {
+		if err := SetAutoReconnect(enabled); err != nil {
+			t.Fatal(err)
+		}
+
+		if fake.autoReconnect != enabled {
+			t.Fatalf("expected auto reconnect %v, got %v", enabled, fake.autoReconnect)
+		}
+	}
+}
+
+func TestSetReconnectPolicy(t *testing.T) {
+	fake := useFakeLib(t)
+
+	if err := SetReconnectPolicy(200*time.Microsecond, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if fake.reconnectBaseMs != 1 || fake.reconnectMaxMs != 10000 {
+		t.Fatalf("expected 1ms up to 10000ms, got %dms up to %dms", fake.reconnectBaseMs, fake.reconnectMaxMs)
+	}
+
+	for _, policy := range [][2]time.Duration{{0, time.Second}, {-time.Second, time.Second}, {2 * time.Second, time.Second}} {
+		if err := SetReconnectPolicy(policy[0], policy[1]); !errors.Is(err, ErrInvalidArg) {
+			t.Fatalf("%v: expected ErrInvalidArg, got %v", policy, err)
+		}
+	}
+	if fake.reconnectBaseMs != 1 || fake.reconnectMaxMs != 10000 {
+		t.Fatalf("expected the policy to be unchanged, got %dms up to %dms", fake.reconnectBaseMs, fake.reconnectMaxMs)
+	}
+}
+
+func TestSetAutoLaunchDaemon(t *testing.T) {
+	fake := useFakeLib(t)
+
+	for _, enabled := range []bool{true, false} {
+		if err := SetAutoLaunchDaemon(enabled); err != nil {
+			t.Fatal(err)
+		}
+
+		if fake.autoLaunch != enabled {
+			t.Fatalf("expected auto launch %v, got %v", enabled, fake.autoLaunch)
+		}
+	}
+}
+
+func TestDataDir(t *testing.T) {
+	useFakeLib(t)
+
+	if dir, err := DaemonDataDir(); err != nil || dir != "/var/lib/rustbee" {
+		t.Fatalf("expected the default directory, got %q (%v)", dir, err)
+	}
+
+	if err := SetDataDir(""); !errors.Is(err, ErrInvalidArg) {
+		t.Fatalf("expected ErrInvalidArg, got %v", err)
+	}
+
+	if err := SetDataDir("rustbee-data"); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := DaemonDataDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, _ := filepath.Abs("rustbee-data"); dir != expected {
+		t.Fatalf("expected %q, got %q", expected, dir)
+	}
+}
+
+func TestNoAdapter(t *testing.T) {
+	fake := useFakeLib(t)
+
+	if !AdapterAvailable() {
+		t.Fatal("expected an adapter")
+	}
+	if adapter, err := DefaultAdapter(); err != nil || !adapter.HasAddr {
+		t.Fatalf("expected the adapter with its address, got %+v (%v)", adapter, err)
+	}
+
+	fake.noAdapter = true
+
+	if AdapterAvailable() {
+		t.Fatal("expected no adapter")
+	}
+	if _, err := DefaultAdapter(); !errors.Is(err, ErrNoAdapter) {
+		t.Fatalf("expected ErrNoAdapter, got %v", err)
+	}
+	if _, err := LaunchDaemon(); !errors.Is(err, ErrNoAdapter) {
+		t.Fatalf("expected ErrNoAdapter, got %v", err)
+	}
+}
+
+func TestSimulatedDaemon(t *testing.T) {
+	fake := useFakeLib(t)
+	fake.noAdapter = true
+
+	addr := [6]byte{0xE8, 0xD4, 0xEA, 0xC4, 0x62, 0x01}
+	seed := DeviceState{Connected: true, Power: true, Brightness: 127, HasColor: true, RGB: Color{255, 0, 0}, Name: "Virtual"}
+
+	if err := SeedSimulatedDevice(addr, seed); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported before the launch, got %v", err)
+	}
+
+	if err := LaunchDaemonSimulated(); err != nil {
+		t.Fatal(err)
+	}
+	if err := SeedSimulatedDevice(addr, seed); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewDevice(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	state, err := d.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The color goes through xy, only its hue is kept
+	rgb := state.RGB
+	state.RGB = seed.RGB
+	if state != seed {
+		t.Fatalf("expected the seeded state %+v, got %+v", seed, state)
+	}
+	if rgb.R <= rgb.G || rgb.R <= rgb.B {
+		t.Fatalf("expected a red color, got %+v", rgb)
+	}
+}
+
+func TestConnectDaemonTCP(t *testing.T) {
+	fake := useFakeLib(t)
+
+	if err := LaunchDaemonTCP("127.0.0.1:9740", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ConnectDaemonTCP("127.0.0.1:9741", "secret"); !errors.Is(err, ErrDaemonUnreachable) {
+		t.Fatalf("expected ErrDaemonUnreachable, got %v", err)
+	}
+	if err := ConnectDaemonTCP("127.0.0.1:9740", "wrong"); !errors.Is(err, ErrDaemonError) {
+		t.Fatalf("expected ErrDaemonError for a wrong token, got %v", err)
+	}
+	if fake.remoteAddr != "" {
+		t.Fatalf("expected the local daemon to be kept, got %q", fake.remoteAddr)
+	}
+
+	if err := ConnectDaemonTCP("127.0.0.1:9740", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.remoteAddr != "127.0.0.1:9740" {
+		t.Fatalf("expected the remote daemon, got %q", fake.remoteAddr)
+	}
+
+	if err := ConnectDaemonTCP("", ""); err != nil {
+		t.Fatal(err)
+	}
+	if fake.remoteAddr != "" {
+		t.Fatalf("expected the local daemon, got %q", fake.remoteAddr)
+	}
+}
+
+func TestSetBrightnessDebouncedOnlyWritesTheLastValue(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	// 100 updates in 50ms, all within the window
+	const window = 100 * time.Millisecond
+	for i := range 100 {
+		device.SetBrightnessDebounced(uint8(i+1), window)
+		time.Sleep(500 * time.Microsecond)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for fake.writes(device) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A superseded timer would write late
+	time.Sleep(2 * window)
+
+	if writes := fake.writes(device); writes != 1 {
+		t.Fatalf("expected a single write, got %d", writes)
+	}
+
+	if brightness := fake.inspect(device).brightness; brightness != 100 {
+		t.Fatalf("expected the last brightness 100, got %d", brightness)
+	}
+}
+
+func TestCloseDuringCallsIsSafe(t *testing.T) {
+	fake := useFakeLib(t)
+
+	const rounds, goroutines = 20, 6
+
+	for range rounds {
+		device, err := NewDevice(testAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for g := range goroutines {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for i := 0; ; i++ {
+					var err error
+					switch (g + i) % 3 {
+					case 0:
+						err = device.SetPower(i%2 == 0)
+					case 1:
+						err = device.SetBrightness(uint8(i%254) + 1)
+					case 2:
+						err = <-device.SetPowerAsync(true)
+					}
+
+					if err == ErrClosed {
+						return
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+
+		time.Sleep(time.Millisecond)
+
+		// Only one of the concurrent closes frees the handle
+		var closes sync.WaitGroup
+		for range 2 {
+			closes.Add(1)
+			go func() {
+				defer closes.Done()
+				device.Close()
+			}()
+		}
+		closes.Wait()
+		wg.Wait()
+	}
+
+	if live := fake.live(); live != 0 {
+		t.Fatalf("expected every device to be freed, %d left", live)
+	}
+}
+
+func TestSetPowerAsync(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := device.SetPowerAsync(true)
+
+	// Waits for the async call to release the device
+	if err := device.SetBrightness(254); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if !fake.inspect(device).power {
+		t.Fatal("the device wasn't powered on")
+	}
+
+	device.Close()
+	if err := <-device.SetPowerAsync(true); err != ErrClosed {
+		t.Fatalf("expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestSubscribeKeepsTheLatestState(t *testing.T) {
+	useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	states, err := device.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state := <-states; state.Power {
+		t.Fatal("expected the initial state to be off")
+	}
+
+	// Nobody reads the intermediate states
+	for _, value := range []uint8{1, 100, 254} {
+		if err := device.SetBrightness(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if state := <-states; state.Brightness != 254 {
+		t.Fatalf("expected the latest brightness 254, got %d", state.Brightness)
+	}
+
+	if err := device.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := <-states; ok {
+		t.Fatal("expected the channel to be closed after Unsubscribe")
+	}
+}
+
+func TestConnectionChanges(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := device.ConnectionChanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if connected := <-changes; connected {
+		t.Fatal("expected the device to be disconnected first")
+	}
+
+	if err := device.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if connected := <-changes; !connected {
+		t.Fatal("expected the device to be connected")
+	}
+
+	// The light drops without a call of the package
+	fake.notify(device, func(d *fakeDevice) { d.setConnected(false) })
+	if connected := <-changes; connected {
+		t.Fatal("expected the drop")
+	}
+
+	if err := device.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-changes; ok {
+		t.Fatal("expected the channel to be closed by Close")
+	}
+}
+
+func TestObserveDropsTheOldestStates(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	states, err := device.Observe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The initial state and the first 4 changes are dropped, nobody reads them
+	for brightness := uint8(1); brightness <= observeBuffer+4; brightness++ {
+		fake.notify(device, func(d *fakeDevice) { d.brightness = brightness })
+	}
+
+	for expected := uint8(5); expected <= observeBuffer+4; expected++ {
+		if state := <-states; state.Brightness != expected {
+			t.Fatalf("expected the brightness %d, got %d", expected, state.Brightness)
+		}
+	}
+
+	if _, err := device.Subscribe(); !errors.Is(err, ErrInvalidArg) {
+		t.Fatalf("expected a single subscription, got %v", err)
+	}
+
+	cancel()
+	if _, ok := <-states; ok {
+		t.Fatal("expected the channel to be closed once the context is done")
+	}
+	if fake.inspect(device).onState != nil {
+		t.Fatal("expected the device to be unsubscribed")
+	}
+
+	if _, err := device.Observe(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
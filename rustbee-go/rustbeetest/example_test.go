@@ -0,0 +1,45 @@
+package rustbeetest_test
+
+import (
+	"testing"
+
+	"github.com/Snoupix/rustbee/rustbee-go"
+	"github.com/Snoupix/rustbee/rustbee-go/rustbeetest"
+)
+
+// wakeUp is the code under test, it takes a rustbee.Light so it's given a
+// *rustbee.Device in production and a *rustbeetest.Light in its tests
+func wakeUp(light rustbee.Light) error {
+	if err := light.SetPower(true); err != nil {
+		return err
+	}
+
+	return light.SetBrightness(254)
+}
+
+func TestWakeUpTurnsTheLightOn(t *testing.T) {
+	light := rustbeetest.NewLight("Bedroom")
+
+	if err := wakeUp(light); err != nil {
+		t.Fatal(err)
+	}
+
+	if !light.Called("SetPower", true) {
+		t.Fatalf("expected SetPower(true), got %v", light.Calls())
+	}
+	if !light.Current().Power {
+		t.Fatal("expected the light to be on")
+	}
+}
+
+func TestWakeUpReportsTheFailure(t *testing.T) {
+	light := rustbeetest.NewLight("Bedroom")
+	light.FailWith(rustbee.ErrDeviceNotFound)
+
+	if err := wakeUp(light); err != rustbee.ErrDeviceNotFound {
+		t.Fatalf("expected ErrDeviceNotFound, got %v", err)
+	}
+	if light.Called("SetBrightness", uint8(254)) {
+		t.Fatal("expected wakeUp to stop after the failure")
+	}
+}
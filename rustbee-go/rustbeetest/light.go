@@ -0,0 +1,272 @@
+// Package rustbeetest provides an in-memory rustbee.Light so the code built on
+// the rustbee package can be unit tested without librustbee nor a light. It
+// doesn't need the rustbee_ffi build tag.
+package rustbeetest
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"sync"
+
+	"github.com/Snoupix/rustbee/rustbee-go"
+)
+
+// Raw brightness range of the lights, as validated by librustbee
+const (
+	minBrightness = 1
+	maxBrightness = 254
+)
+
+// Call is a method call made on a Light
+type Call struct {
+	Method string
+	Args   []any
+}
+
+// Light records its calls and applies them to its state like a color light
+// would. Like a Device, the setters connect it and fail with
+// rustbee.ErrInvalidArg on an out of range brightness, every method but Close
+// fails with rustbee.ErrClosed once closed. It's safe for concurrent use.
+type Light struct {
+	mu     sync.Mutex
+	state  rustbee.DeviceState
+	calls  []Call
+	err    error
+	closed bool
+}
+
+var _ rustbee.Light = (*Light)(nil)
+
+// NewLight is off and disconnected, it's white at full brightness once on
+func NewLight(name string) *Light {
+	return &Light{state: rustbee.DeviceState{
+		Brightness: maxBrightness,
+		HasColor:   true,
+		RGB:        rustbee.Color{R: 255, G: 255, B: 255},
+		Name:       name,
+	}}
+}
+
+// FailWith makes every following call but Close fail with err (e.g.
+// rustbee.ErrDeviceNotFound) until FailWith(nil). The failed calls are
+// recorded too
+func (l *Light) FailWith(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.err = err
+}
+
+// Current is the state of the light, it's not a recorded call
+func (l *Light) Current() rustbee.DeviceState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.state
+}
+
+// Calls returns a copy of the calls made so far, the oldest first
+func (l *Light) Calls() []Call {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return slices.Clone(l.calls)
+}
+
+// Called reports whether the method was called with these args, compared
+// with reflect.DeepEqual
+func (l *Light) Called(method string, args ...any) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if args == nil {
+		args = []any{}
+	}
+
+	return slices.ContainsFunc(l.calls, func(call Call) bool {
+		return call.Method == method && reflect.DeepEqual(call.Args, args)
+	})
+}
+
+// Reset forgets the recorded calls, the state is kept
+func (l *Light) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.calls = nil
+}
+
+// call records the call then runs apply with the lock held unless the light
+// is closed or failing
+func (l *Light) call(method string, args []any, apply func() error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if args == nil {
+		args = []any{}
+	}
+	l.calls = append(l.calls, Call{Method: method, Args: args})
+
+	if l.closed {
+		return rustbee.ErrClosed
+	}
+	if l.err != nil {
+		return l.err
+	}
+
+	return apply()
+}
+
+func (l *Light) Connect(ctx context.Context) error {
+	return l.call("Connect", nil, func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		l.state.Connected = true
+		return nil
+	})
+}
+
+func (l *Light) Disconnect() error {
+	return l.call("Disconnect", nil, func() error {
+		l.state.Connected = false
+		return nil
+	})
+}
+
+func (l *Light) IsConnected() (bool, error) {
+	var connected bool
+	err := l.call("IsConnected", nil, func() error {
+		connected = l.state.Connected
+		return nil
+	})
+
+	return connected, err
+}
+
+func (l *Light) SetPower(on bool) error {
+	return l.call("SetPower", []any{on}, func() error {
+		l.state.Connected = true
+		l.state.Power = on
+		return nil
+	})
+}
+
+func (l *Light) Power() (bool, error) {
+	var on bool
+	err := l.call("Power", nil, func() error {
+		l.state.Connected = true
+		on = l.state.Power
+		return nil
+	})
+
+	return on, err
+}
+
+func (l *Light) TogglePower() (bool, error) {
+	var on bool
+	err := l.call("TogglePower", nil, func() error {
+		l.state.Connected = true
+		l.state.Power = !l.state.Power
+		on = l.state.Power
+		return nil
+	})
+
+	return on, err
+}
+
+func (l *Light) SetBrightness(value uint8) error {
+	return l.call("SetBrightness", []any{value}, func() error {
+		if !validBrightness(value) {
+			return rustbee.ErrInvalidArg
+		}
+
+		l.state.Connected = true
+		l.state.Brightness = value
+		return nil
+	})
+}
+
+func (l *Light) Brightness() (uint8, error) {
+	var value uint8
+	err := l.call("Brightness", nil, func() error {
+		l.state.Connected = true
+		value = l.state.Brightness
+		return nil
+	})
+
+	return value, err
+}
+
+func (l *Light) SetColor(c rustbee.Color) error {
+	return l.call("SetColor", []any{c}, func() error {
+		l.state.Connected = true
+		l.state.RGB = c
+		return nil
+	})
+}
+
+// SetState applies the non nil fields, the color temperature is only validated
+// since the state has no field for it
+func (l *Light) SetState(state rustbee.DesiredState) error {
+	return l.call("SetState", []any{state}, func() error {
+		if state.Brightness != nil && !validBrightness(*state.Brightness) {
+			return rustbee.ErrInvalidArg
+		}
+		if state.RGB != nil && state.ColorTemp != nil {
+			return rustbee.ErrInvalidArg
+		}
+
+		l.state.Connected = true
+		if state.Power != nil {
+			l.state.Power = *state.Power
+		}
+		if state.Brightness != nil {
+			l.state.Brightness = *state.Brightness
+		}
+		if state.RGB != nil {
+			l.state.RGB = *state.RGB
+		}
+
+		return nil
+	})
+}
+
+func (l *Light) State() (rustbee.DeviceState, error) {
+	var state rustbee.DeviceState
+	err := l.call("State", nil, func() error {
+		l.state.Connected = true
+		state = l.state
+		return nil
+	})
+
+	return state, err
+}
+
+func (l *Light) Name() (string, error) {
+	var name string
+	err := l.call("Name", nil, func() error {
+		l.state.Connected = true
+		name = l.state.Name
+		return nil
+	})
+
+	return name, err
+}
+
+// Close is recorded and can be called more than once, like Device.Close
+func (l *Light) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.calls = append(l.calls, Call{Method: "Close", Args: []any{}})
+	l.closed = true
+
+	return nil
+}
+
+func validBrightness(value uint8) bool {
+	return value >= minBrightness && value <= maxBrightness
+}
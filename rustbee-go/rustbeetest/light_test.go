@@ -0,0 +1,86 @@
+package rustbeetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Snoupix/rustbee/rustbee-go"
+)
+
+func TestLightAppliesTheCalls(t *testing.T) {
+	light := NewLight("Desk")
+
+	if connected, _ := light.IsConnected(); connected {
+		t.Fatal("expected a disconnected light")
+	}
+	if err := light.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	on, brightness, red := true, uint8(100), rustbee.Color{R: 255}
+	err := light.SetState(rustbee.DesiredState{Power: &on, Brightness: &brightness, RGB: &red})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := light.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := rustbee.DeviceState{
+		Connected:  true,
+		Power:      true,
+		Brightness: 100,
+		HasColor:   true,
+		RGB:        red,
+		Name:       "Desk",
+	}
+	if state != expected {
+		t.Fatalf("expected %+v, got %+v", expected, state)
+	}
+
+	if !light.Called("Connect") || len(light.Calls()) != 4 {
+		t.Fatalf("expected 4 calls starting with Connect, got %v", light.Calls())
+	}
+
+	light.Reset()
+	if calls := light.Calls(); len(calls) != 0 {
+		t.Fatalf("expected no calls, got %v", calls)
+	}
+}
+
+func TestLightValidatesLikeADevice(t *testing.T) {
+	light := NewLight("Desk")
+
+	for _, value := range []uint8{0, 255} {
+		if err := light.SetBrightness(value); !errors.Is(err, rustbee.ErrInvalidArg) {
+			t.Errorf("%d: expected ErrInvalidArg, got %v", value, err)
+		}
+	}
+
+	temp, white := uint16(300), rustbee.Color{R: 255, G: 255, B: 255}
+	if err := light.SetState(rustbee.DesiredState{RGB: &white, ColorTemp: &temp}); !errors.Is(err, rustbee.ErrInvalidArg) {
+		t.Errorf("expected ErrInvalidArg for a color and a temperature, got %v", err)
+	}
+
+	if brightness := light.Current().Brightness; brightness != maxBrightness {
+		t.Fatalf("expected the brightness to be kept, got %d", brightness)
+	}
+}
+
+func TestClosedLight(t *testing.T) {
+	light := NewLight("Desk")
+
+	light.Close()
+	if err := light.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := light.SetPower(true); err != rustbee.ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if light.Current().Power {
+		t.Fatal("expected a closed light to stay off")
+	}
+}
@@ -0,0 +1,190 @@
+package rustbee
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// scanNameLen is the length of the names sent by the daemon while scanning,
+// longer names are cut
+const scanNameLen = 13
+
+// scanPollInterval is how long Scan waits for a device before checking its
+// context again
+const scanPollInterval = 100 * time.Millisecond
+
+// ConnectByNameScan is how long ConnectByName scans, at most half of the time
+// left before the context deadline
+var ConnectByNameScan = 5 * time.Second
+
+// SignifyCompanyID is the company id of the manufacturer data advertised by
+// Hue lights
+const SignifyCompanyID uint16 = 0x010F
+
+// Discovered is a device found by Scan, Name is at most 13 bytes long.
+// ManufacturerData is the company id (little endian) followed by the data of
+// its advertisement, only ScanAdvertised fills it and it's empty if it had
+// none.
+type Discovered struct {
+	Addr             [6]byte
+	Name             string
+	ManufacturerData []byte
+}
+
+// CompanyID is the company id of the manufacturer data, false if there is
+// none
+func (d Discovered) CompanyID() (uint16, bool) {
+	if len(d.ManufacturerData) < 2 {
+		return 0, false
+	}
+
+	return binary.LittleEndian.Uint16(d.ManufacturerData), true
+}
+
+// Scan streams the named devices as soon as they're found during the duration
+// (or until the context deadline), finding none isn't an error. The channel is
+// closed once the scan is done, the scan is cancelled and the channel closed
+// shortly after the context is done. It must be drained or the context
+// canceled.
+//
+// It fails if the daemon isn't running, a scan that fails later closes the
+// channel early.
+func Scan(ctx context.Context, duration time.Duration) (<-chan Discovered, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		// The deadline can pass right after the check
+		duration = max(min(duration, time.Until(deadline)), 0)
+	}
+
+	scan, err := lib.startScan(uint32(duration.Milliseconds()))
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(chan Discovered)
+	go func() {
+		defer close(found)
+		defer lib.stopScan(scan)
+
+		// The context is checked between the polls
+		for ctx.Err() == nil {
+			device, ok, err := lib.pollScan(scan, uint32(scanPollInterval.Milliseconds()))
+			if errors.Is(err, ErrTimeout) {
+				continue
+			}
+			if err != nil || !ok {
+				return
+			}
+
+			select {
+			case found <- device:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return found, nil
+}
+
+// ScanAdvertised blocks for the duration (or until the context deadline) and
+// returns the named devices found with their manufacturer data, e.g. to skip
+// the devices that aren't Hue lights before connecting. The model isn't
+// advertised, it's only known once connected.
+func ScanAdvertised(ctx context.Context, duration time.Duration) ([]Discovered, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		// The deadline can pass right after the check
+		duration = max(min(duration, time.Until(deadline)), 0)
+	}
+
+	return lib.scanAdvertised(uint32(duration.Milliseconds()))
+}
+
+// scanAll collects a whole scan, unlike Scan it returns the scan error
+func scanAll(duration time.Duration) ([]Discovered, error) {
+	var found []Discovered
+	err := lib.scan(uint32(duration.Milliseconds()), func(device Discovered) bool {
+		found = append(found, device)
+		return true
+	})
+
+	return found, err
+}
+
+// ConnectByName scans for a device named name and connects to it, the
+// returned device must be closed. It fails with ErrDeviceNotFound if no
+// device matched and with an *AmbiguousNameError if several did.
+//
+// The daemon cuts the names of the scanned devices, so only the first 13
+// bytes of longer names are compared.
+func ConnectByName(ctx context.Context, name string) (*Device, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	duration := ConnectByNameScan
+	if deadline, ok := ctx.Deadline(); ok {
+		// The deadline can pass right after the check
+		duration = max(min(duration, time.Until(deadline)/2), 0)
+	}
+
+	found, err := scanAll(duration)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	want := scannedName(name)
+
+	var addrs [][6]byte
+	for _, device := range found {
+		if device.Name == want {
+			addrs = append(addrs, device.Addr)
+		}
+	}
+
+	switch len(addrs) {
+	case 0:
+		return nil, fmt.Errorf("rustbee: no device named %q: %w", name, ErrDeviceNotFound)
+	case 1:
+	default:
+		return nil, &AmbiguousNameError{Name: name, Addrs: addrs}
+	}
+
+	d, err := NewDevice(addrs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.Connect(ctx); err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// scannedName is the name as sent by the daemon while scanning, cut to
+// scanNameLen bytes with a replacement char if a rune was cut
+func scannedName(name string) string {
+	if len(name) <= scanNameLen {
+		return name
+	}
+
+	return strings.ToValidUTF8(name[:scanNameLen], string(utf8.RuneError))
+}
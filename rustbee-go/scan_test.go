@@ -0,0 +1,240 @@
+package rustbee
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestScanStreamsUntilTheContextIsDone(t *testing.T) {
+	fake := useFakeLib(t)
+
+	fake.found = []Discovered{
+		{Addr: testAddr, Name: "Hue bar"},
+		{Addr: [6]byte{1}, Name: "Hue lamp"},
+		{Addr: [6]byte{2}, Name: "Hue go"},
+	}
+
+	found, err := Scan(context.Background(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for device := range found {
+		names = append(names, device.Name)
+	}
+	if len(names) != len(fake.found) {
+		t.Fatalf("expected %d devices, got %q", len(fake.found), names)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	found, err = Scan(ctx, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device := <-found; device.Name != "Hue bar" {
+		t.Fatalf("expected the first device, got %+v", device)
+	}
+	cancel()
+
+	select {
+	case _, ok := <-found:
+		// A device already relayed can still be received
+		if ok {
+			if _, ok := <-found; ok {
+				t.Fatal("the channel wasn't closed after the context was canceled")
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the channel wasn't closed after the context was canceled")
+	}
+
+	if _, err := Scan(ctx, time.Second); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestScanIsStoppedWhenTheContextIsDone(t *testing.T) {
+	fake := useFakeLib(t)
+
+	fake.found = []Discovered{{Addr: testAddr, Name: "Hue bar"}}
+	fake.scanRunning = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	found, err := Scan(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device := <-found; device.Addr != testAddr {
+		t.Fatalf("expected %X, got %+v", testAddr, device)
+	}
+	cancel()
+
+	select {
+	case _, ok := <-found:
+		if ok {
+			t.Fatal("expected no other device")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the channel wasn't closed after the context was canceled")
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.stoppedScans != 1 {
+		t.Fatalf("expected the scan to be stopped, got %d stops", fake.stoppedScans)
+	}
+}
+
+func TestScanNeverWrapsTheDuration(t *testing.T) {
+	fake := useFakeLib(t)
+
+	// The deadline passes before or right after the context check
+	for range 100 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Microsecond)
+		if found, err := Scan(ctx, time.Second); err == nil {
+			for range found {
+			}
+		}
+		cancel()
+	}
+	for _, ms := range fake.scanMs {
+		if ms != 0 {
+			t.Fatalf("expected empty scans, got %v", fake.scanMs)
+		}
+	}
+}
+
+func TestConnectByName(t *testing.T) {
+	fake := useFakeLib(t)
+
+	lamp := [6]byte{0xec, 0x27, 0xa7, 0xd6, 0x5a, 0x9c}
+	fake.found = []Discovered{
+		{Addr: testAddr, Name: "Hue bar"},
+		{Addr: lamp, Name: scannedName("Living Room Lamp")},
+		{Addr: [6]byte{1}, Name: "Hue lamp"},
+		{Addr: [6]byte{2}, Name: "Hue lamp"},
+	}
+
+	d, err := ConnectByName(context.Background(), "Living Room Lamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if d.addr != lamp {
+		t.Fatalf("expected %X, got %X", lamp, d.addr)
+	}
+	if connected, _ := d.IsConnected(); !connected {
+		t.Fatal("the device isn't connected")
+	}
+
+	if _, err := ConnectByName(context.Background(), "Kitchen"); !errors.Is(err, ErrDeviceNotFound) {
+		t.Fatalf("expected ErrDeviceNotFound, got %v", err)
+	}
+
+	_, err = ConnectByName(context.Background(), "Hue lamp")
+	var ambiguous *AmbiguousNameError
+	if !errors.As(err, &ambiguous) {
+		t.Fatalf("expected an AmbiguousNameError, got %v", err)
+	}
+	if len(ambiguous.Addrs) != 2 {
+		t.Fatalf("expected 2 addresses, got %X", ambiguous.Addrs)
+	}
+
+	// Only the connected device is still allocated
+	if live := fake.live(); live != 1 {
+		t.Fatalf("expected 1 live device, got %d", live)
+	}
+}
+
+func TestConnectByNameChecksTheContextFirst(t *testing.T) {
+	fake := useFakeLib(t)
+	fake.found = []Discovered{{Addr: testAddr, Name: "Hue bar"}}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	if _, err := ConnectByName(ctx, "Hue bar"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if len(fake.scanMs) != 0 {
+		t.Fatalf("expected no scan, got %v", fake.scanMs)
+	}
+
+	// A deadline passing right after the check never wraps to a long scan
+	for range 100 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Microsecond)
+		if d, err := ConnectByName(ctx, "Hue bar"); err == nil {
+			d.Close()
+		}
+		cancel()
+	}
+	for _, ms := range fake.scanMs {
+		if ms != 0 {
+			t.Fatalf("expected empty scans, got %v", fake.scanMs)
+		}
+	}
+}
+
+func TestScanAdvertisedKeepsTheManufacturerData(t *testing.T) {
+	fake := useFakeLib(t)
+
+	fake.found = []Discovered{
+		{Addr: testAddr, Name: "Hue bar", ManufacturerData: []byte{0x0f, 0x01, 0x02}},
+		{Addr: [6]byte{1}, Name: "Headphones", ManufacturerData: []byte{0x4c, 0x00}},
+		{Addr: [6]byte{2}, Name: "Thermometer"},
+	}
+
+	found, err := ScanAdvertised(context.Background(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hue []string
+	for _, device := range found {
+		if id, ok := device.CompanyID(); ok && id == SignifyCompanyID {
+			hue = append(hue, device.Name)
+		}
+	}
+	if len(hue) != 1 || hue[0] != "Hue bar" {
+		t.Fatalf("expected only Hue bar, got %q", hue)
+	}
+
+	// Scan streams without it
+	streamed, err := Scan(context.Background(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for device := range streamed {
+		if _, ok := device.CompanyID(); ok {
+			t.Fatalf("expected no manufacturer data, got %+v", device)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ScanAdvertised(ctx, time.Second); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestScanAdvertisedNeverWrapsTheDuration(t *testing.T) {
+	fake := useFakeLib(t)
+
+	// The deadline passes before or right after the context check
+	for range 100 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Microsecond)
+		ScanAdvertised(ctx, time.Second)
+		cancel()
+	}
+	for _, ms := range fake.scanMs {
+		if ms != 0 {
+			t.Fatalf("expected empty scans, got %v", fake.scanMs)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package rustbee
+
+import "time"
+
+// Schedule makes the daemon apply the state like SetState at the given time,
+// right away if it's past. The daemon runs it on its own so the program can
+// exit meanwhile, e.g. for a sunrise fading in over 10 minutes:
+//
+//	on, brightness := true, uint8(254)
+//	job, err := device.Schedule(rustbee.DesiredState{
+//		Power:      &on,
+//		Brightness: &brightness,
+//		Transition: 10 * time.Minute,
+//	}, wakeUp)
+//
+// The state is validated first (ErrInvalidArg). The jobs are lost if the
+// daemon exits, it doesn't time out while some are waiting. The returned id
+// cancels it with CancelScheduled.
+func (d *Device) Schedule(state DesiredState, at time.Time) (uint64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return 0, ErrClosed
+	}
+
+	return lib.schedule(d.handle, state, uint64(max(at.UnixMilli(), 0)))
+}
+
+// CancelScheduled cancels a job of Device.Schedule, it fails with
+// ErrInvalidArg if the job doesn't exist or already started
+func CancelScheduled(job uint64) error {
+	return lib.cancelScheduled(job)
+}
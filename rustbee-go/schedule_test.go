@@ -0,0 +1,54 @@
+package rustbee
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestScheduleUntilCancelled(t *testing.T) {
+	fake := useFakeLib(t)
+
+	device, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	on := true
+	at := time.UnixMilli(1_700_000_000_123)
+	job, err := device.Schedule(DesiredState{Power: &on, Transition: 10 * time.Minute}, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled, ok := fake.scheduled[job]
+	if !ok || scheduled.addr != testAddr || scheduled.atUnixMs != 1_700_000_000_123 {
+		t.Fatalf("expected job %d of %v at 1700000000123, got %+v", job, testAddr, scheduled)
+	}
+
+	// Before the epoch, it runs right away
+	if _, err := device.Schedule(DesiredState{Power: &on}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.scheduled) != 2 || fake.scheduled[fake.lastJob].atUnixMs != 0 {
+		t.Fatalf("expected a second job at 0, got %+v", fake.scheduled)
+	}
+
+	if err := CancelScheduled(job); err != nil {
+		t.Fatal(err)
+	}
+	if err := CancelScheduled(job); !errors.Is(err, ErrInvalidArg) {
+		t.Fatalf("expected ErrInvalidArg cancelling twice, got %v", err)
+	}
+
+	rgb, mireds := Color{R: 255}, uint16(300)
+	if _, err := device.Schedule(DesiredState{RGB: &rgb, ColorTemp: &mireds}, at); !errors.Is(err, ErrInvalidArg) {
+		t.Fatalf("expected ErrInvalidArg, got %v", err)
+	}
+
+	device.Close()
+	if _, err := device.Schedule(DesiredState{Power: &on}, at); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
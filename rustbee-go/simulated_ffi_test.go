@@ -0,0 +1,68 @@
+//go:build rustbee_ffi
+
+package rustbee
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Against a real simulated daemon on its own socket, skipped without the
+// rustbee-daemon binary
+func TestSimulatedDaemonOverFFI(t *testing.T) {
+	if _, err := exec.LookPath("rustbee-daemon"); err != nil {
+		t.Skip("rustbee-daemon isn't installed")
+	}
+
+	dir := t.TempDir()
+	t.Setenv("RUSTBEE_SOCKET_PATH", filepath.Join(dir, "rustbee.sock"))
+	t.Setenv("RUSTBEE_DATA_DIR", dir)
+
+	if err := LaunchDaemonSimulated(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := ShutdownDaemon(false); err != nil {
+			t.Error(err)
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	found := false
+	discovered, err := Scan(ctx, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for device := range discovered {
+		found = found || device.Addr == testAddr
+	}
+	if !found {
+		t.Fatalf("expected %v to be found", testAddr)
+	}
+
+	d, err := NewDevice(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetPower(true); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := d.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Connected || !state.Power || state.Name != "Hue bar 1" {
+		t.Fatalf("expected the powered Hue bar 1, got %+v", state)
+	}
+}
@@ -0,0 +1,102 @@
+package rustbee
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// deviceStateJSON names the fields like the device_state_json output of
+// librustbee, rgb is only there for the lights that have a color
+type deviceStateJSON struct {
+	Connected  bool   `json:"connected"`
+	Power      bool   `json:"power"`
+	Brightness uint8  `json:"brightness"`
+	RGB        *Color `json:"rgb,omitempty"`
+	Name       string `json:"name,omitempty"`
+}
+
+func (s DeviceState) MarshalJSON() ([]byte, error) {
+	state := deviceStateJSON{
+		Connected:  s.Connected,
+		Power:      s.Power,
+		Brightness: s.Brightness,
+		Name:       s.Name,
+	}
+	if s.HasColor {
+		state.RGB = &s.RGB
+	}
+
+	return json.Marshal(state)
+}
+
+func (s *DeviceState) UnmarshalJSON(data []byte) error {
+	var state deviceStateJSON
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	*s = DeviceState{
+		Connected:  state.Connected,
+		Power:      state.Power,
+		Brightness: state.Brightness,
+		HasColor:   state.RGB != nil,
+		Name:       state.Name,
+	}
+	if state.RGB != nil {
+		s.RGB = *state.RGB
+	}
+
+	return nil
+}
+
+// desiredStateJSON leaves out the nil fields, the transition is a duration
+// string like "1.5s"
+type desiredStateJSON struct {
+	Power      *bool   `json:"power,omitempty"`
+	Brightness *uint8  `json:"brightness,omitempty"`
+	RGB        *Color  `json:"rgb,omitempty"`
+	ColorTemp  *uint16 `json:"color_temp,omitempty"`
+	Transition string  `json:"transition,omitempty"`
+}
+
+func (s DesiredState) MarshalJSON() ([]byte, error) {
+	state := desiredStateJSON{
+		Power:      s.Power,
+		Brightness: s.Brightness,
+		RGB:        s.RGB,
+		ColorTemp:  s.ColorTemp,
+	}
+	if s.Transition != 0 {
+		state.Transition = s.Transition.String()
+	}
+
+	return json.Marshal(state)
+}
+
+// UnmarshalJSON replaces the whole state, the fields missing from data are nil
+// even if they were set before
+func (s *DesiredState) UnmarshalJSON(data []byte) error {
+	var state desiredStateJSON
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	var transition time.Duration
+	if state.Transition != "" {
+		var err error
+		if transition, err = time.ParseDuration(state.Transition); err != nil {
+			return fmt.Errorf("invalid transition %q: %w", state.Transition, err)
+		}
+	}
+
+	*s = DesiredState{
+		Power:      state.Power,
+		Brightness: state.Brightness,
+		RGB:        state.RGB,
+		ColorTemp:  state.ColorTemp,
+		Transition: transition,
+	}
+
+	return nil
+}
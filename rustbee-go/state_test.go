@@ -0,0 +1,107 @@
+package rustbee
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDesiredStateJSON(t *testing.T) {
+	on, off := true, false
+	brightness, zero := uint8(200), uint8(0)
+	rgb := Color{255, 128, 0}
+	mireds := uint16(370)
+
+	tests := []struct {
+		state DesiredState
+		json  string
+	}{
+		{DesiredState{}, `{}`},
+		{DesiredState{Power: &on}, `{"power":true}`},
+		// Set to false or 0 isn't left out like nil
+		{DesiredState{Power: &off, Brightness: &zero}, `{"power":false,"brightness":0}`},
+		{DesiredState{Brightness: &brightness, RGB: &rgb}, `{"brightness":200,"rgb":"#ff8000"}`},
+		{DesiredState{ColorTemp: &mireds, Transition: 1500 * time.Millisecond}, `{"color_temp":370,"transition":"1.5s"}`},
+		{
+			DesiredState{Power: &on, Brightness: &brightness, RGB: &rgb, Transition: time.Hour},
+			`{"power":true,"brightness":200,"rgb":"#ff8000","transition":"1h0m0s"}`,
+		},
+	}
+
+	for _, test := range tests {
+		data, err := json.Marshal(test.state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.json {
+			t.Errorf("expected %s, got %s", test.json, data)
+		}
+
+		var decoded DesiredState
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("%s: %v", data, err)
+		}
+		if !reflect.DeepEqual(decoded, test.state) {
+			t.Errorf("%s: expected %+v back, got %+v", data, test.state, decoded)
+		}
+	}
+}
+
+func TestDesiredStateJSONReplacesTheState(t *testing.T) {
+	on := true
+	state := DesiredState{Power: &on, Transition: time.Second}
+
+	if err := json.Unmarshal([]byte(`{"brightness":10}`), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Power != nil || state.Transition != 0 {
+		t.Fatalf("expected the missing fields to be nil, got %+v", state)
+	}
+	if state.Brightness == nil || *state.Brightness != 10 {
+		t.Fatalf("expected a brightness of 10, got %v", state.Brightness)
+	}
+
+	for _, data := range []string{`{"transition":"soon"}`, `{"brightness":300}`, `{"rgb":"#12"}`} {
+		if err := json.Unmarshal([]byte(data), &state); err == nil {
+			t.Errorf("%s: expected an error", data)
+		}
+	}
+}
+
+func TestDeviceStateJSON(t *testing.T) {
+	tests := []struct {
+		state DeviceState
+		json  string
+	}{
+		{DeviceState{}, `{"connected":false,"power":false,"brightness":0}`},
+		{
+			DeviceState{Connected: true, Power: true, Brightness: 254, Name: "Hue white"},
+			`{"connected":true,"power":true,"brightness":254,"name":"Hue white"}`,
+		},
+		// Black is still a color for the lights that have one
+		{DeviceState{Brightness: 1, HasColor: true}, `{"connected":false,"power":false,"brightness":1,"rgb":"#000000"}`},
+		{
+			DeviceState{Connected: true, Brightness: 100, HasColor: true, RGB: Color{0, 0, 255}, Name: "Hue color"},
+			`{"connected":true,"power":false,"brightness":100,"rgb":"#0000ff","name":"Hue color"}`,
+		},
+	}
+
+	for _, test := range tests {
+		data, err := json.Marshal(test.state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.json {
+			t.Errorf("expected %s, got %s", test.json, data)
+		}
+
+		var decoded DeviceState
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("%s: %v", data, err)
+		}
+		if decoded != test.state {
+			t.Errorf("%s: expected %+v back, got %+v", data, test.state, decoded)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package rustbee
+
+import (
+	"fmt"
+	"time"
+)
+
+// DaemonStats are the counters of the daemon since it started, e.g. to
+// diagnose a flaky BLE environment
+type DaemonStats struct {
+	Connected int
+	// Connections of devices that were already connected once
+	Reconnects     int
+	FailedCommands int
+	// Of the device commands, including their (re)connection
+	AvgLatency time.Duration
+	// Failed GATT writes that were retried, see Device.SetWriteRetries
+	WriteRetries int
+	// GATT writes held back by the write rate, see SetGlobalWriteRate
+	DelayedWrites int
+	// GATT writes that failed since they'd have waited more than a second
+	DroppedWrites int
+	// Dropped devices being reconnected and the longest of their current
+	// backoffs, see SetReconnectPolicy
+	Reconnecting int
+	MaxBackoff   time.Duration
+}
+
+func (s DaemonStats) String() string {
+	return fmt.Sprintf(
+		"%d connected, %d reconnects, %d failed commands, %v average latency, %d write retries, %d delayed writes, %d dropped writes, %d reconnecting (backoff up to %v)",
+		s.Connected, s.Reconnects, s.FailedCommands, s.AvgLatency, s.WriteRetries, s.DelayedWrites, s.DroppedWrites, s.Reconnecting, s.MaxBackoff,
+	)
+}
+
+// Stats of the running daemon, it fails with ErrDaemonUnreachable if there is
+// none
+func Stats() (DaemonStats, error) {
+	return lib.daemonStats()
+}
@@ -0,0 +1,31 @@
+package rustbee
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDaemonStatsString(t *testing.T) {
+	fake := useFakeLib(t)
+	fake.stats = DaemonStats{
+		Connected:      2,
+		Reconnects:     5,
+		FailedCommands: 1,
+		AvgLatency:     120 * time.Millisecond,
+		WriteRetries:   3,
+		DelayedWrites:  8,
+		DroppedWrites:  1,
+		Reconnecting:   3,
+		MaxBackoff:     4 * time.Second,
+	}
+
+	stats, err := Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const expected = "2 connected, 5 reconnects, 1 failed commands, 120ms average latency, 3 write retries, 8 delayed writes, 1 dropped writes, 3 reconnecting (backoff up to 4s)"
+	if s := stats.String(); s != expected {
+		t.Fatalf("expected %q, got %q", expected, s)
+	}
+}
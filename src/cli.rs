@@ -161,7 +161,7 @@ impl Command {
                             );
                             String::new()
                         } else {
-                            String::from_utf8(buf.to_vec()).unwrap()
+                            String::from_utf8_lossy(&buf).into_owned()
                         };
 
                         info!(
@@ -209,7 +209,7 @@ impl Command {
                             );
                             String::new()
                         } else {
-                            String::from_utf8(buf.to_vec()).unwrap()
+                            String::from_utf8_lossy(&buf).into_owned()
                         };
 
                         info!(